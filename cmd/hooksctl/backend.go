@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codingconcepts/env"
+	"github.com/golden-vcr/hooks"
+	"github.com/golden-vcr/hooks/internal/apptoken"
+	"github.com/golden-vcr/hooks/internal/subscription"
+	"github.com/golden-vcr/hooks/internal/userauth"
+	"github.com/golden-vcr/server-common/twitch"
+	"golang.org/x/exp/slog"
+)
+
+// Backend carries out admin operations, either by calling the hooks server or by
+// calling the Twitch API directly
+type Backend interface {
+	// Status returns the status of all EventSub subscriptions required by and/or
+	// registered to the hooks service
+	Status(ctx context.Context) (*subscription.Status, error)
+
+	// Apply creates all required subscriptions that are missing
+	Apply(ctx context.Context) error
+
+	// DeleteAll deletes ALL subscriptions registered to the hooks service
+	DeleteAll(ctx context.Context) error
+
+	// ScopeStatus reports whether the broadcaster has granted all the OAuth scopes that
+	// our subscriptions require
+	ScopeStatus(ctx context.Context) (*userauth.ScopeStatus, error)
+
+	// AuthUrl returns a URL that the broadcaster can open in a browser in order to
+	// (re)authorize our app, after which they'll be sent to returnTo (if non-empty)
+	AuthUrl(ctx context.Context, returnTo string) (string, error)
+}
+
+// remoteBackend carries out admin operations by calling the endpoints of a running
+// hooks server, authenticated as the broadcaster
+type remoteBackend struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newRemoteBackend(url string, token string) *remoteBackend {
+	return &remoteBackend{
+		url:   strings.TrimSuffix(url, "/"),
+		token: token,
+		client: &http.Client{
+			// Creating or deleting subscriptions may take a while, since the hooks
+			// server must wait for Twitch to verify each new subscription
+			Timeout: 5 * time.Minute,
+		},
+	}
+}
+
+func (b *remoteBackend) Status(ctx context.Context) (*subscription.Status, error) {
+	var status subscription.Status
+	if err := b.do(ctx, http.MethodGet, "/subscriptions", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (b *remoteBackend) Apply(ctx context.Context) error {
+	return b.do(ctx, http.MethodPatch, "/subscriptions", nil)
+}
+
+func (b *remoteBackend) DeleteAll(ctx context.Context) error {
+	return b.do(ctx, http.MethodDelete, "/subscriptions", nil)
+}
+
+func (b *remoteBackend) ScopeStatus(ctx context.Context) (*userauth.ScopeStatus, error) {
+	var status userauth.ScopeStatus
+	if err := b.do(ctx, http.MethodGet, "/userauth/status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (b *remoteBackend) AuthUrl(ctx context.Context, returnTo string) (string, error) {
+	path := "/userauth/start-link"
+	if returnTo != "" {
+		path += "?" + url.Values{"return_to": {returnTo}}.Encode()
+	}
+	var link userauth.StartAuthResponse
+	if err := b.do(ctx, http.MethodPost, path, &link); err != nil {
+		return "", err
+	}
+	return link.Url, nil
+}
+
+// do sends a request to the hooks server, decoding the JSON response body into result
+// if non-nil: if the server responds with an error, its message is returned
+func (b *remoteBackend) do(ctx context.Context, method string, path string, result interface{}) error {
+	if b.token == "" {
+		return fmt.Errorf("a token is required in order to call the hooks server: set -token or $HOOKS_TOKEN (or use -direct)")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "Bearer "+b.token)
+	req.Header.Set("accept", "application/json")
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = http.StatusText(res.StatusCode)
+		}
+		return fmt.Errorf("got response %d from %s %s: %s", res.StatusCode, method, path, message)
+	}
+	if result != nil {
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(result); err != nil {
+			return fmt.Errorf("failed to decode response from %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// DirectConfig is the subset of the hooks server's config that we need in order to
+// manage its subscriptions directly: it's read from the same environment variables
+type DirectConfig struct {
+	Origin string `env:"ORIGIN" default:"https://goldenvcr.com/api/hooks"`
+
+	TwitchChannelName   string `env:"TWITCH_CHANNEL_NAME" required:"true"`
+	TwitchClientId      string `env:"TWITCH_CLIENT_ID" required:"true"`
+	TwitchClientSecret  string `env:"TWITCH_CLIENT_SECRET" required:"true"`
+	TwitchWebhookSecret string `env:"TWITCH_WEBHOOK_SECRET" required:"true"`
+
+	TwitchWebhookSecretRotatedAt string `env:"TWITCH_WEBHOOK_SECRET_ROTATED_AT"`
+
+	EventsubTransport        string   `env:"EVENTSUB_TRANSPORT" default:"webhook"`
+	ConduitShardCallbackUrls []string `env:"CONDUIT_SHARD_CALLBACK_URLS"`
+	ConduitId                string   `env:"CONDUIT_ID"`
+	LegacyCallbackUrls       []string `env:"LEGACY_CALLBACK_URLS"`
+}
+
+// scopesSourceFlag identifies granted scopes that were given on the command line
+const scopesSourceFlag = "flag"
+
+// directBackend carries out admin operations by calling the Twitch API directly,
+// using the same logic as the hooks server: this is intended for break-glass
+// situations in which the hooks server is unavailable. The broadcaster's user access
+// token belongs to the hooks server, which may need to refresh it at any time, so we
+// never touch it: the scopes that the broadcaster has granted are instead given on
+// the command line, and are unknown (nil) otherwise.
+type directBackend struct {
+	origin        string
+	subscriptions *subscription.Server
+	grantedScopes []string
+	logger        *slog.Logger
+}
+
+func newDirectBackend(ctx context.Context, grantedScopes []string) (*directBackend, error) {
+	config := DirectConfig{}
+	if err := env.Set(&config); err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+
+	// Resolve the Twitch User ID of our desired channel, using an app access token
+	appTokens := apptoken.NewProvider(config.TwitchClientId, config.TwitchClientSecret)
+	twitchClient, err := appTokens.NewTwitchClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	channelUserId, err := twitch.ResolveChannelUserId(twitchClient, config.TwitchChannelName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve Twitch user ID for channel '%s': %w", config.TwitchChannelName, err)
+	}
+
+	var conduitShardCallbackUrls []string
+	switch config.EventsubTransport {
+	case "webhook":
+	case "conduit":
+		conduitShardCallbackUrls = config.ConduitShardCallbackUrls
+		if len(conduitShardCallbackUrls) == 0 {
+			conduitShardCallbackUrls = []string{config.Origin + "/callback"}
+		}
+	default:
+		return nil, fmt.Errorf("EVENTSUB_TRANSPORT must be 'webhook' or 'conduit'; got '%s'", config.EventsubTransport)
+	}
+
+	var secretRotatedAt time.Time
+	if config.TwitchWebhookSecretRotatedAt != "" {
+		secretRotatedAt, err = time.Parse(time.RFC3339, config.TwitchWebhookSecretRotatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TWITCH_WEBHOOK_SECRET_ROTATED_AT: %w", err)
+		}
+	}
+
+	b := &directBackend{
+		origin:        config.Origin,
+		grantedScopes: grantedScopes,
+		logger:        slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+	b.subscriptions = subscription.NewServer(
+		config.Origin,
+		channelUserId,
+		appTokens,
+		config.TwitchWebhookSecret,
+		subscription.Options{
+			GetGrantedScopes:         b.lookupGrantedScopes,
+			ConduitShardCallbackUrls: conduitShardCallbackUrls,
+			ConduitId:                config.ConduitId,
+			LegacyCallbackUrls:       config.LegacyCallbackUrls,
+			SecretRotatedAt:          secretRotatedAt,
+		},
+	)
+	return b, nil
+}
+
+func (b *directBackend) Status(ctx context.Context) (*subscription.Status, error) {
+	return b.subscriptions.Status(ctx)
+}
+
+func (b *directBackend) Apply(ctx context.Context) error {
+	_, err := b.subscriptions.Apply(ctx, b.logger)
+	return err
+}
+
+func (b *directBackend) DeleteAll(ctx context.Context) error {
+	return b.subscriptions.DeleteAll(ctx, b.logger)
+}
+
+func (b *directBackend) ScopeStatus(ctx context.Context) (*userauth.ScopeStatus, error) {
+	if b.grantedScopes == nil {
+		return nil, fmt.Errorf("granted scopes can't be checked in direct mode unless they're given with -granted-scopes")
+	}
+	granted := &userauth.GrantedScopes{
+		Scopes: b.grantedScopes,
+		Source: scopesSourceFlag,
+	}
+	return userauth.NewScopeStatus(hooks.Subscriptions, granted, b.origin), nil
+}
+
+// lookupGrantedScopes returns the scopes given on the command line, so that the
+// subscriptions they don't cover can be flagged: if none were given, they're unknown
+// and nil is returned
+func (b *directBackend) lookupGrantedScopes(ctx context.Context) ([]string, error) {
+	return b.grantedScopes, nil
+}
+
+func (b *directBackend) AuthUrl(ctx context.Context, returnTo string) (string, error) {
+	return "", fmt.Errorf("an auth URL can only be issued by a running hooks server, so it can't be obtained with -direct")
+}
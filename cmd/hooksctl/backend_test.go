@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golden-vcr/hooks"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_remoteBackend(t *testing.T) {
+	type request struct {
+		method        string
+		path          string
+		query         string
+		authorization string
+	}
+	var requests []request
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests = append(requests, request{req.Method, req.URL.Path, req.URL.RawQuery, req.Header.Get("authorization")})
+		switch req.Method + " " + req.URL.Path {
+		case "GET /subscriptions":
+			res.Write([]byte(`{"ok":true,"subscriptions":[{"type":"channel.follow","version":"2","required":true,"status":"enabled"}]}`))
+		case "GET /userauth/status":
+			res.Write([]byte(`{"ok":false,"connected":false,"missing_scopes":["bits:read"]}`))
+		case "POST /userauth/start-link":
+			res.Write([]byte(`{"url":"https://goldenvcr.com/api/hooks/userauth/start-link?ticket=abc"}`))
+		case "PATCH /subscriptions", "DELETE /subscriptions":
+			res.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(res, "no such route", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	b := newRemoteBackend(srv.URL+"/", "my-token")
+	ctx := context.Background()
+
+	status, err := b.Status(ctx)
+	assert.NoError(t, err)
+	assert.True(t, status.Ok)
+	if assert.Len(t, status.Subscriptions, 1) {
+		assert.Equal(t, "channel.follow", status.Subscriptions[0].Type)
+	}
+
+	scopeStatus, err := b.ScopeStatus(ctx)
+	assert.NoError(t, err)
+	assert.False(t, scopeStatus.Ok)
+	assert.Equal(t, []string{"bits:read"}, scopeStatus.MissingScopes)
+
+	assert.NoError(t, b.Apply(ctx))
+	assert.NoError(t, b.DeleteAll(ctx))
+
+	// The auth URL is issued by the server, so it's based on the server's origin
+	authUrl, err := b.AuthUrl(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://goldenvcr.com/api/hooks/userauth/start-link?ticket=abc", authUrl)
+	_, err = b.AuthUrl(ctx, "https://goldenvcr.com/admin/hooks?tab=scopes")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []request{
+		{http.MethodGet, "/subscriptions", "", "Bearer my-token"},
+		{http.MethodGet, "/userauth/status", "", "Bearer my-token"},
+		{http.MethodPatch, "/subscriptions", "", "Bearer my-token"},
+		{http.MethodDelete, "/subscriptions", "", "Bearer my-token"},
+		{http.MethodPost, "/userauth/start-link", "", "Bearer my-token"},
+		{http.MethodPost, "/userauth/start-link", "return_to=https%3A%2F%2Fgoldenvcr.com%2Fadmin%2Fhooks%3Ftab%3Dscopes", "Bearer my-token"},
+	}, requests)
+}
+
+func Test_remoteBackend_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{
+			"a token is required",
+			"",
+			http.StatusOK,
+			`{}`,
+			"a token is required in order to call the hooks server: set -token or $HOOKS_TOKEN (or use -direct)",
+		},
+		{
+			"error responses are reported with their message",
+			"my-token",
+			http.StatusForbidden,
+			"access denied\n",
+			"got response 403 from GET /subscriptions: access denied",
+		},
+		{
+			"error responses without a message are reported with their status text",
+			"my-token",
+			http.StatusBadGateway,
+			"",
+			"got response 502 from GET /subscriptions: Bad Gateway",
+		},
+		{
+			"invalid JSON is reported",
+			"my-token",
+			http.StatusOK,
+			"not json",
+			"failed to decode response from GET /subscriptions: invalid character 'o' in literal null (expecting 'u')",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(tt.status)
+				res.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			b := newRemoteBackend(srv.URL, tt.token)
+			_, err := b.Status(context.Background())
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_directBackend_ScopeStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		grantedScopes []string
+		wantErr       string
+		wantOk        bool
+		wantMissing   []string
+	}{
+		{
+			"granted scopes are unknown unless given",
+			nil,
+			"granted scopes can't be checked in direct mode unless they're given with -granted-scopes",
+			false,
+			nil,
+		},
+		{
+			"status is ok if all required scopes are given",
+			hooks.Subscriptions.GetRequiredUserScopes(),
+			"",
+			true,
+			[]string{},
+		},
+		{
+			"missing scopes are reported",
+			[]string{"moderator:read:followers"},
+			"",
+			false,
+			[]string{"channel:read:hype_train", "bits:read", "channel:read:subscriptions"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &directBackend{
+				origin:        "https://example.com/api/hooks",
+				grantedScopes: tt.grantedScopes,
+			}
+			status, err := b.ScopeStatus(context.Background())
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, status.Connected)
+			assert.Equal(t, scopesSourceFlag, status.ScopesSource)
+			assert.Equal(t, tt.grantedScopes, status.GrantedScopes)
+			assert.Equal(t, tt.wantOk, status.Ok)
+			assert.ElementsMatch(t, tt.wantMissing, status.MissingScopes)
+			if !tt.wantOk {
+				assert.Equal(t, "https://example.com/api/hooks/userauth/start", status.ReauthUrl)
+			}
+
+			// The same scopes are used to flag subscriptions that can't be created
+			scopes, err := b.lookupGrantedScopes(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.grantedScopes, scopes)
+		})
+	}
+}
+
+func Test_directBackend_AuthUrl(t *testing.T) {
+	b := &directBackend{origin: "https://example.com/api/hooks"}
+	_, err := b.AuthUrl(context.Background(), "")
+	assert.EqualError(t, err, "an auth URL can only be issued by a running hooks server, so it can't be obtained with -direct")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/golden-vcr/hooks/internal/subscription"
+)
+
+func initApplyCommand(cmd *flag.FlagSet) {
+}
+
+func runApplyCommand(ctx context.Context, b Backend) error {
+	// Show what we're about to do before doing it
+	status, err := b.Status(ctx)
+	if err != nil {
+		return err
+	}
+	plan := subscription.NewPlan(status)
+	printPlan(plan)
+	if plan.Blocker != "" {
+		return errNotOk
+	}
+	if len(plan.ToCreate) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	if err := b.Apply(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Created %d subscription(s).\n", len(plan.ToCreate))
+	return nil
+}
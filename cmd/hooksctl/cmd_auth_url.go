@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+var authUrlReturnTo string
+
+func initAuthUrlCommand(cmd *flag.FlagSet) {
+	cmd.StringVar(&authUrlReturnTo, "return-to", "", "Allowlisted URL to which the broadcaster should be sent once they've authorized our app")
+}
+
+func runAuthUrlCommand(ctx context.Context, b Backend) error {
+	u, err := b.AuthUrl(ctx, authUrlReturnTo)
+	if err != nil {
+		return err
+	}
+	fmt.Println(u)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golden-vcr/hooks/internal/subscription"
+)
+
+var deleteYes bool
+
+func initDeleteCommand(cmd *flag.FlagSet) {
+	cmd.BoolVar(&deleteYes, "yes", false, "Delete without asking for confirmation")
+}
+
+func runDeleteCommand(ctx context.Context, b Backend) error {
+	status, err := b.Status(ctx)
+	if err != nil {
+		return err
+	}
+	registered := make([]subscription.State, 0)
+	for _, state := range status.Subscriptions {
+		if state.Status != "missing" {
+			registered = append(registered, state)
+		}
+	}
+	if len(registered) == 0 {
+		fmt.Println("No subscriptions are registered: nothing to delete.")
+		return nil
+	}
+
+	fmt.Printf("%d subscription(s) will be deleted:\n\n", len(registered))
+	printSubscriptions(os.Stdout, registered)
+	fmt.Println()
+
+	// Deleting subscriptions stops all events from reaching downstream consumers, so
+	// make sure that's what the user wants
+	if !deleteYes {
+		fmt.Print("Type 'delete' to confirm: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read confirmation: %w", err)
+		}
+		if strings.TrimSpace(line) != "delete" {
+			fmt.Println("Aborted.")
+			return errNotOk
+		}
+	}
+
+	if err := b.DeleteAll(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d subscription(s).\n", len(registered))
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golden-vcr/hooks/internal/subscription"
+)
+
+var planOutput outputFormat
+
+func initPlanCommand(cmd *flag.FlagSet) {
+	addOutputFlag(cmd, &planOutput)
+}
+
+func runPlanCommand(ctx context.Context, b Backend) error {
+	// The plan is resolved locally from the current status, using the same logic that
+	// the hooks server uses when applying it
+	status, err := b.Status(ctx)
+	if err != nil {
+		return err
+	}
+	plan := subscription.NewPlan(status)
+	if planOutput == outputFormatJson {
+		if err := printJson(plan); err != nil {
+			return err
+		}
+	} else {
+		printPlan(plan)
+	}
+	if plan.Blocker != "" {
+		return errNotOk
+	}
+	return nil
+}
+
+func printPlan(plan *subscription.Plan) {
+	if len(plan.ToCreate) == 0 {
+		fmt.Println("No changes: all required subscriptions are registered.")
+		return
+	}
+	fmt.Printf("%d subscription(s) will be created:\n\n", len(plan.ToCreate))
+	printSubscriptions(os.Stdout, plan.ToCreate)
+	if plan.Blocker != "" {
+		fmt.Printf("\nThis plan cannot be applied: %s\n", plan.Blocker)
+	}
+}
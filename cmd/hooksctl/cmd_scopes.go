@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golden-vcr/hooks/internal/userauth"
+)
+
+var scopesOutput outputFormat
+
+func initScopesCommand(cmd *flag.FlagSet) {
+	addOutputFlag(cmd, &scopesOutput)
+}
+
+func runScopesCommand(ctx context.Context, b Backend) error {
+	status, err := b.ScopeStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if scopesOutput == outputFormatJson {
+		if err := printJson(status); err != nil {
+			return err
+		}
+	} else {
+		printScopeStatus(status)
+	}
+	if !status.Ok {
+		return errNotOk
+	}
+	return nil
+}
+
+func printScopeStatus(status *userauth.ScopeStatus) {
+	if status.Connected {
+		fmt.Printf("Connected: yes (scopes from %s)\n", status.ScopesSource)
+	} else {
+		fmt.Println("Connected: no")
+	}
+	fmt.Printf("Required scopes: %s\n", formatScopes(status.RequiredScopes))
+	fmt.Printf("Granted scopes:  %s\n", formatScopes(status.GrantedScopes))
+	fmt.Printf("Missing scopes:  %s\n", formatScopes(status.MissingScopes))
+
+	affected := make([]userauth.SubscriptionScopeStatus, 0)
+	for _, subscription := range status.Subscriptions {
+		if len(subscription.MissingScopes) > 0 {
+			affected = append(affected, subscription)
+		}
+	}
+	if len(affected) > 0 {
+		fmt.Println()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TYPE\tVERSION\tMISSING SCOPES")
+		for _, subscription := range affected {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", subscription.Type, subscription.Version, strings.Join(subscription.MissingScopes, ", "))
+		}
+		tw.Flush()
+	}
+
+	fmt.Println()
+	fmt.Printf("Status: %s\n", formatOk(status.Ok))
+	if status.ReauthUrl != "" {
+		fmt.Println("The broadcaster must authorize our app: get a link with 'hooksctl auth-url'")
+	}
+}
+
+func formatScopes(scopes []string) string {
+	if len(scopes) == 0 {
+		return "(none)"
+	}
+	return strings.Join(scopes, " ")
+}
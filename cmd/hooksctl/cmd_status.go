@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/golden-vcr/hooks/internal/subscription"
+)
+
+var statusOutput outputFormat
+
+func initStatusCommand(cmd *flag.FlagSet) {
+	addOutputFlag(cmd, &statusOutput)
+}
+
+func runStatusCommand(ctx context.Context, b Backend) error {
+	status, err := b.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if statusOutput == outputFormatJson {
+		if err := printJson(status); err != nil {
+			return err
+		}
+	} else {
+		printStatus(status)
+	}
+
+	// Exit with a non-zero status if anything needs attention, so that this command
+	// can be used as a check in scripts
+	if !status.Ok {
+		return errNotOk
+	}
+	return nil
+}
+
+func printStatus(status *subscription.Status) {
+	printSubscriptions(os.Stdout, status.Subscriptions)
+	fmt.Println()
+
+	if status.Cost != nil {
+		fmt.Printf("Cost: %d subscription(s) with a total cost of %d (max %d)\n", status.Cost.Total, status.Cost.TotalCost, status.Cost.MaxTotalCost)
+	}
+	if status.Conduit != nil {
+		fmt.Printf("Conduit: %s (%s)\n", status.Conduit.Id, formatOk(status.Conduit.Ok))
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  SHARD\tCALLBACK\tSTATUS")
+		for _, shard := range status.Conduit.Shards {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", shard.Id, shard.Callback, shard.Status)
+		}
+		tw.Flush()
+	}
+	if status.SecretRotation != nil {
+		fmt.Printf("Secret rotation: %d subscription(s) may still use a previous secret (rotated at %s)\n", status.SecretRotation.NumPending, status.SecretRotation.RotatedAt.Format("2006-01-02 15:04:05 MST"))
+	}
+	if status.Disconnection != nil {
+		fmt.Printf("Disconnected: the broadcaster's channel was disconnected at %s (%s); reauthorize with 'hooksctl auth-url'\n", status.Disconnection.At.Format("2006-01-02 15:04:05 MST"), status.Disconnection.Reason)
+	}
+	fmt.Printf("Status: %s\n", formatOk(status.Ok))
+}
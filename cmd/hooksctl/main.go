@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"unicode"
+
+	"github.com/codingconcepts/env"
+	"github.com/joho/godotenv"
+)
+
+// Config describes how to reach a running hooks server: these values are used unless
+// overridden by the -url and -token flags
+type Config struct {
+	HooksUrl   string `env:"HOOKS_URL" default:"http://localhost:5004"`
+	HooksToken string `env:"HOOKS_TOKEN"`
+}
+
+type Command struct {
+	name        string
+	description string
+	initFunc    func(cmd *flag.FlagSet)
+	runFunc     func(ctx context.Context, b Backend) error
+}
+
+var commands = []Command{
+	{"status", "Show the status of all EventSub subscriptions", initStatusCommand, runStatusCommand},
+	{"plan", "Show which subscriptions 'apply' would create", initPlanCommand, runPlanCommand},
+	{"apply", "Create all required subscriptions that are missing", initApplyCommand, runApplyCommand},
+	{"delete", "Delete ALL subscriptions registered to the service", initDeleteCommand, runDeleteCommand},
+	{"scopes", "Check that the broadcaster has granted all required scopes", initScopesCommand, runScopesCommand},
+	{"auth-url", "Print a single-use link at which the broadcaster can authorize our app", initAuthUrlCommand, runAuthUrlCommand},
+}
+
+// errNotOk is returned by commands that have already reported a problem (e.g. missing
+// scopes), so that we exit with a non-zero status without logging anything further
+var errNotOk = errors.New("not ok")
+
+func main() {
+	// Parse config from environment variables
+	err := godotenv.Load()
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("error loading .env file: %v", err)
+	}
+	config := Config{}
+	if err := env.Set(&config); err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+
+	// Parse the subcommand that we want to run, or print usage if no match
+	var command *Command
+	commandName := ""
+	if len(os.Args) > 1 {
+		commandName = os.Args[1]
+	}
+	for i := range commands {
+		if commands[i].name == commandName {
+			command = &commands[i]
+			break
+		}
+	}
+	if command == nil {
+		printUsage()
+		os.Exit(2)
+	}
+
+	// Initialize command-line flags for the chosen subcommand, along with the flags
+	// that determine how we'll carry it out
+	flagSet := flag.NewFlagSet(command.name, flag.ExitOnError)
+	url := flagSet.String("url", config.HooksUrl, "URL of the hooks server (defaults to $HOOKS_URL)")
+	token := flagSet.String("token", "", "Bearer token granting broadcaster access to the hooks server (defaults to $HOOKS_TOKEN)")
+	direct := flagSet.Bool("direct", false, "Bypass the hooks server and call the Twitch API directly, using the server's own config from the environment")
+	var grantedScopes scopeList
+	flagSet.Var(&grantedScopes, "granted-scopes", "With -direct, the OAuth scopes that the broadcaster has granted, separated by spaces or commas (otherwise they're unknown)")
+	command.initFunc(flagSet)
+	if err := flagSet.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Parse error: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Unless we're running directly against the Twitch API (e.g. because the hooks
+	// server is down), all operations are carried out by the hooks server
+	var b Backend
+	if *direct {
+		b, err = newDirectBackend(ctx, grantedScopes.scopes)
+		if err != nil {
+			log.Fatalf("Failed to initialize direct backend: %v", err)
+		}
+	} else {
+		if grantedScopes.scopes != nil {
+			log.Fatalf("-granted-scopes can only be used with -direct")
+		}
+		if *token == "" {
+			*token = config.HooksToken
+		}
+		b = newRemoteBackend(*url, *token)
+	}
+
+	if err := command.runFunc(ctx, b); err != nil {
+		if errors.Is(err, errNotOk) {
+			os.Exit(1)
+		}
+		log.Fatalf("%s failed: %v", command.name, err)
+	}
+}
+
+// scopeList is a flag value listing OAuth scopes, separated by spaces or commas: scopes
+// is nil unless the flag is given, and empty if it's given as an empty string
+type scopeList struct {
+	scopes []string
+}
+
+func (l *scopeList) String() string {
+	return strings.Join(l.scopes, " ")
+}
+
+func (l *scopeList) Set(value string) error {
+	l.scopes = strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if l.scopes == nil {
+		l.scopes = []string{}
+	}
+	return nil
+}
+
+func printUsage() {
+	lines := []string{
+		"Usage: hooksctl <command> [-url URL] [-token TOKEN] [-direct [-granted-scopes SCOPES]] [flags]",
+		"",
+		"Commands:",
+	}
+	for i := range commands {
+		lines = append(lines, fmt.Sprintf("  %-10s %s", commands[i].name, commands[i].description))
+	}
+	lines = append(lines, "", "Run 'hooksctl <command> -h' for details of a command's flags.")
+	fmt.Fprintln(os.Stderr, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_scopeList(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantScopes []string
+	}{
+		{
+			"scopes are nil if the flag is not given",
+			[]string{},
+			nil,
+		},
+		{
+			"scopes are empty if the flag is given as an empty string",
+			[]string{"-granted-scopes", ""},
+			[]string{},
+		},
+		{
+			"scopes may be separated by spaces",
+			[]string{"-granted-scopes", "bits:read  moderator:read:followers"},
+			[]string{"bits:read", "moderator:read:followers"},
+		},
+		{
+			"scopes may be separated by commas",
+			[]string{"-granted-scopes", "bits:read, moderator:read:followers,"},
+			[]string{"bits:read", "moderator:read:followers"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l scopeList
+			flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+			flagSet.Var(&l, "granted-scopes", "")
+			assert.NoError(t, flagSet.Parse(tt.args))
+			assert.Equal(t, tt.wantScopes, l.scopes)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golden-vcr/hooks/internal/subscription"
+)
+
+// outputFormat determines how a command prints its results: as a human-readable table
+// or as JSON
+type outputFormat string
+
+const (
+	outputFormatTable outputFormat = "table"
+	outputFormatJson  outputFormat = "json"
+)
+
+func (f *outputFormat) String() string {
+	return string(*f)
+}
+
+func (f *outputFormat) Set(value string) error {
+	switch outputFormat(value) {
+	case outputFormatTable, outputFormatJson:
+		*f = outputFormat(value)
+		return nil
+	}
+	return fmt.Errorf("must be '%s' or '%s'", outputFormatTable, outputFormatJson)
+}
+
+// addOutputFlag registers an -o flag that sets the given output format
+func addOutputFlag(cmd *flag.FlagSet, f *outputFormat) {
+	*f = outputFormatTable
+	cmd.Var(f, "o", "Output format: 'table' or 'json'")
+}
+
+// printJson writes a value to stdout as indented JSON
+func printJson(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printSubscriptions writes a table describing the given subscriptions
+func printSubscriptions(w io.Writer, subscriptions []subscription.State) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tVERSION\tREQUIRED\tSTATUS\tCOST\tCONDITION\tNOTES")
+	for _, state := range subscriptions {
+		cost := fmt.Sprintf("%d", state.Cost)
+		if state.CostEstimated {
+			cost += " (est.)"
+		}
+		notes := make([]string, 0)
+		if len(state.MissingScopes) > 0 {
+			notes = append(notes, "missing scopes: "+strings.Join(state.MissingScopes, ", "))
+		}
+		if state.LegacyCallbackUrl != "" {
+			notes = append(notes, "legacy callback: "+state.LegacyCallbackUrl)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			state.Type,
+			state.Version,
+			formatBool(state.Required),
+			state.Status,
+			cost,
+			formatCondition(state.Condition),
+			strings.Join(notes, "; "),
+		)
+	}
+	tw.Flush()
+}
+
+// formatCondition formats a subscription condition as a sorted list of key=value pairs
+func formatCondition(condition map[string]string) string {
+	pairs := make([]string, 0, len(condition))
+	for k, v := range condition {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func formatBool(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatOk(ok bool) string {
+	if ok {
+		return "OK"
+	}
+	return "NOT OK"
+}
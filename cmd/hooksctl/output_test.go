@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golden-vcr/hooks/internal/subscription"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_outputFormat_Set(t *testing.T) {
+	var f outputFormat
+	assert.NoError(t, f.Set("json"))
+	assert.Equal(t, outputFormatJson, f)
+	assert.NoError(t, f.Set("table"))
+	assert.Equal(t, outputFormatTable, f)
+	assert.EqualError(t, f.Set("yaml"), "must be 'table' or 'json'")
+	assert.Equal(t, outputFormatTable, f)
+}
+
+func Test_printSubscriptions(t *testing.T) {
+	var b strings.Builder
+	printSubscriptions(&b, []subscription.State{
+		{
+			Type:          "channel.follow",
+			Version:       "2",
+			Required:      true,
+			Status:        "missing",
+			Cost:          1,
+			CostEstimated: true,
+			Condition:     map[string]string{"moderator_user_id": "90790024", "broadcaster_user_id": "90790024"},
+			MissingScopes: []string{"moderator:read:followers"},
+		},
+		{
+			Type:              "channel.raid",
+			Version:           "1",
+			Status:            "enabled",
+			Condition:         map[string]string{"to_broadcaster_user_id": "90790024"},
+			LegacyCallbackUrl: "https://example.com/callback",
+		},
+	})
+	assert.Equal(t, strings.Join([]string{
+		"TYPE            VERSION  REQUIRED  STATUS   COST      CONDITION                                                NOTES",
+		"channel.follow  2        yes       missing  1 (est.)  broadcaster_user_id=90790024,moderator_user_id=90790024  missing scopes: moderator:read:followers",
+		"channel.raid    1        no        enabled  0         to_broadcaster_user_id=90790024                          legacy callback: https://example.com/callback",
+		"",
+	}, "\n"), b.String())
+}
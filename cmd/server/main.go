@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"regexp"
+	"time"
 
 	"github.com/codingconcepts/env"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	amqp "github.com/rabbitmq/amqp091-go"
 
 	"github.com/golden-vcr/auth"
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/golden-vcr/hooks/internal/apptoken"
 	"github.com/golden-vcr/hooks/internal/callback"
+	"github.com/golden-vcr/hooks/internal/enrich"
+	"github.com/golden-vcr/hooks/internal/followburst"
+	"github.com/golden-vcr/hooks/internal/publish"
+	"github.com/golden-vcr/hooks/internal/rollup"
+	"github.com/golden-vcr/hooks/internal/rules"
+	"github.com/golden-vcr/hooks/internal/selftest"
+	"github.com/golden-vcr/hooks/internal/session"
 	"github.com/golden-vcr/hooks/internal/subscription"
 	"github.com/golden-vcr/hooks/internal/userauth"
 	"github.com/golden-vcr/server-common/entry"
@@ -28,6 +39,9 @@ type Config struct {
 	TwitchClientSecret  string `env:"TWITCH_CLIENT_SECRET" required:"true"`
 	TwitchWebhookSecret string `env:"TWITCH_WEBHOOK_SECRET" required:"true"`
 
+	TwitchPreviousWebhookSecrets []string `env:"TWITCH_PREVIOUS_WEBHOOK_SECRETS"`
+	TwitchWebhookSecretRotatedAt string   `env:"TWITCH_WEBHOOK_SECRET_ROTATED_AT"`
+
 	RmqHost     string `env:"RMQ_HOST" required:"true"`
 	RmqPort     int    `env:"RMQ_PORT" required:"true"`
 	RmqVhost    string `env:"RMQ_VHOST" required:"true"`
@@ -35,6 +49,59 @@ type Config struct {
 	RmqPassword string `env:"RMQ_PASSWORD" required:"true"`
 
 	AuthURL string `env:"AUTH_URL" default:"http://localhost:5002"`
+
+	Replicas int `env:"REPLICAS" default:"1"`
+
+	EventsubTransport        string   `env:"EVENTSUB_TRANSPORT" default:"webhook"`
+	ConduitShardCallbackUrls []string `env:"CONDUIT_SHARD_CALLBACK_URLS"`
+	ConduitId                string   `env:"CONDUIT_ID"`
+	LegacyCallbackUrls       []string `env:"LEGACY_CALLBACK_URLS"`
+
+	CallbackWorkers      int           `env:"CALLBACK_WORKERS" default:"0"`
+	CallbackQueueSize    int           `env:"CALLBACK_QUEUE_SIZE" default:"1000"`
+	CallbackDrainTimeout time.Duration `env:"CALLBACK_DRAIN_TIMEOUT" default:"20s"`
+	CallbackSpoolPath    string        `env:"CALLBACK_SPOOL_PATH" default:"./.data/callback-spool.jsonl"`
+	ProducerCloseTimeout time.Duration `env:"PRODUCER_CLOSE_TIMEOUT" default:"5s"`
+	OutputFormat         string        `env:"OUTPUT_FORMAT" default:"bare"`
+
+	RulesPath string `env:"RULES_PATH"`
+
+	SessionStatePath   string `env:"SESSION_STATE_PATH" default:"./.data/sessions.json"`
+	SessionHistorySize int    `env:"SESSION_HISTORY_SIZE" default:"20"`
+	RollupsPath        string `env:"ROLLUPS_PATH" default:"./.data/rollups.json"`
+
+	FollowBurstDetection         bool          `env:"FOLLOW_BURST_DETECTION" default:"false"`
+	FollowBurstWindow            time.Duration `env:"FOLLOW_BURST_WINDOW" default:"1m"`
+	FollowBurstMaxFollows        int           `env:"FOLLOW_BURST_MAX_FOLLOWS" default:"20"`
+	FollowBurstLoginPattern      string        `env:"FOLLOW_BURST_LOGIN_PATTERN" default:"^[a-z_]+[0-9]{4,}$"`
+	FollowBurstMaxPatternFollows int           `env:"FOLLOW_BURST_MAX_PATTERN_FOLLOWS" default:"5"`
+	FollowBurstPrefixLength      int           `env:"FOLLOW_BURST_PREFIX_LENGTH" default:"5"`
+	FollowBurstMaxPrefixFollows  int           `env:"FOLLOW_BURST_MAX_PREFIX_FOLLOWS" default:"5"`
+	FollowBurstCooldown          time.Duration `env:"FOLLOW_BURST_COOLDOWN" default:"2m"`
+	FollowBurstHold              bool          `env:"FOLLOW_BURST_HOLD" default:"false"`
+	FollowBurstResolution        string        `env:"FOLLOW_BURST_RESOLUTION" default:"release"`
+	FollowBurstMaxHeld           int           `env:"FOLLOW_BURST_MAX_HELD" default:"1000"`
+	FollowBurstStatePath         string        `env:"FOLLOW_BURST_STATE_PATH" default:"./.data/follow-burst.json"`
+	FollowBurstFlushTimeout      time.Duration `env:"FOLLOW_BURST_FLUSH_TIMEOUT" default:"30s"`
+
+	EnrichProfiles  bool          `env:"ENRICH_PROFILES" default:"false"`
+	EnrichCacheSize int           `env:"ENRICH_CACHE_SIZE" default:"10000"`
+	EnrichCacheTtl  time.Duration `env:"ENRICH_CACHE_TTL" default:"1h"`
+
+	SubscriptionCheckInterval time.Duration `env:"SUBSCRIPTION_CHECK_INTERVAL" default:"5m"`
+	AlertWebhookUrl           string        `env:"ALERT_WEBHOOK_URL"`
+	AlertWebhookTemplate      string        `env:"ALERT_WEBHOOK_TEMPLATE"`
+
+	SelfTestOnStartup    bool          `env:"SELF_TEST_ON_STARTUP" default:"false"`
+	SelfTestStartupDelay time.Duration `env:"SELF_TEST_STARTUP_DELAY" default:"10s"`
+	SelfTestCallbackUrl  string        `env:"SELF_TEST_CALLBACK_URL"`
+
+	UserTokenPath          string        `env:"USER_TOKEN_PATH" default:"./.data/user-token.enc"`
+	UserTokenEncryptionKey string        `env:"USER_TOKEN_ENCRYPTION_KEY" required:"true"`
+	UserTokenCheckInterval time.Duration `env:"USER_TOKEN_CHECK_INTERVAL" default:"5m"`
+	UserauthStateSecret    string        `env:"USERAUTH_STATE_SECRET" required:"true"`
+	UserauthReplayCacheDir string        `env:"USERAUTH_REPLAY_CACHE_DIR"`
+	UserauthReturnTo       []string      `env:"USERAUTH_RETURN_TO_ALLOWLIST" default:"https://goldenvcr.com/admin/hooks"`
 }
 
 func main() {
@@ -51,15 +118,36 @@ func main() {
 		app.Fail("Failed to load config", err)
 	}
 
-	// Initialize an AMQP client
-	amqpConn, err := amqp.Dial(rmq.FormatConnectionString(config.RmqHost, config.RmqPort, config.RmqVhost, config.RmqUser, config.RmqPassword))
+	// Initialize an AMQP client, with producers that wait for the broker to confirm
+	// each message, and that reconnect (with backoff) if the connection is lost
+	broker, err := publish.NewBroker(rmq.FormatConnectionString(config.RmqHost, config.RmqPort, config.RmqVhost, config.RmqUser, config.RmqPassword))
 	if err != nil {
 		app.Fail("Failed to connect to AMQP server", err)
 	}
-	producer, err := rmq.NewProducer(amqpConn, "twitch-events")
+	producer, err := publish.NewProducer(broker, "twitch-events")
 	if err != nil {
 		app.Fail("Failed to initialize AMQP producer", err)
 	}
+	alertsProducer, err := publish.NewProducer(broker, "hooks-alerts")
+	if err != nil {
+		app.Fail("Failed to initialize AMQP producer for alerts", err)
+	}
+	rollupsProducer, err := publish.NewProducer(broker, "hooks-rollups")
+	if err != nil {
+		app.Fail("Failed to initialize AMQP producer for rollups", err)
+	}
+
+	// Alerts (e.g. when a required EventSub subscription stops being enabled) are
+	// produced to a dedicated queue, and optionally sent to an outbound webhook so that
+	// the broadcaster will be notified directly
+	notifier := alert.NewQueueNotifier(alertsProducer)
+	if config.AlertWebhookUrl != "" {
+		webhookNotifier, err := alert.NewWebhookNotifier(config.AlertWebhookUrl, config.AlertWebhookTemplate)
+		if err != nil {
+			app.Fail("Failed to initialize alert webhook notifier", err)
+		}
+		notifier = alert.Multi(notifier, webhookNotifier)
+	}
 
 	// Initialize an auth client so we can require broadcaster-level access in order to
 	// call the admin-only subscription management endpoints
@@ -68,9 +156,12 @@ func main() {
 		app.Fail("Failed to initialize auth client", err)
 	}
 
-	// Initialize a Twitch API client with an app access token, then use it to resolve
-	// the Twitch User ID of our desired channel
-	twitchClient, err := twitch.NewClientWithAppToken(ctx, config.TwitchClientId, config.TwitchClientSecret)
+	// All requests to the Twitch API that are made on behalf of our app share a single,
+	// cached app access token, which is refreshed as needed. Initialize a Twitch API
+	// client that uses that token, then use it to resolve the Twitch User ID of our
+	// desired channel
+	appTokens := apptoken.NewProvider(config.TwitchClientId, config.TwitchClientSecret)
+	twitchClient, err := appTokens.NewTwitchClient(ctx)
 	if err != nil {
 		app.Fail("Failed to initialize Twitch API client", err)
 	}
@@ -84,34 +175,329 @@ func main() {
 		"channelUserId", channelUserId,
 	)
 
+	// Once the broadcaster has granted our app access to their channel, we hold onto the
+	// resulting user access token: it's encrypted at rest, and we keep it refreshed in
+	// the background
+	userTokenEncryptionKey, err := userauth.ParseEncryptionKey(config.UserTokenEncryptionKey)
+	if err != nil {
+		app.Fail("Failed to parse USER_TOKEN_ENCRYPTION_KEY", err)
+	}
+	twitchAuthClient, err := userauth.NewTwitchAuthClient(config.Origin, config.TwitchClientId, config.TwitchClientSecret)
+	if err != nil {
+		app.Fail("Failed to initialize Twitch API client for user auth", err)
+	}
+	userTokens := userauth.NewTokenManager(
+		userauth.NewFileTokenStore(config.UserTokenPath),
+		userTokenEncryptionKey,
+		twitchAuthClient,
+	)
+	go userTokens.Run(ctx, app.Log(), config.UserTokenCheckInterval)
+
+	// By default, EventSub subscriptions deliver notifications directly to our webhook
+	// callback URL. With EVENTSUB_TRANSPORT=conduit, they're instead registered against
+	// a conduit whose shards fan notifications out across the callback URLs listed in
+	// CONDUIT_SHARD_CALLBACK_URLS (e.g. one per replica)
+	var conduitShardCallbackUrls []string
+	switch config.EventsubTransport {
+	case "webhook":
+	case "conduit":
+		conduitShardCallbackUrls = config.ConduitShardCallbackUrls
+		if len(conduitShardCallbackUrls) == 0 {
+			conduitShardCallbackUrls = []string{config.Origin + "/callback"}
+		}
+	default:
+		app.Fail("Invalid config", fmt.Errorf("EVENTSUB_TRANSPORT must be 'webhook' or 'conduit'; got '%s'", config.EventsubTransport))
+	}
+
+	// While rotating our webhook secret, TWITCH_WEBHOOK_SECRET is the new secret (which
+	// is used when creating subscriptions), and TWITCH_PREVIOUS_WEBHOOK_SECRETS lists
+	// old secrets that we'll continue to accept: any subscription created before
+	// TWITCH_WEBHOOK_SECRET_ROTATED_AT is assumed to use a previous secret. That time
+	// must be given explicitly, since it has to be the same on every replica and across
+	// restarts
+	webhookSecrets := append([]string{config.TwitchWebhookSecret}, config.TwitchPreviousWebhookSecrets...)
+	var secretRotatedAt time.Time
+	if len(config.TwitchPreviousWebhookSecrets) > 0 {
+		if config.TwitchWebhookSecretRotatedAt == "" {
+			app.Fail("Invalid config", fmt.Errorf("TWITCH_WEBHOOK_SECRET_ROTATED_AT must be set when TWITCH_PREVIOUS_WEBHOOK_SECRETS is set"))
+		}
+		secretRotatedAt, err = time.Parse(time.RFC3339, config.TwitchWebhookSecretRotatedAt)
+		if err != nil {
+			app.Fail("Failed to parse TWITCH_WEBHOOK_SECRET_ROTATED_AT", err)
+		}
+	}
+
 	// Start setting up our HTTP handlers, using gorilla/mux for routing
 	r := mux.NewRouter()
 
-	// Twitch will call POST /callback (once we've registered EventSub subscriptions
-	// configuring it to do so) in response to events that occur on Twitch
-	callbackServer := callback.NewServer(config.TwitchWebhookSecret, producer)
-	callbackServer.RegisterRoutes(r)
-
 	// A client authenticated as the broadcaster can call GET /subscriptions to view the
 	// status of required EventSub subscriptions, PATCH to create ones that are missing,
-	// and DELETE to remove them all
+	// and DELETE to remove them all. POST /subscriptions/migrate replaces subscriptions
+	// whose version has changed, or that are still registered against any of the
+	// callback URLs given by LEGACY_CALLBACK_URLS (e.g. after ORIGIN has changed), and
+	// POST /subscriptions/rotate-secret recreates subscriptions that may still be using
+	// a previous webhook secret.
 	subscriptionServer := subscription.NewServer(
 		config.Origin,
 		channelUserId,
-		config.TwitchClientId,
-		config.TwitchClientSecret,
+		appTokens,
 		config.TwitchWebhookSecret,
+		subscription.Options{
+			GetGrantedScopes:         userTokens.LookupGrantedScopes,
+			GetDisconnection:         getDisconnectionFunc(userTokens),
+			ConduitShardCallbackUrls: conduitShardCallbackUrls,
+			ConduitId:                config.ConduitId,
+			LegacyCallbackUrls:       config.LegacyCallbackUrls,
+			SecretRotatedAt:          secretRotatedAt,
+		},
 	)
 	subscriptionServer.RegisterRoutes(authClient, r)
 
+	// Periodically check the status of our EventSub subscriptions in the background,
+	// raising an alert whenever a subscription's status changes
+	monitor := subscription.NewMonitor(subscriptionServer, notifier)
+	go monitor.Run(ctx, app.Log(), config.SubscriptionCheckInterval)
+
+	// The broadcaster can POST /userauth/disconnect to delete all our subscriptions and
+	// revoke our user access token; and if they revoke our app's access from their
+	// Twitch settings instead, we'll be notified via 'user.authorization.revoke'
+	disconnector := userauth.NewDisconnector(
+		config.TwitchClientId,
+		channelUserId,
+		userTokens,
+		notifier,
+		subscriptionServer.DeleteAll,
+	)
+	disconnector.RegisterRoutes(authClient, r)
+
+	// We keep track of the current stream session (persisted to SESSION_STATE_PATH,
+	// which must be shared by all replicas) so that we can indicate which broadcast
+	// each event occurred in. Anyone can GET /sessions to see the current session and
+	// the SESSION_HISTORY_SIZE most recent ones.
+	sessionTracker, err := session.NewTracker(config.SessionStatePath, config.SessionHistorySize)
+	if err != nil {
+		app.Fail("Failed to initialize stream session tracker", err)
+	}
+	sessionTracker.RegisterRoutes(r)
+
+	// For each session, we also keep running totals of bits, subs, gifts, raids and
+	// follows (persisted to ROLLUPS_PATH), which the broadcaster can GET via /rollups:
+	// when a session ends, its final totals are produced to hooks-rollups. Rollups are
+	// held per replica, so they're only complete if we're the only replica.
+	rollupTracker, err := rollup.NewTracker(config.RollupsPath, config.SessionHistorySize, rollupsProducer)
+	if err != nil {
+		app.Fail("Failed to initialize rollup tracker", err)
+	}
+	if config.Replicas > 1 || len(conduitShardCallbackUrls) > 1 {
+		app.Log().Warn("Running multiple replicas: rollups will only count the events handled by each replica", "replicas", config.Replicas)
+	}
+	rollupTracker.RegisterRoutes(authClient, r)
+
+	// If ENRICH_PROFILES is set, each event that involves a viewer is produced along
+	// with that viewer's Twitch user profile, which we look up via the Twitch API: up to
+	// ENRICH_CACHE_SIZE profiles are cached for ENRICH_CACHE_TTL
+	var enrichEvent callback.EnrichEventFunc
+	if config.EnrichProfiles {
+		enrichEvent = enrich.NewProfileEnricher(twitchClient, config.EnrichCacheSize, config.EnrichCacheTtl).Enrich
+	}
+
+	// If RULES_PATH is set, events are filtered, tagged, or rerouted according to the
+	// rules defined in that file before they're produced. The broadcaster can GET
+	// /rules to inspect the loaded rules and see how often each one has matched.
+	ruleEngine, err := rules.NewEngine(nil)
+	if err != nil {
+		app.Fail("Failed to initialize rules engine", err)
+	}
+	if config.RulesPath != "" {
+		ruleEngine, err = rules.Load(config.RulesPath)
+		if err != nil {
+			app.Fail("Failed to load rules", err)
+		}
+	}
+	rerouteProducers := make(map[string]*publish.Producer)
+	for _, exchange := range ruleEngine.Exchanges() {
+		rerouteProducer, err := publish.NewProducer(broker, exchange)
+		if err != nil {
+			app.Fail(fmt.Sprintf("Failed to initialize AMQP producer for exchange '%s'", exchange), err)
+		}
+		rerouteProducers[exchange] = rerouteProducer
+	}
+	ruleEngine.RegisterRoutes(authClient, r)
+
+	// If FOLLOW_BURST_DETECTION is set, we watch follow events for signs of a follow-bot
+	// attack, raising alerts when a burst of follows is suspected and when it ends. If
+	// FOLLOW_BURST_HOLD is also set, follow events are held back during a burst, then
+	// released or discarded (per FOLLOW_BURST_RESOLUTION) once it's over. Held events
+	// are persisted to FOLLOW_BURST_STATE_PATH, so they survive a restart.
+	var holdEvent callback.HoldEventFunc
+	var followBurstDetector *followburst.Detector
+	if config.FollowBurstDetection {
+		loginPattern, err := regexp.Compile(config.FollowBurstLoginPattern)
+		if err != nil {
+			app.Fail("Invalid FOLLOW_BURST_LOGIN_PATTERN", err)
+		}
+		followBurstDetector, err = followburst.NewDetector(followburst.Config{
+			Window:            config.FollowBurstWindow,
+			MaxFollows:        config.FollowBurstMaxFollows,
+			LoginPattern:      loginPattern,
+			MaxPatternFollows: config.FollowBurstMaxPatternFollows,
+			PrefixLength:      config.FollowBurstPrefixLength,
+			MaxPrefixFollows:  config.FollowBurstMaxPrefixFollows,
+			Cooldown:          config.FollowBurstCooldown,
+			Hold:              config.FollowBurstHold,
+			Resolution:        followburst.Resolution(config.FollowBurstResolution),
+			MaxHeld:           config.FollowBurstMaxHeld,
+		}, notifier, config.FollowBurstStatePath)
+		if err != nil {
+			app.Fail("Failed to initialize follow burst detector", err)
+		}
+		holdEvent = followBurstDetector.Observe
+	}
+
+	// Events are produced to twitch-events in OUTPUT_FORMAT: 'bare' (the default)
+	// produces each event as-is, 'envelope' wraps each event in a versioned envelope
+	// that also records when and how Twitch delivered it, and 'cloudevents-structured'
+	// or 'cloudevents-binary' produces each event as a CloudEvent
+	outputFormat, err := callback.ParseOutputFormat(config.OutputFormat)
+	if err != nil {
+		app.Fail("Invalid OUTPUT_FORMAT", err)
+	}
+
+	// Twitch will call POST /callback (once we've registered EventSub subscriptions
+	// configuring it to do so) in response to events that occur on Twitch, or to notify
+	// us that a subscription has been revoked. By default, each event is handled
+	// before we respond to Twitch; if CALLBACK_WORKERS is set, events are instead
+	// queued and then handled in the background by that many workers, with any that
+	// repeatedly fail spooled to CALLBACK_SPOOL_PATH. On shutdown, we spend up to
+	// CALLBACK_DRAIN_TIMEOUT handling queued events, and any that remain are spooled,
+	// to be handled when we next start up
+	callbackServer := callback.NewServer(webhookSecrets, producer, callback.Options{
+		HandleRevocation:          monitor.HandleRevocation,
+		HandleAuthorizationRevoke: disconnector.HandleAuthorizationRevoke,
+		TrackSession:              sessionTracker.Observe,
+		ObserveEvent:              rollupTracker.Observe,
+		EnrichEvent:               enrichEvent,
+		ApplyRules:                ruleEngine.Apply,
+		RerouteProducers:          asCallbackProducers(rerouteProducers),
+		HoldEvent:                 holdEvent,
+		OutputFormat:              outputFormat,
+		NumWorkers:                config.CallbackWorkers,
+		QueueSize:                 config.CallbackQueueSize,
+		SpoolPath:                 config.CallbackSpoolPath,
+	})
+	callbackServer.RegisterRoutes(r)
+	if followBurstDetector != nil {
+		go followBurstDetector.Run(ctx, app.Log(), time.Second, callbackServer.ReleaseHeldEvent)
+	}
+	callbackDone := make(chan struct{})
+	go func() {
+		callbackServer.Run(ctx, app.Log(), config.CallbackDrainTimeout)
+		close(callbackDone)
+	}()
+
 	// Registering EventSub subscriptions requires that our application be connected to
 	// the target Twitch channel: the broadcaster can GET /userauth/start to initiate an
 	// OAuth code grant flow that will accomplish that, and redirect_uri for that flow
-	// will send an authorization code back to GET /userauth/finish
-	userauthServer := userauth.NewServer(config.Origin, config.TwitchClientId)
-	userauthServer.RegisterRoutes(r)
+	// will send an authorization code back to GET /userauth/finish, which then sends the
+	// broadcaster back to the admin frontend (or any other URL in the allowlist given
+	// by USERAUTH_RETURN_TO_ALLOWLIST) with the result. The broadcaster can also GET
+	// /userauth/token to see details of the resulting user access token, and GET
+	// /userauth/status to check whether any required scopes are missing. The OAuth
+	// 'state' value is a token signed with USERAUTH_STATE_SECRET, so any replica can
+	// verify it; each token is single-use, as enforced by the replay cache. By default
+	// that cache is in-memory, which only prevents reuse against the same replica: when
+	// running multiple replicas (as declared by REPLICAS, or implied by having more than
+	// one conduit shard), USERAUTH_REPLAY_CACHE_DIR must name a directory on a volume
+	// shared by all of them
+	replays := userauth.NewMemoryReplayCache()
+	if config.UserauthReplayCacheDir != "" {
+		replays = userauth.NewFileReplayCache(config.UserauthReplayCacheDir)
+	} else if config.Replicas > 1 {
+		app.Fail("Invalid config", fmt.Errorf("USERAUTH_REPLAY_CACHE_DIR must be set when running multiple replicas (REPLICAS is %d)", config.Replicas))
+	} else if len(conduitShardCallbackUrls) > 1 {
+		app.Fail("Invalid config", fmt.Errorf("USERAUTH_REPLAY_CACHE_DIR must be set when running multiple replicas (CONDUIT_SHARD_CALLBACK_URLS lists %d)", len(conduitShardCallbackUrls)))
+	}
+	userauthServer := userauth.NewServer(
+		config.Origin,
+		config.TwitchClientId,
+		[]byte(config.UserauthStateSecret),
+		replays,
+		userTokens,
+		config.UserauthReturnTo,
+	)
+	userauthServer.RegisterRoutes(authClient, r)
+
+	// The broadcaster can POST /selftest to confirm that a notification delivered to
+	// our public callback URL (or SELF_TEST_CALLBACK_URL, if set) is verified,
+	// transformed, and published to twitch-events: the test signs a synthetic
+	// notification with our webhook secret, and the resulting event is marked as
+	// synthetic so that consumers can ignore it. If SELF_TEST_ON_STARTUP is set, we
+	// also run a self-test once SELF_TEST_STARTUP_DELAY has elapsed after startup
+	selfTestCallbackUrl := config.SelfTestCallbackUrl
+	if selfTestCallbackUrl == "" {
+		selfTestCallbackUrl = config.Origin + "/callback"
+	}
+	selfTestRunner := selftest.NewRunner(selfTestCallbackUrl, config.TwitchWebhookSecret, channelUserId)
+	selfTestRunner.RegisterRoutes(authClient, r)
+	if config.SelfTestOnStartup {
+		go selfTestRunner.RunAtStartup(ctx, app.Log(), config.SelfTestStartupDelay)
+	}
 
 	// Handle incoming HTTP connections until our top-level context is canceled, at
 	// which point shut down cleanly
 	entry.RunServer(ctx, app.Log(), r, config.BindAddr, config.ListenPort)
+
+	// Once we've stopped accepting callbacks and finished with any queued events,
+	// spend up to FOLLOW_BURST_FLUSH_TIMEOUT resolving any follow events still held
+	// during bursts that have ended (any that remain, along with any burst that's still
+	// ongoing, will be resolved when we next start up), wait for any outstanding
+	// publisher confirms, then close our AMQP connection
+	<-callbackDone
+	if followBurstDetector != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), config.FollowBurstFlushTimeout)
+		followBurstDetector.Flush(flushCtx, app.Log(), callbackServer.ReleaseHeldEvent)
+		cancel()
+	}
+	closeCtx, cancel := context.WithTimeout(context.Background(), config.ProducerCloseTimeout)
+	defer cancel()
+	if err := producer.Close(closeCtx); err != nil {
+		app.Log().Error("Failed to close AMQP producer cleanly", "error", err)
+	}
+	if err := alertsProducer.Close(closeCtx); err != nil {
+		app.Log().Error("Failed to close AMQP producer for alerts cleanly", "error", err)
+	}
+	if err := rollupsProducer.Close(closeCtx); err != nil {
+		app.Log().Error("Failed to close AMQP producer for rollups cleanly", "error", err)
+	}
+	for exchange, rerouteProducer := range rerouteProducers {
+		if err := rerouteProducer.Close(closeCtx); err != nil {
+			app.Log().Error(fmt.Sprintf("Failed to close AMQP producer for exchange '%s' cleanly", exchange), "error", err)
+		}
+	}
+	if err := broker.Close(); err != nil {
+		app.Log().Error("Failed to close AMQP connection", "error", err)
+	}
+	app.Log().Info("Shutdown complete")
+}
+
+// getDisconnectionFunc reports the broadcaster's disconnection of our app, as recorded
+// by the given token manager, to the subscription server
+func getDisconnectionFunc(tokens *userauth.TokenManager) subscription.GetDisconnectionFunc {
+	return func(ctx context.Context) (*subscription.Disconnection, error) {
+		disconnection, err := tokens.GetDisconnection(ctx)
+		if err != nil || disconnection == nil {
+			return nil, err
+		}
+		return &subscription.Disconnection{At: disconnection.At, Reason: disconnection.Reason}, nil
+	}
+}
+
+// asCallbackProducers returns the same set of producers, keyed by exchange, as
+// callback.Producer values
+func asCallbackProducers(producers map[string]*publish.Producer) map[string]callback.Producer {
+	result := make(map[string]callback.Producer, len(producers))
+	for exchange, producer := range producers {
+		result[exchange] = producer
+	}
+	return result
 }
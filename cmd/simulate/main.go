@@ -115,7 +115,10 @@ func main() {
 
 	// Build a message payload, finding a required subscription that matches the type
 	// indicated by our subcommand
-	params := hooks.RequiredSubscriptionConditionParams{ChannelUserId: channelUserId}
+	params := hooks.RequiredSubscriptionConditionParams{
+		ChannelUserId: channelUserId,
+		ClientId:      config.TwitchClientId,
+	}
 	payload := MessagePayload{}
 	for _, required := range hooks.Subscriptions {
 		if required.Type == subscriptionType {
@@ -0,0 +1,91 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type Type string
+
+const (
+	TypeSubscriptionStatusChanged Type = "subscription-status-changed"
+	TypeChannelDisconnected       Type = "channel-disconnected"
+	TypeFollowBurstSuspected      Type = "follow-burst-suspected"
+	TypeFollowBurstEnded          Type = "follow-burst-ended"
+)
+
+// Alert describes a condition that downstream consumers (and potentially the
+// broadcaster) should be made aware of
+type Alert struct {
+	Type       Type      `json:"type"`
+	Message    string    `json:"message"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Payload    *Payload  `json:"payload"`
+}
+
+// Payload carries the type-specific details of an Alert: exactly one field will be set,
+// corresponding to the alert's Type
+type Payload struct {
+	SubscriptionStatusChanged *PayloadSubscriptionStatusChanged `json:"subscription_status_changed,omitempty"`
+	ChannelDisconnected       *PayloadChannelDisconnected       `json:"channel_disconnected,omitempty"`
+	FollowBurst               *PayloadFollowBurst               `json:"follow_burst,omitempty"`
+}
+
+// PayloadSubscriptionStatusChanged describes a state transition for a single EventSub
+// subscription, e.g. from 'enabled' to 'authorization_revoked'
+type PayloadSubscriptionStatusChanged struct {
+	Required       bool              `json:"required"`
+	Type           string            `json:"type"`
+	Version        string            `json:"version"`
+	Condition      map[string]string `json:"condition"`
+	PreviousStatus string            `json:"previous_status"`
+	Status         string            `json:"status"`
+	Source         string            `json:"source"`
+}
+
+// PayloadChannelDisconnected indicates that our app is no longer authorized to access
+// the broadcaster's channel, either because the broadcaster revoked access via Twitch
+// or because an admin explicitly disconnected the app
+type PayloadChannelDisconnected struct {
+	UserId    string `json:"user_id"`
+	UserLogin string `json:"user_login"`
+	Reason    string `json:"reason"`
+}
+
+// PayloadFollowBurst describes a suspected follow-bot attack, i.e. a burst of follows
+// that exceeded one or more of our detection thresholds. The same payload is used when
+// the burst is first suspected and when it's ended: Signals lists the thresholds that
+// were exceeded. If follow events were held back during the burst, Resolution
+// indicates whether they were 'released' or 'discarded' once the burst ended.
+type PayloadFollowBurst struct {
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	Signals    []string   `json:"signals"`
+	NumFollows int        `json:"num_follows"`
+	NumHeld    int        `json:"num_held"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+// Notifier is anything that can convey an Alert to some interested party
+type Notifier interface {
+	Notify(ctx context.Context, a *Alert) error
+}
+
+// Multi returns a Notifier that conveys each alert to all of the given notifiers,
+// returning a combined error if any of them fail
+func Multi(notifiers ...Notifier) Notifier {
+	return multiNotifier(notifiers)
+}
+
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(ctx context.Context, a *Alert) error {
+	errs := make([]error, 0)
+	for _, n := range m {
+		if err := n.Notify(ctx, a); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
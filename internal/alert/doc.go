@@ -0,0 +1,5 @@
+// Package alert defines the structured alerts that the hooks service raises when
+// something happens that threatens its ability to deliver Twitch events (e.g. a
+// required EventSub subscription being revoked), along with the notifiers used to
+// convey those alerts to downstream consumers and to the broadcaster.
+package alert
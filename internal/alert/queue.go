@@ -0,0 +1,26 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/golden-vcr/server-common/rmq"
+)
+
+// NewQueueNotifier returns a Notifier that produces each alert, as JSON, to a message
+// queue
+func NewQueueNotifier(producer rmq.Producer) Notifier {
+	return &queueNotifier{producer: producer}
+}
+
+type queueNotifier struct {
+	producer rmq.Producer
+}
+
+func (n *queueNotifier) Notify(ctx context.Context, a *Alert) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return n.producer.Send(ctx, data)
+}
@@ -0,0 +1,71 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+)
+
+// DefaultWebhookTemplate is the message template used by a webhook notifier when no
+// custom template is configured
+const DefaultWebhookTemplate = "**[hooks]** {{.Message}}"
+
+// NewWebhookNotifier returns a Notifier that sends a human-readable message to an
+// outbound, Discord- or Slack-style webhook URL. The message text is rendered from
+// tmpl (using text/template syntax, with the Alert as the template data), and the
+// request body carries that text as both 'content' (for Discord) and 'text' (for Slack)
+func NewWebhookNotifier(url string, tmpl string) (Notifier, error) {
+	if tmpl == "" {
+		tmpl = DefaultWebhookTemplate
+	}
+	t, err := template.New("alert").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webhook message template: %w", err)
+	}
+	return &webhookNotifier{
+		client: http.DefaultClient,
+		url:    url,
+		tmpl:   t,
+	}, nil
+}
+
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	tmpl   *template.Template
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, a *Alert) error {
+	var text bytes.Buffer
+	if err := n.tmpl.Execute(&text, a); err != nil {
+		return fmt.Errorf("failed to render webhook message: %w", err)
+	}
+	body, err := json.Marshal(struct {
+		Content string `json:"content"`
+		Text    string `json:"text"`
+	}{
+		Content: text.String(),
+		Text:    text.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("got response %d from alert webhook", res.StatusCode)
+	}
+	return nil
+}
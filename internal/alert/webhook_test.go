@@ -0,0 +1,77 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_webhookNotifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		tmpl        string
+		status      int
+		wantErr     bool
+		wantContent string
+	}{
+		{
+			"default template renders message",
+			"",
+			http.StatusNoContent,
+			false,
+			"**[hooks]** channel.follow is now authorization_revoked",
+		},
+		{
+			"custom template can reference payload fields",
+			"{{.Payload.SubscriptionStatusChanged.Type}}: {{.Payload.SubscriptionStatusChanged.PreviousStatus}} -> {{.Payload.SubscriptionStatusChanged.Status}}",
+			http.StatusOK,
+			false,
+			"channel.follow: enabled -> authorization_revoked",
+		},
+		{
+			"non-2xx response is an error",
+			"",
+			http.StatusBadRequest,
+			true,
+			"**[hooks]** channel.follow is now authorization_revoked",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBody struct {
+				Content string `json:"content"`
+				Text    string `json:"text"`
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				assert.NoError(t, json.NewDecoder(req.Body).Decode(&gotBody))
+				res.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			n, err := NewWebhookNotifier(srv.URL, tt.tmpl)
+			assert.NoError(t, err)
+			err = n.Notify(context.Background(), &Alert{
+				Type:    TypeSubscriptionStatusChanged,
+				Message: "channel.follow is now authorization_revoked",
+				Payload: &Payload{
+					SubscriptionStatusChanged: &PayloadSubscriptionStatusChanged{
+						Type:           "channel.follow",
+						PreviousStatus: "enabled",
+						Status:         "authorization_revoked",
+					},
+				},
+			})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantContent, gotBody.Content)
+			assert.Equal(t, tt.wantContent, gotBody.Text)
+		})
+	}
+}
@@ -0,0 +1,15 @@
+// Package apptoken manages the Twitch app access token that identifies our app when
+// calling the Twitch API, e.g. to manage EventSub subscriptions.
+//
+// App access tokens are obtained via the OAuth client credentials grant flow, using
+// our app's client ID and client secret:
+//
+// - https://dev.twitch.tv/docs/authentication/getting-tokens-oauth/#client-credentials-grant-flow
+//
+// Each token is valid for a long time (typically around 60 days), so rather than
+// minting a new token for every request, a single Provider is shared by everything in
+// the process that needs to call the Twitch API. The Provider caches its token,
+// requests a new one shortly before the current token expires, and discards its token
+// and retries if Twitch rejects a request with a 401 (e.g. because the token was
+// revoked early).
+package apptoken
@@ -0,0 +1,178 @@
+package apptoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+const (
+	// DefaultTokenUrl is the Twitch OAuth endpoint that issues app access tokens
+	DefaultTokenUrl = "https://id.twitch.tv/oauth2/token"
+
+	// RefreshMargin is how long before our token's expiry we'll request a new one
+	RefreshMargin = 5 * time.Minute
+)
+
+// Provider issues app access tokens for our Twitch app, caching each token until
+// shortly before it expires. It also implements helix.HTTPClient, authorizing each
+// request with the current token.
+type Provider struct {
+	clientId     string
+	clientSecret string
+	tokenUrl     string
+	httpClient   *http.Client
+	now          func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewProvider(clientId, clientSecret string) *Provider {
+	return &Provider{
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		tokenUrl:     DefaultTokenUrl,
+		httpClient:   http.DefaultClient,
+		now:          time.Now,
+	}
+}
+
+// ClientId returns the client ID of the Twitch app for which we issue tokens
+func (p *Provider) ClientId() string {
+	return p.clientId
+}
+
+// Token returns a valid app access token, requesting a new token from Twitch if we
+// don't have one or if our current token is about to expire
+func (p *Provider) Token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && p.now().Before(p.expiresAt.Add(-RefreshMargin)) {
+		return p.token, nil
+	}
+
+	token, expiresIn, err := p.requestToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get app access token from Twitch API: %w", err)
+	}
+	p.token = token
+	p.expiresAt = p.now().Add(expiresIn)
+	return p.token, nil
+}
+
+// Invalidate discards the given token if it's the one we currently have cached, so
+// that the next call to Token will request a new one. This should be called when
+// Twitch rejects a request made with that token.
+func (p *Provider) Invalidate(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token == token {
+		p.token = ""
+		p.expiresAt = time.Time{}
+	}
+}
+
+// Do sends an HTTP request to the Twitch API, authorized with our app access token. If
+// Twitch responds with a 401, we discard our token and retry the request once with a
+// new token.
+func (p *Provider) Do(req *http.Request) (*http.Response, error) {
+	token, err := p.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.send(req, token)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	// We can only retry if we're able to send the same request body again
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return res, nil
+	}
+	res.Body.Close()
+
+	p.Invalidate(token)
+	token, err = p.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.send(retry, token)
+}
+
+// NewTwitchClient returns a Twitch API client whose requests are authorized with our
+// app access token
+func (p *Provider) NewTwitchClient(ctx context.Context) (*helix.Client, error) {
+	c, err := helix.NewClientWithContext(ctx, &helix.Options{
+		ClientID:   p.clientId,
+		HTTPClient: p,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Twitch API client: %w", err)
+	}
+	return c, nil
+}
+
+// send sends a copy of the given request, with an authorization header bearing token
+func (p *Provider) send(req *http.Request, token string) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("authorization", "Bearer "+token)
+	req.Header.Set("client-id", p.clientId)
+	return p.httpClient.Do(req)
+}
+
+// requestToken obtains a new app access token via the client credentials grant flow,
+// returning the token along with its lifetime
+func (p *Provider) requestToken(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{
+		"client_id":     {p.clientId},
+		"client_secret": {p.clientSecret},
+		"grant_type":    {"client_credentials"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(res.Body)
+		return "", 0, fmt.Errorf("got status %d: %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("response did not include an access token")
+	}
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,147 @@
+package apptoken
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Provider_Token(t *testing.T) {
+	tokens := &fakeTokenEndpoint{expiresIn: 3600}
+	server := httptest.NewServer(tokens)
+	defer server.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := newTestProvider(server)
+	p.now = func() time.Time { return now }
+
+	// The first call should request a token, and subsequent calls should reuse it
+	token, err := p.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	token, err = p.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.Equal(t, 1, tokens.numRequests)
+
+	// Shortly before the token expires, we should request a new one
+	now = now.Add(time.Hour - RefreshMargin)
+	token, err = p.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+	assert.Equal(t, 2, tokens.numRequests)
+
+	// Invalidating a token we no longer hold should have no effect
+	p.Invalidate("token-1")
+	token, err = p.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	// Invalidating our current token should cause a new one to be requested
+	p.Invalidate("token-2")
+	token, err = p.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+	assert.Equal(t, 3, tokens.numRequests)
+}
+
+func Test_Provider_Token_error(t *testing.T) {
+	tokens := &fakeTokenEndpoint{rejectCredentials: true}
+	server := httptest.NewServer(tokens)
+	defer server.Close()
+
+	p := newTestProvider(server)
+	_, err := p.Token(context.Background())
+	assert.ErrorContains(t, err, "got status 403")
+}
+
+func Test_Provider_Do(t *testing.T) {
+	tokens := &fakeTokenEndpoint{expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.Handle("/oauth2/token", tokens)
+
+	// Our fake API only accepts the most recently issued token, simulating a token that
+	// Twitch has revoked before its expiry
+	var receivedBodies []string
+	mux.HandleFunc("/helix/things", func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "my-client-id", req.Header.Get("client-id"))
+		body, _ := io.ReadAll(req.Body)
+		receivedBodies = append(receivedBodies, string(body))
+		if req.Header.Get("authorization") != fmt.Sprintf("Bearer token-%d", tokens.numRequests) || tokens.numRequests < 2 {
+			http.Error(res, "invalid access token", http.StatusUnauthorized)
+			return
+		}
+		res.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := newTestProvider(server)
+	p.tokenUrl = server.URL + "/oauth2/token"
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/helix/things", strings.NewReader("my-payload"))
+	assert.NoError(t, err)
+	res, err := p.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// The request should have been retried exactly once, with a new token and the same
+	// body
+	assert.Equal(t, 2, tokens.numRequests)
+	assert.Equal(t, []string{"my-payload", "my-payload"}, receivedBodies)
+
+	// Subsequent requests should use the new token without retrying
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/helix/things", nil)
+	assert.NoError(t, err)
+	res, err = p.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, tokens.numRequests)
+	assert.Len(t, receivedBodies, 3)
+}
+
+func newTestProvider(server *httptest.Server) *Provider {
+	p := NewProvider("my-client-id", "my-client-secret")
+	p.tokenUrl = server.URL
+	p.httpClient = server.Client()
+	return p
+}
+
+// fakeTokenEndpoint simulates the Twitch OAuth token endpoint, issuing a new token on
+// each request
+type fakeTokenEndpoint struct {
+	expiresIn         int
+	rejectCredentials bool
+	numRequests       int
+}
+
+func (f *fakeTokenEndpoint) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.PostForm.Get("grant_type") != "client_credentials" {
+		http.Error(res, "unsupported grant type", http.StatusBadRequest)
+		return
+	}
+	if f.rejectCredentials || req.PostForm.Get("client_id") != "my-client-id" || req.PostForm.Get("client_secret") != "my-client-secret" {
+		http.Error(res, "invalid client secret", http.StatusForbidden)
+		return
+	}
+	f.numRequests++
+	res.Header().Set("content-type", "application/json")
+	fmt.Fprintf(res, `{"access_token":"token-%d","expires_in":%d,"token_type":"bearer"}`, f.numRequests, f.expiresIn)
+}
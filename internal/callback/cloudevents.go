@@ -0,0 +1,151 @@
+package callback
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/publish"
+	"github.com/nicklaw5/helix/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// CloudEventsSpecVersion is the version of the CloudEvents specification to which
+	// the events we produce conform
+	CloudEventsSpecVersion = "1.0"
+
+	// CloudEventsContentType is the content type of a message that carries a
+	// JSON-formatted CloudEvent in structured content mode
+	CloudEventsContentType = "application/cloudevents+json"
+
+	// CloudEventsTypePrefix is prepended to the EventSub subscription type in order to
+	// produce the 'type' attribute of each CloudEvent, e.g.
+	// 'tv.twitch.eventsub.channel.follow.v2'
+	CloudEventsTypePrefix = "tv.twitch.eventsub."
+
+	// CloudEventsHeaderPrefix is prepended to the name of each CloudEvents attribute
+	// in order to produce the name of the AMQP header that carries it in binary content
+	// mode, as defined by the CloudEvents AMQP protocol binding
+	CloudEventsHeaderPrefix = "cloudEvents:"
+)
+
+// CloudEvent is a CloudEvents 1.0 event, in its JSON representation
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            *time.Time      `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// eventTimeFields names the field of each type of EventSub event that records when the
+// event occurred, for those types that have one
+var eventTimeFields = map[string]string{
+	helix.EventSubTypeChannelFollow:  "followed_at",
+	helix.EventSubTypeStreamOnline:   "started_at",
+	helix.EventSubTypeHypeTrainBegin: "started_at",
+}
+
+// newCloudEvent returns a CloudEvent that carries the given event data, identified by
+// the ID of the Twitch message that delivered it; eventsubData is the event as
+// delivered by Twitch
+func newCloudEvent(delivery *Delivery, subscription *helix.EventSubSubscription, eventsubData json.RawMessage, data json.RawMessage) *CloudEvent {
+	ce := &CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		Id:              delivery.MessageId,
+		Source:          cloudEventSource(subscription),
+		Type:            cloudEventType(subscription),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	// Prefer the time at which the event occurred, if the event records it; otherwise
+	// fall back to the time at which Twitch sent the event, then to the time at which
+	// we received it: 'time' is optional, so omit it if we have none of these
+	timestamp := eventTime(subscription.Type, eventsubData)
+	if timestamp.IsZero() {
+		timestamp = delivery.MessageTimestamp
+	}
+	if timestamp.IsZero() {
+		timestamp = delivery.ReceivedAt
+	}
+	if !timestamp.IsZero() {
+		timestamp = timestamp.UTC()
+		ce.Time = &timestamp
+	}
+	return ce
+}
+
+// eventTime returns the time at which an EventSub event occurred, or the zero time if
+// the event doesn't record it
+func eventTime(subscriptionType string, eventsubData json.RawMessage) time.Time {
+	field, ok := eventTimeFields[subscriptionType]
+	if !ok {
+		return time.Time{}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(eventsubData, &fields); err != nil {
+		return time.Time{}
+	}
+	var t time.Time
+	if value, ok := fields[field]; !ok || json.Unmarshal(value, &t) != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// cloudEventType returns the CloudEvents 'type' for events produced via the given
+// subscription, which identifies both the subscription type and its version
+func cloudEventType(subscription *helix.EventSubSubscription) string {
+	return fmt.Sprintf("%s%s.v%s", CloudEventsTypePrefix, subscription.Type, subscription.Version)
+}
+
+// cloudEventSource returns the CloudEvents 'source' for events produced via the given
+// subscription, which identifies the Twitch channel in which they occurred
+func cloudEventSource(subscription *helix.EventSubSubscription) string {
+	channelId := subscription.Condition.BroadcasterUserID
+	if channelId == "" {
+		// Raids are identified by the channel being raided
+		channelId = subscription.Condition.ToBroadcasterUserID
+	}
+	if channelId == "" {
+		return "urn:twitch:eventsub:subscription:" + subscription.ID
+	}
+	return "urn:twitch:channel:" + channelId
+}
+
+// toStructured returns a message that carries the CloudEvent in structured content
+// mode
+func (ce *CloudEvent) toStructured() (publish.Message, error) {
+	body, err := json.Marshal(ce)
+	if err != nil {
+		return publish.Message{}, err
+	}
+	return publish.Message{
+		ContentType: CloudEventsContentType,
+		Body:        body,
+	}, nil
+}
+
+// toBinary returns a message that carries the CloudEvent in binary content mode:
+// 'datacontenttype' maps to the message's content type, and all other attributes are
+// carried in headers
+func (ce *CloudEvent) toBinary() publish.Message {
+	headers := amqp.Table{
+		CloudEventsHeaderPrefix + "specversion": ce.SpecVersion,
+		CloudEventsHeaderPrefix + "id":          ce.Id,
+		CloudEventsHeaderPrefix + "source":      ce.Source,
+		CloudEventsHeaderPrefix + "type":        ce.Type,
+	}
+	if ce.Time != nil {
+		headers[CloudEventsHeaderPrefix+"time"] = ce.Time.Format(time.RFC3339Nano)
+	}
+	return publish.Message{
+		ContentType: ce.DataContentType,
+		Headers:     headers,
+		Body:        ce.Data,
+	}
+}
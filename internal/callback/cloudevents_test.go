@@ -0,0 +1,230 @@
+package callback
+
+import (
+	"encoding/json"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/schemas/core"
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_formatMessage_cloudEvents(t *testing.T) {
+	ev := &etwitch.Event{
+		Type: etwitch.EventTypeViewerFollowed,
+		Viewer: &core.Viewer{
+			TwitchUserId:      "1234",
+			TwitchDisplayName: "Bungus",
+		},
+	}
+	wantData := `{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`
+
+	tests := []struct {
+		name         string
+		delivery     *Delivery
+		subscription *helix.EventSubSubscription
+		eventsubData string
+		wantType     string
+		wantSource   string
+		wantTime     string
+	}{
+		{
+			"channel event, with time taken from the event",
+			&Delivery{
+				MessageId:        "message-1",
+				MessageTimestamp: time.Date(1997, 9, 1, 12, 0, 0, 0, time.UTC),
+				ReceivedAt:       time.Date(1997, 9, 1, 12, 0, 0, 250000000, time.UTC),
+			},
+			&helix.EventSubSubscription{
+				ID:        "some-follow-subscription",
+				Type:      helix.EventSubTypeChannelFollow,
+				Version:   "2",
+				Condition: helix.EventSubCondition{BroadcasterUserID: "953753877"},
+			},
+			`{"user_id":"1234","user_login":"bungus","user_name":"Bungus","followed_at":"1997-09-01T11:59:58.5-04:00"}`,
+			"tv.twitch.eventsub.channel.follow.v2",
+			"urn:twitch:channel:953753877",
+			"1997-09-01T15:59:58.5Z",
+		},
+		{
+			"time falls back to time sent if the event doesn't record it",
+			&Delivery{
+				MessageId:        "message-1",
+				MessageTimestamp: time.Date(1997, 9, 1, 12, 0, 0, 0, time.UTC),
+				ReceivedAt:       time.Date(1997, 9, 1, 12, 0, 0, 250000000, time.UTC),
+			},
+			&helix.EventSubSubscription{
+				ID:        "some-follow-subscription",
+				Type:      helix.EventSubTypeChannelFollow,
+				Version:   "2",
+				Condition: helix.EventSubCondition{BroadcasterUserID: "953753877"},
+			},
+			`{"user_id":"1234","user_login":"bungus","user_name":"Bungus"}`,
+			"tv.twitch.eventsub.channel.follow.v2",
+			"urn:twitch:channel:953753877",
+			"1997-09-01T12:00:00Z",
+		},
+		{
+			"raid identifies the channel being raided",
+			&Delivery{
+				MessageId:        "message-2",
+				MessageTimestamp: time.Date(1997, 9, 1, 12, 0, 0, 0, time.FixedZone("EDT", -4*60*60)),
+			},
+			&helix.EventSubSubscription{
+				ID:        "some-raid-subscription",
+				Type:      helix.EventSubTypeChannelRaid,
+				Version:   "1",
+				Condition: helix.EventSubCondition{ToBroadcasterUserID: "953753877"},
+			},
+			`{"from_broadcaster_user_id":"5","viewers":69}`,
+			"tv.twitch.eventsub.channel.raid.v1",
+			"urn:twitch:channel:953753877",
+			"1997-09-01T16:00:00Z",
+		},
+		{
+			"time falls back to time received, and source falls back to subscription",
+			&Delivery{
+				MessageId:  "message-3",
+				ReceivedAt: time.Date(1997, 9, 1, 12, 0, 0, 250000000, time.UTC),
+			},
+			&helix.EventSubSubscription{
+				ID:      "some-subscription",
+				Type:    helix.EventSubTypeChannelFollow,
+				Version: "2",
+			},
+			`{}`,
+			"tv.twitch.eventsub.channel.follow.v2",
+			"urn:twitch:eventsub:subscription:some-subscription",
+			"1997-09-01T12:00:00.25Z",
+		},
+		{
+			"time is omitted if unknown",
+			&Delivery{
+				MessageId: "message-4",
+			},
+			&helix.EventSubSubscription{
+				ID:        "some-follow-subscription",
+				Type:      helix.EventSubTypeChannelFollow,
+				Version:   "2",
+				Condition: helix.EventSubCondition{BroadcasterUserID: "953753877"},
+			},
+			`{}`,
+			"tv.twitch.eventsub.channel.follow.v2",
+			"urn:twitch:channel:953753877",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" (structured)", func(t *testing.T) {
+			message, err := formatMessage(OutputFormatCloudEventsStructured, tt.delivery, tt.subscription, json.RawMessage(tt.eventsubData), ev, &Extensions{})
+			assert.NoError(t, err)
+			assert.Equal(t, "application/cloudevents+json", message.ContentType)
+			assert.Empty(t, message.Headers)
+
+			var attributes map[string]json.RawMessage
+			assert.NoError(t, json.Unmarshal(message.Body, &attributes))
+			data, hasData := attributes["data"]
+			delete(attributes, "data")
+			assert.True(t, hasData)
+			assert.JSONEq(t, wantData, string(data))
+
+			values := make(map[string]string)
+			for name, raw := range attributes {
+				var value string
+				assert.NoError(t, json.Unmarshal(raw, &value), "attribute %s should be a string", name)
+				values[name] = value
+			}
+			assertConformsToCloudEvents(t, values)
+			assert.Equal(t, tt.delivery.MessageId, values["id"])
+			assert.Equal(t, tt.wantType, values["type"])
+			assert.Equal(t, tt.wantSource, values["source"])
+			assert.Equal(t, tt.wantTime, values["time"])
+			assert.Equal(t, "application/json", values["datacontenttype"])
+		})
+		t.Run(tt.name+" (binary)", func(t *testing.T) {
+			message, err := formatMessage(OutputFormatCloudEventsBinary, tt.delivery, tt.subscription, json.RawMessage(tt.eventsubData), ev, &Extensions{})
+			assert.NoError(t, err)
+			assert.JSONEq(t, wantData, string(message.Body))
+
+			// The AMQP protocol binding maps 'datacontenttype' to the message's
+			// content-type property, and all other attributes to prefixed headers
+			values := map[string]string{"datacontenttype": message.ContentType}
+			for header, raw := range message.Headers {
+				assert.True(t, strings.HasPrefix(header, "cloudEvents:"), "header %s should be prefixed", header)
+				value, ok := raw.(string)
+				assert.True(t, ok, "header %s should be a string", header)
+				values[strings.TrimPrefix(header, "cloudEvents:")] = value
+			}
+			assertConformsToCloudEvents(t, values)
+			assert.Equal(t, tt.delivery.MessageId, values["id"])
+			assert.Equal(t, tt.wantType, values["type"])
+			assert.Equal(t, tt.wantSource, values["source"])
+			assert.Equal(t, tt.wantTime, values["time"])
+			assert.Equal(t, "application/json", values["datacontenttype"])
+		})
+	}
+}
+
+func Test_formatMessage_cloudEvents_extensions(t *testing.T) {
+	ev := &etwitch.Event{
+		Type: etwitch.EventTypeViewerFollowed,
+		Viewer: &core.Viewer{
+			TwitchUserId:      "1234",
+			TwitchDisplayName: "Bungus",
+		},
+	}
+	delivery := &Delivery{MessageId: "message-1"}
+	subscription := &helix.EventSubSubscription{
+		ID:        "some-follow-subscription",
+		Type:      helix.EventSubTypeChannelFollow,
+		Version:   "2",
+		Condition: helix.EventSubCondition{BroadcasterUserID: "953753877"},
+	}
+	extensions := &Extensions{SessionId: json.RawMessage(`"some-session"`), Tags: []string{"vip"}}
+
+	// Extensions are carried in the event data, just as they are in the bare format
+	message, err := formatMessage(OutputFormatCloudEventsBinary, delivery, subscription, json.RawMessage(`{}`), ev, extensions)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null,"extensions":{"session_id":"some-session","tags":["vip"]}}`, string(message.Body))
+}
+
+// cloudEventsAttributeNamePattern matches the names that the CloudEvents spec permits
+// for context attributes
+var cloudEventsAttributeNamePattern = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// assertConformsToCloudEvents checks a set of CloudEvents context attributes against
+// the requirements of the CloudEvents 1.0 spec
+func assertConformsToCloudEvents(t *testing.T, attributes map[string]string) {
+	t.Helper()
+
+	// All attribute names must consist of lowercase letters and digits
+	for name := range attributes {
+		assert.Regexp(t, cloudEventsAttributeNamePattern, name)
+	}
+
+	// Required attributes: 'id', 'source', 'specversion', and 'type' must be present
+	// and non-empty, 'source' must be a URI-reference, and 'specversion' must be '1.0'
+	for _, name := range []string{"id", "source", "specversion", "type"} {
+		assert.NotEmpty(t, attributes[name], "required attribute %s", name)
+	}
+	_, err := url.Parse(attributes["source"])
+	assert.NoError(t, err, "source must be a URI-reference")
+	assert.Equal(t, "1.0", attributes["specversion"])
+
+	// Optional attributes, if present, must be well-formed: 'time' must be an RFC3339
+	// timestamp, and 'datacontenttype' must be a media type
+	if value, ok := attributes["time"]; ok {
+		_, err := time.Parse(time.RFC3339, value)
+		assert.NoError(t, err, "time must be an RFC3339 timestamp")
+	}
+	if value, ok := attributes["datacontenttype"]; ok {
+		_, _, err := mime.ParseMediaType(value)
+		assert.NoError(t, err, "datacontenttype must be a media type")
+	}
+}
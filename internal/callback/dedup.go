@@ -0,0 +1,152 @@
+package callback
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// DeduplicationWindow is how long we remember the messages and events we've handled,
+// in order to discard duplicates
+const DeduplicationWindow = 10 * time.Minute
+
+// deduplicator keeps track of recently-handled messages so that we can discard any
+// duplicates. Twitch may redeliver the same message (with the same message ID) if it
+// doesn't receive a timely response; and while migrating a subscription from one
+// version to another, both versions will deliver the same event in separate messages.
+// In the latter case, we identify duplicates by the normalized event that we produce:
+// if a subscription of the same type but with a different ID has already produced an
+// identical event, we discard it. Each produced event can only account for one such
+// duplicate, so that identical events that genuinely occur more than once (e.g. two
+// anonymous cheers of the same amount) are each produced once, whichever subscription
+// happens to deliver them first.
+//
+// This state is held in memory, so it's per replica: a message redelivered to a
+// different replica (e.g. via another conduit shard) won't be recognized as a
+// duplicate, and consumers should deduplicate by message ID themselves if that matters.
+type deduplicator struct {
+	mu       sync.Mutex
+	window   time.Duration
+	now      func() time.Time
+	messages map[string]time.Time
+	events   map[string][]seenEvent
+}
+
+type seenEvent struct {
+	subscriptionId string
+	at             time.Time
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window:   window,
+		now:      time.Now,
+		messages: make(map[string]time.Time),
+		events:   make(map[string][]seenEvent),
+	}
+}
+
+// isDuplicateMessage returns true if we've already handled a message with the given ID
+func (d *deduplicator) isDuplicateMessage(messageId string) bool {
+	if messageId == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	_, ok := d.messages[messageId]
+	return ok
+}
+
+// recordMessage records that we've successfully handled the message with the given ID
+func (d *deduplicator) recordMessage(messageId string) {
+	if messageId == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages[messageId] = d.now()
+}
+
+// claimMessage records that we're handling the message with the given ID, returning
+// false if it's already been recorded. Unlike a check followed by recordMessage, this
+// is atomic, so that concurrent deliveries of the same message can't both claim it.
+func (d *deduplicator) claimMessage(messageId string) bool {
+	if messageId == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	if _, ok := d.messages[messageId]; ok {
+		return false
+	}
+	d.messages[messageId] = d.now()
+	return true
+}
+
+// discardDuplicateEvent returns true if we've already produced an identical event in
+// response to a message from a different subscription of the same type. In that case,
+// the record of that event is consumed, so that it can't be used to discard another
+// event that happens to be identical.
+func (d *deduplicator) discardDuplicateEvent(subscriptionType string, subscriptionId string, eventData []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	key := eventKey(subscriptionType, eventData)
+	seen := d.events[key]
+	for i := range seen {
+		if seen[i].subscriptionId != subscriptionId {
+			seen = append(seen[:i:i], seen[i+1:]...)
+			if len(seen) == 0 {
+				delete(d.events, key)
+			} else {
+				d.events[key] = seen
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// recordEvent records that we've produced the given event in response to a message
+// from the given subscription
+func (d *deduplicator) recordEvent(subscriptionType string, subscriptionId string, eventData []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := eventKey(subscriptionType, eventData)
+	d.events[key] = append(d.events[key], seenEvent{
+		subscriptionId: subscriptionId,
+		at:             d.now(),
+	})
+}
+
+// prune discards any records that have fallen outside our deduplication window. Must
+// be called with mu held.
+func (d *deduplicator) prune() {
+	cutoff := d.now().Add(-d.window)
+	for messageId, at := range d.messages {
+		if at.Before(cutoff) {
+			delete(d.messages, messageId)
+		}
+	}
+	for key, seen := range d.events {
+		kept := seen[:0]
+		for _, e := range seen {
+			if !e.at.Before(cutoff) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.events, key)
+		} else {
+			d.events[key] = kept
+		}
+	}
+}
+
+func eventKey(subscriptionType string, eventData []byte) string {
+	digest := sha256.Sum256(eventData)
+	return subscriptionType + ":" + hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,59 @@
+package callback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deduplicator(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := newDeduplicator(10 * time.Minute)
+	d.now = func() time.Time { return now }
+
+	// Messages are only considered duplicates once they've been handled
+	assert.False(t, d.isDuplicateMessage("message-1"))
+	assert.False(t, d.isDuplicateMessage("message-1"))
+	d.recordMessage("message-1")
+	assert.True(t, d.isDuplicateMessage("message-1"))
+	assert.False(t, d.isDuplicateMessage("message-2"))
+	assert.False(t, d.isDuplicateMessage(""))
+
+	// Claiming a message records it, but only succeeds the first time
+	assert.True(t, d.claimMessage("message-3"))
+	assert.False(t, d.claimMessage("message-3"))
+	assert.True(t, d.isDuplicateMessage("message-3"))
+	assert.False(t, d.claimMessage(""))
+
+	// An identical event is a duplicate only if it comes from a different
+	// subscription of the same type
+	event := []byte(`{"type":"follow","viewer":{"id":"42"}}`)
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v1", event))
+	d.recordEvent("channel.follow", "sub-v1", event)
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v1", event))
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v2", []byte(`{"type":"follow","viewer":{"id":"43"}}`)))
+	assert.False(t, d.discardDuplicateEvent("channel.cheer", "sub-v2", event))
+	assert.True(t, d.discardDuplicateEvent("channel.follow", "sub-v2", event))
+
+	// Once a duplicate has been discarded, the record is consumed: an identical event
+	// that occurs again is produced, whichever subscription delivers it first, and its
+	// own duplicate is discarded in turn
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v2", event))
+	d.recordEvent("channel.follow", "sub-v2", event)
+	assert.True(t, d.discardDuplicateEvent("channel.follow", "sub-v1", event))
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v1", event))
+
+	// Each produced event accounts for exactly one duplicate
+	d.recordEvent("channel.follow", "sub-v1", event)
+	d.recordEvent("channel.follow", "sub-v1", event)
+	assert.True(t, d.discardDuplicateEvent("channel.follow", "sub-v2", event))
+	assert.True(t, d.discardDuplicateEvent("channel.follow", "sub-v2", event))
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v2", event))
+	d.recordEvent("channel.follow", "sub-v1", event)
+
+	// Records are forgotten once they fall outside the window
+	now = now.Add(11 * time.Minute)
+	assert.False(t, d.isDuplicateMessage("message-1"))
+	assert.False(t, d.discardDuplicateEvent("channel.follow", "sub-v2", event))
+}
@@ -0,0 +1,157 @@
+package callback
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/enrich"
+	"github.com/golden-vcr/hooks/internal/publish"
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
+	"github.com/nicklaw5/helix/v2"
+)
+
+// OutputFormat determines how events are formatted when we produce them
+type OutputFormat string
+
+const (
+	// OutputFormatBare produces each event as the bare JSON representation of the
+	// etwitch.Event, with an 'extensions' block added if there are any extensions
+	OutputFormatBare OutputFormat = "bare"
+
+	// OutputFormatEnvelope produces each event wrapped in a versioned envelope that
+	// also carries the details of how the event was delivered to us by Twitch
+	OutputFormatEnvelope OutputFormat = "envelope"
+
+	// OutputFormatCloudEventsStructured produces each event as a CloudEvent in
+	// structured content mode: the message body is a JSON-formatted CloudEvent
+	OutputFormatCloudEventsStructured OutputFormat = "cloudevents-structured"
+
+	// OutputFormatCloudEventsBinary produces each event as a CloudEvent in binary
+	// content mode: the message body is the event data, and CloudEvents attributes are
+	// carried in AMQP headers
+	OutputFormatCloudEventsBinary OutputFormat = "cloudevents-binary"
+)
+
+// ParseOutputFormat validates the name of an output format
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch OutputFormat(s) {
+	case OutputFormatBare, OutputFormatEnvelope, OutputFormatCloudEventsStructured, OutputFormatCloudEventsBinary:
+		return OutputFormat(s), nil
+	}
+	return "", fmt.Errorf("unsupported output format %q: must be '%s', '%s', '%s', or '%s'", s, OutputFormatBare, OutputFormatEnvelope, OutputFormatCloudEventsStructured, OutputFormatCloudEventsBinary)
+}
+
+// EnvelopeVersion is the version of the envelope format that we currently produce: it
+// will be incremented if the structure of the envelope changes incompatibly
+const EnvelopeVersion = 1
+
+// Delivery describes how a single event notification was delivered to us by Twitch
+type Delivery struct {
+	// MessageId is the unique ID of the message, as sent in the
+	// Twitch-Eventsub-Message-Id header: messages that Twitch redelivers will have the
+	// same ID
+	MessageId string
+	// MessageTimestamp is the time at which Twitch sent the message, as sent in the
+	// Twitch-Eventsub-Message-Timestamp header
+	MessageTimestamp time.Time
+	// ReceivedAt is the time at which we received the message
+	ReceivedAt time.Time
+}
+
+// Envelope is the format in which we produce events when using OutputFormatEnvelope
+type Envelope struct {
+	EnvelopeVersion int            `json:"envelope_version"`
+	Twitch          EnvelopeTwitch `json:"twitch"`
+	ReceivedAt      time.Time      `json:"received_at"`
+	Event           *etwitch.Event `json:"event"`
+	Extensions      *Extensions    `json:"extensions,omitempty"`
+}
+
+// EnvelopeTwitch carries the details of the EventSub notification from which an event
+// was produced
+type EnvelopeTwitch struct {
+	MessageId           string    `json:"message_id"`
+	MessageTimestamp    time.Time `json:"message_timestamp"`
+	SubscriptionId      string    `json:"subscription_id"`
+	SubscriptionType    string    `json:"subscription_type"`
+	SubscriptionVersion string    `json:"subscription_version"`
+}
+
+// enrichedEvent is an event that's produced in the bare format along with an
+// 'extensions' block containing supplementary details
+type enrichedEvent struct {
+	*etwitch.Event
+	Extensions *Extensions `json:"extensions,omitempty"`
+}
+
+// Extensions holds supplementary details that are produced alongside an event, in any
+// output format. It's defined only here: other packages (e.g. enrich and rules) just
+// supply the values that we put in it.
+type Extensions struct {
+	// SessionId is the JSON-encoded ID of the stream session in which the event
+	// occurred, or 'null' if the stream was offline; it's omitted entirely if we're not
+	// tracking sessions
+	SessionId json.RawMessage `json:"session_id,omitempty"`
+
+	// ViewerProfile is the Twitch user profile of the viewer involved in the event,
+	// if profile enrichment is enabled
+	ViewerProfile *enrich.Profile `json:"viewer_profile,omitempty"`
+
+	// Tags are attached to the event by the rules that it matched
+	Tags []string `json:"tags,omitempty"`
+
+	// Synthetic is true if the event was produced by a self-test rather than by
+	// Twitch: consumers should ignore synthetic events
+	Synthetic bool `json:"synthetic,omitempty"`
+}
+
+func (e *Extensions) isEmpty() bool {
+	return e.SessionId == nil && e.ViewerProfile == nil && len(e.Tags) == 0 && !e.Synthetic
+}
+
+// formatMessage returns the message that should be produced for an event, in the
+// given format, given both the event as delivered by Twitch and as transformed
+func formatMessage(format OutputFormat, delivery *Delivery, subscription *helix.EventSubSubscription, eventsubData json.RawMessage, ev *etwitch.Event, extensions *Extensions) (publish.Message, error) {
+	if extensions != nil && extensions.isEmpty() {
+		extensions = nil
+	}
+	switch format {
+	case OutputFormatEnvelope:
+		body, err := json.Marshal(&Envelope{
+			EnvelopeVersion: EnvelopeVersion,
+			Twitch: EnvelopeTwitch{
+				MessageId:           delivery.MessageId,
+				MessageTimestamp:    delivery.MessageTimestamp,
+				SubscriptionId:      subscription.ID,
+				SubscriptionType:    subscription.Type,
+				SubscriptionVersion: subscription.Version,
+			},
+			ReceivedAt: delivery.ReceivedAt,
+			Event:      ev,
+			Extensions: extensions,
+		})
+		return publish.Message{ContentType: "application/json", Body: body}, err
+	case OutputFormatCloudEventsStructured, OutputFormatCloudEventsBinary:
+		data, err := marshalBare(ev, extensions)
+		if err != nil {
+			return publish.Message{}, err
+		}
+		ce := newCloudEvent(delivery, subscription, eventsubData, data)
+		if format == OutputFormatCloudEventsBinary {
+			return ce.toBinary(), nil
+		}
+		return ce.toStructured()
+	}
+	body, err := marshalBare(ev, extensions)
+	return publish.Message{ContentType: "application/json", Body: body}, err
+}
+
+// marshalBare returns the bare JSON representation of an event, with an 'extensions'
+// block if there are any extensions
+func marshalBare(ev *etwitch.Event, extensions *Extensions) ([]byte, error) {
+	if extensions == nil {
+		return json.Marshal(ev)
+	}
+	return json.Marshal(&enrichedEvent{Event: ev, Extensions: extensions})
+}
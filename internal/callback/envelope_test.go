@@ -0,0 +1,131 @@
+package callback
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/enrich"
+	"github.com/golden-vcr/schemas/core"
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseOutputFormat(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    OutputFormat
+		wantErr bool
+	}{
+		{"bare", OutputFormatBare, false},
+		{"envelope", OutputFormatEnvelope, false},
+		{"cloudevents-structured", OutputFormatCloudEventsStructured, false},
+		{"cloudevents-binary", OutputFormatCloudEventsBinary, false},
+		{"", "", true},
+		{"cloudevents", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseOutputFormat(tt.s)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_formatMessage(t *testing.T) {
+	delivery := &Delivery{
+		MessageId:        "message-1",
+		MessageTimestamp: time.Date(1997, 9, 1, 12, 0, 0, 0, time.UTC),
+		ReceivedAt:       time.Date(1997, 9, 1, 12, 0, 0, 250000000, time.UTC),
+	}
+	subscription := &helix.EventSubSubscription{
+		ID:      "some-follow-subscription",
+		Type:    helix.EventSubTypeChannelFollow,
+		Version: "2",
+	}
+	ev := &etwitch.Event{
+		Type: etwitch.EventTypeViewerFollowed,
+		Viewer: &core.Viewer{
+			TwitchUserId:      "1234",
+			TwitchDisplayName: "Bungus",
+		},
+	}
+	sessionId, err := json.Marshal("some-session")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		format      OutputFormat
+		extensions  *Extensions
+		wantMessage string
+	}{
+		{
+			"bare format with no extensions",
+			OutputFormatBare,
+			&Extensions{},
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`,
+		},
+		{
+			"bare format with extensions",
+			OutputFormatBare,
+			&Extensions{SessionId: sessionId, Tags: []string{"vip"}},
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null,"extensions":{"session_id":"some-session","tags":["vip"]}}`,
+		},
+		{
+			"envelope format with no extensions",
+			OutputFormatEnvelope,
+			&Extensions{},
+			`{
+				"envelope_version": 1,
+				"twitch": {
+					"message_id": "message-1",
+					"message_timestamp": "1997-09-01T12:00:00Z",
+					"subscription_id": "some-follow-subscription",
+					"subscription_type": "channel.follow",
+					"subscription_version": "2"
+				},
+				"received_at": "1997-09-01T12:00:00.25Z",
+				"event": {"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}
+			}`,
+		},
+		{
+			"envelope format with extensions",
+			OutputFormatEnvelope,
+			&Extensions{
+				SessionId:     json.RawMessage("null"),
+				ViewerProfile: &enrich.Profile{TwitchUserId: "1234", Login: "bungus", DisplayName: "Bungus"},
+			},
+			`{
+				"envelope_version": 1,
+				"twitch": {
+					"message_id": "message-1",
+					"message_timestamp": "1997-09-01T12:00:00Z",
+					"subscription_id": "some-follow-subscription",
+					"subscription_type": "channel.follow",
+					"subscription_version": "2"
+				},
+				"received_at": "1997-09-01T12:00:00.25Z",
+				"event": {"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null},
+				"extensions": {
+					"session_id": null,
+					"viewer_profile": {"twitch_user_id":"1234","login":"bungus","display_name":"Bungus","profile_image_url":"","broadcaster_type":"","created_at":"0001-01-01T00:00:00Z"}
+				}
+			}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := formatMessage(tt.format, delivery, subscription, json.RawMessage(`{}`), ev, tt.extensions)
+			assert.NoError(t, err)
+			assert.Equal(t, "application/json", message.ContentType)
+			assert.Empty(t, message.Headers)
+			assert.JSONEq(t, tt.wantMessage, string(message.Body))
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package callback
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+// sequencer determines which of the events that we've accepted must be handled before
+// each new event, so that events can otherwise be handled concurrently:
+//
+//   - Events of the same type that concern the same broadcaster are handled one at a
+//     time, in the order in which they were accepted.
+//   - 'stream.online' and 'stream.offline' events begin a new stream session, so each
+//     one is handled only once every event that was accepted before it (and concerns
+//     the same broadcaster) has been handled, and every event accepted after it waits
+//     for it in turn: otherwise (for example) an event that was accepted just after
+//     'stream.online' could be handled first, and attributed to the wrong session.
+//
+// Every event must be admitted in the order in which it was accepted, and every
+// ticket must eventually be released, whether or not its event was handled. The zero
+// value is ready to use.
+type sequencer struct {
+	mu     sync.Mutex
+	last   map[string]chan struct{}
+	epochs map[string]*epoch
+}
+
+// epoch is the span between one session-changing event and the next, for a single
+// broadcaster
+type epoch struct {
+	// ready is closed once the event that began this epoch has been handled
+	ready chan struct{}
+
+	// pending counts the events accepted during this epoch that haven't been handled
+	pending sync.WaitGroup
+}
+
+// ticket records the events that must be handled before a single event
+type ticket struct {
+	prev  <-chan struct{} // closed once the previous event of the same type is handled
+	epoch *epoch          // the epoch in which the event was accepted
+	next  *epoch          // the epoch that the event begins, if it changes the session
+	done  chan struct{}
+}
+
+// admit returns a ticket for an event that has just been accepted
+func (s *sequencer) admit(subscription *helix.EventSubSubscription) *ticket {
+	key := orderingKey(subscription)
+	kind := key + " " + subscription.Type
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		s.last = make(map[string]chan struct{})
+		s.epochs = make(map[string]*epoch)
+	}
+	e, ok := s.epochs[key]
+	if !ok {
+		e = &epoch{ready: make(chan struct{})}
+		close(e.ready)
+		s.epochs[key] = e
+	}
+
+	t := &ticket{prev: s.last[kind], epoch: e, done: make(chan struct{})}
+	s.last[kind] = t.done
+	if changesSession(subscription.Type) {
+		t.next = &epoch{ready: make(chan struct{})}
+		s.epochs[key] = t.next
+	} else {
+		e.pending.Add(1)
+	}
+	return t
+}
+
+// wait blocks until the event may be handled, or until ctx is done
+func (t *ticket) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.prev != nil {
+		select {
+		case <-t.prev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-t.epoch.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if t.next != nil {
+		drained := make(chan struct{})
+		go func() {
+			t.epoch.pending.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release allows any events that were waiting on this one to proceed
+func (t *ticket) release() {
+	close(t.done)
+	if t.next != nil {
+		close(t.next.ready)
+	} else {
+		t.epoch.pending.Done()
+	}
+}
+
+// changesSession returns true if events of the given type begin or end a stream
+// session
+func changesSession(subscriptionType string) bool {
+	return subscriptionType == helix.EventSubTypeStreamOnline || subscriptionType == helix.EventSubTypeStreamOffline
+}
+
+// orderingKey identifies the broadcaster that an event concerns. Events whose
+// condition doesn't name a broadcaster are ordered by type instead.
+func orderingKey(subscription *helix.EventSubSubscription) string {
+	condition := &subscription.Condition
+	for _, userId := range []string{condition.BroadcasterUserID, condition.ToBroadcasterUserID, condition.FromBroadcasterUserID, condition.UserID} {
+		if userId != "" {
+			return userId
+		}
+	}
+	return subscription.Type
+}
@@ -0,0 +1,348 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// ShutdownGracePeriod is how long, once the drain timeout has elapsed and in-flight
+// handlers have been canceled, we'll wait for those handlers to return
+const ShutdownGracePeriod = 5 * time.Second
+
+const (
+	// DefaultMaxHandleAttempts is the number of times a worker will attempt to handle
+	// an event before giving up on it and spooling it instead
+	DefaultMaxHandleAttempts = 5
+
+	// DefaultHandleRetryBaseDelay is how long a worker will wait before its first retry
+	// of an event that failed; the delay doubles with each attempt, up to
+	// HandleRetryMaxDelay
+	DefaultHandleRetryBaseDelay = time.Second
+
+	// HandleRetryMaxDelay is the longest a worker will wait between attempts to handle
+	// an event
+	HandleRetryMaxDelay = 30 * time.Second
+)
+
+// ErrQueueFull is returned when an event can't be accepted because our queue of
+// unhandled events is at capacity
+var ErrQueueFull = errors.New("event queue is full")
+
+// ErrPoolClosed is returned when an event can't be accepted because we're shutting
+// down
+var ErrPoolClosed = errors.New("event queue is closed")
+
+// job is a single verified event notification, waiting to be handled
+type job struct {
+	logger       *slog.Logger
+	delivery     Delivery
+	subscription helix.EventSubSubscription
+	data         json.RawMessage
+
+	// ticket determines which other events must be handled before this one
+	ticket *ticket
+}
+
+// workerPool handles events asynchronously, using a fixed number of workers, all of
+// which consume from a single bounded queue. Workers handle events concurrently, except
+// where the order of events matters (see sequencer): a worker that picks up an event
+// waits until the events that must precede it have been handled. Since we've already
+// acknowledged each event to Twitch by the time it's handled, Twitch won't redeliver an
+// event that fails: instead, the worker retries it with backoff, and if it still fails,
+// spools it to be handled when we next start.
+type workerPool struct {
+	handleEvent HandleEventFunc
+	numWorkers  int
+	queue       chan *job
+	sequencer   sequencer
+	spool       *spool
+
+	maxAttempts    int
+	retryBaseDelay time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+
+	// running holds the job currently being handled by each worker, if any, and
+	// unhandled collects jobs that we gave up on due to shutting down
+	statusMu  sync.Mutex
+	running   []*job
+	unhandled []*job
+}
+
+// newWorkerPool initializes a pool of numWorkers workers, with a queue capacity of
+// queueSize events. If spoolPath is set, events that we're unable to handle before
+// shutting down are persisted there, and handled when we next start up.
+func newWorkerPool(handleEvent HandleEventFunc, numWorkers int, queueSize int, spoolPath string) *workerPool {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	var s *spool
+	if spoolPath != "" {
+		s = &spool{path: spoolPath}
+	}
+	return &workerPool{
+		handleEvent:    handleEvent,
+		numWorkers:     numWorkers,
+		queue:          make(chan *job, queueSize),
+		spool:          s,
+		maxAttempts:    DefaultMaxHandleAttempts,
+		retryBaseDelay: DefaultHandleRetryBaseDelay,
+		running:        make([]*job, numWorkers),
+	}
+}
+
+// enqueue accepts an event for asynchronous handling, failing immediately with
+// ErrQueueFull if our queue has no capacity, or with ErrPoolClosed if we're shutting
+// down
+func (p *workerPool) enqueue(j *job) error {
+	// Events must be queued in the same order in which they're admitted to our
+	// sequencer, so that no worker ever waits on an event that's still queued behind
+	// the one it's holding
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	if len(p.queue) == cap(p.queue) {
+		return ErrQueueFull
+	}
+	j.ticket = p.sequencer.admit(&j.subscription)
+	p.queue <- j
+	return nil
+}
+
+// run handles any events left over from a previous shutdown, then starts the pool's
+// workers and blocks until ctx is canceled. At that point, we stop accepting new events
+// and finish handling those already accepted, waiting for up to drainTimeout. Any
+// events that still haven't been handled by then are spooled to disk (or, failing
+// that, logged as dropped).
+func (p *workerPool) run(ctx context.Context, logger *slog.Logger, drainTimeout time.Duration) {
+	// Handling an event shouldn't be interrupted just because we're shutting down, so
+	// workers only give up once the drain timeout has elapsed
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	// Events that were spooled are older than any we've just accepted, so handle them
+	// before starting our workers
+	p.replay(workCtx, logger)
+	for i := 0; i < p.numWorkers; i++ {
+		p.wg.Add(1)
+		go p.work(workCtx, i)
+	}
+	<-ctx.Done()
+
+	p.mu.Lock()
+	p.closed = true
+	numPending := len(p.queue)
+	close(p.queue)
+	p.mu.Unlock()
+	logger.Info("Draining event queue", "numPending", numPending)
+
+	if waitTimeout(&p.wg, drainTimeout) {
+		logger.Info("Event queue drained")
+		return
+	}
+
+	// We've run out of time: cancel any handlers that are still running, and give
+	// them a chance to return, so that we know which events weren't handled
+	logger.Warn("Timed out draining event queue; canceling in-flight events")
+	cancel()
+	timedOut := !waitTimeout(&p.wg, ShutdownGracePeriod)
+
+	// If a handler still hasn't returned, we can't tell whether its event was
+	// produced: spool it anyway, since producing it twice is better than never
+	p.statusMu.Lock()
+	unhandled := p.unhandled
+	p.unhandled = nil
+	if timedOut {
+		for i, j := range p.running {
+			if j != nil {
+				j.logger.Error("Event was still being handled at shutdown; it may or may not have been produced")
+				unhandled = append(unhandled, j)
+				p.running[i] = nil
+			}
+		}
+	}
+	p.statusMu.Unlock()
+	p.persist(logger, unhandled)
+}
+
+// work handles events from our queue, one at a time, until the queue is closed and
+// empty. Once ctx is canceled, any remaining events are set aside as unhandled.
+func (p *workerPool) work(ctx context.Context, index int) {
+	defer p.wg.Done()
+	for j := range p.queue {
+		if err := j.ticket.wait(ctx); err != nil {
+			p.abandon(j)
+			j.ticket.release()
+			continue
+		}
+
+		p.setRunning(index, j)
+		err := p.handle(ctx, j)
+		p.setRunning(index, nil)
+		j.ticket.release()
+		if err != nil {
+			if ctx.Err() != nil {
+				p.abandon(j)
+				continue
+			}
+			j.logger.Error("Failed to handle event; giving up until next startup", "error", err, "numAttempts", p.maxAttempts)
+			p.persist(j.logger, []*job{j})
+			continue
+		}
+		j.logger.Info("Handled event")
+	}
+}
+
+// handle attempts to handle a single event, retrying with exponential backoff if it
+// fails, up to maxAttempts times. Any events that must be handled after this one wait
+// in the meantime, so that they're still handled in order.
+func (p *workerPool) handle(ctx context.Context, j *job) error {
+	delay := p.retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := p.handleEvent(ctx, j.logger, &j.delivery, &j.subscription, j.data)
+		if err == nil || attempt >= p.maxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		j.logger.Warn("Failed to handle event; retrying", "error", err, "attempt", attempt, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > HandleRetryMaxDelay {
+			delay = HandleRetryMaxDelay
+		}
+	}
+}
+
+// replay handles any events that were spooled when we last shut down. Events that
+// fail are spooled again.
+func (p *workerPool) replay(ctx context.Context, logger *slog.Logger) {
+	if p.spool == nil {
+		return
+	}
+	events, err := p.spool.read()
+	if err != nil {
+		logger.Error("Failed to read spooled events", "error", err, "spoolPath", p.spool.path)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	// Each event is only removed from the spool once it's been handled, so that if we
+	// crash partway through, the remaining events are still there the next time we
+	// start: events that fail are kept, to be retried after the next restart
+	logger.Info("Handling spooled events", "numEvents", len(events))
+	failed := make([]spooledEvent, 0)
+	for i := range events {
+		j := &job{
+			logger: eventLogger(logger, events[i].MessageId, &events[i].Subscription, events[i].Event),
+			delivery: Delivery{
+				MessageId:        events[i].MessageId,
+				MessageTimestamp: events[i].MessageTimestamp,
+				ReceivedAt:       events[i].ReceivedAt,
+			},
+			subscription: events[i].Subscription,
+			data:         events[i].Event,
+		}
+		if err := p.handleEvent(ctx, j.logger, &j.delivery, &j.subscription, j.data); err != nil {
+			j.logger.Error("Failed to handle spooled event; keeping it in the spool", "error", err)
+			failed = append(failed, events[i])
+		} else {
+			j.logger.Info("Handled spooled event")
+		}
+
+		remaining := append(failed[:len(failed):len(failed)], events[i+1:]...)
+		if err := p.spool.replace(remaining); err != nil {
+			logger.Error("Failed to update spool; handled events may be handled again", "error", err, "spoolPath", p.spool.path)
+		}
+	}
+}
+
+// persist writes unhandled events to the spool, logging each one that's spooled, or
+// that's dropped if we have no spool or can't write to it
+func (p *workerPool) persist(logger *slog.Logger, unhandled []*job) {
+	if len(unhandled) == 0 {
+		return
+	}
+
+	var err error
+	if p.spool == nil {
+		err = errors.New("no spool is configured")
+	} else {
+		events := make([]spooledEvent, 0, len(unhandled))
+		for _, j := range unhandled {
+			events = append(events, spooledEvent{
+				MessageId:        j.delivery.MessageId,
+				MessageTimestamp: j.delivery.MessageTimestamp,
+				ReceivedAt:       j.delivery.ReceivedAt,
+				Subscription:     j.subscription,
+				Event:            j.data,
+			})
+		}
+		err = p.spool.write(events)
+	}
+
+	if err != nil {
+		for _, j := range unhandled {
+			j.logger.Error("Dropped unhandled event")
+		}
+		logger.Error("Failed to spool unhandled events", "error", err, "numDropped", len(unhandled))
+		return
+	}
+	for _, j := range unhandled {
+		j.logger.Warn("Spooled unhandled event")
+	}
+	logger.Warn("Spooled unhandled events", "numSpooled", len(unhandled), "spoolPath", p.spool.path)
+}
+
+func (p *workerPool) setRunning(index int, j *job) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.running[index] = j
+}
+
+func (p *workerPool) abandon(j *job) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.unhandled = append(p.unhandled, j)
+}
+
+// eventLogger returns a logger annotated with the details of a single event
+func eventLogger(logger *slog.Logger, messageId string, subscription *helix.EventSubSubscription, data json.RawMessage) *slog.Logger {
+	return logger.With(
+		"messageId", messageId,
+		"subscriptionId", subscription.ID,
+		"subscriptionType", subscription.Type,
+		"subscriptionVersion", subscription.Version,
+		"event", string(data),
+	)
+}
+
+// waitTimeout waits for wg, returning false if it's not done within the given timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
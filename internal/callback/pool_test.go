@@ -0,0 +1,374 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Server_handlePostCallback_async(t *testing.T) {
+	// Block the handler until we've finished sending events, so that they pile up in
+	// the queue
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	s := &Server{
+		verifyNotification: func(header http.Header, message string) bool {
+			return true
+		},
+		dedup: newDeduplicator(DeduplicationWindow),
+		now:   time.Now,
+	}
+	s.pool = newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		<-release
+		var event struct {
+			Seq int `json:"seq"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+		mu.Lock()
+		handled[subscription.Type] = append(handled[subscription.Type], event.Seq)
+		mu.Unlock()
+		return nil
+	}, 2, 8, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, slog.Default(), time.Second)
+		close(done)
+	}()
+
+	post := func(messageId string, subscriptionType string, seq int) int {
+		body := fmt.Sprintf(`{"subscription":{"id":"%s-subscription","type":"%s"},"event":{"seq":%d}}`, subscriptionType, subscriptionType, seq)
+		req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(body))
+		req.Header.Set("twitch-eventsub-message-type", "notification")
+		req.Header.Set(HeaderMessageId, messageId)
+		res := httptest.NewRecorder()
+		s.handlePostCallback(res, req)
+		return res.Code
+	}
+
+	// Each of our 2 workers picks up an event (the first blocks in the handler, and the
+	// second waits for it, since they're of the same type), and then our queue holds 8
+	// more, at which point we should get a 503
+	statuses := make([]int, 0)
+	for seq := 0; seq < 11; seq++ {
+		statuses = append(statuses, post(fmt.Sprintf("message-%d", seq), "channel.follow", seq))
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, []int{200, 200, 200, 200, 200, 200, 200, 200, 200, 200, 503}, statuses)
+
+	// An event that was rejected can be redelivered successfully once there's room
+	close(release)
+	assert.Eventually(t, func() bool {
+		return post("message-10", "channel.follow", 10) == http.StatusOK
+	}, time.Second, 5*time.Millisecond)
+
+	// Once we shut down, we should handle everything that was accepted, in order, and
+	// we should reject anything new
+	cancel()
+	<-done
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, handled["channel.follow"])
+	assert.Equal(t, http.StatusServiceUnavailable, post("message-11", "channel.follow", 11))
+}
+
+func Test_workerPool_ordering(t *testing.T) {
+	type handledEvent struct {
+		subscriptionType string
+		seq              int
+	}
+	var mu sync.Mutex
+	handled := make(map[string][]handledEvent)
+	p := newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		// Take a varying amount of time to handle each event, so that events handled
+		// concurrently finish in an arbitrary order
+		var seq int
+		if err := json.Unmarshal(data, &seq); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(seq%3) * 100 * time.Microsecond)
+
+		key := orderingKey(subscription)
+		mu.Lock()
+		handled[key] = append(handled[key], handledEvent{subscription.Type, seq})
+		mu.Unlock()
+		return nil
+	}, 4, 400, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx, slog.Default(), time.Second)
+		close(done)
+	}()
+
+	// Accept a mix of events concerning two broadcasters, naming the broadcaster in
+	// various fields of the condition
+	subscriptions := []helix.EventSubSubscription{
+		{Type: "stream.online", Condition: helix.EventSubCondition{BroadcasterUserID: "90790024"}},
+		{Type: "channel.follow", Condition: helix.EventSubCondition{BroadcasterUserID: "90790024", ModeratorUserID: "90790024"}},
+		{Type: "channel.cheer", Condition: helix.EventSubCondition{BroadcasterUserID: "90790024"}},
+		{Type: "channel.raid", Condition: helix.EventSubCondition{ToBroadcasterUserID: "90790024"}},
+		{Type: "channel.raid", Condition: helix.EventSubCondition{FromBroadcasterUserID: "90790024"}},
+		{Type: "stream.offline", Condition: helix.EventSubCondition{BroadcasterUserID: "90790024"}},
+		{Type: "stream.online", Condition: helix.EventSubCondition{BroadcasterUserID: "12345"}},
+		{Type: "channel.follow", Condition: helix.EventSubCondition{BroadcasterUserID: "12345", ModeratorUserID: "12345"}},
+		{Type: "stream.offline", Condition: helix.EventSubCondition{BroadcasterUserID: "12345"}},
+	}
+	numAccepted := make(map[string]int)
+	for seq := 0; seq < 20; seq++ {
+		for _, subscription := range subscriptions {
+			numAccepted[orderingKey(&subscription)]++
+			err := p.enqueue(&job{
+				logger:       slog.Default(),
+				subscription: subscription,
+				data:         json.RawMessage(fmt.Sprintf("%d", seq)),
+			})
+			assert.NoError(t, err)
+		}
+	}
+	cancel()
+	<-done
+
+	assert.Len(t, handled, 2)
+	for key, events := range handled {
+		assert.Len(t, events, numAccepted[key], key)
+
+		// Events of the same type should have been handled in the order they were
+		// accepted
+		seqsByType := make(map[string][]int)
+		for _, ev := range events {
+			seqsByType[ev.subscriptionType] = append(seqsByType[ev.subscriptionType], ev.seq)
+		}
+		for subscriptionType, seqs := range seqsByType {
+			assert.IsNonDecreasing(t, seqs, "%s %s", key, subscriptionType)
+		}
+
+		// Each 'stream.online' or 'stream.offline' event should have been handled after
+		// every event accepted before it, and before every event accepted after it: i.e.
+		// each event falls within the session in which it was accepted
+		position := func(ev handledEvent) int {
+			switch ev.subscriptionType {
+			case "stream.online":
+				return ev.seq * 3
+			case "stream.offline":
+				return ev.seq*3 + 2
+			}
+			return ev.seq*3 + 1
+		}
+		positions := make([]int, 0, len(events))
+		for _, ev := range events {
+			positions = append(positions, position(ev))
+		}
+		assert.IsNonDecreasing(t, positions, key)
+	}
+}
+
+func Test_workerPool_concurrency(t *testing.T) {
+	// Events that needn't be handled in any particular order should be handled
+	// concurrently: each handler waits until both events are being handled at once
+	var started sync.WaitGroup
+	started.Add(2)
+	p := newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		started.Done()
+		if !waitTimeout(&started, time.Second) {
+			return fmt.Errorf("%s event was not handled concurrently", subscription.Type)
+		}
+		return nil
+	}, 2, 10, "")
+	p.maxAttempts = 1
+
+	var mu sync.Mutex
+	errs := make([]error, 0)
+	handleEvent := p.handleEvent
+	p.handleEvent = func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		err := handleEvent(ctx, logger, delivery, subscription, data)
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx, slog.Default(), 5*time.Second)
+		close(done)
+	}()
+	for _, subscriptionType := range []string{"channel.follow", "channel.cheer"} {
+		assert.NoError(t, p.enqueue(&job{
+			logger:       slog.Default(),
+			subscription: helix.EventSubSubscription{Type: subscriptionType, Condition: helix.EventSubCondition{BroadcasterUserID: "90790024"}},
+			data:         json.RawMessage("0"),
+		}))
+	}
+	cancel()
+	<-done
+	assert.Equal(t, []error{nil, nil}, errs)
+}
+
+func Test_workerPool_drainTimeout(t *testing.T) {
+	spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+
+	// Simulate a handler that hangs until canceled (e.g. because the AMQP broker never
+	// confirms our message)
+	p := newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 1, 10, spoolPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx, slog.Default(), 20*time.Millisecond)
+		close(done)
+	}()
+	messageTimestamp := time.Date(1997, 9, 1, 12, 0, 0, 0, time.UTC)
+	receivedAt := messageTimestamp.Add(250 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, p.enqueue(&job{
+			logger: slog.Default(),
+			delivery: Delivery{
+				MessageId:        fmt.Sprintf("message-%d", i),
+				MessageTimestamp: messageTimestamp,
+				ReceivedAt:       receivedAt,
+			},
+			subscription: helix.EventSubSubscription{ID: "some-subscription", Type: "channel.follow"},
+			data:         json.RawMessage(fmt.Sprintf("%d", i)),
+		}))
+	}
+
+	// A handler that never finishes should not prevent us from shutting down
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker pool did not shut down after drain timeout")
+	}
+	assert.ErrorIs(t, p.enqueue(&job{logger: slog.Default()}), ErrPoolClosed)
+
+	// All three events (the one that was in flight and the two that were still queued)
+	// should have been spooled to disk, and they should be handled, in order, the next
+	// time we start up, with their original delivery metadata intact
+	handled := make([]string, 0)
+	p = newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		handled = append(handled, string(data))
+		assert.Equal(t, fmt.Sprintf("message-%s", data), delivery.MessageId)
+		assert.True(t, delivery.MessageTimestamp.Equal(messageTimestamp))
+		assert.True(t, delivery.ReceivedAt.Equal(receivedAt))
+		return nil
+	}, 1, 10, spoolPath)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx, slog.Default(), time.Second)
+	assert.Equal(t, []string{"0", "1", "2"}, handled)
+	_, err := os.Stat(spoolPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_workerPool_retry(t *testing.T) {
+	tests := []struct {
+		name        string
+		numFailures int
+		wantSpooled bool
+	}{
+		{"event that fails transiently is retried until handled", 2, false},
+		{"event that keeps failing is spooled", 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+			numAttempts := 0
+			p := newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+				numAttempts++
+				if numAttempts <= tt.numFailures {
+					return fmt.Errorf("mock error")
+				}
+				return nil
+			}, 1, 10, spoolPath)
+			p.maxAttempts = 3
+			p.retryBaseDelay = time.Millisecond
+
+			assert.NoError(t, p.enqueue(&job{
+				logger:       slog.Default(),
+				delivery:     Delivery{MessageId: "message-0"},
+				subscription: helix.EventSubSubscription{ID: "some-subscription", Type: "channel.follow"},
+				data:         json.RawMessage("0"),
+			}))
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			p.run(ctx, slog.Default(), time.Second)
+
+			events, err := (&spool{path: spoolPath}).read()
+			assert.NoError(t, err)
+			if tt.wantSpooled {
+				assert.Equal(t, 3, numAttempts)
+				if assert.Len(t, events, 1) {
+					assert.Equal(t, "message-0", events[0].MessageId)
+				}
+			} else {
+				assert.Equal(t, tt.numFailures+1, numAttempts)
+				assert.Empty(t, events)
+			}
+		})
+	}
+}
+
+func Test_workerPool_replay(t *testing.T) {
+	spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+	s := &spool{path: spoolPath}
+	events := make([]spooledEvent, 0, 3)
+	for i := 0; i < 3; i++ {
+		events = append(events, spooledEvent{
+			MessageId:    fmt.Sprintf("message-%d", i),
+			Subscription: helix.EventSubSubscription{ID: "some-subscription", Type: "channel.follow"},
+			Event:        json.RawMessage(fmt.Sprintf("%d", i)),
+		})
+	}
+	assert.NoError(t, s.write(events))
+
+	// Each event should only be removed from the spool once it's been handled, so that
+	// if we were to crash while handling an event, it would be replayed again; events
+	// that fail should remain in the spool
+	p := newWorkerPool(func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		spooled, err := s.read()
+		assert.NoError(t, err)
+		messageIds := make([]string, 0, len(spooled))
+		for _, event := range spooled {
+			messageIds = append(messageIds, event.MessageId)
+		}
+		switch string(data) {
+		case "0":
+			assert.Equal(t, []string{"message-0", "message-1", "message-2"}, messageIds)
+		case "1":
+			assert.Equal(t, []string{"message-1", "message-2"}, messageIds)
+			return fmt.Errorf("mock error")
+		case "2":
+			assert.Equal(t, []string{"message-1", "message-2"}, messageIds)
+		}
+		return nil
+	}, 1, 10, spoolPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx, slog.Default(), time.Second)
+
+	spooled, err := s.read()
+	assert.NoError(t, err)
+	if assert.Len(t, spooled, 1) {
+		assert.Equal(t, "message-1", spooled[0].MessageId)
+	}
+}
@@ -0,0 +1,75 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/selftest"
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// produceSelfTestEvent handles a synthetic notification sent by a self-test, recording
+// each stage in trace: the event is produced to twitch-events, marked as synthetic, but
+// it bypasses rules, session tracking, enrichment, and holding, so that a self-test
+// has no effect beyond the message it produces
+func (s *Server) produceSelfTestEvent(ctx context.Context, logger *slog.Logger, trace *selftest.Trace, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+	transformed := trace.Begin(selftest.StageTransformation)
+	ev, err := etwitch.FromEventSub(subscription, data)
+	if err != nil {
+		transformed(err)
+		return err
+	}
+	message, err := formatMessage(s.outputFormat, delivery, subscription, data, ev, &Extensions{Synthetic: true})
+	transformed(err)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Producing synthetic event to twitch-events", "twitchEvent", ev)
+	published := trace.Begin(selftest.StagePublishing)
+	err = s.producer.SendMessage(ctx, message)
+	published(err)
+	return err
+}
+
+// SelfTestMaxClockSkew is how far a synthetic notification's timestamp may differ
+// from our own clock. It matches DeduplicationWindow, so that a notification is
+// either recent enough that we still remember its message ID or old enough to be
+// rejected outright.
+const SelfTestMaxClockSkew = DeduplicationWindow
+
+// checkSelfTestReplay guards against a captured synthetic notification being replayed
+// in order to publish it again: Twitch's guidance is to reject any notification whose
+// timestamp is more than 10 minutes old, and to discard any message ID that we've
+// already seen. Message IDs are remembered per replica, so a replay to a different
+// replica is only caught by the timestamp check.
+func (s *Server) checkSelfTestReplay(messageId string, timestamp string) error {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to parse message timestamp: %w", err)
+	}
+	skew := s.now().Sub(t)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > SelfTestMaxClockSkew {
+		return fmt.Errorf("message timestamp %s is more than %s from the current time", timestamp, SelfTestMaxClockSkew)
+	}
+	if s.dedup != nil && !s.dedup.claimMessage(messageId) {
+		return fmt.Errorf("message %s has already been handled", messageId)
+	}
+	return nil
+}
+
+// respondToSelfTest reports the stages recorded in trace to the self-test that sent a
+// synthetic notification
+func respondToSelfTest(res http.ResponseWriter, trace *selftest.Trace, status int) {
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(selftest.CallbackResponse{Stages: trace.Stages()})
+}
@@ -0,0 +1,202 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/publish"
+	"github.com/golden-vcr/hooks/internal/rules"
+	"github.com/golden-vcr/hooks/internal/selftest"
+	"github.com/gorilla/mux"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Server_selfTest(t *testing.T) {
+	tests := []struct {
+		name        string
+		secret      string
+		sendErr     error
+		wantOk      bool
+		wantStages  []string
+		wantFailed  string
+		wantMessage string
+	}{
+		{
+			"synthetic event is verified, transformed, and published",
+			"webhook-secret",
+			nil,
+			true,
+			[]string{selftest.StageDelivery, selftest.StageVerification, selftest.StageTransformation, selftest.StagePublishing},
+			"",
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"0","twitch_display_name":"HooksSelfTest"},"payload":null,"extensions":{"synthetic":true}}`,
+		},
+		{
+			"verification fails if signed with the wrong secret",
+			"wrong-secret",
+			nil,
+			false,
+			[]string{selftest.StageDelivery, selftest.StageVerification, selftest.StageTransformation, selftest.StagePublishing},
+			selftest.StageVerification,
+			"",
+		},
+		{
+			"publishing fails if the producer fails",
+			"webhook-secret",
+			fmt.Errorf("mock error"),
+			false,
+			[]string{selftest.StageDelivery, selftest.StageVerification, selftest.StageTransformation, selftest.StagePublishing},
+			selftest.StagePublishing,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Synthetic events should bypass rules and session tracking, and should be
+			// handled synchronously even if we're using a worker pool (which isn't running
+			// here, so any queued event would never be handled)
+			applyRules := func(subscription *helix.EventSubSubscription, data json.RawMessage) (*rules.Decision, error) {
+				t.Errorf("rules were applied to synthetic event")
+				return &rules.Decision{}, nil
+			}
+			trackSession := func(logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) *string {
+				t.Errorf("session was tracked for synthetic event")
+				return nil
+			}
+			producer := &failingProducer{err: tt.sendErr}
+			s := NewServer([]string{"webhook-secret"}, producer, Options{
+				ApplyRules:   applyRules,
+				TrackSession: trackSession,
+				NumWorkers:   1,
+				QueueSize:    1,
+			})
+			r := mux.NewRouter()
+			s.RegisterRoutes(r)
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			runner := selftest.NewRunner(srv.URL+"/callback", tt.secret, "90790024")
+			result := runner.Run(context.Background())
+			assert.Equal(t, tt.wantOk, result.Ok)
+
+			stageNames := make([]string, 0, len(result.Stages))
+			for _, stage := range result.Stages {
+				stageNames = append(stageNames, stage.Name)
+				if stage.Name == tt.wantFailed {
+					assert.False(t, stage.Ok)
+					assert.NotEmpty(t, stage.Error)
+				} else if tt.wantFailed == "" {
+					assert.True(t, stage.Ok)
+				}
+			}
+			assert.Equal(t, tt.wantStages, stageNames)
+			assertProduced(t, tt.wantMessage, &producer.recordingProducer)
+		})
+	}
+}
+
+func Test_Server_selfTest_replay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		timestamp    string
+		numRequests  int
+		wantStatus   []int
+		wantProduced int
+		wantError    string
+	}{
+		{
+			"a fresh synthetic message is handled",
+			now.Add(-time.Minute).Format(time.RFC3339Nano),
+			1,
+			[]int{http.StatusOK},
+			1,
+			"",
+		},
+		{
+			"a replayed synthetic message is rejected",
+			now.Add(-time.Minute).Format(time.RFC3339Nano),
+			2,
+			[]int{http.StatusOK, http.StatusBadRequest},
+			1,
+			"message hooks-self-test-1234 has already been handled",
+		},
+		{
+			"a stale synthetic message is rejected",
+			now.Add(-11 * time.Minute).Format(time.RFC3339Nano),
+			1,
+			[]int{http.StatusBadRequest},
+			0,
+			"message timestamp 2024-01-01T11:49:00Z is more than 10m0s from the current time",
+		},
+		{
+			"a synthetic message from the future is rejected",
+			now.Add(11 * time.Minute).Format(time.RFC3339Nano),
+			1,
+			[]int{http.StatusBadRequest},
+			0,
+			"message timestamp 2024-01-01T12:11:00Z is more than 10m0s from the current time",
+		},
+		{
+			"a synthetic message without a timestamp is rejected",
+			"",
+			1,
+			[]int{http.StatusBadRequest},
+			0,
+			`failed to parse message timestamp: parsing time "" as "2006-01-02T15:04:05.999999999Z07:00": cannot parse "" as "2006"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer := &recordingProducer{}
+			s := NewServer([]string{"webhook-secret"}, producer, Options{})
+			s.verifyNotification = func(header http.Header, message string) bool {
+				return true
+			}
+			s.now = func() time.Time { return now }
+			s.dedup.now = s.now
+
+			var gotStatus []int
+			var lastResponse selftest.CallbackResponse
+			for i := 0; i < tt.numRequests; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(`{"subscription":{"id":"hooks-self-test","type":"channel.follow","version":"2"},"event":{"user_id":"0","user_login":"hooks_self_test","user_name":"HooksSelfTest","broadcaster_user_id":"90790024","followed_at":"2024-01-01T11:59:00Z"}}`))
+				req.Header.Set("twitch-eventsub-message-type", "notification")
+				req.Header.Set(HeaderMessageId, "hooks-self-test-1234")
+				req.Header.Set(HeaderMessageTimestamp, tt.timestamp)
+				res := httptest.NewRecorder()
+				s.handlePostCallback(res, req)
+				gotStatus = append(gotStatus, res.Code)
+				lastResponse = selftest.CallbackResponse{}
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&lastResponse))
+			}
+			assert.Equal(t, tt.wantStatus, gotStatus)
+			assert.Len(t, producer.messages, tt.wantProduced)
+
+			if tt.wantError != "" && assert.NotEmpty(t, lastResponse.Stages) {
+				assert.Equal(t, selftest.StageVerification, lastResponse.Stages[0].Name)
+				assert.False(t, lastResponse.Stages[0].Ok)
+				assert.Equal(t, tt.wantError, lastResponse.Stages[0].Error)
+			}
+		})
+	}
+}
+
+// failingProducer is a recordingProducer that fails to send messages if err is set
+type failingProducer struct {
+	recordingProducer
+	err error
+}
+
+func (p *failingProducer) SendMessage(ctx context.Context, message publish.Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.recordingProducer.SendMessage(ctx, message)
+}
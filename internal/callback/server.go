@@ -4,31 +4,162 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 
+	"github.com/golden-vcr/hooks/internal/enrich"
+	"github.com/golden-vcr/hooks/internal/publish"
+	"github.com/golden-vcr/hooks/internal/rules"
+	"github.com/golden-vcr/hooks/internal/selftest"
 	etwitch "github.com/golden-vcr/schemas/twitch-events"
 	"github.com/golden-vcr/server-common/entry"
-	"github.com/golden-vcr/server-common/rmq"
 	"github.com/gorilla/mux"
 	"github.com/nicklaw5/helix/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"golang.org/x/exp/slog"
 )
 
 type VerifyNotificationFunc func(header http.Header, message string) bool
-type HandleEventFunc func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) error
+type HandleEventFunc func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error
+type HandleRevocationFunc func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription) error
+type HandleAuthorizationRevokeFunc func(ctx context.Context, logger *slog.Logger, data json.RawMessage) error
+type EnrichEventFunc func(ctx context.Context, logger *slog.Logger, ev *etwitch.Event) *enrich.Profile
+type ApplyRulesFunc func(subscription *helix.EventSubSubscription, data json.RawMessage) (*rules.Decision, error)
+type TrackSessionFunc func(logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) *string
+type ObserveEventFunc func(ctx context.Context, logger *slog.Logger, messageId string, subscription *helix.EventSubSubscription, data json.RawMessage, sessionId *string)
+type HoldEventFunc func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage, held json.RawMessage) bool
+
+// Producer sends messages, along with their AMQP properties, to a single exchange; it's
+// implemented by publish.Producer
+type Producer interface {
+	SendMessage(ctx context.Context, message publish.Message) error
+}
+
+// MessageTypeRevocation is the value of the Twitch-Eventsub-Message-Type header that
+// indicates that Twitch has revoked one of our subscriptions
+const MessageTypeRevocation = "revocation"
+
+// HeaderMessageId is the header that carries the unique ID of each message sent by
+// Twitch: messages that Twitch redelivers will have the same ID
+const HeaderMessageId = "twitch-eventsub-message-id"
+
+// HeaderMessageTimestamp is the header that carries the time at which Twitch sent each
+// message, in RFC3339 format
+const HeaderMessageTimestamp = "twitch-eventsub-message-timestamp"
 
 type Server struct {
 	verifyNotification VerifyNotificationFunc
 	handleEvent        HandleEventFunc
+	handleRevocation   HandleRevocationFunc
+	dedup              *deduplicator
+	now                func() time.Time
+
+	// producer and outputFormat are used to produce synthetic events sent by
+	// self-tests, which bypass handleEvent; producer and rerouteProducers are used to
+	// produce held events once they're released
+	producer         Producer
+	rerouteProducers map[string]Producer
+	outputFormat     OutputFormat
+	observeEvent     ObserveEventFunc
+
+	// If pool is non-nil, events are handled asynchronously once accepted; otherwise
+	// they're handled synchronously before we respond to Twitch, in an order
+	// determined by sequencer
+	pool      *workerPool
+	sequencer sequencer
 }
 
-func NewServer(twitchWebhookSecret string, producer rmq.Producer) *Server {
-	return &Server{
+// Options configures how a Server handles events. Every field is optional: by default,
+// events are produced as-is, in the bare format, before we respond to Twitch.
+type Options struct {
+	// HandleRevocation is called when Twitch notifies us that it has revoked one of our
+	// subscriptions
+	HandleRevocation HandleRevocationFunc
+
+	// HandleAuthorizationRevoke is called for each 'user.authorization.revoke' event,
+	// which is of concern to this service rather than to downstream consumers
+	HandleAuthorizationRevoke HandleAuthorizationRevokeFunc
+
+	// TrackSession is called for each event in order to determine the ID of the stream
+	// session in which the event occurred, and that session ID (or null, if the stream
+	// is offline) is produced alongside the event
+	TrackSession TrackSessionFunc
+
+	// ObserveEvent is called for each event once it's been produced (so not for events
+	// that are dropped by rules, or held and then discarded), along with the ID of the
+	// session in which it occurred (e.g. to maintain totals). An event may be observed
+	// more than once (e.g. if Twitch redelivers it), with the same message ID.
+	ObserveEvent ObserveEventFunc
+
+	// EnrichEvent is called for each event before it's produced, and the viewer profile
+	// it returns (if any) is produced alongside the event
+	EnrichEvent EnrichEventFunc
+
+	// ApplyRules is called for each event before it's produced, and its decision may
+	// cause the event to be dropped, tagged, or produced to a different exchange:
+	// RerouteProducers must contain a producer for every exchange to which events may
+	// be rerouted
+	ApplyRules       ApplyRulesFunc
+	RerouteProducers map[string]Producer
+
+	// HoldEvent is called for each event immediately before it's produced, along with
+	// a JSON representation of the message that would be produced: if it returns true,
+	// the event is considered handled, and HoldEvent has taken responsibility for
+	// producing it later (by passing that representation to ReleaseHeldEvent) or
+	// discarding it
+	HoldEvent HoldEventFunc
+
+	// OutputFormat determines how events are produced: as bare events (the default),
+	// wrapped in a versioned Envelope that carries delivery metadata, or as CloudEvents
+	OutputFormat OutputFormat
+
+	// If NumWorkers is greater than zero, each event is handled asynchronously, by one
+	// of NumWorkers workers, once we've accepted it: up to QueueSize events may be
+	// waiting to be handled at once, beyond which we'll ask Twitch to try again later.
+	// Any events that can't be handled before shutting down are persisted to
+	// SpoolPath, to be handled once we start up again.
+	NumWorkers int
+	QueueSize  int
+	SpoolPath  string
+}
+
+// NewServer returns a Server that handles EventSub messages from Twitch, producing
+// events with the given producer as configured by opts. Messages are accepted if
+// they're signed with any of the given webhook secrets: our current secret should be
+// listed first, followed by any previous secrets that are still in use while the secret
+// is being rotated. If events are handled asynchronously, Run must be called in order
+// for them to be handled.
+//
+// Synthetic notifications sent by a self-test (see the selftest package) are always
+// handled synchronously, and the response describes how long each stage of handling
+// them took.
+func NewServer(twitchWebhookSecrets []string, producer Producer, opts Options) *Server {
+	if opts.OutputFormat == "" {
+		opts.OutputFormat = OutputFormatBare
+	}
+	dedup := newDeduplicator(DeduplicationWindow)
+	s := &Server{
 		verifyNotification: func(header http.Header, message string) bool {
-			return helix.VerifyEventSubNotification(twitchWebhookSecret, header, message)
+			for _, secret := range twitchWebhookSecrets {
+				if helix.VerifyEventSubNotification(secret, header, message) {
+					return true
+				}
+			}
+			return false
 		},
-		handleEvent: func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+		handleEvent: func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+			// 'user.authorization.revoke' tells us that a user has disconnected our app:
+			// that's of concern to this service, not to downstream consumers of
+			// twitch-events
+			if subscription.Type == helix.EventSubTypeUserAuthorizationRevoke {
+				if opts.HandleAuthorizationRevoke == nil {
+					return nil
+				}
+				return opts.HandleAuthorizationRevoke(ctx, logger, data)
+			}
+
 			ev, err := etwitch.FromEventSub(subscription, data)
 			if err != nil {
 				return err
@@ -37,18 +168,175 @@ func NewServer(twitchWebhookSecret string, producer rmq.Producer) *Server {
 			if err != nil {
 				return err
 			}
-			logger.Info("Producing to twitch-events", "twitchEvent", ev)
-			return producer.Send(ctx, jsonData)
+
+			// If we're subscribed to multiple versions of the same event type (e.g. while
+			// migrating to a new version), we'll get the same event from each: only
+			// produce it once
+			if dedup.discardDuplicateEvent(subscription.Type, subscription.ID, jsonData) {
+				logger.Info("Discarding event already produced via another subscription", "twitchEvent", ev)
+				return nil
+			}
+
+			// Keep track of the current stream session, so that we can indicate which
+			// broadcast each event occurred in
+			extensions := &Extensions{}
+			var sessionId *string
+			if opts.TrackSession != nil {
+				sessionId = opts.TrackSession(logger, subscription, data)
+				extensions.SessionId, err = json.Marshal(sessionId)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Apply any configured rules, which may cause us to drop the event, tag it,
+			// or produce it to a different exchange
+			decision := &rules.Decision{}
+			if opts.ApplyRules != nil {
+				decision, err = opts.ApplyRules(subscription, data)
+				if err != nil {
+					return err
+				}
+				if len(decision.Matched) > 0 {
+					logger = logger.With("matchedRules", decision.Matched)
+				}
+			}
+			if decision.Drop {
+				logger.Info("Dropping event as directed by rules", "twitchEvent", ev)
+				dedup.recordEvent(subscription.Type, subscription.ID, jsonData)
+				return nil
+			}
+			exchange := "twitch-events"
+			target := producer
+			if decision.Exchange != "" {
+				exchange = decision.Exchange
+				target = opts.RerouteProducers[exchange]
+				if target == nil {
+					return fmt.Errorf("no producer is configured for exchange '%s'", exchange)
+				}
+			}
+
+			// If enabled, look up supplementary details to be produced alongside the
+			// event: deduplication is based solely on the event itself, so this doesn't
+			// need to be deterministic
+			if opts.EnrichEvent != nil {
+				extensions.ViewerProfile = opts.EnrichEvent(ctx, logger, ev)
+			}
+			extensions.Tags = decision.Tags
+			message, err := formatMessage(opts.OutputFormat, delivery, subscription, data, ev, extensions)
+			if err != nil {
+				return err
+			}
+
+			// Give the caller a chance to hold the event back (e.g. during a suspected
+			// follow-bot attack) rather than producing it now
+			if opts.HoldEvent != nil {
+				held, err := json.Marshal(&heldEvent{
+					Exchange:     exchange,
+					ContentType:  message.ContentType,
+					Headers:      message.Headers,
+					Body:         message.Body,
+					MessageId:    delivery.MessageId,
+					Subscription: *subscription,
+					Event:        data,
+					SessionId:    sessionId,
+				})
+				if err != nil {
+					return err
+				}
+				if opts.HoldEvent(ctx, logger, subscription, data, held) {
+					logger.Info("Holding event", "twitchEvent", ev)
+					dedup.recordEvent(subscription.Type, subscription.ID, jsonData)
+					return nil
+				}
+			}
+
+			logger.Info("Producing to "+exchange, "twitchEvent", ev)
+			if err := target.SendMessage(ctx, message); err != nil {
+				return err
+			}
+			dedup.recordEvent(subscription.Type, subscription.ID, jsonData)
+			if opts.ObserveEvent != nil {
+				opts.ObserveEvent(ctx, logger, delivery.MessageId, subscription, data, sessionId)
+			}
+			return nil
 		},
+		handleRevocation: opts.HandleRevocation,
+		dedup:            dedup,
+		now:              time.Now,
+		producer:         producer,
+		rerouteProducers: opts.RerouteProducers,
+		observeEvent:     opts.ObserveEvent,
+		outputFormat:     opts.OutputFormat,
+	}
+	if opts.NumWorkers > 0 {
+		s.pool = newWorkerPool(s.handleEvent, opts.NumWorkers, opts.QueueSize, opts.SpoolPath)
 	}
+	return s
 }
 
 func (s *Server) RegisterRoutes(r *mux.Router) {
 	r.Path("/callback").Methods("POST").HandlerFunc(s.handlePostCallback)
 }
 
+// Run handles accepted events in the background until ctx is canceled, then spends up
+// to drainTimeout handling any events that are still queued before returning. Events
+// that are still unhandled at that point are spooled to disk. If events are handled
+// synchronously, Run returns immediately.
+func (s *Server) Run(ctx context.Context, logger *slog.Logger, drainTimeout time.Duration) {
+	if s.pool == nil {
+		return
+	}
+	s.pool.run(ctx, logger, drainTimeout)
+}
+
+// ReleaseHeldEvent produces an event that was held back by Options.HoldEvent, given
+// the representation of it that was passed to HoldEvent, then observes it
+func (s *Server) ReleaseHeldEvent(ctx context.Context, logger *slog.Logger, held json.RawMessage) error {
+	var h heldEvent
+	if err := json.Unmarshal(held, &h); err != nil {
+		return fmt.Errorf("failed to parse held event: %w", err)
+	}
+	target := s.producer
+	if h.Exchange != "twitch-events" {
+		target = s.rerouteProducers[h.Exchange]
+		if target == nil {
+			return fmt.Errorf("no producer is configured for exchange '%s'", h.Exchange)
+		}
+	}
+	logger = eventLogger(logger, h.MessageId, &h.Subscription, h.Event)
+	logger.Info("Producing held event to " + h.Exchange)
+	if err := target.SendMessage(ctx, publish.Message{
+		ContentType: h.ContentType,
+		Headers:     h.Headers,
+		Body:        h.Body,
+	}); err != nil {
+		return err
+	}
+	if s.observeEvent != nil {
+		s.observeEvent(ctx, logger, h.MessageId, &h.Subscription, h.Event, h.SessionId)
+	}
+	return nil
+}
+
+// heldEvent is the representation of an event that's passed to Options.HoldEvent: it
+// carries everything needed to produce and then observe the event later, so it can be
+// persisted
+type heldEvent struct {
+	Exchange    string     `json:"exchange"`
+	ContentType string     `json:"content_type"`
+	Headers     amqp.Table `json:"headers,omitempty"`
+	Body        []byte     `json:"body"`
+
+	MessageId    string                     `json:"message_id"`
+	Subscription helix.EventSubSubscription `json:"subscription"`
+	Event        json.RawMessage            `json:"event"`
+	SessionId    *string                    `json:"session_id"`
+}
+
 func (s *Server) handlePostCallback(res http.ResponseWriter, req *http.Request) {
 	logger := entry.Log(req)
+	receivedAt := s.now()
 
 	// Pre-emptively read the request body so we can verify its signature
 	body, err := io.ReadAll(req.Body)
@@ -59,12 +347,35 @@ func (s *Server) handlePostCallback(res http.ResponseWriter, req *http.Request)
 	}
 	defer req.Body.Close()
 
+	// If this is a synthetic notification sent by a self-test, keep track of how long
+	// each stage of handling it takes, so we can report back to the sender
+	messageId := req.Header.Get(HeaderMessageId)
+	var trace *selftest.Trace
+	if selftest.IsSynthetic(messageId) {
+		trace = selftest.NewTrace()
+	}
+
 	// Verify that this event comes from Twitch: abort if phony
+	verified := trace.Begin(selftest.StageVerification)
 	if !s.verifyNotification(req.Header, string(body)) {
 		logger.Error("Failed to verify signature")
+		if trace != nil {
+			verified(fmt.Errorf("signature verification failed"))
+			respondToSelfTest(res, trace, http.StatusBadRequest)
+			return
+		}
 		http.Error(res, "Signature verification failed", http.StatusBadRequest)
 		return
 	}
+	if trace != nil {
+		if err := s.checkSelfTestReplay(messageId, req.Header.Get(HeaderMessageTimestamp)); err != nil {
+			logger.Error("Rejecting synthetic notification", "error", err)
+			verified(err)
+			respondToSelfTest(res, trace, http.StatusBadRequest)
+			return
+		}
+	}
+	verified(nil)
 
 	// Decode the payload from JSON so we can examine the details of the event
 	var payload struct {
@@ -89,20 +400,97 @@ func (s *Server) handlePostCallback(res http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	// Attempt to handle the event, using our HandleEventFunc: this should be relatively
-	// lightweight, since we're doing it synchronously in the callback handler and
-	// waiting to respond to Twitch until finished
-	logger = logger.With(
-		"subscriptionId", payload.Subscription.ID,
-		"subscriptionType", payload.Subscription.Type,
-		"subscriptionVersion", payload.Subscription.Version,
-		"event", string(payload.Event),
-	)
-	if err := s.handleEvent(req.Context(), logger, &payload.Subscription, payload.Event); err != nil {
+	// If Twitch is notifying us that a subscription has been revoked, there's no event
+	// to handle: we just need to record the subscription's new status
+	if req.Header.Get("twitch-eventsub-message-type") == MessageTypeRevocation {
+		logger = logger.With(
+			"subscriptionId", payload.Subscription.ID,
+			"subscriptionType", payload.Subscription.Type,
+			"subscriptionVersion", payload.Subscription.Version,
+			"subscriptionStatus", payload.Subscription.Status,
+		)
+		if s.handleRevocation != nil {
+			if err := s.handleRevocation(req.Context(), logger, &payload.Subscription); err != nil {
+				logger.Error("Failed to handle revocation", "error", err)
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		logger.Warn("Handled revocation")
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// If Twitch is redelivering a message that we've already handled, there's nothing
+	// more to do: just acknowledge it again. Synthetic messages have already been
+	// claimed during verification, since they're never legitimately redelivered.
+	logger = eventLogger(logger, messageId, &payload.Subscription, payload.Event)
+	if trace == nil && s.dedup != nil && s.dedup.isDuplicateMessage(messageId) {
+		logger.Info("Ignoring duplicate message")
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Record the details of how this message was delivered, so that they can be
+	// included with the event when it's produced
+	delivery := &Delivery{
+		MessageId:  messageId,
+		ReceivedAt: receivedAt,
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, req.Header.Get(HeaderMessageTimestamp)); err == nil {
+		delivery.MessageTimestamp = timestamp
+	} else {
+		logger.Warn("Failed to parse message timestamp", "error", err)
+	}
+
+	// Synthetic events are always handled synchronously, so that we can report the
+	// outcome of each stage in our response
+	if trace != nil {
+		if err := s.produceSelfTestEvent(req.Context(), logger, trace, delivery, &payload.Subscription, payload.Event); err != nil {
+			logger.Error("Failed to handle synthetic event", "error", err)
+			respondToSelfTest(res, trace, http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Handled synthetic event")
+		respondToSelfTest(res, trace, http.StatusOK)
+		return
+	}
+
+	// If we're handling events asynchronously, we can respond to Twitch as soon as the
+	// event is queued; but if our queue is full (or we're shutting down), respond with
+	// a 503 so that Twitch will redeliver the event later
+	if s.pool != nil {
+		if err := s.pool.enqueue(&job{logger: logger, delivery: *delivery, subscription: payload.Subscription, data: payload.Event}); err != nil {
+			logger.Warn("Unable to accept event", "error", err)
+			http.Error(res, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if s.dedup != nil {
+			s.dedup.recordMessage(messageId)
+		}
+		logger.Info("Accepted event")
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Otherwise, attempt to handle the event synchronously, using our HandleEventFunc:
+	// this should be relatively lightweight, since we're waiting to respond to Twitch
+	// until finished. As with the worker pool, we wait for any events that must be
+	// handled before this one.
+	t := s.sequencer.admit(&payload.Subscription)
+	err = t.wait(req.Context())
+	if err == nil {
+		err = s.handleEvent(req.Context(), logger, delivery, &payload.Subscription, payload.Event)
+	}
+	t.release()
+	if err != nil {
 		logger.Error("Failed to handle event", "error", err)
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if s.dedup != nil {
+		s.dedup.recordMessage(messageId)
+	}
 
 	// If successful, write a 200 response and we're done
 	logger.Info("Handled event")
@@ -2,13 +2,23 @@ package callback
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golden-vcr/hooks/internal/enrich"
+	"github.com/golden-vcr/hooks/internal/publish"
+	"github.com/golden-vcr/hooks/internal/rules"
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
 	"github.com/nicklaw5/helix/v2"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/exp/slog"
@@ -17,51 +27,76 @@ import (
 func Test_Server_handlePostCallback(t *testing.T) {
 	tests := []struct {
 		name                 string
+		messageType          string
 		requestBody          string
 		signatureIsOK        bool
 		wantStatus           int
 		wantBody             string
 		wantHandledEventData string
+		wantRevokedStatus    string
 	}{
 		{
 			"if signature verification fails, returns 400",
+			"notification",
 			"{}",
 			false,
 			400,
 			"Signature verification failed",
 			"",
+			"",
 		},
 		{
 			"if challenge is set, echoes challenge with 200",
+			"webhook_callback_verification",
 			`{"subscription":{"id":"some-subscription"},"challenge":"foobar12345"}`,
 			true,
 			200,
 			"foobar12345",
 			"",
+			"",
 		},
 		{
 			"valid event is recorded via handle func",
+			"notification",
 			`{"subscription":{"id":"some-subscription","type":"test"},"event":{"value":42}}`,
 			true,
 			200,
 			"",
 			`{"value":42}`,
+			"",
+		},
+		{
+			"revocation is recorded via revocation func",
+			"revocation",
+			`{"subscription":{"id":"some-subscription","type":"test","status":"authorization_revoked"}}`,
+			true,
+			204,
+			"",
+			"",
+			"authorization_revoked",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			handledEventData := ""
+			revokedStatus := ""
 			s := &Server{
+				now: time.Now,
 				verifyNotification: func(header http.Header, message string) bool {
 					return tt.signatureIsOK
 				},
-				handleEvent: func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+				handleEvent: func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
 					logger.Debug("Handled event", "data", data)
 					handledEventData = string(data)
 					return nil
 				},
+				handleRevocation: func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription) error {
+					revokedStatus = subscription.Status
+					return nil
+				},
 			}
 			req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(tt.requestBody))
+			req.Header.Set("twitch-eventsub-message-type", tt.messageType)
 			res := httptest.NewRecorder()
 			s.handlePostCallback(res, req)
 
@@ -72,6 +107,366 @@ func Test_Server_handlePostCallback(t *testing.T) {
 			assert.Equal(t, tt.wantBody, body)
 
 			assert.Equal(t, tt.wantHandledEventData, handledEventData)
+			assert.Equal(t, tt.wantRevokedStatus, revokedStatus)
+		})
+	}
+}
+
+func Test_Server_handlePostCallback_duplicateMessage(t *testing.T) {
+	numHandled := 0
+	s := &Server{
+		verifyNotification: func(header http.Header, message string) bool {
+			return true
+		},
+		handleEvent: func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+			numHandled++
+			return nil
+		},
+		dedup: newDeduplicator(DeduplicationWindow),
+		now:   time.Now,
+	}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(`{"subscription":{"id":"some-subscription","type":"test"},"event":{"value":42}}`))
+		req.Header.Set("twitch-eventsub-message-type", "notification")
+		req.Header.Set(HeaderMessageId, "message-1")
+		res := httptest.NewRecorder()
+		s.handlePostCallback(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	}
+	assert.Equal(t, 1, numHandled)
+}
+
+func Test_Server_handlePostCallback_delivery(t *testing.T) {
+	receivedAt := time.Date(1997, 9, 1, 12, 0, 1, 0, time.UTC)
+	var delivery *Delivery
+	s := &Server{
+		verifyNotification: func(header http.Header, message string) bool {
+			return true
+		},
+		handleEvent: func(ctx context.Context, logger *slog.Logger, d *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+			delivery = d
+			return nil
+		},
+		now: func() time.Time { return receivedAt },
+	}
+	req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(`{"subscription":{"id":"some-subscription","type":"test"},"event":{"value":42}}`))
+	req.Header.Set("twitch-eventsub-message-type", "notification")
+	req.Header.Set(HeaderMessageId, "message-1")
+	req.Header.Set(HeaderMessageTimestamp, "1997-09-01T12:00:00.123456789Z")
+	res := httptest.NewRecorder()
+	s.handlePostCallback(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, &Delivery{
+		MessageId:        "message-1",
+		MessageTimestamp: time.Date(1997, 9, 1, 12, 0, 0, 123456789, time.UTC),
+		ReceivedAt:       receivedAt,
+	}, delivery)
+}
+
+func Test_Server_handlePostCallback_concurrency(t *testing.T) {
+	// When handling events synchronously, events that needn't be handled in any
+	// particular order should still be handled concurrently: each handler waits until
+	// both events are being handled at once
+	var started sync.WaitGroup
+	started.Add(2)
+	s := &Server{
+		verifyNotification: func(header http.Header, message string) bool {
+			return true
+		},
+		handleEvent: func(ctx context.Context, logger *slog.Logger, delivery *Delivery, subscription *helix.EventSubSubscription, data json.RawMessage) error {
+			started.Done()
+			if !waitTimeout(&started, time.Second) {
+				return fmt.Errorf("%s event was not handled concurrently", subscription.Type)
+			}
+			return nil
+		},
+		now: time.Now,
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i, subscriptionType := range []string{"channel.follow", "channel.cheer"} {
+		wg.Add(1)
+		go func(i int, subscriptionType string) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"subscription":{"id":"some-subscription","type":"%s","condition":{"broadcaster_user_id":"90790024"}},"event":{}}`, subscriptionType)
+			req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(body))
+			req.Header.Set("twitch-eventsub-message-type", "notification")
+			req.Header.Set(HeaderMessageId, fmt.Sprintf("message-%d", i))
+			res := httptest.NewRecorder()
+			s.handlePostCallback(res, req)
+			codes[i] = res.Code
+		}(i, subscriptionType)
+	}
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+}
+
+func Test_NewServer_verifyNotification(t *testing.T) {
+	body := `{"subscription":{"id":"some-subscription","type":"test"},"event":{"value":42}}`
+	sign := func(secret string) http.Header {
+		h := http.Header{}
+		h.Set(HeaderMessageId, "message-1")
+		h.Set("twitch-eventsub-message-timestamp", "2024-01-01T12:00:00Z")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(h.Get(HeaderMessageId) + h.Get("twitch-eventsub-message-timestamp") + body))
+		h.Set("twitch-eventsub-message-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		return h
+	}
+
+	s := NewServer([]string{"new-secret", "old-secret"}, nil, Options{})
+	assert.True(t, s.verifyNotification(sign("new-secret"), body))
+	assert.True(t, s.verifyNotification(sign("old-secret"), body))
+	assert.False(t, s.verifyNotification(sign("retired-secret"), body))
+}
+
+func Test_NewServer_handleEvent_enrichment(t *testing.T) {
+	subscription := &helix.EventSubSubscription{
+		ID:      "follow-subscription",
+		Type:    helix.EventSubTypeChannelFollow,
+		Version: "2",
+	}
+	data := json.RawMessage(`{"user_id":"1234","user_login":"bungus","user_name":"Bungus","broadcaster_user_id":"90790024","broadcaster_user_login":"wasabimilkshake","broadcaster_user_name":"wasabimilkshake","followed_at":"2024-01-01T12:00:00Z"}`)
+	tests := []struct {
+		name        string
+		enrichEvent EnrichEventFunc
+		wantMessage string
+	}{
+		{
+			"enrichment disabled",
+			nil,
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`,
+		},
+		{
+			"extensions are produced alongside event",
+			func(ctx context.Context, logger *slog.Logger, ev *etwitch.Event) *enrich.Profile {
+				return &enrich.Profile{
+					TwitchUserId: ev.Viewer.TwitchUserId,
+					Login:        "bungus",
+					DisplayName:  "Bungus",
+					CreatedAt:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				}
+			},
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null,"extensions":{"viewer_profile":{"twitch_user_id":"1234","login":"bungus","display_name":"Bungus","profile_image_url":"","broadcaster_type":"","created_at":"2020-01-01T00:00:00Z"}}}`,
+		},
+		{
+			"event is produced as-is when enrichment yields nothing",
+			func(ctx context.Context, logger *slog.Logger, ev *etwitch.Event) *enrich.Profile {
+				return nil
+			},
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer := &recordingProducer{}
+			s := NewServer(nil, producer, Options{EnrichEvent: tt.enrichEvent})
+			err := s.handleEvent(context.Background(), slog.Default(), &Delivery{}, subscription, data)
+			assert.NoError(t, err)
+			assert.Len(t, producer.messages, 1)
+			assert.JSONEq(t, tt.wantMessage, string(producer.messages[0]))
+
+			// Deduplication should disregard extensions
+			err = s.handleEvent(context.Background(), slog.Default(), &Delivery{}, &helix.EventSubSubscription{
+				ID:      "other-follow-subscription",
+				Type:    subscription.Type,
+				Version: subscription.Version,
+			}, data)
+			assert.NoError(t, err)
+			assert.Len(t, producer.messages, 1)
+		})
+	}
+}
+
+// recordingProducer is a Producer that records the body of each message it's asked to
+// send
+type recordingProducer struct {
+	messages [][]byte
+}
+
+func (p *recordingProducer) SendMessage(ctx context.Context, message publish.Message) error {
+	p.messages = append(p.messages, message.Body)
+	return nil
+}
+
+func Test_NewServer_handleEvent_rules(t *testing.T) {
+	subscription := &helix.EventSubSubscription{
+		ID:      "follow-subscription",
+		Type:    helix.EventSubTypeChannelFollow,
+		Version: "2",
+	}
+	data := json.RawMessage(`{"user_id":"1234","user_login":"bungus","user_name":"Bungus","broadcaster_user_id":"90790024","broadcaster_user_login":"wasabimilkshake","broadcaster_user_name":"wasabimilkshake","followed_at":"2024-01-01T12:00:00Z"}`)
+	tests := []struct {
+		name         string
+		decision     *rules.Decision
+		wantProduced string
+		wantRerouted string
+		wantErr      string
+	}{
+		{
+			"no rules matched",
+			&rules.Decision{},
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`,
+			"",
+			"",
+		},
+		{
+			"event is dropped",
+			&rules.Decision{Drop: true, Matched: []string{"ignore-bots"}},
+			"",
+			"",
+			"",
+		},
+		{
+			"event is tagged",
+			&rules.Decision{Tags: []string{"staff", "test"}, Matched: []string{"staff", "test"}},
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null,"extensions":{"tags":["staff","test"]}}`,
+			"",
+			"",
+		},
+		{
+			"event is rerouted",
+			&rules.Decision{Exchange: "twitch-events-quiet", Matched: []string{"quiet"}},
+			"",
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`,
+			"",
+		},
+		{
+			"event is rerouted to unknown exchange",
+			&rules.Decision{Exchange: "nonexistent", Matched: []string{"typo"}},
+			"",
+			"",
+			"no producer is configured for exchange 'nonexistent'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer := &recordingProducer{}
+			quietProducer := &recordingProducer{}
+			applyRules := func(subscription *helix.EventSubSubscription, data json.RawMessage) (*rules.Decision, error) {
+				return tt.decision, nil
+			}
+			rerouteProducers := map[string]Producer{"twitch-events-quiet": quietProducer}
+			s := NewServer(nil, producer, Options{ApplyRules: applyRules, RerouteProducers: rerouteProducers})
+			err := s.handleEvent(context.Background(), slog.Default(), &Delivery{}, subscription, data)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assertProduced(t, tt.wantProduced, producer)
+			assertProduced(t, tt.wantRerouted, quietProducer)
+		})
+	}
+}
+
+func assertProduced(t *testing.T, want string, p *recordingProducer) {
+	if want == "" {
+		assert.Empty(t, p.messages)
+		return
+	}
+	if assert.Len(t, p.messages, 1) {
+		assert.JSONEq(t, want, string(p.messages[0]))
+	}
+}
+
+func Test_NewServer_handleEvent_hold(t *testing.T) {
+	subscription := &helix.EventSubSubscription{
+		ID:      "follow-subscription",
+		Type:    helix.EventSubTypeChannelFollow,
+		Version: "2",
+	}
+	data := json.RawMessage(`{"user_id":"1234","user_login":"bungus","user_name":"Bungus","broadcaster_user_id":"90790024","broadcaster_user_login":"wasabimilkshake","broadcaster_user_name":"wasabimilkshake","followed_at":"2024-01-01T12:00:00Z"}`)
+
+	var held json.RawMessage
+	holdEvent := func(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage, h json.RawMessage) bool {
+		held = h
+		return true
+	}
+	observed := make([]string, 0)
+	observeEvent := func(ctx context.Context, logger *slog.Logger, messageId string, subscription *helix.EventSubSubscription, data json.RawMessage, sessionId *string) {
+		observed = append(observed, messageId)
+	}
+	producer := &recordingProducer{}
+	s := NewServer(nil, producer, Options{HoldEvent: holdEvent, ObserveEvent: observeEvent})
+
+	// A held event should not be produced (or observed) until it's released
+	err := s.handleEvent(context.Background(), slog.Default(), &Delivery{MessageId: "message-1"}, subscription, data)
+	assert.NoError(t, err)
+	assert.Empty(t, producer.messages)
+	assert.Empty(t, observed)
+	if assert.NotNil(t, held) {
+		assert.NoError(t, s.ReleaseHeldEvent(context.Background(), slog.Default(), held))
+	}
+	assertProduced(t, `{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null}`, producer)
+	assert.Equal(t, []string{"message-1"}, observed)
+}
+
+func Test_NewServer_handleEvent_observeAfterProducing(t *testing.T) {
+	subscription := &helix.EventSubSubscription{
+		ID:      "follow-subscription",
+		Type:    helix.EventSubTypeChannelFollow,
+		Version: "2",
+	}
+	data := json.RawMessage(`{"user_id":"1234","user_login":"bungus","user_name":"Bungus","broadcaster_user_id":"90790024","broadcaster_user_login":"wasabimilkshake","broadcaster_user_name":"wasabimilkshake","followed_at":"2024-01-01T12:00:00Z"}`)
+	observed := make([]string, 0)
+	observeEvent := func(ctx context.Context, logger *slog.Logger, messageId string, subscription *helix.EventSubSubscription, data json.RawMessage, sessionId *string) {
+		observed = append(observed, messageId)
+	}
+	producer := &failingProducer{err: fmt.Errorf("mock error")}
+	s := NewServer(nil, producer, Options{ObserveEvent: observeEvent})
+
+	// An event that fails to be produced shouldn't be observed until it's retried
+	// successfully
+	delivery := &Delivery{MessageId: "message-1"}
+	assert.Error(t, s.handleEvent(context.Background(), slog.Default(), delivery, subscription, data))
+	assert.Empty(t, observed)
+	producer.err = nil
+	assert.NoError(t, s.handleEvent(context.Background(), slog.Default(), delivery, subscription, data))
+	assert.Equal(t, []string{"message-1"}, observed)
+}
+
+func Test_NewServer_handleEvent_session(t *testing.T) {
+	subscription := &helix.EventSubSubscription{
+		ID:      "follow-subscription",
+		Type:    helix.EventSubTypeChannelFollow,
+		Version: "2",
+	}
+	data := json.RawMessage(`{"user_id":"1234","user_login":"bungus","user_name":"Bungus","broadcaster_user_id":"90790024","broadcaster_user_login":"wasabimilkshake","broadcaster_user_name":"wasabimilkshake","followed_at":"2024-01-01T12:00:00Z"}`)
+	tests := []struct {
+		name        string
+		sessionId   *string
+		wantMessage string
+	}{
+		{
+			"event during live session carries session ID",
+			func() *string { id := "1001"; return &id }(),
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null,"extensions":{"session_id":"1001"}}`,
+		},
+		{
+			"event while offline carries null session ID",
+			nil,
+			`{"type":"viewer-followed","viewer":{"twitch_user_id":"1234","twitch_display_name":"Bungus"},"payload":null,"extensions":{"session_id":null}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer := &recordingProducer{}
+			trackSession := func(logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) *string {
+				return tt.sessionId
+			}
+			var observedSessionId *string
+			numObserved := 0
+			observeEvent := func(ctx context.Context, logger *slog.Logger, messageId string, subscription *helix.EventSubSubscription, data json.RawMessage, sessionId *string) {
+				observedSessionId = sessionId
+				numObserved++
+			}
+			s := NewServer(nil, producer, Options{TrackSession: trackSession, ObserveEvent: observeEvent})
+			err := s.handleEvent(context.Background(), slog.Default(), &Delivery{}, subscription, data)
+			assert.NoError(t, err)
+			assertProduced(t, tt.wantMessage, producer)
+			assert.Equal(t, 1, numObserved)
+			assert.Equal(t, tt.sessionId, observedSessionId)
 		})
 	}
 }
@@ -0,0 +1,122 @@
+package callback
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+// spooledEvent is the on-disk representation of an event that we accepted from Twitch
+// but were unable to handle before shutting down
+type spooledEvent struct {
+	MessageId        string                     `json:"message_id"`
+	MessageTimestamp time.Time                  `json:"message_timestamp"`
+	ReceivedAt       time.Time                  `json:"received_at"`
+	Subscription     helix.EventSubSubscription `json:"subscription"`
+	Event            json.RawMessage            `json:"event"`
+}
+
+// spool persists unhandled events to a file (as newline-delimited JSON), either on
+// shutdown or when they've repeatedly failed, so that they can be handled the next time
+// we start up
+type spool struct {
+	path string
+	mu   sync.Mutex
+}
+
+// write appends the given events to the spool file
+func (s *spool) write(events []spooledEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// read returns all events from the spool file, in the order they were written
+func (s *spool) read() ([]spooledEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := make([]spooledEvent, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event spooledEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// replace atomically replaces the contents of the spool file with the given events,
+// removing the file if there are none
+func (s *spool) replace(events []spooledEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(events) == 0 {
+		err := os.Remove(s.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	enc := json.NewEncoder(f)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
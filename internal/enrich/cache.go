@@ -0,0 +1,80 @@
+package enrich
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// profileCache is an LRU cache of user profiles, keyed by Twitch user ID, in which each
+// entry also expires after a fixed TTL
+type profileCache struct {
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	userId    string
+	profile   *Profile
+	expiresAt time.Time
+}
+
+func newProfileCache(capacity int, ttl time.Duration) *profileCache {
+	return &profileCache{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached profile for the given user, if present and not yet expired
+func (c *profileCache) get(userId string) (*Profile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[userId]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, userId)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.profile, true
+}
+
+// put caches a profile, evicting the least recently used entry if we're at capacity
+func (c *profileCache) put(userId string, profile *Profile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(c.ttl)
+	if elem, ok := c.entries[userId]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.profile = profile
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[userId] = c.order.PushFront(&cacheEntry{
+		userId:    userId,
+		profile:   profile,
+		expiresAt: expiresAt,
+	})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).userId)
+	}
+}
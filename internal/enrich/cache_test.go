@@ -0,0 +1,38 @@
+package enrich
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_profileCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newProfileCache(2, time.Hour)
+	c.now = func() time.Time { return now }
+
+	c.put("1", &Profile{TwitchUserId: "1"})
+	c.put("2", &Profile{TwitchUserId: "2"})
+
+	// Accessing user 1 should make user 2 the least recently used entry, so that it's
+	// evicted when we exceed capacity
+	_, ok := c.get("1")
+	assert.True(t, ok)
+	c.put("3", &Profile{TwitchUserId: "3"})
+	_, ok = c.get("2")
+	assert.False(t, ok)
+	profile, ok := c.get("1")
+	assert.True(t, ok)
+	assert.Equal(t, "1", profile.TwitchUserId)
+
+	// Once an entry's TTL has elapsed, it should no longer be returned
+	now = now.Add(30 * time.Minute)
+	c.put("1", &Profile{TwitchUserId: "1"})
+	now = now.Add(45 * time.Minute)
+	_, ok = c.get("3")
+	assert.False(t, ok)
+	_, ok = c.get("1")
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.order.Len())
+}
@@ -0,0 +1,12 @@
+// Package enrich adds supplementary details to the events that we produce to
+// twitch-events, so that downstream consumers don't each need to query the Twitch API
+// for the same information.
+//
+// EventSub payloads only identify the viewer involved in an event by user ID, login
+// and display name. When enrichment is enabled, we look up that viewer's Twitch user
+// profile (avatar, account creation date, broadcaster type, etc.) and include it in an
+// 'extensions' block alongside the event. Profiles are cached (with a bounded size and
+// a TTL), and lookups that occur close together are batched into a single request.
+// Enrichment is best-effort: if the Twitch API is unavailable, events are produced
+// without it.
+package enrich
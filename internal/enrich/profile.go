@@ -0,0 +1,183 @@
+package enrich
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// DefaultBatchWindow is how long we'll wait after a lookup is requested, to allow
+	// other lookups to be batched into the same request
+	DefaultBatchWindow = 50 * time.Millisecond
+
+	// DefaultLookupTimeout is the maximum amount of time we'll delay an event while
+	// waiting to look up a profile
+	DefaultLookupTimeout = 2 * time.Second
+
+	// MaxBatchSize is the maximum number of users that can be looked up in a single
+	// request to the Twitch API
+	MaxBatchSize = 100
+)
+
+// Profile describes a Twitch user
+type Profile struct {
+	TwitchUserId    string    `json:"twitch_user_id"`
+	Login           string    `json:"login"`
+	DisplayName     string    `json:"display_name"`
+	ProfileImageUrl string    `json:"profile_image_url"`
+	BroadcasterType string    `json:"broadcaster_type"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// TwitchClient represents the subset of Twitch API client functionality used to look
+// up user profiles
+type TwitchClient interface {
+	GetUsers(params *helix.UsersParams) (*helix.UsersResponse, error)
+}
+
+// ProfileEnricher looks up the profile of the viewer involved in each event, caching
+// profiles and batching lookups
+type ProfileEnricher struct {
+	c             TwitchClient
+	cache         *profileCache
+	batchWindow   time.Duration
+	lookupTimeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string][]chan *Profile
+	timer   *time.Timer
+}
+
+// NewProfileEnricher returns a ProfileEnricher that caches up to cacheSize profiles,
+// each for up to cacheTtl
+func NewProfileEnricher(c TwitchClient, cacheSize int, cacheTtl time.Duration) *ProfileEnricher {
+	return &ProfileEnricher{
+		c:             c,
+		cache:         newProfileCache(cacheSize, cacheTtl),
+		batchWindow:   DefaultBatchWindow,
+		lookupTimeout: DefaultLookupTimeout,
+		pending:       make(map[string][]chan *Profile),
+	}
+}
+
+// Enrich returns the profile of the viewer involved in the given event, or nil if
+// there's nothing to add (e.g. if the event involves no viewer, or the viewer's
+// profile couldn't be found)
+func (e *ProfileEnricher) Enrich(ctx context.Context, logger *slog.Logger, ev *etwitch.Event) *Profile {
+	if ev.Viewer == nil || ev.Viewer.TwitchUserId == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.lookupTimeout)
+	defer cancel()
+	profile, err := e.Lookup(ctx, ev.Viewer.TwitchUserId)
+	if err != nil {
+		logger.Warn("Failed to look up viewer profile; producing event without it", "error", err)
+		return nil
+	}
+	return profile
+}
+
+// Lookup returns the profile of the Twitch user with the given ID, or nil if no such
+// user exists
+func (e *ProfileEnricher) Lookup(ctx context.Context, userId string) (*Profile, error) {
+	if profile, ok := e.cache.get(userId); ok {
+		return profile, nil
+	}
+
+	result := make(chan *Profile, 1)
+	e.mu.Lock()
+	e.pending[userId] = append(e.pending[userId], result)
+	if len(e.pending) >= MaxBatchSize {
+		e.flushLocked()
+	} else if e.timer == nil {
+		e.timer = time.AfterFunc(e.batchWindow, e.flush)
+	}
+	e.mu.Unlock()
+
+	select {
+	case profile, ok := <-result:
+		if !ok {
+			return nil, fmt.Errorf("failed to get user %s from Twitch API", userId)
+		}
+		return profile, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush looks up all users for which lookups are pending
+func (e *ProfileEnricher) flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.flushLocked()
+}
+
+// flushLocked starts a batched lookup of all pending users; e.mu must be held
+func (e *ProfileEnricher) flushLocked() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if len(e.pending) == 0 {
+		return
+	}
+	batch := e.pending
+	e.pending = make(map[string][]chan *Profile)
+	go e.lookupBatch(batch)
+}
+
+// lookupBatch looks up a batch of users in a single request, delivering each profile
+// to everyone waiting for it. If the request fails, each waiter's channel is closed
+// without a result.
+func (e *ProfileEnricher) lookupBatch(batch map[string][]chan *Profile) {
+	userIds := make([]string, 0, len(batch))
+	for userId := range batch {
+		userIds = append(userIds, userId)
+	}
+
+	profiles, err := e.getUsers(userIds)
+	for userId, waiters := range batch {
+		for _, waiter := range waiters {
+			if err != nil {
+				close(waiter)
+				continue
+			}
+			waiter <- profiles[userId]
+		}
+	}
+}
+
+// getUsers requests profiles for the given users from the Twitch API, caching each
+// profile that's found
+func (e *ProfileEnricher) getUsers(userIds []string) (map[string]*Profile, error) {
+	r, err := e.c.GetUsers(&helix.UsersParams{IDs: userIds})
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got response %d from get users request: %s", r.StatusCode, r.ErrorMessage)
+	}
+
+	profiles := make(map[string]*Profile)
+	for _, user := range r.Data.Users {
+		profile := &Profile{
+			TwitchUserId:    user.ID,
+			Login:           user.Login,
+			DisplayName:     user.DisplayName,
+			ProfileImageUrl: user.ProfileImageURL,
+			BroadcasterType: user.BroadcasterType,
+			CreatedAt:       user.CreatedAt.Time,
+		}
+		profiles[user.ID] = profile
+		e.cache.put(user.ID, profile)
+	}
+	return profiles, nil
+}
@@ -0,0 +1,201 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/schemas/core"
+	etwitch "github.com/golden-vcr/schemas/twitch-events"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_ProfileEnricher_Enrich(t *testing.T) {
+	tests := []struct {
+		name       string
+		c          *mockTwitchClient
+		ev         *etwitch.Event
+		wantResult *Profile
+		wantLogs   bool
+	}{
+		{
+			"event with viewer is enriched with viewer's profile",
+			&mockTwitchClient{},
+			&etwitch.Event{Viewer: &core.Viewer{TwitchUserId: "1234"}},
+			mockProfile("1234"),
+			false,
+		},
+		{
+			"event without viewer is not enriched",
+			&mockTwitchClient{},
+			&etwitch.Event{},
+			nil,
+			false,
+		},
+		{
+			"event is not enriched if user does not exist",
+			&mockTwitchClient{},
+			&etwitch.Event{Viewer: &core.Viewer{TwitchUserId: "0"}},
+			nil,
+			false,
+		},
+		{
+			"event is not enriched if Twitch API is unavailable",
+			&mockTwitchClient{err: errors.New("connection refused")},
+			&etwitch.Event{Viewer: &core.Viewer{TwitchUserId: "1234"}},
+			nil,
+			true,
+		},
+		{
+			"event is not enriched if Twitch API responds with an error",
+			&mockTwitchClient{status: http.StatusServiceUnavailable},
+			&etwitch.Event{Viewer: &core.Viewer{TwitchUserId: "1234"}},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logRecorder{}
+			logger := slog.New(slog.NewTextHandler(logs, nil))
+			e := NewProfileEnricher(tt.c, 100, time.Hour)
+			e.batchWindow = time.Millisecond
+			result := e.Enrich(context.Background(), logger, tt.ev)
+			assert.Equal(t, tt.wantResult, result)
+			assert.Equal(t, tt.wantLogs, logs.n > 0)
+		})
+	}
+}
+
+func Test_ProfileEnricher_Lookup_batched(t *testing.T) {
+	c := &mockTwitchClient{}
+	e := NewProfileEnricher(c, 100, time.Hour)
+	e.batchWindow = 20 * time.Millisecond
+
+	// Concurrent lookups should be batched into a single request
+	userIds := []string{"1", "2", "3", "2"}
+	var wg sync.WaitGroup
+	results := make([]*Profile, len(userIds))
+	for i, userId := range userIds {
+		wg.Add(1)
+		go func(i int, userId string) {
+			defer wg.Done()
+			profile, err := e.Lookup(context.Background(), userId)
+			assert.NoError(t, err)
+			results[i] = profile
+		}(i, userId)
+	}
+	wg.Wait()
+	for i, userId := range userIds {
+		assert.Equal(t, mockProfile(userId), results[i])
+	}
+	assert.Equal(t, [][]string{{"1", "2", "3"}}, c.requested())
+
+	// Subsequent lookups should be served from the cache
+	profile, err := e.Lookup(context.Background(), "3")
+	assert.NoError(t, err)
+	assert.Equal(t, mockProfile("3"), profile)
+	assert.Len(t, c.requested(), 1)
+}
+
+func Test_ProfileEnricher_Lookup_maxBatchSize(t *testing.T) {
+	c := &mockTwitchClient{}
+	e := NewProfileEnricher(c, 1000, time.Hour)
+	e.batchWindow = time.Hour
+
+	// Once we have a full batch, it should be looked up immediately, without waiting
+	// for the batch window to elapse
+	var wg sync.WaitGroup
+	for i := 0; i < MaxBatchSize; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := e.Lookup(ctx, string(rune('a'+i%26))+string(rune('a'+i/26)))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	requested := c.requested()
+	assert.Len(t, requested, 1)
+	assert.Len(t, requested[0], MaxBatchSize)
+}
+
+func mockProfile(userId string) *Profile {
+	return &Profile{
+		TwitchUserId:    userId,
+		Login:           "user" + userId,
+		DisplayName:     "User" + userId,
+		ProfileImageUrl: "https://example.com/" + userId + ".png",
+		BroadcasterType: "affiliate",
+		CreatedAt:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// mockTwitchClient returns a mock profile for every requested user ID other than "0",
+// unless configured to fail
+type mockTwitchClient struct {
+	err    error
+	status int
+
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (m *mockTwitchClient) GetUsers(params *helix.UsersParams) (*helix.UsersResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userIds := append([]string(nil), params.IDs...)
+	sort.Strings(userIds)
+	m.batches = append(m.batches, userIds)
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.status != 0 {
+		r := &helix.UsersResponse{}
+		r.StatusCode = m.status
+		r.ErrorMessage = http.StatusText(m.status)
+		return r, nil
+	}
+	r := &helix.UsersResponse{}
+	r.StatusCode = http.StatusOK
+	for _, userId := range userIds {
+		if userId == "0" {
+			continue
+		}
+		profile := mockProfile(userId)
+		r.Data.Users = append(r.Data.Users, helix.User{
+			ID:              profile.TwitchUserId,
+			Login:           profile.Login,
+			DisplayName:     profile.DisplayName,
+			ProfileImageURL: profile.ProfileImageUrl,
+			BroadcasterType: profile.BroadcasterType,
+			CreatedAt:       helix.Time{Time: profile.CreatedAt},
+		})
+	}
+	return r, nil
+}
+
+func (m *mockTwitchClient) requested() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.batches
+}
+
+// logRecorder counts the number of lines that are logged
+type logRecorder struct {
+	n int
+}
+
+func (l *logRecorder) Write(p []byte) (int, error) {
+	l.n++
+	return len(p), nil
+}
@@ -0,0 +1,450 @@
+package followburst
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/golden-vcr/hooks/internal/statefile"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// SignalRate indicates that more than MaxFollows follows occurred within the window
+	SignalRate = "rate"
+
+	// SignalLoginPattern indicates that more than MaxPatternFollows follows within the
+	// window came from accounts whose logins match LoginPattern
+	SignalLoginPattern = "login_pattern"
+
+	// SignalSharedPrefix indicates that more than MaxPrefixFollows follows within the
+	// window came from accounts whose logins begin with the same PrefixLength
+	// characters
+	SignalSharedPrefix = "shared_prefix"
+)
+
+// DefaultLoginPattern matches logins that consist of letters followed by a long string
+// of digits, as are common among bot accounts
+const DefaultLoginPattern = `^[a-z_]+[0-9]{4,}$`
+
+// Resolution determines what happens to held follow events once a burst ends
+type Resolution string
+
+const (
+	ResolutionRelease Resolution = "release"
+	ResolutionDiscard Resolution = "discard"
+)
+
+// Config defines the thresholds used to detect follow bursts, and what we should do
+// with follow events while a burst is ongoing. A threshold of zero disables the
+// corresponding signal.
+type Config struct {
+	Window            time.Duration
+	MaxFollows        int
+	LoginPattern      *regexp.Regexp
+	MaxPatternFollows int
+	PrefixLength      int
+	MaxPrefixFollows  int
+	Cooldown          time.Duration
+
+	Hold       bool
+	Resolution Resolution
+	MaxHeld    int
+}
+
+// ReleaseFunc produces an event that was held during a burst, given the
+// representation of it that was passed to Observe
+type ReleaseFunc func(ctx context.Context, logger *slog.Logger, held json.RawMessage) error
+
+// Detector watches follow events for signs of a follow-bot attack. Any follow events
+// that it's holding are persisted to a JSON file, so that they survive a restart.
+type Detector struct {
+	config   Config
+	notifier alert.Notifier
+	path     string
+	now      func() time.Time
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	follows []follow
+	state   state
+
+	// resolveMu ensures that only one caller at a time resolves ended bursts
+	resolveMu sync.Mutex
+}
+
+// follow records a single follow that occurred within our sliding window
+type follow struct {
+	at    time.Time
+	login string
+}
+
+// state is the persisted state of a Detector: the burst that's ongoing (if any),
+// along with any bursts that have ended but haven't yet been fully resolved
+type state struct {
+	Current *burst   `json:"current"`
+	Ended   []*burst `json:"ended"`
+}
+
+// burst records the state of a suspected follow burst
+type burst struct {
+	StartedAt       time.Time         `json:"started_at"`
+	LastTriggeredAt time.Time         `json:"last_triggered_at"`
+	EndedAt         *time.Time        `json:"ended_at,omitempty"`
+	Signals         []string          `json:"signals"`
+	NumFollows      int               `json:"num_follows"`
+	NumHeld         int               `json:"num_held"`
+	NumOverflowed   int               `json:"num_overflowed"` // number of events that couldn't be held, once MaxHeld was reached
+	Held            []json.RawMessage `json:"held"`           // held events that haven't yet been resolved
+}
+
+// NewDetector initializes a Detector, loading any held events that were previously
+// persisted to statePath
+func NewDetector(config Config, notifier alert.Notifier, statePath string) (*Detector, error) {
+	if config.Window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	if config.Hold && config.Resolution != ResolutionRelease && config.Resolution != ResolutionDiscard {
+		return nil, fmt.Errorf("unsupported resolution %q: must be '%s' or '%s'", config.Resolution, ResolutionRelease, ResolutionDiscard)
+	}
+	if config.MaxPatternFollows > 0 && config.LoginPattern == nil {
+		return nil, fmt.Errorf("login pattern is required if max pattern follows is set")
+	}
+	d := &Detector{
+		config:   config,
+		notifier: notifier,
+		path:     statePath,
+		now:      time.Now,
+		wake:     make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read follow burst state: %w", err)
+	}
+	if err := json.Unmarshal(data, &d.state); err != nil {
+		return nil, fmt.Errorf("failed to parse follow burst state: %w", err)
+	}
+	return d, nil
+}
+
+// Observe examines an event before it's produced: if it's a follow event, it's counted
+// toward our thresholds. If a burst is ongoing and we're configured to hold follow
+// events, Observe persists held (an opaque representation of the event, as produced by
+// the caller) and returns true, indicating that the detector has taken responsibility
+// for the event: it will be passed to a ReleaseFunc once the burst ends, if it's to be
+// released. Otherwise, Observe returns false, and the caller should produce the event
+// as normal.
+//
+// Held events are resolved by Run (or Flush), not by Observe, so that handling a follow
+// event never waits on the release of other events: a follow that occurs just after a
+// burst ends may therefore be produced before the events that were held during it.
+func (d *Detector) Observe(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage, held json.RawMessage) bool {
+	if subscription.Type != helix.EventSubTypeChannelFollow {
+		return false
+	}
+	var ev struct {
+		UserLogin string `json:"user_login"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		logger.Warn("Failed to parse follow event for burst detection", "error", err)
+		return false
+	}
+
+	d.mu.Lock()
+	now := d.now()
+	ended := d.endExpiredBurstLocked(now)
+	d.follows = append(d.follows, follow{at: now, login: strings.ToLower(ev.UserLogin)})
+	d.pruneLocked(now)
+
+	isNewBurst := false
+	if signals := d.evaluateLocked(); len(signals) > 0 {
+		if d.state.Current == nil {
+			d.state.Current = &burst{StartedAt: now, NumFollows: len(d.follows) - 1}
+			isNewBurst = true
+		}
+		d.state.Current.LastTriggeredAt = now
+		for _, signal := range signals {
+			if !contains(d.state.Current.Signals, signal) {
+				d.state.Current.Signals = append(d.state.Current.Signals, signal)
+			}
+		}
+	}
+
+	handled := false
+	overflowed := false
+	if b := d.state.Current; b != nil {
+		b.NumFollows++
+		if d.config.Hold {
+			if b.NumHeld < d.config.MaxHeld {
+				b.Held = append(b.Held, held)
+				b.NumHeld++
+				handled = true
+			} else {
+				// If we can't hold any more events, resolve this one immediately
+				b.NumOverflowed++
+				overflowed = b.NumOverflowed == 1
+				handled = d.config.Resolution == ResolutionDiscard
+			}
+		}
+	}
+	var started *alert.PayloadFollowBurst
+	if isNewBurst {
+		started = d.state.Current.payload(d.config)
+	}
+	if ended || d.state.Current != nil {
+		d.saveLocked(logger)
+	}
+	d.mu.Unlock()
+
+	if ended {
+		d.signal()
+	}
+	if overflowed {
+		logger.Warn("Unable to hold any more follow events; resolving further events immediately", "maxHeld", d.config.MaxHeld)
+	}
+	if started != nil {
+		logger.Warn("Follow burst suspected", "signals", started.Signals, "numFollows", started.NumFollows)
+		d.notify(ctx, logger, &alert.Alert{
+			Type:       alert.TypeFollowBurstSuspected,
+			Message:    fmt.Sprintf("Follow burst suspected: %d follows in the last %s (%s)", started.NumFollows, d.config.Window, strings.Join(started.Signals, ", ")),
+			OccurredAt: now,
+			Payload:    &alert.Payload{FollowBurst: started},
+		})
+	}
+	return handled
+}
+
+// Run blocks until the given context is canceled, resolving the events held during
+// each burst once it ends: it periodically checks whether an ongoing burst has ended,
+// so that held events can be resolved even if no further follows occur. Any bursts
+// that had ended but weren't fully resolved before we last shut down are resolved
+// immediately.
+func (d *Detector) Run(ctx context.Context, logger *slog.Logger, interval time.Duration, release ReleaseFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.mu.Lock()
+		if d.endExpiredBurstLocked(d.now()) {
+			d.saveLocked(logger)
+		}
+		d.mu.Unlock()
+		d.resolveEnded(ctx, logger, release)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Flush resolves the events held during any bursts that have ended: this should be
+// called on shutdown, once no further events will be observed. A burst that's still
+// ongoing is left as-is, so that the attack isn't let through just because we're
+// restarting: it remains persisted, along with its held events, and it ends once its
+// cooldown period has elapsed after we start up again. Likewise, any events that can't
+// be released before ctx is done remain persisted, and they're released once we start
+// up again.
+func (d *Detector) Flush(ctx context.Context, logger *slog.Logger, release ReleaseFunc) {
+	d.mu.Lock()
+	if d.endExpiredBurstLocked(d.now()) {
+		d.saveLocked(logger)
+	}
+	d.mu.Unlock()
+	d.resolveEnded(ctx, logger, release)
+}
+
+// signal wakes Run so that it can resolve a burst that has just ended
+func (d *Detector) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// endExpiredBurstLocked ends the current burst if no signal has exceeded its threshold
+// for the duration of our cooldown period, returning true if it ended
+func (d *Detector) endExpiredBurstLocked(now time.Time) bool {
+	if d.state.Current == nil || now.Sub(d.state.Current.LastTriggeredAt) < d.config.Cooldown {
+		return false
+	}
+	d.endCurrentLocked(now)
+	return true
+}
+
+// endCurrentLocked ends the current burst, queueing it to be resolved
+func (d *Detector) endCurrentLocked(now time.Time) {
+	ended := d.state.Current
+	ended.EndedAt = &now
+	d.state.Current = nil
+	d.state.Ended = append(d.state.Ended, ended)
+}
+
+// pruneLocked discards all follows that have fallen outside our sliding window
+func (d *Detector) pruneLocked(now time.Time) {
+	cutoff := now.Add(-d.config.Window)
+	i := 0
+	for i < len(d.follows) && !d.follows[i].at.After(cutoff) {
+		i++
+	}
+	d.follows = d.follows[i:]
+}
+
+// evaluateLocked returns the signals that currently exceed their thresholds
+func (d *Detector) evaluateLocked() []string {
+	signals := make([]string, 0)
+	if d.config.MaxFollows > 0 && len(d.follows) > d.config.MaxFollows {
+		signals = append(signals, SignalRate)
+	}
+	if d.config.MaxPatternFollows > 0 {
+		n := 0
+		for _, f := range d.follows {
+			if d.config.LoginPattern.MatchString(f.login) {
+				n++
+			}
+		}
+		if n > d.config.MaxPatternFollows {
+			signals = append(signals, SignalLoginPattern)
+		}
+	}
+	if d.config.PrefixLength > 0 && d.config.MaxPrefixFollows > 0 {
+		counts := make(map[string]int)
+		for _, f := range d.follows {
+			if len(f.login) < d.config.PrefixLength {
+				continue
+			}
+			prefix := f.login[:d.config.PrefixLength]
+			counts[prefix]++
+			if counts[prefix] == d.config.MaxPrefixFollows+1 {
+				signals = append(signals, SignalSharedPrefix)
+				break
+			}
+		}
+	}
+	return signals
+}
+
+// resolveEnded resolves each burst that has ended, in order: it releases or discards
+// the events that were held during the burst, then raises an alert to indicate that
+// the burst is over. Each event is only removed from our persisted state once it's
+// been released: if an event can't be released, we stop, and try again later.
+func (d *Detector) resolveEnded(ctx context.Context, logger *slog.Logger, release ReleaseFunc) {
+	d.resolveMu.Lock()
+	defer d.resolveMu.Unlock()
+	for {
+		d.mu.Lock()
+		if len(d.state.Ended) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		b := d.state.Ended[0]
+		payload := b.payload(d.config)
+		d.mu.Unlock()
+
+		burstLogger := logger.With("signals", payload.Signals, "numFollows", payload.NumFollows, "numHeld", payload.NumHeld)
+		if d.config.Resolution == ResolutionRelease {
+			for {
+				d.mu.Lock()
+				if len(b.Held) == 0 {
+					d.mu.Unlock()
+					break
+				}
+				held := b.Held[0]
+				d.mu.Unlock()
+
+				if err := release(ctx, burstLogger, held); err != nil {
+					burstLogger.Error("Failed to release held follow event; will retry", "error", err, "numRemaining", len(b.Held))
+					return
+				}
+
+				d.mu.Lock()
+				b.Held = b.Held[1:]
+				d.saveLocked(burstLogger)
+				d.mu.Unlock()
+			}
+			if payload.NumHeld > 0 {
+				burstLogger.Info("Released follow events held during burst")
+			}
+		} else if payload.NumHeld > 0 {
+			burstLogger.Info("Discarded follow events held during burst")
+		}
+
+		burstLogger.Info("Follow burst ended")
+		message := fmt.Sprintf("Follow burst ended after %s: %d follows", payload.EndedAt.Sub(payload.StartedAt).Round(time.Second), payload.NumFollows)
+		if payload.Resolution != "" {
+			message += fmt.Sprintf(", %d held and %s", payload.NumHeld, payload.Resolution)
+		}
+		d.notify(ctx, burstLogger, &alert.Alert{
+			Type:       alert.TypeFollowBurstEnded,
+			Message:    message,
+			OccurredAt: *payload.EndedAt,
+			Payload:    &alert.Payload{FollowBurst: payload},
+		})
+
+		d.mu.Lock()
+		d.state.Ended = d.state.Ended[1:]
+		d.saveLocked(burstLogger)
+		d.mu.Unlock()
+	}
+}
+
+func (d *Detector) notify(ctx context.Context, logger *slog.Logger, a *alert.Alert) {
+	if err := d.notifier.Notify(ctx, a); err != nil {
+		logger.Error("Failed to send alert", "alertType", a.Type, "error", err)
+	}
+}
+
+// saveLocked persists our state, writing to a temporary file and then renaming it so
+// that we never leave a partially written state file on disk
+func (d *Detector) saveLocked(logger *slog.Logger) {
+	if err := d.writeLocked(); err != nil {
+		logger.Error("Failed to persist follow burst state", "error", err)
+	}
+}
+
+func (d *Detector) writeLocked() error {
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+	return statefile.Write(d.path, data)
+}
+
+// payload describes the burst for inclusion in an alert
+func (b *burst) payload(config Config) *alert.PayloadFollowBurst {
+	payload := &alert.PayloadFollowBurst{
+		StartedAt:  b.StartedAt,
+		EndedAt:    b.EndedAt,
+		Signals:    append([]string(nil), b.Signals...),
+		NumFollows: b.NumFollows,
+		NumHeld:    b.NumHeld,
+	}
+	if config.Hold {
+		if config.Resolution == ResolutionRelease {
+			payload.Resolution = "released"
+		} else {
+			payload.Resolution = "discarded"
+		}
+	}
+	return payload
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,423 @@
+package followburst
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Detector_signals(t *testing.T) {
+	tests := []struct {
+		name        string
+		logins      []string
+		interval    time.Duration
+		wantSignals []string
+		wantFollows int
+	}{
+		{
+			"steady trickle of follows is not a burst",
+			distinctLogins(60),
+			10 * time.Second,
+			nil,
+			0,
+		},
+		{
+			"high rate of follows is a burst",
+			distinctLogins(30),
+			time.Second,
+			[]string{SignalRate},
+			30,
+		},
+		{
+			"high rate of follows spread beyond window is not a burst",
+			distinctLogins(30),
+			3 * time.Second,
+			nil,
+			0,
+		},
+		{
+			"many follows with bot-like logins are a burst",
+			[]string{"alice", "bob", "xx_bunny1234", "carol", "qq_kitten9876", "darkwing4321", "dave", "slaytastic1111", "zz_gamer0001", "hoss42424242"},
+			2 * time.Second,
+			[]string{SignalLoginPattern},
+			10,
+		},
+		{
+			"many follows with shared login prefix are a burst",
+			[]string{"alice", "hoss_xyz", "bob", "hoss_abc", "carol", "hoss_lmnop", "dave", "hoss_bonk", "erin", "hoss_zorp", "frank", "hoss_qwerty"},
+			2 * time.Second,
+			[]string{SignalSharedPrefix},
+			12,
+		},
+		{
+			"multiple signals are combined",
+			syntheticLogins("botty", 30),
+			time.Second,
+			[]string{SignalLoginPattern, SignalSharedPrefix, SignalRate},
+			30,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, testConfig())
+			for _, login := range tt.logins {
+				h.follow(login)
+				h.advance(tt.interval)
+			}
+			if tt.wantSignals == nil {
+				assert.Empty(t, h.notifier.alerts)
+				return
+			}
+			h.advance(time.Hour)
+			h.d.Flush(context.Background(), slog.Default(), h.release)
+			if assert.Len(t, h.notifier.alerts, 2) {
+				assert.Equal(t, alert.TypeFollowBurstSuspected, h.notifier.alerts[0].Type)
+				assert.Equal(t, alert.TypeFollowBurstEnded, h.notifier.alerts[1].Type)
+				assert.ElementsMatch(t, tt.wantSignals, h.notifier.alerts[1].Payload.FollowBurst.Signals)
+				assert.Equal(t, tt.wantFollows, h.notifier.alerts[1].Payload.FollowBurst.NumFollows)
+			}
+			assert.Equal(t, tt.logins, h.produced)
+		})
+	}
+}
+
+func Test_Detector_holdAndRelease(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = ResolutionRelease
+	h := newHarness(t, config)
+
+	// 25 follows in 25 seconds: the 21st follow exceeds our threshold, so that follow
+	// and all that follow it should be held
+	logins := distinctLogins(25)
+	for _, login := range logins {
+		h.follow(login)
+		h.advance(time.Second)
+	}
+	assert.Equal(t, logins[:20], h.produced)
+	if assert.Len(t, h.notifier.alerts, 1) {
+		a := h.notifier.alerts[0]
+		assert.Equal(t, alert.TypeFollowBurstSuspected, a.Type)
+		assert.Equal(t, "Follow burst suspected: 21 follows in the last 1m0s (rate)", a.Message)
+		assert.Equal(t, &alert.PayloadFollowBurst{
+			StartedAt:  h.start.Add(20 * time.Second),
+			Signals:    []string{SignalRate},
+			NumFollows: 21,
+			NumHeld:    1,
+			Resolution: "released",
+		}, a.Payload.FollowBurst)
+	}
+
+	// Follows that occur within the cooldown period should still be held, even once
+	// the rate drops below our threshold
+	h.advance(time.Minute)
+	h.follow("latecomer")
+	assert.Len(t, h.produced, 20)
+
+	// Once the cooldown period elapses without any further signals, the next follow
+	// should be produced immediately, and held events should then be released in order,
+	// outside of the call to Observe
+	h.advance(2 * time.Minute)
+	h.follow("legitviewer")
+	assert.Equal(t, append(logins[:20:20], "legitviewer"), h.produced)
+	h.resolve()
+	assert.Equal(t, append(append(append(logins[:20:20], "legitviewer"), logins[20:]...), "latecomer"), h.produced)
+	if assert.Len(t, h.notifier.alerts, 2) {
+		a := h.notifier.alerts[1]
+		assert.Equal(t, alert.TypeFollowBurstEnded, a.Type)
+		assert.Equal(t, "Follow burst ended after 3m5s: 26 follows, 6 held and released", a.Message)
+		endedAt := h.start.Add(3*time.Minute + 25*time.Second)
+		assert.Equal(t, &alert.PayloadFollowBurst{
+			StartedAt:  h.start.Add(20 * time.Second),
+			EndedAt:    &endedAt,
+			Signals:    []string{SignalRate},
+			NumFollows: 26,
+			NumHeld:    6,
+			Resolution: "released",
+		}, a.Payload.FollowBurst)
+	}
+}
+
+func Test_Detector_holdAndDiscard(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = ResolutionDiscard
+	config.MaxHeld = 5
+	h := newHarness(t, config)
+
+	// Follows beyond MaxHeld should be discarded immediately
+	logins := distinctLogins(30)
+	for _, login := range logins {
+		h.follow(login)
+		h.advance(time.Second)
+	}
+	h.advance(3 * time.Minute)
+	h.follow("legitviewer")
+	h.resolve()
+	assert.Equal(t, append(logins[:20], "legitviewer"), h.produced)
+	if assert.Len(t, h.notifier.alerts, 2) {
+		a := h.notifier.alerts[1]
+		assert.Equal(t, alert.TypeFollowBurstEnded, a.Type)
+		assert.Equal(t, 30, a.Payload.FollowBurst.NumFollows)
+		assert.Equal(t, 5, a.Payload.FollowBurst.NumHeld)
+		assert.Equal(t, "discarded", a.Payload.FollowBurst.Resolution)
+	}
+}
+
+func Test_Detector_Run(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = ResolutionRelease
+	h := newHarness(t, config)
+	logins := distinctLogins(25)
+	for _, login := range logins {
+		h.follow(login)
+	}
+	assert.Len(t, h.produced, 20)
+
+	// Held events should be released once the cooldown period elapses, even if no
+	// further follows occur
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	go func() {
+		h.d.Run(ctx, slog.Default(), time.Millisecond, h.release)
+		close(done)
+	}()
+	h.advance(3 * time.Minute)
+	assert.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.produced) == 25
+	}, time.Second, time.Millisecond)
+}
+
+func Test_Detector_Observe_ignoresOtherEvents(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = ResolutionDiscard
+	h := newHarness(t, config)
+	for _, login := range distinctLogins(30) {
+		h.follow(login)
+	}
+
+	held := h.d.Observe(context.Background(), slog.Default(), &helix.EventSubSubscription{Type: helix.EventSubTypeChannelCheer}, json.RawMessage(`{"user_login":"viewer1"}`), json.RawMessage(`"viewer1"`))
+	assert.False(t, held)
+}
+
+func Test_Detector_persistence(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = ResolutionRelease
+	h := newHarness(t, config)
+	logins := distinctLogins(25)
+	for _, login := range logins {
+		h.follow(login)
+		h.advance(time.Second)
+	}
+	assert.Equal(t, logins[:20], h.produced)
+
+	// Held events have already been acknowledged, so they should survive a restart,
+	// along with the burst that's still ongoing
+	restarted := h.restart()
+	h.advance(3 * time.Minute)
+
+	// If a held event can't be released, it should be retried later, and events should
+	// only be removed from our persisted state once they're released
+	restarted.fail = 2
+	restarted.d.Run(canceledContext(), slog.Default(), time.Hour, restarted.release)
+	assert.Equal(t, logins[20:22], restarted.produced)
+	assert.Empty(t, restarted.notifier.alerts)
+
+	again := restarted.restart()
+	again.d.Flush(context.Background(), slog.Default(), again.release)
+	assert.Equal(t, logins[22:], again.produced)
+	if assert.Len(t, again.notifier.alerts, 1) {
+		assert.Equal(t, "Follow burst ended after 3m5s: 25 follows, 5 held and released", again.notifier.alerts[0].Message)
+	}
+
+	// Once all held events have been released, there's nothing left to resolve
+	final := again.restart()
+	final.d.Flush(context.Background(), slog.Default(), final.release)
+	assert.Empty(t, final.produced)
+	assert.Empty(t, final.notifier.alerts)
+}
+
+func Test_Detector_Flush_leavesOngoingBurst(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = ResolutionRelease
+	h := newHarness(t, config)
+	logins := distinctLogins(25)
+	for _, login := range logins {
+		h.follow(login)
+	}
+	assert.Len(t, h.produced, 20)
+
+	// Shutting down mid-burst shouldn't end the burst or let the attack through: held
+	// events should remain persisted along with the ongoing burst
+	h.d.Flush(context.Background(), slog.Default(), h.release)
+	assert.Len(t, h.produced, 20)
+	assert.Len(t, h.notifier.alerts, 1)
+
+	// If we start up again before the cooldown period has elapsed, the burst is still
+	// ongoing, so further follows are still held
+	restarted := h.restart()
+	restarted.follow("latecomer")
+	restarted.d.Flush(context.Background(), slog.Default(), restarted.release)
+	assert.Empty(t, restarted.produced)
+	assert.Empty(t, restarted.notifier.alerts)
+
+	// Once the cooldown period elapses, the burst ends and all held events are released
+	again := restarted.restart()
+	h.advance(3 * time.Minute)
+	again.d.Flush(context.Background(), slog.Default(), again.release)
+	assert.Equal(t, append(append([]string(nil), logins[20:]...), "latecomer"), again.produced)
+	if assert.Len(t, again.notifier.alerts, 1) {
+		assert.Equal(t, alert.TypeFollowBurstEnded, again.notifier.alerts[0].Type)
+		assert.Equal(t, 26, again.notifier.alerts[0].Payload.FollowBurst.NumFollows)
+	}
+}
+
+func Test_NewDetector_invalid(t *testing.T) {
+	config := testConfig()
+	config.Hold = true
+	config.Resolution = "explode"
+	_, err := NewDetector(config, &recordingNotifier{}, filepath.Join(t.TempDir(), "follow-burst.json"))
+	assert.ErrorContains(t, err, "unsupported resolution")
+}
+
+func testConfig() Config {
+	return Config{
+		Window:            time.Minute,
+		MaxFollows:        20,
+		LoginPattern:      regexp.MustCompile(DefaultLoginPattern),
+		MaxPatternFollows: 5,
+		PrefixLength:      4,
+		MaxPrefixFollows:  5,
+		Cooldown:          2 * time.Minute,
+		MaxHeld:           1000,
+	}
+}
+
+// distinctLogins returns n logins that don't resemble one another
+func distinctLogins(n int) []string {
+	logins := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		logins = append(logins, fmt.Sprintf("%c%cviewer", 'a'+i%26, 'a'+i/26))
+	}
+	return logins
+}
+
+// syntheticLogins returns n bot-like logins, all beginning with the same prefix
+func syntheticLogins(prefix string, n int) []string {
+	logins := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		logins = append(logins, fmt.Sprintf("%s%04d", prefix, i))
+	}
+	return logins
+}
+
+// harness feeds synthetic follow events to a Detector using a fake clock, recording the
+// logins of all follow events that are produced (either immediately or upon release)
+type harness struct {
+	t        *testing.T
+	d        *Detector
+	notifier *recordingNotifier
+	start    time.Time
+
+	mu       sync.Mutex
+	now      time.Time
+	produced []string
+	fail     int // if nonzero, the number of events to release before failing
+}
+
+func newHarness(t *testing.T, config Config) *harness {
+	notifier := &recordingNotifier{}
+	d, err := NewDetector(config, notifier, filepath.Join(t.TempDir(), "follow-burst.json"))
+	assert.NoError(t, err)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	h := &harness{t: t, d: d, notifier: notifier, start: start, now: start}
+	d.now = func() time.Time {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.now
+	}
+	return h
+}
+
+func (h *harness) follow(login string) {
+	subscription := &helix.EventSubSubscription{Type: helix.EventSubTypeChannelFollow}
+	data := json.RawMessage(fmt.Sprintf(`{"user_id":"1","user_login":"%s","user_name":"%s"}`, login, login))
+	held := json.RawMessage(fmt.Sprintf(`"%s"`, login))
+	if !h.d.Observe(context.Background(), slog.Default(), subscription, data, held) {
+		h.release(context.Background(), slog.Default(), held)
+	}
+}
+
+// release is a ReleaseFunc that records the login of each released event
+func (h *harness) release(ctx context.Context, logger *slog.Logger, held json.RawMessage) error {
+	var login string
+	if err := json.Unmarshal(held, &login); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fail > 0 && len(h.produced) == h.fail {
+		return fmt.Errorf("mock error")
+	}
+	h.produced = append(h.produced, login)
+	return nil
+}
+
+// restart returns a new harness, sharing our clock, whose Detector loads the state
+// that was persisted by ours
+func (h *harness) restart() *harness {
+	notifier := &recordingNotifier{}
+	d, err := NewDetector(h.d.config, notifier, h.d.path)
+	assert.NoError(h.t, err)
+	d.now = h.d.now
+	return &harness{t: h.t, d: d, notifier: notifier, start: h.start}
+}
+
+// resolve resolves any bursts that have ended, as Run would
+func (h *harness) resolve() {
+	h.d.resolveEnded(context.Background(), slog.Default(), h.release)
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func (h *harness) advance(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now = h.now.Add(d)
+}
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []*alert.Alert
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, a *alert.Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, a)
+	return nil
+}
@@ -0,0 +1,16 @@
+// Package followburst detects follow-bot attacks, in which a channel is flooded with
+// follows from bot accounts (typically in order to spam on-screen alerts).
+//
+// The Detector watches 'channel.follow' events over a sliding window, looking for
+// several signals: an unusually high rate of follows, many follows from accounts whose
+// logins match a suspicious pattern (e.g. a word followed by a string of digits), and
+// many follows from accounts whose logins share the same prefix. When any signal
+// exceeds its threshold, a burst is suspected, and we raise an alert. The burst ends
+// once no signal has exceeded its threshold for a cooldown period, at which point we
+// raise another alert.
+//
+// Optionally, individual follow events may be held back for the duration of a burst,
+// so that they never reach twitch-events while the attack is ongoing: once the burst
+// ends, held events are either released (i.e. produced as normal) or discarded. Held
+// events are persisted until they're resolved, so that they survive a restart.
+package followburst
@@ -0,0 +1,105 @@
+package publish
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// NewBroker connects to the AMQP broker at the given URL. The connection is shared by
+// all channels opened via the resulting Broker, and it's reestablished as needed.
+func NewBroker(url string) (Broker, error) {
+	b := &amqpBroker{url: url}
+	if _, err := b.connection(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// amqpBroker implements Broker using a single AMQP connection
+type amqpBroker struct {
+	url string
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	closed bool
+}
+
+// OpenChannel opens a channel in confirm mode, declaring the fanout exchange to which
+// we'll publish, and redialing the broker first if our connection has been lost
+func (b *amqpBroker) OpenChannel(exchange string) (Channel, error) {
+	conn, err := b.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create channel: %w", err)
+	}
+
+	durable := true
+	autoDelete := false
+	internal := false
+	noWait := false
+	if err := ch.ExchangeDeclare(exchange, "fanout", durable, autoDelete, internal, noWait, nil); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to declare exchange: %w", err)
+	}
+	if err := ch.Confirm(noWait); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to put channel into confirm mode: %w", err)
+	}
+	return &amqpChannel{ch}, nil
+}
+
+// Close closes our connection to the broker; no further channels may be opened
+func (b *amqpBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.conn == nil || b.conn.IsClosed() {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+// connection returns our current connection, dialing the broker if we don't have one
+func (b *amqpBroker) connection() (*amqp.Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, fmt.Errorf("connection to AMQP broker is closed")
+	}
+	if b.conn != nil && !b.conn.IsClosed() {
+		return b.conn, nil
+	}
+
+	conn, err := amqp.Dial(b.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to AMQP server: %w", err)
+	}
+	b.conn = conn
+	return conn, nil
+}
+
+// amqpChannel adapts amqp.Channel to our Channel interface
+type amqpChannel struct {
+	ch *amqp.Channel
+}
+
+func (c *amqpChannel) Publish(ctx context.Context, exchange string, msg amqp.Publishing) (Confirmation, error) {
+	mandatory := false
+	immediate := false
+	return c.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, "", mandatory, immediate, msg)
+}
+
+func (c *amqpChannel) IsClosed() bool {
+	return c.ch.IsClosed()
+}
+
+func (c *amqpChannel) Close() error {
+	return c.ch.Close()
+}
@@ -0,0 +1,10 @@
+// Package publish implements the AMQP producer that the hooks service uses to publish
+// messages (e.g. to the twitch-events exchange).
+//
+// Unlike a bare AMQP channel, which simply writes each message to the socket, Producer
+// puts its channel into confirm mode, so that Send only succeeds once the broker has
+// confirmed that it has taken responsibility for the message. This allows us to be
+// sure, before telling Twitch that we've handled an event, that the event will
+// actually reach downstream consumers. On shutdown, Close stops accepting new messages
+// and waits for any outstanding confirmations before closing the channel.
+package publish
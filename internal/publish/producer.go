@@ -0,0 +1,276 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// ReconnectBaseDelay is how long we'll wait before our first attempt to reopen a
+	// channel after failing to do so; the delay doubles with each failed attempt
+	ReconnectBaseDelay = 500 * time.Millisecond
+
+	// ReconnectMaxDelay is the longest we'll wait between attempts to reopen a channel
+	ReconnectMaxDelay = 30 * time.Second
+)
+
+// ErrClosed is returned when attempting to send a message after Close has been called
+var ErrClosed = errors.New("producer is closed")
+
+// ErrRejected is returned when the broker explicitly rejects a message
+var ErrRejected = errors.New("published message was rejected by broker")
+
+// Broker opens channels to an AMQP broker, reconnecting if necessary
+type Broker interface {
+	OpenChannel(exchange string) (Channel, error)
+	Close() error
+}
+
+// Channel is an AMQP channel in confirm mode
+type Channel interface {
+	Publish(ctx context.Context, exchange string, msg amqp.Publishing) (Confirmation, error)
+	IsClosed() bool
+	Close() error
+}
+
+// Confirmation is a pending publisher confirmation for a single message, which
+// resolves to true if the broker acknowledged the message or false if it rejected it.
+// If the channel is closed before the broker responds, the confirmation resolves to
+// false.
+type Confirmation interface {
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+// Message is a message to be published, along with the AMQP properties that describe
+// its body
+type Message struct {
+	ContentType string
+	Headers     amqp.Table
+	Body        []byte
+}
+
+// Producer sends JSON-formatted messages to a single AMQP exchange, waiting for the
+// broker to confirm each message. If the channel is lost (e.g. because the broker
+// restarted), the Producer reopens it, with backoff, and resends any messages that
+// weren't confirmed. It implements rmq.Producer.
+type Producer struct {
+	broker   Broker
+	exchange string
+	sleep    func(ctx context.Context, d time.Duration) error
+
+	mu          sync.Mutex
+	ch          Channel
+	closed      bool
+	numInFlight int
+	idle        chan struct{}
+
+	// reopenMu ensures that only one caller at a time attempts to reopen the channel
+	reopenMu sync.Mutex
+}
+
+// NewProducer opens a channel to the given broker and returns a Producer that will
+// send messages to the fanout exchange with the given name
+func NewProducer(broker Broker, exchange string) (*Producer, error) {
+	ch, err := broker.OpenChannel(exchange)
+	if err != nil {
+		return nil, err
+	}
+	return &Producer{
+		broker:   broker,
+		exchange: exchange,
+		sleep:    sleepContext,
+		ch:       ch,
+	}, nil
+}
+
+// Send publishes a message, blocking until the broker confirms it. If the channel is
+// lost before the message is confirmed, we reopen it and publish the message again, so
+// the message may be delivered more than once. If the broker rejects the message, or if
+// ctx is canceled before a confirmation is received, an error is returned: in the
+// latter case, the message may or may not have been delivered.
+func (p *Producer) Send(ctx context.Context, jsonData []byte) error {
+	return p.SendMessage(ctx, Message{
+		ContentType: "application/json",
+		Body:        jsonData,
+	})
+}
+
+// SendMessage publishes a message with the given content type and headers, with the
+// same delivery guarantees as Send
+func (p *Producer) SendMessage(ctx context.Context, message Message) error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.end()
+
+	msg := amqp.Publishing{
+		ContentType:  message.ContentType,
+		Headers:      message.Headers,
+		DeliveryMode: amqp.Persistent,
+		Body:         message.Body,
+	}
+	for {
+		ch, err := p.channel(ctx)
+		if err != nil {
+			return err
+		}
+
+		confirmation, err := ch.Publish(ctx, p.exchange, msg)
+		if err != nil {
+			if ch.IsClosed() {
+				p.discard(ch)
+				continue
+			}
+			return fmt.Errorf("failed to publish message: %w", err)
+		}
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get confirmation for published message: %w", err)
+		}
+		if !acked {
+			// A closed channel nacks all unconfirmed messages, in which case the broker
+			// may never have received the message: try again on a new channel
+			if ch.IsClosed() {
+				p.discard(ch)
+				continue
+			}
+			return ErrRejected
+		}
+		return nil
+	}
+}
+
+// Close stops accepting new messages, then waits for all messages currently being
+// sent to be confirmed before closing the channel. If ctx is canceled first, the
+// channel is closed anyway, and an error reports how many messages were unconfirmed.
+func (p *Producer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	numInFlight := p.numInFlight
+	var idle chan struct{}
+	if numInFlight > 0 {
+		idle = make(chan struct{})
+		p.idle = idle
+	}
+	p.mu.Unlock()
+
+	var err error
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			p.mu.Lock()
+			numInFlight = p.numInFlight
+			p.mu.Unlock()
+			err = fmt.Errorf("%d message(s) were not confirmed before closing", numInFlight)
+		}
+	}
+
+	p.mu.Lock()
+	ch := p.ch
+	p.ch = nil
+	p.mu.Unlock()
+	if ch != nil && !ch.IsClosed() {
+		if closeErr := ch.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close channel: %w", closeErr)
+		}
+	}
+	return err
+}
+
+// channel returns our current channel, reopening it if it's been lost. If the broker
+// is unavailable, we keep trying, with exponential backoff and jitter, until ctx is
+// canceled.
+func (p *Producer) channel(ctx context.Context) (Channel, error) {
+	if ch := p.current(); ch != nil {
+		return ch, nil
+	}
+
+	p.reopenMu.Lock()
+	defer p.reopenMu.Unlock()
+	for attempt := 0; ; attempt++ {
+		// Another caller may have reopened the channel while we were waiting
+		if ch := p.current(); ch != nil {
+			return ch, nil
+		}
+
+		ch, err := p.broker.OpenChannel(p.exchange)
+		if err == nil {
+			p.mu.Lock()
+			p.ch = ch
+			p.mu.Unlock()
+			return ch, nil
+		}
+		if err := p.sleep(ctx, backoff(attempt)); err != nil {
+			return nil, fmt.Errorf("failed to reopen channel: %w", err)
+		}
+	}
+}
+
+// current returns our current channel, or nil if it's been lost
+func (p *Producer) current() Channel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch != nil && p.ch.IsClosed() {
+		p.ch = nil
+	}
+	return p.ch
+}
+
+// discard forgets the given channel, if it's still our current channel, so that the
+// next call to channel will reopen it
+func (p *Producer) discard(ch Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == ch {
+		p.ch = nil
+	}
+}
+
+// begin registers a message as being in flight, failing if we've been closed
+func (p *Producer) begin() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.numInFlight++
+	return nil
+}
+
+// end registers that a message is no longer in flight, notifying Close if it's
+// waiting for the last in-flight message
+func (p *Producer) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.numInFlight--
+	if p.numInFlight == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// backoff returns how long to wait after the given failed attempt to reopen our
+// channel, with jitter so that many producers don't reconnect in lockstep
+func backoff(attempt int) time.Duration {
+	delay := ReconnectBaseDelay << attempt
+	if delay <= 0 || delay > ReconnectMaxDelay {
+		delay = ReconnectMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,335 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Producer_Send(t *testing.T) {
+	tests := []struct {
+		name       string
+		publishErr error
+		ack        bool
+		wantErr    string
+	}{
+		{
+			"message confirmed by broker",
+			nil,
+			true,
+			"",
+		},
+		{
+			"message rejected by broker",
+			nil,
+			false,
+			"rejected by broker",
+		},
+		{
+			"message could not be published",
+			errors.New("invalid message"),
+			false,
+			"invalid message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeBroker{publishErr: tt.publishErr, autoConfirm: true, ack: tt.ack}
+			p := newTestProducer(t, b)
+			err := p.Send(context.Background(), []byte(`{"hello":"world"}`))
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				published := b.allPublished()
+				assert.Len(t, published, 1)
+				assert.Equal(t, "twitch-events", published[0].exchange)
+				assert.Equal(t, "application/json", published[0].msg.ContentType)
+				assert.Equal(t, amqp.Persistent, published[0].msg.DeliveryMode)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+			assert.Equal(t, 1, b.numOpened())
+		})
+	}
+}
+
+func Test_Producer_SendMessage(t *testing.T) {
+	b := &fakeBroker{autoConfirm: true, ack: true}
+	p := newTestProducer(t, b)
+	err := p.SendMessage(context.Background(), Message{
+		ContentType: "application/cloudevents+json",
+		Headers:     amqp.Table{"cloudEvents:id": "message-1"},
+		Body:        []byte(`{"hello":"world"}`),
+	})
+	assert.NoError(t, err)
+	published := b.allPublished()
+	assert.Len(t, published, 1)
+	assert.Equal(t, "application/cloudevents+json", published[0].msg.ContentType)
+	assert.Equal(t, amqp.Table{"cloudEvents:id": "message-1"}, published[0].msg.Headers)
+	assert.Equal(t, amqp.Persistent, published[0].msg.DeliveryMode)
+	assert.Equal(t, `{"hello":"world"}`, string(published[0].msg.Body))
+}
+
+func Test_Producer_Send_reconnect(t *testing.T) {
+	b := &fakeBroker{autoConfirm: true, ack: true}
+	p := newTestProducer(t, b)
+	assert.NoError(t, p.Send(context.Background(), []byte(`{"seq":1}`)))
+
+	// Simulate the broker restarting: our channel is closed, and the broker is
+	// unavailable for a couple of attempts before it comes back up
+	b.restart(2)
+	assert.NoError(t, p.Send(context.Background(), []byte(`{"seq":2}`)))
+	assert.Equal(t, 2, b.numOpened())
+	assert.Equal(t, 2, b.numFailedOpens)
+	published := b.allPublished()
+	assert.Len(t, published, 2)
+	assert.Equal(t, `{"seq":2}`, string(published[1].msg.Body))
+	assert.Equal(t, "twitch-events", b.declaredExchanges[1])
+}
+
+func Test_Producer_Send_channelClosedBeforeConfirm(t *testing.T) {
+	b := &fakeBroker{ack: true}
+	p := newTestProducer(t, b)
+
+	sent := make(chan error)
+	go func() {
+		sent <- p.Send(context.Background(), []byte(`{}`))
+	}()
+	assert.Eventually(t, func() bool { return b.numPending() == 1 }, time.Second, time.Millisecond)
+
+	// If the channel is closed while we're waiting for a confirm, our message is
+	// nacked, and it should be published again on a new channel
+	b.restart(0)
+	assert.Eventually(t, func() bool { return b.numPending() == 1 && b.numOpened() == 2 }, time.Second, time.Millisecond)
+	b.confirmAll()
+	assert.NoError(t, <-sent)
+	assert.Len(t, b.allPublished(), 2)
+}
+
+func Test_Producer_Send_brokerUnavailable(t *testing.T) {
+	b := &fakeBroker{autoConfirm: true, ack: true}
+	p := newTestProducer(t, b)
+	b.restart(math.MaxInt32)
+
+	// If the broker never comes back, we should give up once ctx is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := p.Send(ctx, []byte(`{}`))
+	assert.ErrorContains(t, err, "failed to reopen channel")
+}
+
+func Test_Producer_Close(t *testing.T) {
+	b := &fakeBroker{ack: true}
+	p := newTestProducer(t, b)
+
+	// Start sending a message, which won't be confirmed until we say so
+	sent := make(chan error)
+	go func() {
+		sent <- p.Send(context.Background(), []byte(`{}`))
+	}()
+	assert.Eventually(t, func() bool { return b.numPending() == 1 }, time.Second, time.Millisecond)
+
+	// Closing should wait for the pending confirmation, and new messages should be
+	// rejected in the meantime
+	closed := make(chan error)
+	go func() {
+		closed <- p.Close(context.Background())
+	}()
+	assert.Eventually(t, func() bool {
+		return errors.Is(p.Send(context.Background(), []byte(`{}`)), ErrClosed)
+	}, time.Second, time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("Close returned before pending message was confirmed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.confirmAll()
+	assert.NoError(t, <-sent)
+	assert.NoError(t, <-closed)
+	assert.True(t, b.channels[0].IsClosed())
+}
+
+func Test_Producer_Close_timeout(t *testing.T) {
+	b := &fakeBroker{ack: true}
+	p := newTestProducer(t, b)
+
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+	go p.Send(sendCtx, []byte(`{}`))
+	assert.Eventually(t, func() bool { return b.numPending() == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := p.Close(ctx)
+	assert.ErrorContains(t, err, "1 message(s) were not confirmed")
+	assert.True(t, b.channels[0].IsClosed())
+}
+
+// newTestProducer returns a Producer for the twitch-events exchange that retries
+// immediately when the broker is unavailable
+func newTestProducer(t *testing.T, b *fakeBroker) *Producer {
+	p, err := NewProducer(b, "twitch-events")
+	assert.NoError(t, err)
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		return ctx.Err()
+	}
+	return p
+}
+
+// fakeBroker simulates an AMQP broker. If autoConfirm is true, each message is
+// confirmed as soon as it's published; otherwise confirmations are pending until
+// confirmAll is called. Confirmations are acks if ack is true, nacks otherwise.
+type fakeBroker struct {
+	publishErr  error
+	autoConfirm bool
+	ack         bool
+
+	mu                sync.Mutex
+	channels          []*fakeChannel
+	declaredExchanges []string
+	numUnavailable    int
+	numFailedOpens    int
+}
+
+func (b *fakeBroker) OpenChannel(exchange string) (Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.numUnavailable > 0 {
+		b.numUnavailable--
+		b.numFailedOpens++
+		return nil, errors.New("connection refused")
+	}
+	ch := &fakeChannel{broker: b}
+	b.channels = append(b.channels, ch)
+	b.declaredExchanges = append(b.declaredExchanges, exchange)
+	return ch, nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+// restart closes all open channels (nacking any unconfirmed messages), then refuses
+// to open new channels for the given number of attempts
+func (b *fakeBroker) restart(numUnavailable int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.channels {
+		ch.closeLocked()
+	}
+	b.numUnavailable = numUnavailable
+}
+
+func (b *fakeBroker) numOpened() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.channels)
+}
+
+func (b *fakeBroker) numPending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, ch := range b.channels {
+		n += len(ch.pending)
+	}
+	return n
+}
+
+func (b *fakeBroker) confirmAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.channels {
+		for _, c := range ch.pending {
+			c.resolve(b.ack)
+		}
+		ch.pending = nil
+	}
+}
+
+func (b *fakeBroker) allPublished() []fakePublishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	published := make([]fakePublishing, 0)
+	for _, ch := range b.channels {
+		published = append(published, ch.published...)
+	}
+	return published
+}
+
+type fakeChannel struct {
+	broker    *fakeBroker
+	published []fakePublishing
+	pending   []*fakeConfirmation
+	closed    bool
+}
+
+type fakePublishing struct {
+	exchange string
+	msg      amqp.Publishing
+}
+
+func (f *fakeChannel) Publish(ctx context.Context, exchange string, msg amqp.Publishing) (Confirmation, error) {
+	f.broker.mu.Lock()
+	defer f.broker.mu.Unlock()
+	if f.closed {
+		return nil, amqp.ErrClosed
+	}
+	if f.broker.publishErr != nil {
+		return nil, f.broker.publishErr
+	}
+	f.published = append(f.published, fakePublishing{exchange, msg})
+	c := &fakeConfirmation{done: make(chan struct{})}
+	if f.broker.autoConfirm {
+		c.resolve(f.broker.ack)
+	} else {
+		f.pending = append(f.pending, c)
+	}
+	return c, nil
+}
+
+func (f *fakeChannel) IsClosed() bool {
+	f.broker.mu.Lock()
+	defer f.broker.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeChannel) Close() error {
+	f.broker.mu.Lock()
+	defer f.broker.mu.Unlock()
+	f.closeLocked()
+	return nil
+}
+
+func (f *fakeChannel) closeLocked() {
+	f.closed = true
+	for _, c := range f.pending {
+		c.resolve(false)
+	}
+	f.pending = nil
+}
+
+type fakeConfirmation struct {
+	done chan struct{}
+	ack  bool
+}
+
+func (c *fakeConfirmation) resolve(ack bool) {
+	c.ack = ack
+	close(c.done)
+}
+
+func (c *fakeConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	select {
+	case <-c.done:
+		return c.ack, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
@@ -0,0 +1,10 @@
+// Package rollup maintains per-session totals of the events that support the
+// broadcaster (bits cheered, new subs, gifted subs, raids received and new follows), so
+// that downstream consumers such as the end-of-stream screen don't need to compute them
+// from twitch-events themselves.
+//
+// Rollups are keyed by stream session ID (see package session), persisted to disk so
+// that they survive restarts, and exposed via the API. When a session ends, its final
+// rollup is also produced as a summary to the hooks-rollups exchange. Rollups are held
+// per replica, so they're only complete when a single replica handles every event.
+package rollup
@@ -0,0 +1,334 @@
+package rollup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/statefile"
+	"github.com/golden-vcr/server-common/rmq"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// DefaultHistorySize is the default number of sessions for which we retain rollups
+const DefaultHistorySize = 20
+
+// AnonymousGifter is the key under which gifted subs are counted in
+// GiftedSubsByGifter when the gifter is anonymous
+const AnonymousGifter = "anonymous"
+
+// Rollup records the totals for a single stream session
+type Rollup struct {
+	SessionId          string                `json:"session_id"`
+	StartedAt          time.Time             `json:"started_at"`
+	EndedAt            *time.Time            `json:"ended_at,omitempty"`
+	BitsCheered        int                   `json:"bits_cheered"`
+	NumCheers          int                   `json:"num_cheers"`
+	NewSubs            int                   `json:"new_subs"`
+	GiftedSubs         int                   `json:"gifted_subs"`
+	GiftedSubsByGifter map[string]*GiftTotal `json:"gifted_subs_by_gifter"`
+	RaidsReceived      int                   `json:"raids_received"`
+	RaidViewers        int                   `json:"raid_viewers"`
+	NewFollows         int                   `json:"new_follows"`
+
+	// messageIds records the message ID of each event that's been observed for this
+	// session, so that an event that Twitch redelivers is only counted once
+	messageIds map[string]bool
+}
+
+// storedRollup is the form in which a Rollup is persisted, along with the message IDs
+// of the events that have been observed for it
+type storedRollup struct {
+	*Rollup
+	MessageIds []string `json:"message_ids,omitempty"`
+}
+
+// GiftTotal records the number of subs gifted by a single viewer, keyed by Twitch user
+// ID (or AnonymousGifter)
+type GiftTotal struct {
+	UserLogin string `json:"user_login,omitempty"`
+	UserName  string `json:"user_name,omitempty"`
+	NumSubs   int    `json:"num_subs"`
+}
+
+// Tracker maintains rollups for the most recent stream sessions, persisting them to a
+// JSON file at the given path, and producing a summary when each session ends
+type Tracker struct {
+	path        string
+	historySize int
+	producer    rmq.Producer
+	now         func() time.Time
+
+	mu      sync.Mutex
+	rollups []*Rollup
+}
+
+// NewTracker initializes a Tracker, loading any rollups that were previously persisted
+// to path. Final rollups are produced as summaries via the given producer.
+func NewTracker(path string, historySize int, producer rmq.Producer) (*Tracker, error) {
+	t := &Tracker{
+		path:        path,
+		historySize: historySize,
+		producer:    producer,
+		now:         time.Now,
+		rollups:     make([]*Rollup, 0),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollups: %w", err)
+	}
+	var stored []storedRollup
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse rollups: %w", err)
+	}
+	for _, sr := range stored {
+		if sr.Rollup == nil {
+			continue
+		}
+		sr.Rollup.messageIds = make(map[string]bool, len(sr.MessageIds))
+		for _, messageId := range sr.MessageIds {
+			sr.Rollup.messageIds[messageId] = true
+		}
+		t.rollups = append(t.rollups, sr.Rollup)
+	}
+	return t, nil
+}
+
+// Get returns a copy of the rollup for the given session, or nil if we have no record
+// of that session
+func (t *Tracker) Get(sessionId string) *Rollup {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.rollups {
+		if r.SessionId == sessionId {
+			return r.clone()
+		}
+	}
+	return nil
+}
+
+// List returns copies of all retained rollups, most recent session first
+func (t *Tracker) List() []*Rollup {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rollups := make([]*Rollup, 0, len(t.rollups))
+	for _, r := range t.rollups {
+		rollups = append(rollups, r.clone())
+	}
+	return rollups
+}
+
+// Observe updates the rollup for the session in which an event occurred: events that
+// occur while the stream is offline (i.e. with a nil sessionId) are not counted, and
+// each event is counted only once, however many times it's observed with the same
+// message ID. A session's start time is taken from its 'stream.online' event. When a
+// 'stream.offline' event ends a session, its final rollup is produced as a summary,
+// and the session is only marked as ended once that succeeds, so that the summary is
+// produced if the event is observed again (e.g. when Twitch redelivers it). If rollups
+// can't be persisted or the summary can't be produced, we log an error but carry on.
+func (t *Tracker) Observe(ctx context.Context, logger *slog.Logger, messageId string, subscription *helix.EventSubSubscription, data json.RawMessage, sessionId *string) {
+	if sessionId == nil {
+		return
+	}
+
+	t.mu.Lock()
+	r, created := t.getOrCreateLocked(*sessionId)
+	if messageId != "" && r.messageIds[messageId] {
+		t.mu.Unlock()
+		logger.Info("Event has already been counted toward rollup", "sessionId", *sessionId)
+		return
+	}
+	if subscription.Type == helix.EventSubTypeStreamOffline {
+		t.mu.Unlock()
+		t.endSession(ctx, logger, r, messageId)
+		return
+	}
+	if subscription.Type == helix.EventSubTypeStreamOnline {
+		var ev helix.EventSubStreamOnlineEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			logger.Error("Failed to parse stream.online event for rollup", "error", err)
+		} else if !ev.StartedAt.IsZero() {
+			r.StartedAt = ev.StartedAt.Time
+		}
+	} else {
+		counted, err := r.apply(subscription.Type, data)
+		if err != nil {
+			t.mu.Unlock()
+			logger.Error("Failed to parse event for rollup", "error", err)
+			return
+		}
+		if !counted && !created {
+			t.mu.Unlock()
+			return
+		}
+	}
+	if messageId != "" {
+		r.messageIds[messageId] = true
+	}
+	if err := t.writeLocked(); err != nil {
+		logger.Error("Failed to persist rollups", "error", err)
+	}
+	t.mu.Unlock()
+}
+
+// endSession produces the final rollup for a session that has just ended, then records
+// that the session has ended (and that the event that ended it has been observed)
+func (t *Tracker) endSession(ctx context.Context, logger *slog.Logger, r *Rollup, messageId string) {
+	t.mu.Lock()
+	if r.EndedAt != nil {
+		// We've already produced a summary for this session
+		t.mu.Unlock()
+		return
+	}
+	endedAt := t.now()
+	summary := r.clone()
+	summary.EndedAt = &endedAt
+	t.mu.Unlock()
+
+	data, err := json.Marshal(summary)
+	if err == nil {
+		err = t.producer.Send(ctx, data)
+	}
+	if err != nil {
+		logger.Error("Failed to produce session rollup summary", "sessionId", summary.SessionId, "error", err)
+		return
+	}
+	logger.Info("Produced session rollup summary", "sessionId", summary.SessionId)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.EndedAt != nil {
+		return
+	}
+	r.EndedAt = &endedAt
+	if messageId != "" {
+		r.messageIds[messageId] = true
+	}
+	if err := t.writeLocked(); err != nil {
+		logger.Error("Failed to persist rollups", "error", err)
+	}
+}
+
+// getOrCreateLocked returns the rollup for the given session, starting a new one (and
+// discarding the oldest, if we're at capacity) if necessary
+func (t *Tracker) getOrCreateLocked(sessionId string) (*Rollup, bool) {
+	for _, r := range t.rollups {
+		if r.SessionId == sessionId {
+			return r, false
+		}
+	}
+	// If we haven't seen this session's 'stream.online' event yet, our best guess at
+	// its start time is now: that event will correct it
+	r := &Rollup{
+		SessionId:          sessionId,
+		StartedAt:          t.now(),
+		GiftedSubsByGifter: make(map[string]*GiftTotal),
+		messageIds:         make(map[string]bool),
+	}
+	t.rollups = append([]*Rollup{r}, t.rollups...)
+	if len(t.rollups) > t.historySize {
+		t.rollups = t.rollups[:t.historySize]
+	}
+	return r, true
+}
+
+// writeLocked persists our rollups, replacing the file atomically so that we never
+// leave a partially written file on disk
+func (t *Tracker) writeLocked() error {
+	stored := make([]storedRollup, 0, len(t.rollups))
+	for _, r := range t.rollups {
+		messageIds := make([]string, 0, len(r.messageIds))
+		for messageId := range r.messageIds {
+			messageIds = append(messageIds, messageId)
+		}
+		sort.Strings(messageIds)
+		stored = append(stored, storedRollup{Rollup: r, MessageIds: messageIds})
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return statefile.Write(t.path, data)
+}
+
+// apply adds an event to the rollup's totals, returning true if the event was counted
+func (r *Rollup) apply(subscriptionType string, data json.RawMessage) (bool, error) {
+	switch subscriptionType {
+	case helix.EventSubTypeChannelCheer:
+		var ev helix.EventSubChannelCheerEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return false, err
+		}
+		r.BitsCheered += ev.Bits
+		r.NumCheers++
+		return true, nil
+	case helix.EventSubTypeChannelSubscription:
+		var ev helix.EventSubChannelSubscribeEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return false, err
+		}
+		// Gifted subs are counted via 'channel.subscription.gift', which tells us who
+		// gifted them
+		if ev.IsGift {
+			return false, nil
+		}
+		r.NewSubs++
+		return true, nil
+	case helix.EventSubTypeChannelSubscriptionGift:
+		var ev helix.EventSubChannelSubscriptionGiftEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return false, err
+		}
+		key := ev.UserID
+		if ev.IsAnonymous || key == "" {
+			key = AnonymousGifter
+		}
+		total, ok := r.GiftedSubsByGifter[key]
+		if !ok {
+			total = &GiftTotal{}
+			if key != AnonymousGifter {
+				total.UserLogin = ev.UserLogin
+				total.UserName = ev.UserName
+			}
+			r.GiftedSubsByGifter[key] = total
+		}
+		total.NumSubs += ev.Total
+		r.GiftedSubs += ev.Total
+		return true, nil
+	case helix.EventSubTypeChannelRaid:
+		var ev helix.EventSubChannelRaidEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return false, err
+		}
+		r.RaidsReceived++
+		r.RaidViewers += ev.Viewers
+		return true, nil
+	case helix.EventSubTypeChannelFollow:
+		r.NewFollows++
+		return true, nil
+	}
+	return false, nil
+}
+
+func (r *Rollup) clone() *Rollup {
+	c := *r
+	c.messageIds = nil
+	if r.EndedAt != nil {
+		endedAt := *r.EndedAt
+		c.EndedAt = &endedAt
+	}
+	c.GiftedSubsByGifter = make(map[string]*GiftTotal, len(r.GiftedSubsByGifter))
+	for key, total := range r.GiftedSubsByGifter {
+		t := *total
+		c.GiftedSubsByGifter[key] = &t
+	}
+	return &c
+}
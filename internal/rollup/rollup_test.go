@@ -0,0 +1,205 @@
+package rollup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Tracker_Observe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollups.json")
+	producer := &recordingProducer{}
+	tracker := newTestTracker(t, path, producer)
+
+	// Events that occur while offline aren't counted
+	observe(tracker, "message-offline", nil, helix.EventSubTypeChannelCheer, `{"user_id":"1","user_login":"alice","user_name":"Alice","bits":500}`)
+	assert.Empty(t, tracker.List())
+
+	session := "1001"
+	events := []struct {
+		subscriptionType string
+		data             string
+	}{
+		{helix.EventSubTypeStreamOnline, `{"id":"1001","type":"live","started_at":"2024-01-01T11:58:30Z"}`},
+		{helix.EventSubTypeChannelFollow, `{"user_id":"1","user_login":"alice","user_name":"Alice"}`},
+		{helix.EventSubTypeChannelFollow, `{"user_id":"2","user_login":"bob","user_name":"Bob"}`},
+		{helix.EventSubTypeChannelCheer, `{"user_id":"1","user_login":"alice","user_name":"Alice","bits":100}`},
+		{helix.EventSubTypeChannelCheer, `{"is_anonymous":true,"bits":250}`},
+		{helix.EventSubTypeChannelSubscription, `{"user_id":"2","user_login":"bob","user_name":"Bob","tier":"1000","is_gift":false}`},
+		{helix.EventSubTypeChannelSubscriptionGift, `{"user_id":"1","user_login":"alice","user_name":"Alice","total":2,"tier":"1000"}`},
+		{helix.EventSubTypeChannelSubscription, `{"user_id":"3","user_login":"carol","user_name":"Carol","tier":"1000","is_gift":true}`},
+		{helix.EventSubTypeChannelSubscription, `{"user_id":"4","user_login":"dave","user_name":"Dave","tier":"1000","is_gift":true}`},
+		{helix.EventSubTypeChannelSubscriptionGift, `{"user_id":"1","user_login":"alice","user_name":"Alice","total":3,"tier":"1000"}`},
+		{helix.EventSubTypeChannelSubscriptionGift, `{"is_anonymous":true,"total":5,"tier":"1000"}`},
+		{helix.EventSubTypeChannelRaid, `{"from_broadcaster_user_id":"5","from_broadcaster_user_login":"tsjonte","viewers":69}`},
+		{helix.EventSubTypeChannelUpdate, `{"title":"Not counted"}`},
+	}
+	for i, ev := range events {
+		observe(tracker, fmt.Sprintf("message-%d", i), &session, ev.subscriptionType, ev.data)
+	}
+
+	// An event that's observed again (e.g. because Twitch redelivered it) shouldn't be
+	// counted twice
+	observe(tracker, "message-3", &session, events[3].subscriptionType, events[3].data)
+
+	want := &Rollup{
+		SessionId:   "1001",
+		StartedAt:   time.Date(2024, 1, 1, 11, 58, 30, 0, time.UTC),
+		BitsCheered: 350,
+		NumCheers:   2,
+		NewSubs:     1,
+		GiftedSubs:  10,
+		GiftedSubsByGifter: map[string]*GiftTotal{
+			"1":             {UserLogin: "alice", UserName: "Alice", NumSubs: 5},
+			AnonymousGifter: {NumSubs: 5},
+		},
+		RaidsReceived: 1,
+		RaidViewers:   69,
+		NewFollows:    2,
+	}
+	assert.Equal(t, want, tracker.Get(session))
+	assert.Empty(t, producer.messages)
+
+	// Rollups should survive a restart, along with the events they've counted
+	restored := newTestTracker(t, path, producer)
+	assert.Equal(t, want, restored.Get(session))
+	observe(restored, "message-3", &session, events[3].subscriptionType, events[3].data)
+	assert.Equal(t, want, restored.Get(session))
+
+	// When the session ends, its final rollup should be produced as a summary, once
+	observe(restored, "message-offline-1", &session, helix.EventSubTypeStreamOffline, `{}`)
+	observe(restored, "message-offline-2", &session, helix.EventSubTypeStreamOffline, `{}`)
+	endedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	want.EndedAt = &endedAt
+	assert.Equal(t, want, restored.Get(session))
+	if assert.Len(t, producer.messages, 1) {
+		var summary Rollup
+		assert.NoError(t, json.Unmarshal(producer.messages[0], &summary))
+		assert.Equal(t, want, &summary)
+	}
+}
+
+func Test_Tracker_Observe_historySize(t *testing.T) {
+	tracker, err := NewTracker(filepath.Join(t.TempDir(), "rollups.json"), 2, &recordingProducer{})
+	assert.NoError(t, err)
+	for _, sessionId := range []string{"1001", "1002", "1003"} {
+		sessionId := sessionId
+		observe(tracker, "message-"+sessionId, &sessionId, helix.EventSubTypeStreamOnline, `{}`)
+	}
+	rollups := tracker.List()
+	assert.Len(t, rollups, 2)
+	assert.Equal(t, "1003", rollups[0].SessionId)
+	assert.Equal(t, "1002", rollups[1].SessionId)
+	assert.Nil(t, tracker.Get("1001"))
+}
+
+func Test_Tracker_Observe_summaryFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollups.json")
+	producer := &recordingProducer{err: errors.New("broker unavailable")}
+	tracker := newTestTracker(t, path, producer)
+	session := "1001"
+	observe(tracker, "message-1", &session, helix.EventSubTypeChannelFollow, `{}`)
+	observe(tracker, "message-2", &session, helix.EventSubTypeStreamOffline, `{}`)
+
+	// If the summary can't be produced, the session shouldn't be marked as ended, even
+	// after a restart, so that we can try again
+	rollup := tracker.Get(session)
+	assert.Nil(t, rollup.EndedAt)
+	assert.Equal(t, 1, rollup.NewFollows)
+	restored := newTestTracker(t, path, producer)
+	assert.Nil(t, restored.Get(session).EndedAt)
+
+	// Once the 'stream.offline' event is observed again (e.g. because Twitch
+	// redelivered it), the summary should be produced, and the session ended, once
+	producer.err = nil
+	observe(restored, "message-2", &session, helix.EventSubTypeStreamOffline, `{}`)
+	observe(restored, "message-2", &session, helix.EventSubTypeStreamOffline, `{}`)
+	assert.Len(t, producer.messages, 1)
+	rollup = restored.Get(session)
+	assert.NotNil(t, rollup.EndedAt)
+	assert.Equal(t, 1, rollup.NewFollows)
+	assert.NotNil(t, newTestTracker(t, path, producer).Get(session).EndedAt)
+}
+
+func Test_Tracker_handlers(t *testing.T) {
+	tracker := newTestTracker(t, filepath.Join(t.TempDir(), "rollups.json"), &recordingProducer{})
+	session := "1001"
+	observe(tracker, "message-1", &session, helix.EventSubTypeChannelCheer, `{"bits":100}`)
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		sessionId  string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			"list all rollups",
+			tracker.handleGetRollups,
+			"",
+			http.StatusOK,
+			`{"rollups":[{"session_id":"1001","started_at":"2024-01-01T12:00:00Z","bits_cheered":100,"num_cheers":1,"new_subs":0,"gifted_subs":0,"gifted_subs_by_gifter":{},"raids_received":0,"raid_viewers":0,"new_follows":0}]}`,
+		},
+		{
+			"get rollup for session",
+			tracker.handleGetRollup,
+			"1001",
+			http.StatusOK,
+			`{"session_id":"1001","started_at":"2024-01-01T12:00:00Z","bits_cheered":100,"num_cheers":1,"new_subs":0,"gifted_subs":0,"gifted_subs_by_gifter":{},"raids_received":0,"raid_viewers":0,"new_follows":0}`,
+		},
+		{
+			"get rollup for unknown session",
+			tracker.handleGetRollup,
+			"9999",
+			http.StatusNotFound,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rollups", nil)
+			req = mux.SetURLVars(req, map[string]string{"sessionId": tt.sessionId})
+			res := httptest.NewRecorder()
+			tt.handler(res, req)
+			assert.Equal(t, tt.wantStatus, res.Code)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, res.Body.String())
+			}
+		})
+	}
+}
+
+func newTestTracker(t *testing.T, path string, producer *recordingProducer) *Tracker {
+	tracker, err := NewTracker(path, DefaultHistorySize, producer)
+	assert.NoError(t, err)
+	tracker.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	return tracker
+}
+
+func observe(tracker *Tracker, messageId string, sessionId *string, subscriptionType string, data string) {
+	tracker.Observe(context.Background(), slog.Default(), messageId, &helix.EventSubSubscription{Type: subscriptionType}, json.RawMessage(data), sessionId)
+}
+
+type recordingProducer struct {
+	err      error
+	messages [][]byte
+}
+
+func (p *recordingProducer) Send(ctx context.Context, jsonData []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, jsonData)
+	return nil
+}
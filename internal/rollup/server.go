@@ -0,0 +1,49 @@
+package rollup
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golden-vcr/auth"
+	"github.com/gorilla/mux"
+)
+
+// Rollups is the response body for GET /rollups
+type Rollups struct {
+	Rollups []*Rollup `json:"rollups"`
+}
+
+func (t *Tracker) RegisterRoutes(c auth.Client, r *mux.Router) {
+	rollups := r.Path("/rollups").Subrouter()
+	rollups.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	rollups.Methods("GET").HandlerFunc(t.handleGetRollups)
+
+	rollup := r.Path("/rollups/{sessionId}").Subrouter()
+	rollup.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	rollup.Methods("GET").HandlerFunc(t.handleGetRollup)
+}
+
+// handleGetRollups (GET /rollups) returns the rollups for all recent stream sessions,
+// most recent first
+func (t *Tracker) handleGetRollups(res http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(res).Encode(&Rollups{Rollups: t.List()}); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleGetRollup (GET /rollups/{sessionId}) returns the rollup for a single stream
+// session
+func (t *Tracker) handleGetRollup(res http.ResponseWriter, req *http.Request) {
+	rollup := t.Get(mux.Vars(req)["sessionId"])
+	if rollup == nil {
+		http.Error(res, "No rollup found for the requested session", http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(res).Encode(rollup); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
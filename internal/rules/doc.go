@@ -0,0 +1,7 @@
+// Package rules implements a simple rules engine that's applied to each event in the
+// callback path before it's produced: rules are loaded from a JSON file, and each rule
+// matches events by subscription type and by the values of fields in the EventSub
+// event payload. A matching rule may drop the event, tag it, or reroute it to a
+// different exchange. The number of times each rule has matched is recorded, and the
+// broadcaster may inspect the loaded rules (along with those hit counts) via the API.
+package rules
@@ -0,0 +1,246 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+// Action indicates what should be done with an event that matches a rule
+type Action string
+
+const (
+	// ActionDrop causes the event to be discarded, without being produced
+	ActionDrop Action = "drop"
+
+	// ActionTag adds a tag to the event when it's produced; rule evaluation then
+	// continues, so an event may be tagged by multiple rules
+	ActionTag Action = "tag"
+
+	// ActionReroute causes the event to be produced to a different exchange instead of
+	// twitch-events
+	ActionReroute Action = "reroute"
+)
+
+// Config is the format of the file from which rules are loaded
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule matches events of a given subscription type (or of any type, if empty) for
+// which every condition in Match holds
+type Rule struct {
+	Name             string               `json:"name"`
+	SubscriptionType string               `json:"subscription_type,omitempty"`
+	Match            map[string]Condition `json:"match,omitempty"`
+	Action           Action               `json:"action"`
+	Tag              string               `json:"tag,omitempty"`
+	Exchange         string               `json:"exchange,omitempty"`
+}
+
+// Condition is checked against the value of a field in the EventSub event payload,
+// identified by its JSON key (with nested fields separated by '.'), e.g. 'user_login'
+// or 'message.text'. All comparisons that are specified must hold for the condition to
+// be met; and numeric comparisons are only met if the field is a number.
+type Condition struct {
+	Equals interface{}   `json:"equals,omitempty"`
+	In     []interface{} `json:"in,omitempty"`
+	Lt     *float64      `json:"lt,omitempty"`
+	Lte    *float64      `json:"lte,omitempty"`
+	Gt     *float64      `json:"gt,omitempty"`
+	Gte    *float64      `json:"gte,omitempty"`
+}
+
+// Decision is the result of applying rules to an event
+type Decision struct {
+	// Drop indicates that the event should not be produced
+	Drop bool
+	// Exchange, if non-empty, is the exchange to which the event should be produced
+	// instead of twitch-events
+	Exchange string
+	// Tags are to be included alongside the event when it's produced
+	Tags []string
+	// Matched lists the names of all rules that matched the event
+	Matched []string
+}
+
+// Engine applies a set of rules to events, in order, counting the number of times each
+// rule matches. Rule evaluation stops at the first matching rule that drops or
+// reroutes the event.
+type Engine struct {
+	rules []Rule
+	hits  []atomic.Int64
+}
+
+// Load reads rules from the JSON file at the given path
+func Load(path string) (*Engine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %w", err)
+	}
+	return NewEngine(config.Rules)
+}
+
+// NewEngine returns an Engine that applies the given rules, or an error if any rule is
+// invalid
+func NewEngine(rules []Rule) (*Engine, error) {
+	names := make(map[string]struct{})
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d (%q) is invalid: %w", i, rules[i].Name, err)
+		}
+		if _, ok := names[rules[i].Name]; ok {
+			return nil, fmt.Errorf("rule %d has duplicate name %q", i, rules[i].Name)
+		}
+		names[rules[i].Name] = struct{}{}
+	}
+	return &Engine{
+		rules: rules,
+		hits:  make([]atomic.Int64, len(rules)),
+	}, nil
+}
+
+// Exchanges returns the names of all exchanges to which events may be rerouted
+func (e *Engine) Exchanges() []string {
+	exchanges := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, rule := range e.rules {
+		if rule.Action != ActionReroute {
+			continue
+		}
+		if _, ok := seen[rule.Exchange]; ok {
+			continue
+		}
+		seen[rule.Exchange] = struct{}{}
+		exchanges = append(exchanges, rule.Exchange)
+	}
+	return exchanges
+}
+
+// Apply evaluates all rules against an event, recording a hit for each rule that
+// matches
+func (e *Engine) Apply(subscription *helix.EventSubSubscription, data json.RawMessage) (*Decision, error) {
+	decision := &Decision{}
+	if len(e.rules) == 0 {
+		return decision, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse event for rule evaluation: %w", err)
+	}
+
+	for i, rule := range e.rules {
+		if !rule.matches(subscription.Type, fields) {
+			continue
+		}
+		e.hits[i].Add(1)
+		decision.Matched = append(decision.Matched, rule.Name)
+		switch rule.Action {
+		case ActionDrop:
+			decision.Drop = true
+			return decision, nil
+		case ActionReroute:
+			decision.Exchange = rule.Exchange
+			return decision, nil
+		case ActionTag:
+			decision.Tags = append(decision.Tags, rule.Tag)
+		}
+	}
+	return decision, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	switch r.Action {
+	case ActionDrop:
+	case ActionTag:
+		if r.Tag == "" {
+			return errors.New("tag is required for 'tag' action")
+		}
+	case ActionReroute:
+		if r.Exchange == "" {
+			return errors.New("exchange is required for 'reroute' action")
+		}
+	default:
+		return fmt.Errorf("unsupported action %q", r.Action)
+	}
+	for field, cond := range r.Match {
+		if field == "" {
+			return errors.New("match field name must not be empty")
+		}
+		if cond.Equals == nil && cond.In == nil && cond.Lt == nil && cond.Lte == nil && cond.Gt == nil && cond.Gte == nil {
+			return fmt.Errorf("condition for field %q has no comparisons", field)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(subscriptionType string, fields map[string]interface{}) bool {
+	if r.SubscriptionType != "" && r.SubscriptionType != subscriptionType {
+		return false
+	}
+	for field, cond := range r.Match {
+		value, ok := lookup(fields, field)
+		if !ok || !cond.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Condition) matches(value interface{}) bool {
+	if c.Equals != nil && !reflect.DeepEqual(c.Equals, value) {
+		return false
+	}
+	if c.In != nil {
+		found := false
+		for _, candidate := range c.In {
+			if reflect.DeepEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.Lt != nil || c.Lte != nil || c.Gt != nil || c.Gte != nil {
+		n, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		if (c.Lt != nil && !(n < *c.Lt)) || (c.Lte != nil && !(n <= *c.Lte)) || (c.Gt != nil && !(n > *c.Gt)) || (c.Gte != nil && !(n >= *c.Gte)) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup resolves a dot-separated field path within a decoded JSON object
+func lookup(fields map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = obj[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
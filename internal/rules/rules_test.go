@@ -0,0 +1,203 @@
+package rules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `{
+  "rules": [
+    {
+      "name": "ignore-bot-follows",
+      "subscription_type": "channel.follow",
+      "match": { "user_login": { "in": ["nightbot", "streamelements"] } },
+      "action": "drop"
+    },
+    {
+      "name": "staff-test-events",
+      "match": { "user_id": { "equals": "1234" } },
+      "action": "tag",
+      "tag": "test"
+    },
+    {
+      "name": "small-cheers",
+      "subscription_type": "channel.cheer",
+      "match": { "bits": { "lt": 100 } },
+      "action": "reroute",
+      "exchange": "twitch-events-quiet"
+    },
+    {
+      "name": "excited-messages",
+      "match": { "message.text": { "equals": "!!!" } },
+      "action": "tag",
+      "tag": "excited"
+    }
+  ]
+}`
+
+func Test_Engine_Apply(t *testing.T) {
+	tests := []struct {
+		name             string
+		subscriptionType string
+		data             string
+		want             *Decision
+	}{
+		{
+			"follow from blocklisted bot is dropped",
+			"channel.follow",
+			`{"user_id":"1","user_login":"nightbot"}`,
+			&Decision{Drop: true, Matched: []string{"ignore-bot-follows"}},
+		},
+		{
+			"follow from anyone else is unaffected",
+			"channel.follow",
+			`{"user_id":"2","user_login":"bungus"}`,
+			&Decision{},
+		},
+		{
+			"subscription type must match",
+			"channel.subscribe",
+			`{"user_id":"1","user_login":"nightbot"}`,
+			&Decision{},
+		},
+		{
+			"events from staff are tagged",
+			"channel.follow",
+			`{"user_id":"1234","user_login":"staffmember"}`,
+			&Decision{Tags: []string{"test"}, Matched: []string{"staff-test-events"}},
+		},
+		{
+			"small cheer is rerouted, after tagging",
+			"channel.cheer",
+			`{"user_id":"1234","bits":99}`,
+			&Decision{Exchange: "twitch-events-quiet", Tags: []string{"test"}, Matched: []string{"staff-test-events", "small-cheers"}},
+		},
+		{
+			"large cheer is unaffected",
+			"channel.cheer",
+			`{"user_id":"5","bits":100}`,
+			&Decision{},
+		},
+		{
+			"numeric comparison does not match non-numeric value",
+			"channel.cheer",
+			`{"user_id":"5","bits":"50"}`,
+			&Decision{},
+		},
+		{
+			"nested fields can be matched",
+			"channel.chat.message",
+			`{"user_id":"5","message":{"text":"!!!"}}`,
+			&Decision{Tags: []string{"excited"}, Matched: []string{"excited-messages"}},
+		},
+		{
+			"missing fields do not match",
+			"channel.chat.message",
+			`{"user_id":"5","message":"!!!"}`,
+			&Decision{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := loadTestEngine(t)
+			got, err := e.Apply(&helix.EventSubSubscription{Type: tt.subscriptionType}, json.RawMessage(tt.data))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_NewEngine_invalid(t *testing.T) {
+	lt := 10.0
+	tests := []struct {
+		name    string
+		rules   []Rule
+		wantErr string
+	}{
+		{
+			"name is required",
+			[]Rule{{Action: ActionDrop}},
+			"name is required",
+		},
+		{
+			"names must be unique",
+			[]Rule{{Name: "a", Action: ActionDrop}, {Name: "a", Action: ActionDrop}},
+			"duplicate name",
+		},
+		{
+			"action must be supported",
+			[]Rule{{Name: "a", Action: "explode"}},
+			"unsupported action",
+		},
+		{
+			"tag requires tag",
+			[]Rule{{Name: "a", Action: ActionTag}},
+			"tag is required",
+		},
+		{
+			"reroute requires exchange",
+			[]Rule{{Name: "a", Action: ActionReroute, Match: map[string]Condition{"bits": {Lt: &lt}}}},
+			"exchange is required",
+		},
+		{
+			"conditions must compare something",
+			[]Rule{{Name: "a", Action: ActionDrop, Match: map[string]Condition{"bits": {}}}},
+			"has no comparisons",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEngine(tt.rules)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_Engine_Exchanges(t *testing.T) {
+	e := loadTestEngine(t)
+	assert.Equal(t, []string{"twitch-events-quiet"}, e.Exchanges())
+}
+
+func Test_Engine_handleGetRules(t *testing.T) {
+	e := loadTestEngine(t)
+	for _, login := range []string{"nightbot", "streamelements", "bungus"} {
+		_, err := e.Apply(&helix.EventSubSubscription{Type: "channel.follow"}, json.RawMessage(`{"user_login":"`+login+`"}`))
+		assert.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rules", nil)
+	res := httptest.NewRecorder()
+	e.handleGetRules(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var status Status
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	assert.Len(t, status.Rules, 4)
+	hits := make(map[string]int64)
+	for _, rule := range status.Rules {
+		hits[rule.Name] = rule.Hits
+	}
+	assert.Equal(t, map[string]int64{
+		"ignore-bot-follows": 2,
+		"staff-test-events":  0,
+		"small-cheers":       0,
+		"excited-messages":   0,
+	}, hits)
+	assert.Equal(t, ActionReroute, status.Rules[2].Action)
+	assert.Equal(t, 100.0, *status.Rules[2].Match["bits"].Lt)
+}
+
+func loadTestEngine(t *testing.T) *Engine {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	assert.NoError(t, os.WriteFile(path, []byte(testConfig), 0o644))
+	e, err := Load(path)
+	assert.NoError(t, err)
+	return e
+}
@@ -0,0 +1,49 @@
+package rules
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golden-vcr/auth"
+	"github.com/gorilla/mux"
+)
+
+// Status describes the rules that are currently loaded
+type Status struct {
+	Rules []RuleStatus `json:"rules"`
+}
+
+// RuleStatus describes a loaded rule, along with the number of events it has matched
+// since the server started
+type RuleStatus struct {
+	Rule
+	Hits int64 `json:"hits"`
+}
+
+// Status returns all loaded rules, in the order they're evaluated, with hit counts
+func (e *Engine) Status() *Status {
+	status := &Status{Rules: make([]RuleStatus, 0, len(e.rules))}
+	for i, rule := range e.rules {
+		status.Rules = append(status.Rules, RuleStatus{
+			Rule: rule,
+			Hits: e.hits[i].Load(),
+		})
+	}
+	return status
+}
+
+func (e *Engine) RegisterRoutes(c auth.Client, r *mux.Router) {
+	rules := r.Path("/rules").Subrouter()
+	rules.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	rules.Methods("GET").HandlerFunc(e.handleGetRules)
+}
+
+// handleGetRules (GET /rules) returns the rules that are applied to incoming events,
+// along with the number of times each rule has matched
+func (e *Engine) handleGetRules(res http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(res).Encode(e.Status()); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
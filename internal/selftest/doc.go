@@ -0,0 +1,15 @@
+// Package selftest verifies, end to end, that an EventSub notification delivered to
+// our public callback URL makes it onto the twitch-events exchange.
+//
+// A self-test signs a synthetic notification with our webhook secret, exactly as
+// Twitch would, and POSTs it to our own callback URL. The callback server recognizes
+// the notification as synthetic by its message ID, handles it synchronously, and
+// responds with a Trace describing how long each stage of handling it took
+// (verification, transformation, and publishing) and whether it succeeded. Because the
+// results are carried in the response, the test works even if the request is routed
+// to a different replica than the one that sent it.
+//
+// Synthetic events are produced with 'extensions.synthetic' set to true so that
+// consumers can ignore them. They bypass rules, session tracking, rollups, profile
+// enrichment, and follow-burst detection.
+package selftest
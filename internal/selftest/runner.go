@@ -0,0 +1,222 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golden-vcr/hooks"
+	"github.com/google/uuid"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// DefaultTimeout is the longest we'll wait for our callback URL to respond to a
+// synthetic notification
+const DefaultTimeout = 30 * time.Second
+
+// SubscriptionId is the subscription ID carried by synthetic notifications
+const SubscriptionId = "hooks-self-test"
+
+// CallbackResponse is the body with which the callback server responds to a synthetic
+// notification, describing each stage of handling it
+type CallbackResponse struct {
+	Stages []Stage `json:"stages"`
+}
+
+// Result describes the outcome of a self-test: it's Ok only if every stage succeeded
+type Result struct {
+	Ok        bool      `json:"ok"`
+	MessageId string    `json:"message_id"`
+	StartedAt time.Time `json:"started_at"`
+	Stages    []Stage   `json:"stages"`
+}
+
+// Runner performs self-tests by sending signed, synthetic notifications to our own
+// public callback URL
+type Runner struct {
+	callbackUrl   string
+	webhookSecret string
+	params        hooks.RequiredSubscriptionConditionParams
+	client        *http.Client
+	now           func() time.Time
+}
+
+// NewRunner returns a Runner that sends synthetic notifications for the given channel
+// to callbackUrl, signed with webhookSecret
+func NewRunner(callbackUrl, webhookSecret, channelUserId string) *Runner {
+	return &Runner{
+		callbackUrl:   callbackUrl,
+		webhookSecret: webhookSecret,
+		params: hooks.RequiredSubscriptionConditionParams{
+			ChannelUserId: channelUserId,
+		},
+		client: &http.Client{Timeout: DefaultTimeout},
+		now:    time.Now,
+	}
+}
+
+// Run performs a single self-test, reporting the outcome and duration of each stage
+func (r *Runner) Run(ctx context.Context) *Result {
+	result := &Result{
+		MessageId: MessageIdPrefix + uuid.NewString(),
+		StartedAt: r.now(),
+		Stages:    make([]Stage, 0),
+	}
+
+	trace := NewTrace()
+	trace.now = r.now
+	stages, err := r.deliver(ctx, trace, result.MessageId, result.StartedAt)
+	result.Stages = append(trace.Stages(), stages...)
+
+	// Every stage must have run and succeeded: if delivery failed, or the callback
+	// server stopped partway through, report the stages that weren't reached
+	result.Ok = err == nil
+	for _, name := range []string{StageVerification, StageTransformation, StagePublishing} {
+		found := false
+		for _, stage := range stages {
+			if stage.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result.Stages = append(result.Stages, Stage{Name: name, Error: "not reached"})
+		}
+	}
+	for _, stage := range result.Stages {
+		if !stage.Ok {
+			result.Ok = false
+		}
+	}
+	return result
+}
+
+// RunAtStartup waits for the given delay (to give our public callback URL a chance to
+// start routing requests to us), then performs a single self-test and logs the result
+func (r *Runner) RunAtStartup(ctx context.Context, logger *slog.Logger, delay time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	result := r.Run(ctx)
+	if result.Ok {
+		logger.Info("Self-test passed", "messageId", result.MessageId, "stages", result.Stages)
+	} else {
+		logger.Error("Self-test failed", "messageId", result.MessageId, "stages", result.Stages)
+	}
+}
+
+// deliver sends a synthetic notification to our callback URL, recording the delivery
+// stage in trace and returning the stages reported by the callback server
+func (r *Runner) deliver(ctx context.Context, trace *Trace, messageId string, timestamp time.Time) ([]Stage, error) {
+	body, err := r.buildNotification(timestamp)
+	if err != nil {
+		trace.Record(StageDelivery, 0, err)
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		trace.Record(StageDelivery, 0, err)
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("twitch-eventsub-message-type", "notification")
+	req.Header.Set("twitch-eventsub-message-id", messageId)
+	req.Header.Set("twitch-eventsub-message-timestamp", timestamp.UTC().Format(time.RFC3339Nano))
+	req.Header.Set("twitch-eventsub-message-signature", r.sign(req.Header, body))
+
+	delivered := trace.Begin(StageDelivery)
+	res, err := r.client.Do(req)
+	if err != nil {
+		delivered(err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		delivered(err)
+		return nil, err
+	}
+
+	// If the request reached a callback server that recognized it as synthetic, the
+	// response describes each stage, even if one of them failed: otherwise, we can't
+	// tell how far the notification got
+	var response CallbackResponse
+	if strings.Contains(res.Header.Get("content-type"), "application/json") {
+		if err := json.Unmarshal(resBody, &response); err == nil {
+			delivered(nil)
+			return response.Stages, nil
+		}
+	}
+	err = fmt.Errorf("got response %d from %s: %s", res.StatusCode, r.callbackUrl, strings.TrimSpace(string(resBody)))
+	delivered(err)
+	return nil, err
+}
+
+// buildNotification returns the JSON body of a synthetic notification: a follow from
+// a made-up viewer
+func (r *Runner) buildNotification(timestamp time.Time) ([]byte, error) {
+	var required *hooks.RequiredSubscription
+	for i := range hooks.Subscriptions {
+		if hooks.Subscriptions[i].Type == helix.EventSubTypeChannelFollow {
+			required = &hooks.Subscriptions[i]
+			break
+		}
+	}
+	if required == nil {
+		return nil, fmt.Errorf("no subscription of type %s is required by the service", helix.EventSubTypeChannelFollow)
+	}
+	condition, err := r.params.Format(&required.TemplatedCondition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format subscription condition from template: %w", err)
+	}
+
+	event, err := json.Marshal(helix.EventSubChannelFollowEvent{
+		UserID:            "0",
+		UserLogin:         "hooks_self_test",
+		UserName:          "HooksSelfTest",
+		BroadcasterUserID: r.params.ChannelUserId,
+		FollowedAt:        helix.Time{Time: timestamp},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Subscription helix.EventSubSubscription `json:"subscription"`
+		Event        json.RawMessage            `json:"event"`
+	}{
+		Subscription: helix.EventSubSubscription{
+			ID:        SubscriptionId,
+			Type:      required.Type,
+			Version:   required.Version,
+			Status:    helix.EventSubStatusEnabled,
+			Condition: *condition,
+			Transport: helix.EventSubTransport{
+				Method:   "webhook",
+				Callback: r.callbackUrl,
+			},
+			CreatedAt: helix.Time{Time: timestamp},
+		},
+		Event: event,
+	})
+}
+
+// sign computes the signature of a notification in the same way as Twitch, so that
+// helix.VerifyEventSubNotification will accept it
+func (r *Runner) sign(h http.Header, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(r.webhookSecret))
+	mac.Write([]byte(h.Get("twitch-eventsub-message-id") + h.Get("twitch-eventsub-message-timestamp")))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
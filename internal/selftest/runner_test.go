@@ -0,0 +1,121 @@
+package selftest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Runner_Run(t *testing.T) {
+	tests := []struct {
+		name       string
+		respond    func(res http.ResponseWriter, stages []Stage)
+		wantOk     bool
+		wantStages []Stage
+	}{
+		{
+			"all stages reported ok",
+			func(res http.ResponseWriter, stages []Stage) {
+				res.Header().Set("content-type", "application/json")
+				json.NewEncoder(res).Encode(CallbackResponse{Stages: stages})
+			},
+			true,
+			[]Stage{
+				{Name: StageDelivery, Ok: true},
+				{Name: StageVerification, Ok: true, DurationMs: 1},
+				{Name: StageTransformation, Ok: true, DurationMs: 2},
+				{Name: StagePublishing, Ok: true, DurationMs: 3},
+			},
+		},
+		{
+			"stages not reported by the callback server are failed",
+			func(res http.ResponseWriter, stages []Stage) {
+				res.Header().Set("content-type", "application/json")
+				res.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(res).Encode(CallbackResponse{Stages: stages[:1]})
+			},
+			false,
+			[]Stage{
+				{Name: StageDelivery, Ok: true},
+				{Name: StageVerification, Ok: true, DurationMs: 1},
+				{Name: StageTransformation, Ok: false, Error: "not reached"},
+				{Name: StagePublishing, Ok: false, Error: "not reached"},
+			},
+		},
+		{
+			"delivery fails if the callback server doesn't recognize the self-test",
+			func(res http.ResponseWriter, stages []Stage) {
+				res.WriteHeader(http.StatusOK)
+			},
+			false,
+			[]Stage{
+				{Name: StageDelivery, Ok: false, Error: "got response 200 from <url>: "},
+				{Name: StageVerification, Ok: false, Error: "not reached"},
+				{Name: StageTransformation, Ok: false, Error: "not reached"},
+				{Name: StagePublishing, Ok: false, Error: "not reached"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotMessageId string
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				body, err := io.ReadAll(req.Body)
+				assert.NoError(t, err)
+				assert.True(t, helix.VerifyEventSubNotification("webhook-secret", req.Header, string(body)))
+				gotMessageId = req.Header.Get("twitch-eventsub-message-id")
+
+				var payload struct {
+					Subscription helix.EventSubSubscription       `json:"subscription"`
+					Event        helix.EventSubChannelFollowEvent `json:"event"`
+				}
+				assert.NoError(t, json.Unmarshal(body, &payload))
+				assert.Equal(t, helix.EventSubTypeChannelFollow, payload.Subscription.Type)
+				assert.Equal(t, "90790024", payload.Subscription.Condition.BroadcasterUserID)
+				assert.Equal(t, "90790024", payload.Event.BroadcasterUserID)
+
+				tt.respond(res, []Stage{
+					{Name: StageVerification, Ok: true, DurationMs: 1},
+					{Name: StageTransformation, Ok: true, DurationMs: 2},
+					{Name: StagePublishing, Ok: true, DurationMs: 3},
+				})
+			}))
+			defer srv.Close()
+
+			r := NewRunner(srv.URL, "webhook-secret", "90790024")
+			result := r.Run(context.Background())
+			assert.Equal(t, tt.wantOk, result.Ok)
+			assert.True(t, IsSynthetic(result.MessageId))
+			assert.Equal(t, result.MessageId, gotMessageId)
+
+			// Delivery timing is nondeterministic, so disregard it
+			if assert.NotEmpty(t, result.Stages) {
+				result.Stages[0].DurationMs = 0
+				if result.Stages[0].Error != "" {
+					result.Stages[0].Error = "got response 200 from <url>: "
+				}
+			}
+			assert.Equal(t, tt.wantStages, result.Stages)
+		})
+	}
+}
+
+func Test_Runner_Run_unreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	r := NewRunner(srv.URL, "webhook-secret", "90790024")
+	result := r.Run(context.Background())
+	assert.False(t, result.Ok)
+	if assert.Len(t, result.Stages, 4) {
+		assert.Equal(t, StageDelivery, result.Stages[0].Name)
+		assert.False(t, result.Stages[0].Ok)
+		assert.NotEmpty(t, result.Stages[0].Error)
+	}
+}
@@ -0,0 +1,37 @@
+package selftest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golden-vcr/auth"
+	"github.com/golden-vcr/server-common/entry"
+	"github.com/gorilla/mux"
+)
+
+func (r *Runner) RegisterRoutes(c auth.Client, router *mux.Router) {
+	selftest := router.Path("/selftest").Subrouter()
+	selftest.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	selftest.Methods("POST").HandlerFunc(r.handlePostSelfTest)
+}
+
+// handlePostSelfTest (POST /selftest) sends a synthetic notification to our callback
+// URL and reports the outcome of each stage of handling it: the response is a 200 if
+// every stage succeeded, or a 500 otherwise
+func (r *Runner) handlePostSelfTest(res http.ResponseWriter, req *http.Request) {
+	logger := entry.Log(req)
+	result := r.Run(req.Context())
+	status := http.StatusOK
+	if result.Ok {
+		logger.Info("Self-test passed", "messageId", result.MessageId, "stages", result.Stages)
+	} else {
+		logger.Error("Self-test failed", "messageId", result.MessageId, "stages", result.Stages)
+		status = http.StatusInternalServerError
+	}
+
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(result)
+}
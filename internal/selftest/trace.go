@@ -0,0 +1,99 @@
+package selftest
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageIdPrefix identifies a synthetic notification sent by a self-test: since the
+// message ID is covered by the notification's signature, only a sender that knows our
+// webhook secret can mark a notification as synthetic
+const MessageIdPrefix = "hooks-self-test-"
+
+// IsSynthetic returns true if the message with the given ID was sent by a self-test
+func IsSynthetic(messageId string) bool {
+	return strings.HasPrefix(messageId, MessageIdPrefix)
+}
+
+const (
+	// StageDelivery covers the entire round trip of the synthetic notification, from
+	// sending it to our callback URL to receiving the response
+	StageDelivery = "delivery"
+
+	// StageVerification covers verifying the notification's signature
+	StageVerification = "verification"
+
+	// StageTransformation covers converting the EventSub notification into the
+	// message that we produce
+	StageTransformation = "transformation"
+
+	// StagePublishing covers publishing the message to twitch-events, up to the point
+	// at which the broker confirms it
+	StagePublishing = "publishing"
+)
+
+// Stage describes the outcome of a single stage of handling a synthetic notification
+type Stage struct {
+	Name       string  `json:"name"`
+	Ok         bool    `json:"ok"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Trace records the outcome of each stage of handling a synthetic notification. A nil
+// *Trace is valid, and records nothing.
+type Trace struct {
+	mu     sync.Mutex
+	stages []Stage
+	now    func() time.Time
+}
+
+// NewTrace returns an empty Trace
+func NewTrace() *Trace {
+	return &Trace{
+		stages: make([]Stage, 0),
+		now:    time.Now,
+	}
+}
+
+// Begin starts timing the given stage, returning a function that should be called
+// with the stage's result once it's finished
+func (t *Trace) Begin(name string) func(err error) {
+	if t == nil {
+		return func(err error) {}
+	}
+	startedAt := t.now()
+	return func(err error) {
+		t.Record(name, t.now().Sub(startedAt), err)
+	}
+}
+
+// Record adds the outcome of a stage that took the given duration
+func (t *Trace) Record(name string, d time.Duration, err error) {
+	if t == nil {
+		return
+	}
+	stage := Stage{
+		Name:       name,
+		Ok:         err == nil,
+		DurationMs: float64(d.Microseconds()) / 1000,
+	}
+	if err != nil {
+		stage.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stages = append(t.stages, stage)
+}
+
+// Stages returns the outcome of every stage recorded so far, in order
+func (t *Trace) Stages() []Stage {
+	if t == nil {
+		return []Stage{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Stage{}, t.stages...)
+}
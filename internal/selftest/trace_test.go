@@ -0,0 +1,38 @@
+package selftest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IsSynthetic(t *testing.T) {
+	assert.True(t, IsSynthetic("hooks-self-test-1234"))
+	assert.False(t, IsSynthetic("befa7b53-d79d-478f-86b9-120f112b044e"))
+	assert.False(t, IsSynthetic(""))
+}
+
+func Test_Trace(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	trace := NewTrace()
+	trace.now = func() time.Time { return now }
+
+	done := trace.Begin(StageVerification)
+	now = now.Add(1500 * time.Microsecond)
+	done(nil)
+	trace.Record(StagePublishing, 20*time.Millisecond, fmt.Errorf("mock error"))
+
+	assert.Equal(t, []Stage{
+		{Name: StageVerification, Ok: true, DurationMs: 1.5},
+		{Name: StagePublishing, Ok: false, DurationMs: 20, Error: "mock error"},
+	}, trace.Stages())
+}
+
+func Test_Trace_nil(t *testing.T) {
+	var trace *Trace
+	trace.Begin(StageVerification)(nil)
+	trace.Record(StagePublishing, time.Second, nil)
+	assert.Empty(t, trace.Stages())
+}
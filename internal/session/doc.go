@@ -0,0 +1,10 @@
+// Package session keeps track of the broadcaster's stream sessions, i.e. individual
+// broadcasts, each identified by the stream ID that Twitch reports in 'stream.online'.
+//
+// Since hooks sees 'stream.online' and 'stream.offline' before any downstream
+// consumer, it's the natural place to record which session is currently live: the
+// Tracker updates its state in response to those events, persists it to disk so that
+// it survives restarts (and can be shared by multiple replicas), and reports the
+// current session ID (if any) so that it can be attached to every event we produce.
+// Current and recent sessions are also exposed via the API.
+package session
@@ -0,0 +1,20 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (t *Tracker) RegisterRoutes(r *mux.Router) {
+	r.Path("/sessions").Methods("GET").HandlerFunc(t.handleGetSessions)
+}
+
+// handleGetSessions (GET /sessions) returns the stream session that's currently live
+// (if any), along with the sessions that have most recently ended
+func (t *Tracker) handleGetSessions(res http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(res).Encode(t.State()); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/statefile"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// DefaultHistorySize is the default number of ended sessions that we keep a record of
+const DefaultHistorySize = 20
+
+// Session describes a single broadcast
+type Session struct {
+	Id        string     `json:"id"`
+	Type      string     `json:"type"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+// State describes the session that's currently live (if any), along with the sessions
+// that have most recently ended, most recent first
+type State struct {
+	Current *Session  `json:"current"`
+	Recent  []Session `json:"recent"`
+}
+
+// Tracker maintains our session state in response to 'stream.online' and
+// 'stream.offline' events, persisting it to a JSON file at the given path. That file
+// may be shared by multiple replicas (each of which receives only some events): the
+// Tracker reloads it whenever it's been changed by another replica.
+type Tracker struct {
+	path        string
+	historySize int
+	now         func() time.Time
+
+	mu     sync.Mutex
+	state  State
+	loaded os.FileInfo // describes the file from which state was last loaded or saved
+}
+
+// NewTracker initializes a Tracker, loading the state that was previously persisted to
+// path, if any
+func NewTracker(path string, historySize int) (*Tracker, error) {
+	t := &Tracker{
+		path:        path,
+		historySize: historySize,
+		now:         time.Now,
+		state:       State{Recent: make([]Session, 0)},
+	}
+	if err := t.refreshLocked(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// refreshLocked reloads our state from disk, if the file has changed (e.g. because
+// another replica has updated it) since we last loaded or saved it
+func (t *Tracker) refreshLocked() error {
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read session state: %w", err)
+	}
+	if t.loaded != nil && info.ModTime().Equal(t.loaded.ModTime()) && info.Size() == t.loaded.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("failed to read session state: %w", err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse session state: %w", err)
+	}
+	if state.Recent == nil {
+		state.Recent = make([]Session, 0)
+	}
+	t.state = state
+	t.loaded = info
+	return nil
+}
+
+// State returns a copy of the current session state. If it can't be reloaded from
+// disk, we return our state as it was last loaded.
+func (t *Tracker) State() *State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshLocked()
+	state := &State{Recent: append(make([]Session, 0, len(t.state.Recent)), t.state.Recent...)}
+	if t.state.Current != nil {
+		current := *t.state.Current
+		state.Current = &current
+	}
+	return state
+}
+
+// Observe updates our session state in response to an event, returning the ID of the
+// session in which the event occurred, or nil if the stream is offline. A
+// 'stream.offline' event is considered to have occurred in the session that it ends.
+// If the updated state can't be persisted, we log an error but carry on with our state
+// in memory.
+func (t *Tracker) Observe(logger *slog.Logger, subscription *helix.EventSubSubscription, data json.RawMessage) *string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refreshLocked(); err != nil {
+		logger.Error("Failed to reload session state; using the state we last loaded", "error", err)
+	}
+
+	switch subscription.Type {
+	case helix.EventSubTypeStreamOnline:
+		var ev helix.EventSubStreamOnlineEvent
+		if err := json.Unmarshal(data, &ev); err != nil || ev.ID == "" {
+			logger.Error("Failed to parse stream.online event for session tracking", "error", err)
+			return t.currentIdLocked()
+		}
+		if t.state.Current != nil && t.state.Current.Id == ev.ID {
+			return t.currentIdLocked()
+		}
+		startedAt := ev.StartedAt.Time
+		if startedAt.IsZero() {
+			startedAt = t.now()
+		}
+		if t.state.Current != nil {
+			logger.Warn("Stream went online without going offline; ending previous session", "sessionId", t.state.Current.Id)
+			t.endCurrentLocked(startedAt)
+		}
+		t.state.Current = &Session{
+			Id:        ev.ID,
+			Type:      ev.Type,
+			StartedAt: startedAt,
+		}
+		logger.Info("Stream session started", "sessionId", ev.ID)
+		t.saveLocked(logger)
+		return t.currentIdLocked()
+	case helix.EventSubTypeStreamOffline:
+		sessionId := t.currentIdLocked()
+		if sessionId != nil {
+			t.endCurrentLocked(t.now())
+			logger.Info("Stream session ended", "sessionId", *sessionId)
+			t.saveLocked(logger)
+		}
+		return sessionId
+	}
+	return t.currentIdLocked()
+}
+
+func (t *Tracker) currentIdLocked() *string {
+	if t.state.Current == nil {
+		return nil
+	}
+	id := t.state.Current.Id
+	return &id
+}
+
+// endCurrentLocked records the end of the current session, moving it into our history
+func (t *Tracker) endCurrentLocked(endedAt time.Time) {
+	ended := *t.state.Current
+	ended.EndedAt = &endedAt
+	t.state.Current = nil
+	t.state.Recent = append([]Session{ended}, t.state.Recent...)
+	if len(t.state.Recent) > t.historySize {
+		t.state.Recent = t.state.Recent[:t.historySize]
+	}
+}
+
+// saveLocked persists our state, writing to a temporary file and then renaming it so
+// that we never leave a partially written state file on disk
+func (t *Tracker) saveLocked(logger *slog.Logger) {
+	if err := t.writeLocked(); err != nil {
+		logger.Error("Failed to persist session state", "error", err)
+	}
+}
+
+func (t *Tracker) writeLocked() error {
+	data, err := json.Marshal(t.state)
+	if err != nil {
+		return err
+	}
+	if err := statefile.Write(t.path, data); err != nil {
+		return err
+	}
+	if info, err := os.Stat(t.path); err == nil {
+		t.loaded = info
+	}
+	return nil
+}
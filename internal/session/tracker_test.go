@@ -0,0 +1,121 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Tracker_Observe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	tracker := newTestTracker(t, path, 2)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	// While offline, events have no session
+	assert.Nil(t, observe(tracker, helix.EventSubTypeChannelFollow, `{}`))
+
+	// stream.online starts a new session, which applies to all subsequent events
+	assert.Equal(t, ptr("1001"), observe(tracker, helix.EventSubTypeStreamOnline, `{"id":"1001","type":"live","started_at":"2024-01-01T12:00:00Z"}`))
+	assert.Equal(t, ptr("1001"), observe(tracker, helix.EventSubTypeChannelFollow, `{}`))
+
+	// Redelivery of the same stream.online event has no effect
+	assert.Equal(t, ptr("1001"), observe(tracker, helix.EventSubTypeStreamOnline, `{"id":"1001","type":"live","started_at":"2024-01-01T12:00:00Z"}`))
+
+	// stream.offline belongs to the session it ends
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, ptr("1001"), observe(tracker, helix.EventSubTypeStreamOffline, `{}`))
+	assert.Nil(t, observe(tracker, helix.EventSubTypeChannelFollow, `{}`))
+	assert.Nil(t, observe(tracker, helix.EventSubTypeStreamOffline, `{}`))
+
+	// If we miss a stream.offline, the next stream.online ends the previous session
+	assert.Equal(t, ptr("1002"), observe(tracker, helix.EventSubTypeStreamOnline, `{"id":"1002","type":"live","started_at":"2024-01-02T12:00:00Z"}`))
+	assert.Equal(t, ptr("1003"), observe(tracker, helix.EventSubTypeStreamOnline, `{"id":"1003","type":"live","started_at":"2024-01-03T12:00:00Z"}`))
+
+	// Only the most recent sessions should be kept in our history
+	endedAt1 := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)
+	endedAt2 := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+	want := &State{
+		Current: &Session{Id: "1003", Type: "live", StartedAt: time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)},
+		Recent: []Session{
+			{Id: "1002", Type: "live", StartedAt: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), EndedAt: &endedAt2},
+			{Id: "1001", Type: "live", StartedAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), EndedAt: &endedAt1},
+		},
+	}
+	assert.Equal(t, want, tracker.State())
+
+	// Our state should be restored from disk after a restart
+	restored := newTestTracker(t, path, 2)
+	assertStateEqual(t, want, restored.State())
+	assert.Equal(t, ptr("1003"), observe(restored, helix.EventSubTypeChannelFollow, `{}`))
+}
+
+func Test_Tracker_Observe_sharedState(t *testing.T) {
+	// Each replica only receives some events, so trackers that share a state file
+	// should each see the sessions that the others have started and ended
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	a := newTestTracker(t, path, 2)
+	b := newTestTracker(t, path, 2)
+
+	assert.Equal(t, ptr("1001"), observe(a, helix.EventSubTypeStreamOnline, `{"id":"1001","type":"live","started_at":"2024-01-01T12:00:00Z"}`))
+	assert.Equal(t, ptr("1001"), observe(b, helix.EventSubTypeChannelFollow, `{}`))
+	assert.Equal(t, ptr("1001"), observe(b, helix.EventSubTypeStreamOffline, `{}`))
+	assert.Nil(t, observe(a, helix.EventSubTypeChannelFollow, `{}`))
+	if recent := a.State().Recent; assert.Len(t, recent, 1) {
+		assert.Equal(t, "1001", recent[0].Id)
+		assert.NotNil(t, recent[0].EndedAt)
+	}
+}
+
+func Test_NewTracker_invalidState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	assert.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err := NewTracker(path, DefaultHistorySize)
+	assert.ErrorContains(t, err, "failed to parse session state")
+}
+
+func Test_Tracker_handleGetSessions(t *testing.T) {
+	tracker := newTestTracker(t, filepath.Join(t.TempDir(), "sessions.json"), DefaultHistorySize)
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	res := httptest.NewRecorder()
+	tracker.handleGetSessions(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "{\"current\":null,\"recent\":[]}\n", res.Body.String())
+
+	observe(tracker, helix.EventSubTypeStreamOnline, `{"id":"1001","type":"live","started_at":"2024-01-01T12:00:00Z"}`)
+	res = httptest.NewRecorder()
+	tracker.handleGetSessions(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "{\"current\":{\"id\":\"1001\",\"type\":\"live\",\"started_at\":\"2024-01-01T12:00:00Z\"},\"recent\":[]}\n", res.Body.String())
+}
+
+func newTestTracker(t *testing.T, path string, historySize int) *Tracker {
+	tracker, err := NewTracker(path, historySize)
+	assert.NoError(t, err)
+	return tracker
+}
+
+func observe(tracker *Tracker, subscriptionType string, data string) *string {
+	return tracker.Observe(slog.Default(), &helix.EventSubSubscription{Type: subscriptionType}, json.RawMessage(data))
+}
+
+func assertStateEqual(t *testing.T, want *State, got *State) {
+	wantJson, err := json.Marshal(want)
+	assert.NoError(t, err)
+	gotJson, err := json.Marshal(got)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(wantJson), string(gotJson))
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,8 @@
+// Package statefile persists the small JSON state files that hooks keeps on disk, such
+// as session, follow-burst, and rollup state.
+//
+// Files are replaced atomically: data is written to a uniquely-named temporary file in
+// the same directory, which is then renamed over the target. A reader never sees a
+// partially written file, and several writers (e.g. replicas sharing a volume) never
+// clobber each other's temporary files.
+package statefile
@@ -0,0 +1,27 @@
+package statefile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write atomically replaces the contents of the file at path with data, creating its
+// parent directory if necessary. The file is only readable by the current user.
+func Write(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
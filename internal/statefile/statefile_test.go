@@ -0,0 +1,51 @@
+package statefile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Write(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []byte
+		data     []byte
+	}{
+		{
+			"file is created along with its parent directory",
+			nil,
+			[]byte(`{"foo":1}`),
+		},
+		{
+			"existing file is replaced",
+			[]byte(`{"foo":1,"bar":2}`),
+			[]byte(`{"foo":3}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state", "state.json")
+			if tt.existing != nil {
+				assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+				assert.NoError(t, os.WriteFile(path, tt.existing, 0o600))
+			}
+
+			assert.NoError(t, Write(path, tt.data))
+			data, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.data, data)
+
+			info, err := os.Stat(path)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+			// No temporary files should be left behind
+			entries, err := os.ReadDir(filepath.Dir(path))
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package subscription
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// TwitchApiBaseUrl is the base URL of the Twitch Helix API
+const TwitchApiBaseUrl = "https://api.twitch.tv/helix"
+
+// ConduitShardStatusEnabled is the status of a conduit shard that's able to receive
+// notifications
+const ConduitShardStatusEnabled = "enabled"
+
+type NewConduitClientFunc func(ctx context.Context) (ConduitClient, error)
+
+// ConduitClient represents the subset of Twitch API functionality used to manage an
+// EventSub conduit: i.e. a single transport for EventSub subscriptions which
+// distributes notifications across a set of shards, with each shard having its own
+// webhook callback URL. (helix does not yet support conduits, so this functionality
+// is implemented separately from TwitchClient.)
+type ConduitClient interface {
+	GetConduits(ctx context.Context) ([]Conduit, error)
+	CreateConduit(ctx context.Context, shardCount int) (*Conduit, error)
+	UpdateConduit(ctx context.Context, conduitId string, shardCount int) (*Conduit, error)
+	GetConduitShards(ctx context.Context, conduitId string) ([]ConduitShard, error)
+	UpdateConduitShards(ctx context.Context, conduitId string, shards []ConduitShard) error
+	CreateConduitSubscription(ctx context.Context, subscriptionType string, version string, condition map[string]string, conduitId string) error
+	GetConduitSubscriptions(ctx context.Context, conduitId string) ([]ConduitSubscription, error)
+}
+
+// Conduit describes an EventSub conduit registered to our app
+type Conduit struct {
+	Id         string `json:"id"`
+	ShardCount int    `json:"shard_count"`
+}
+
+// ConduitSubscription describes an EventSub subscription that delivers notifications
+// via a conduit
+type ConduitSubscription struct {
+	Id        string            `json:"id"`
+	Type      string            `json:"type"`
+	Version   string            `json:"version"`
+	Condition map[string]string `json:"condition"`
+}
+
+// ConduitShard describes a single shard of an EventSub conduit, i.e. the transport
+// that will receive some subset of the conduit's notifications
+type ConduitShard struct {
+	Id        string                `json:"id"`
+	Status    string                `json:"status,omitempty"`
+	Transport ConduitShardTransport `json:"transport"`
+}
+
+// ConduitShardTransport describes the webhook to which a conduit shard's notifications
+// are delivered
+type ConduitShardTransport struct {
+	Method   string `json:"method"`
+	Callback string `json:"callback,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+// twitchConduitClient implements ConduitClient by making requests directly against
+// the Twitch API: httpClient is responsible for authenticating each request with an
+// app access token
+type twitchConduitClient struct {
+	httpClient helix.HTTPClient
+	baseUrl    string
+}
+
+func (c *twitchConduitClient) GetConduits(ctx context.Context) ([]Conduit, error) {
+	var result struct {
+		Data []Conduit `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/eventsub/conduits", nil, nil, http.StatusOK, &result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+func (c *twitchConduitClient) CreateConduit(ctx context.Context, shardCount int) (*Conduit, error) {
+	payload := map[string]int{"shard_count": shardCount}
+	var result struct {
+		Data []Conduit `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/eventsub/conduits", nil, payload, http.StatusOK, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != 1 {
+		return nil, fmt.Errorf("expected 1 conduit in response; got %d", len(result.Data))
+	}
+	return &result.Data[0], nil
+}
+
+func (c *twitchConduitClient) UpdateConduit(ctx context.Context, conduitId string, shardCount int) (*Conduit, error) {
+	payload := Conduit{Id: conduitId, ShardCount: shardCount}
+	var result struct {
+		Data []Conduit `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodPatch, "/eventsub/conduits", nil, payload, http.StatusOK, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != 1 {
+		return nil, fmt.Errorf("expected 1 conduit in response; got %d", len(result.Data))
+	}
+	return &result.Data[0], nil
+}
+
+func (c *twitchConduitClient) GetConduitShards(ctx context.Context, conduitId string) ([]ConduitShard, error) {
+	shards := make([]ConduitShard, 0)
+	query := url.Values{"conduit_id": {conduitId}}
+	for {
+		var result struct {
+			Data       []ConduitShard `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/eventsub/conduits/shards", query, nil, http.StatusOK, &result); err != nil {
+			return nil, err
+		}
+		shards = append(shards, result.Data...)
+		if result.Pagination.Cursor == "" {
+			break
+		}
+		query.Set("after", result.Pagination.Cursor)
+	}
+	return shards, nil
+}
+
+func (c *twitchConduitClient) UpdateConduitShards(ctx context.Context, conduitId string, shards []ConduitShard) error {
+	payload := struct {
+		ConduitId string         `json:"conduit_id"`
+		Shards    []ConduitShard `json:"shards"`
+	}{conduitId, shards}
+	var result struct {
+		Errors []struct {
+			Id      string `json:"id"`
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		} `json:"errors"`
+	}
+	if err := c.do(ctx, http.MethodPatch, "/eventsub/conduits/shards", nil, payload, http.StatusAccepted, &result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("failed to update shard %s: %s", result.Errors[0].Id, result.Errors[0].Message)
+	}
+	return nil
+}
+
+func (c *twitchConduitClient) CreateConduitSubscription(ctx context.Context, subscriptionType string, version string, condition map[string]string, conduitId string) error {
+	payload := map[string]interface{}{
+		"type":      subscriptionType,
+		"version":   version,
+		"condition": condition,
+		"transport": map[string]string{
+			"method":     "conduit",
+			"conduit_id": conduitId,
+		},
+	}
+	return c.do(ctx, http.MethodPost, "/eventsub/subscriptions", nil, payload, http.StatusAccepted, nil)
+}
+
+func (c *twitchConduitClient) GetConduitSubscriptions(ctx context.Context, conduitId string) ([]ConduitSubscription, error) {
+	// Twitch doesn't support filtering subscriptions by conduit, so we have to list all
+	// of our app's subscriptions and check the conduit ID of each one's transport
+	subscriptions := make([]ConduitSubscription, 0)
+	query := url.Values{}
+	for {
+		var result struct {
+			Data []struct {
+				ConduitSubscription
+				Transport struct {
+					Method    string `json:"method"`
+					ConduitId string `json:"conduit_id"`
+				} `json:"transport"`
+			} `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/eventsub/subscriptions", query, nil, http.StatusOK, &result); err != nil {
+			return nil, err
+		}
+		for _, subscription := range result.Data {
+			if subscription.Transport.Method == "conduit" && subscription.Transport.ConduitId == conduitId {
+				subscriptions = append(subscriptions, subscription.ConduitSubscription)
+			}
+		}
+		if result.Pagination.Cursor == "" {
+			break
+		}
+		query.Set("after", result.Pagination.Cursor)
+	}
+	return subscriptions, nil
+}
+
+// do makes an authenticated request to the Twitch API, JSON-encoding payload (if
+// non-nil) as the request body and decoding the response body into result (if
+// non-nil)
+func (c *twitchConduitClient) do(ctx context.Context, method string, path string, query url.Values, payload interface{}, wantStatus int, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := c.baseUrl + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != wantStatus {
+		message, _ := io.ReadAll(res.Body)
+		return &apiError{
+			method:     method,
+			path:       path,
+			statusCode: res.StatusCode,
+			header:     res.Header,
+			message:    string(bytes.TrimSpace(message)),
+		}
+	}
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return fmt.Errorf("failed to decode response from %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// apiError is returned by twitchConduitClient when the Twitch API responds with an
+// unexpected status, so that the request can be retried if appropriate
+type apiError struct {
+	method     string
+	path       string
+	statusCode int
+	header     http.Header
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("got response %d from %s %s: %s", e.statusCode, e.method, e.path, e.message)
+}
+
+// usesConduit returns true if the server is configured to register subscriptions
+// against a conduit rather than directly against our webhook callback URL
+func (s *Server) usesConduit() bool {
+	return len(s.conduitShardCallbackUrls) > 0
+}
+
+// findConduit returns the conduit that's used to deliver our EventSub notifications,
+// or nil if no conduit has been created yet. If a conduit ID is configured, only that
+// conduit is ours, and it must exist; otherwise we assume that our app manages a
+// single conduit, and we refuse to guess if Twitch reports more than one.
+func (s *Server) findConduit(ctx context.Context, cc ConduitClient) (*Conduit, error) {
+	conduits, err := cc.GetConduits(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conduits: %w", err)
+	}
+	if s.conduitId != "" {
+		for i := range conduits {
+			if conduits[i].Id == s.conduitId {
+				return &conduits[i], nil
+			}
+		}
+		return nil, fmt.Errorf("conduit %s does not exist", s.conduitId)
+	}
+	if len(conduits) == 0 {
+		return nil, nil
+	}
+	if len(conduits) > 1 {
+		return nil, fmt.Errorf("found %d conduits; a conduit ID must be configured to identify ours", len(conduits))
+	}
+	return &conduits[0], nil
+}
+
+// fetchConduitStatus resolves the current state of our conduit and its shards,
+// reporting any shard that is not enabled and pointed at its expected callback URL
+func (s *Server) fetchConduitStatus(ctx context.Context, cc ConduitClient) (*ConduitStatus, error) {
+	conduit, err := s.findConduit(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ConduitStatus{
+		Ok:     true,
+		Shards: make([]ShardState, 0, len(s.conduitShardCallbackUrls)),
+	}
+	shardsById := make(map[string]ConduitShard)
+	if conduit != nil {
+		status.Id = conduit.Id
+		shards, err := cc.GetConduitShards(ctx, conduit.Id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get conduit shards: %w", err)
+		}
+		for _, shard := range shards {
+			shardsById[shard.Id] = shard
+		}
+	}
+
+	for i, callbackUrl := range s.conduitShardCallbackUrls {
+		shardId := fmt.Sprintf("%d", i)
+		state := ShardState{
+			Id:       shardId,
+			Callback: callbackUrl,
+			Status:   "missing",
+		}
+		if shard, ok := shardsById[shardId]; ok {
+			state.Status = shard.Status
+			if shard.Transport.Callback != callbackUrl {
+				state.Status = "misconfigured"
+			}
+		}
+		if state.Status != ConduitShardStatusEnabled {
+			status.Ok = false
+		}
+		status.Shards = append(status.Shards, state)
+	}
+	if conduit != nil && conduit.ShardCount != len(s.conduitShardCallbackUrls) {
+		status.Ok = false
+	}
+	return status, nil
+}
+
+// ensureConduit creates our conduit if it doesn't exist, resizes it if it has the
+// wrong number of shards, and (re)assigns any shard that isn't enabled with the
+// expected callback URL, returning the ID of the conduit
+func (s *Server) ensureConduit(ctx context.Context, logger *slog.Logger, cc ConduitClient) (string, error) {
+	shardCount := len(s.conduitShardCallbackUrls)
+	conduit, err := s.findConduit(ctx, cc)
+	if err != nil {
+		return "", err
+	}
+	if conduit == nil {
+		conduit, err = cc.CreateConduit(ctx, shardCount)
+		if err != nil {
+			return "", fmt.Errorf("failed to create conduit: %w", err)
+		}
+		logger.Info("Created EventSub conduit", "conduitId", conduit.Id, "shardCount", shardCount)
+	} else if conduit.ShardCount != shardCount {
+		conduit, err = cc.UpdateConduit(ctx, conduit.Id, shardCount)
+		if err != nil {
+			return "", fmt.Errorf("failed to update conduit: %w", err)
+		}
+		logger.Info("Resized EventSub conduit", "conduitId", conduit.Id, "shardCount", shardCount)
+	}
+
+	status, err := s.fetchConduitStatus(ctx, cc)
+	if err != nil {
+		return "", err
+	}
+	updates := make([]ConduitShard, 0)
+	for _, shard := range status.Shards {
+		if shard.Status == ConduitShardStatusEnabled {
+			continue
+		}
+		updates = append(updates, ConduitShard{
+			Id: shard.Id,
+			Transport: ConduitShardTransport{
+				Method:   "webhook",
+				Callback: shard.Callback,
+				Secret:   s.twitchWebhookSecret,
+			},
+		})
+	}
+	if len(updates) > 0 {
+		if err := cc.UpdateConduitShards(ctx, conduit.Id, updates); err != nil {
+			return "", fmt.Errorf("failed to update conduit shards: %w", err)
+		}
+		for _, update := range updates {
+			logger.Info("Assigned EventSub conduit shard",
+				"conduitId", conduit.Id,
+				"shardId", update.Id,
+				"shardCallback", update.Transport.Callback,
+			)
+		}
+	}
+	return conduit.Id, nil
+}
+
+// waitForShardEnabled polls the status of a newly-assigned conduit shard until it's
+// enabled, failing if it ends up in any other state or if it doesn't become enabled in
+// time
+func (s *Server) waitForShardEnabled(ctx context.Context, cc ConduitClient, shardId string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.verificationTimeout)
+	defer cancel()
+	for {
+		status, err := s.fetchConduitStatus(ctx, cc)
+		if err != nil {
+			return fmt.Errorf("failed to resolve EventSub conduit status: %w", err)
+		}
+		for _, shard := range status.Shards {
+			if shard.Id != shardId {
+				continue
+			}
+			switch shard.Status {
+			case ConduitShardStatusEnabled:
+				return nil
+			case "webhook_callback_verification_pending":
+			default:
+				return fmt.Errorf("shard has status '%s'", shard.Status)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for shard to be enabled")
+		case <-time.After(s.verificationPollInterval):
+		}
+	}
+}
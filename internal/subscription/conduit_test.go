@@ -0,0 +1,395 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golden-vcr/hooks"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Server_conduit(t *testing.T) {
+	tests := []struct {
+		name            string
+		conduits        []Conduit
+		shards          []ConduitShard
+		wantConduitOk   bool
+		wantShardStates []ShardState
+	}{
+		{
+			"no conduit",
+			nil,
+			nil,
+			false,
+			[]ShardState{
+				{Id: "0", Callback: "https://replica-a.com/callback", Status: "missing"},
+				{Id: "1", Callback: "https://replica-b.com/callback", Status: "missing"},
+			},
+		},
+		{
+			"conduit with healthy shards",
+			[]Conduit{{Id: "my-conduit", ShardCount: 2}},
+			[]ConduitShard{
+				{Id: "0", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-a.com/callback"}},
+				{Id: "1", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-b.com/callback"}},
+			},
+			true,
+			[]ShardState{
+				{Id: "0", Callback: "https://replica-a.com/callback", Status: "enabled"},
+				{Id: "1", Callback: "https://replica-b.com/callback", Status: "enabled"},
+			},
+		},
+		{
+			"conduit with unhealthy and misconfigured shards",
+			[]Conduit{{Id: "my-conduit", ShardCount: 2}},
+			[]ConduitShard{
+				{Id: "0", Status: "webhook_callback_verification_failed", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-a.com/callback"}},
+				{Id: "1", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://old-replica.com/callback"}},
+			},
+			false,
+			[]ShardState{
+				{Id: "0", Callback: "https://replica-a.com/callback", Status: "webhook_callback_verification_failed"},
+				{Id: "1", Callback: "https://replica-b.com/callback", Status: "misconfigured"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &mockTwitchClient{}
+			cc := &mockConduitClient{twitch: c, conduits: tt.conduits, shards: tt.shards}
+			s := newTestConduitServer(c, cc)
+
+			status, err := s.fetchSubscriptionStatus(context.Background(), c)
+			assert.NoError(t, err)
+			assert.NotNil(t, status.Conduit)
+			assert.Equal(t, tt.wantConduitOk, status.Conduit.Ok)
+			assert.Equal(t, tt.wantShardStates, status.Conduit.Shards)
+			if !tt.wantConduitOk {
+				assert.False(t, status.Ok)
+			}
+		})
+	}
+}
+
+func Test_Server_handlePatchSubscriptions_conduit(t *testing.T) {
+	c := &mockTwitchClient{
+		subscriptions: []helix.EventSubSubscription{
+			{
+				ID:      "10000001",
+				Type:    helix.EventSubTypeStreamOnline,
+				Version: "1",
+				Condition: helix.EventSubCondition{
+					BroadcasterUserID: "1337",
+				},
+				Transport: helix.EventSubTransport{
+					Method:   "webhook",
+					Callback: "https://my-cool-service.com/callback",
+				},
+				Status: "enabled",
+			},
+		},
+	}
+	cc := &mockConduitClient{
+		twitch: c,
+		shards: []ConduitShard{
+			{Id: "0", Status: "webhook_callback_verification_failed", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-a.com/callback"}},
+		},
+	}
+	s := newTestConduitServer(c, cc)
+
+	req := httptest.NewRequest(http.MethodPatch, "/subscriptions", nil)
+	res := httptest.NewRecorder()
+	s.handlePatchSubscriptions(res, req)
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	// A conduit should have been created, with a shard for each replica
+	assert.Len(t, cc.conduits, 1)
+	assert.Equal(t, 2, cc.conduits[0].ShardCount)
+	assert.Equal(t, []ConduitShard{
+		{Id: "0", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-a.com/callback"}},
+		{Id: "1", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-b.com/callback"}},
+	}, cc.shards)
+
+	// Our required subscription should have been registered against the conduit; the
+	// existing webhook subscription is not ours and should be left alone
+	assert.Len(t, c.subscriptions, 2)
+	assert.Equal(t, "webhook", c.subscriptions[0].Transport.Method)
+	assert.Equal(t, "conduit", c.subscriptions[1].Transport.Method)
+	assert.Equal(t, helix.EventSubTypeStreamOnline, c.subscriptions[1].Type)
+
+	status, err := s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.True(t, status.Ok)
+}
+
+func Test_Server_findConduit(t *testing.T) {
+	tests := []struct {
+		name        string
+		conduitId   string
+		conduits    []Conduit
+		wantConduit *Conduit
+		wantErr     string
+	}{
+		{
+			"no conduit",
+			"",
+			nil,
+			nil,
+			"",
+		},
+		{
+			"single conduit is ours",
+			"",
+			[]Conduit{{Id: "my-conduit", ShardCount: 2}},
+			&Conduit{Id: "my-conduit", ShardCount: 2},
+			"",
+		},
+		{
+			"multiple conduits without a configured ID is an error",
+			"",
+			[]Conduit{{Id: "other-conduit", ShardCount: 1}, {Id: "my-conduit", ShardCount: 2}},
+			nil,
+			"found 2 conduits",
+		},
+		{
+			"configured ID selects our conduit",
+			"my-conduit",
+			[]Conduit{{Id: "other-conduit", ShardCount: 1}, {Id: "my-conduit", ShardCount: 2}},
+			&Conduit{Id: "my-conduit", ShardCount: 2},
+			"",
+		},
+		{
+			"configured ID must exist",
+			"my-conduit",
+			[]Conduit{{Id: "other-conduit", ShardCount: 1}},
+			nil,
+			"conduit my-conduit does not exist",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &mockConduitClient{conduits: tt.conduits}
+			s := &Server{conduitId: tt.conduitId}
+			conduit, err := s.findConduit(context.Background(), cc)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantConduit, conduit)
+		})
+	}
+}
+
+func Test_Server_fetchSubscriptionStatus_otherConduit(t *testing.T) {
+	c := &mockTwitchClient{}
+	cc := &mockConduitClient{
+		twitch:   c,
+		conduits: []Conduit{{Id: "other-conduit", ShardCount: 1}, {Id: "my-conduit", ShardCount: 2}},
+	}
+	s := newTestConduitServer(c, cc)
+	s.conduitId = "my-conduit"
+
+	// A matching subscription registered against another conduit doesn't deliver
+	// notifications to us, so it can't satisfy our requirement
+	assert.NoError(t, cc.CreateConduitSubscription(context.Background(), helix.EventSubTypeStreamOnline, "1", map[string]string{"broadcaster_user_id": "1337"}, "other-conduit"))
+	status, err := s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.Len(t, status.Subscriptions, 1)
+	assert.Equal(t, "missing", status.Subscriptions[0].Status)
+
+	assert.NoError(t, cc.CreateConduitSubscription(context.Background(), helix.EventSubTypeStreamOnline, "1", map[string]string{"broadcaster_user_id": "1337"}, "my-conduit"))
+	status, err = s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.Len(t, status.Subscriptions, 1)
+	assert.Equal(t, "enabled", status.Subscriptions[0].Status)
+}
+
+func Test_twitchConduitClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eventsub/conduits/shards", func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			assert.Equal(t, "my-conduit", req.URL.Query().Get("conduit_id"))
+			if req.URL.Query().Get("after") == "" {
+				res.Write([]byte(`{"data":[{"id":"0","status":"enabled","transport":{"method":"webhook","callback":"https://a.com/callback"}}],"pagination":{"cursor":"next"}}`))
+			} else {
+				res.Write([]byte(`{"data":[{"id":"1","status":"enabled","transport":{"method":"webhook","callback":"https://b.com/callback"}}],"pagination":{}}`))
+			}
+		case http.MethodPatch:
+			var payload struct {
+				ConduitId string         `json:"conduit_id"`
+				Shards    []ConduitShard `json:"shards"`
+			}
+			assert.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+			assert.Equal(t, "my-conduit", payload.ConduitId)
+			res.WriteHeader(http.StatusAccepted)
+			res.Write([]byte(`{"data":[],"errors":[{"id":"1","message":"The callback URL is invalid","code":"invalid_parameter"}]}`))
+		}
+	})
+	mux.HandleFunc("/eventsub/subscriptions", func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("after") == "" {
+			res.Write([]byte(`{"data":[{"id":"a","type":"stream.online","version":"1","condition":{"broadcaster_user_id":"1337"},"transport":{"method":"conduit","conduit_id":"my-conduit"}},{"id":"b","type":"stream.online","version":"1","condition":{"broadcaster_user_id":"1337"},"transport":{"method":"conduit","conduit_id":"other-conduit"}}],"pagination":{"cursor":"next"}}`))
+		} else {
+			res.Write([]byte(`{"data":[{"id":"c","type":"stream.online","version":"1","condition":{"broadcaster_user_id":"1337"},"transport":{"method":"webhook","callback":"https://a.com/callback"}},{"id":"d","type":"stream.offline","version":"1","condition":{"broadcaster_user_id":"1337"},"transport":{"method":"conduit","conduit_id":"my-conduit"}}],"pagination":{}}`))
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cc := &twitchConduitClient{
+		httpClient: server.Client(),
+		baseUrl:    server.URL,
+	}
+
+	shards, err := cc.GetConduitShards(context.Background(), "my-conduit")
+	assert.NoError(t, err)
+	assert.Len(t, shards, 2)
+	assert.Equal(t, "https://b.com/callback", shards[1].Transport.Callback)
+
+	err = cc.UpdateConduitShards(context.Background(), "my-conduit", []ConduitShard{{Id: "1"}})
+	assert.ErrorContains(t, err, "The callback URL is invalid")
+
+	subscriptions, err := cc.GetConduitSubscriptions(context.Background(), "my-conduit")
+	assert.NoError(t, err)
+	assert.Equal(t, []ConduitSubscription{
+		{Id: "a", Type: "stream.online", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}},
+		{Id: "d", Type: "stream.offline", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}},
+	}, subscriptions)
+
+	_, err = cc.GetConduits(context.Background())
+	assert.ErrorContains(t, err, "got response 404")
+	var apiErr *apiError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.statusCode)
+	}
+}
+
+func newTestConduitServer(c *mockTwitchClient, cc *mockConduitClient) *Server {
+	return &Server{
+		callbackUrl: "https://my-cool-service.com/callback",
+		conditionParams: hooks.RequiredSubscriptionConditionParams{
+			ChannelUserId: "1337",
+		},
+		requiredSubscriptions: hooks.RequiredSubscriptions{
+			{
+				Type:    helix.EventSubTypeStreamOnline,
+				Version: "1",
+				TemplatedCondition: helix.EventSubCondition{
+					BroadcasterUserID: "{{.ChannelUserId}}",
+				},
+			},
+		},
+		newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+			return c, nil
+		},
+		conduitShardCallbackUrls: []string{
+			"https://replica-a.com/callback",
+			"https://replica-b.com/callback",
+		},
+		newConduitClient: func(ctx context.Context) (ConduitClient, error) {
+			return cc, nil
+		},
+	}
+}
+
+type mockConduitClient struct {
+	twitch          *mockTwitchClient
+	conduits        []Conduit
+	shards          []ConduitShard
+	numShardUpdates int
+
+	// subscriptionConduitIds records the conduit ID of each subscription created via
+	// CreateConduitSubscription, since helix can't represent it
+	subscriptionConduitIds map[string]string
+}
+
+func (m *mockConduitClient) GetConduits(ctx context.Context) ([]Conduit, error) {
+	return m.conduits, nil
+}
+
+func (m *mockConduitClient) CreateConduit(ctx context.Context, shardCount int) (*Conduit, error) {
+	m.conduits = append(m.conduits, Conduit{Id: "my-conduit", ShardCount: shardCount})
+	return &m.conduits[len(m.conduits)-1], nil
+}
+
+func (m *mockConduitClient) UpdateConduit(ctx context.Context, conduitId string, shardCount int) (*Conduit, error) {
+	for i := range m.conduits {
+		if m.conduits[i].Id == conduitId {
+			m.conduits[i].ShardCount = shardCount
+			return &m.conduits[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no such conduit")
+}
+
+func (m *mockConduitClient) GetConduitShards(ctx context.Context, conduitId string) ([]ConduitShard, error) {
+	return m.shards, nil
+}
+
+func (m *mockConduitClient) UpdateConduitShards(ctx context.Context, conduitId string, shards []ConduitShard) error {
+	m.numShardUpdates++
+	for _, update := range shards {
+		// Simulate our callback URL immediately responding to Twitch's verification
+		// challenge, and don't retain the secret
+		updated := ConduitShard{
+			Id:     update.Id,
+			Status: "enabled",
+			Transport: ConduitShardTransport{
+				Method:   update.Transport.Method,
+				Callback: update.Transport.Callback,
+			},
+		}
+		found := false
+		for i := range m.shards {
+			if m.shards[i].Id == update.Id {
+				m.shards[i] = updated
+				found = true
+			}
+		}
+		if !found {
+			m.shards = append(m.shards, updated)
+		}
+	}
+	return nil
+}
+
+func (m *mockConduitClient) CreateConduitSubscription(ctx context.Context, subscriptionType string, version string, condition map[string]string, conduitId string) error {
+	payload := &helix.EventSubSubscription{
+		Type:      subscriptionType,
+		Version:   version,
+		Condition: parseCondition(condition),
+		Transport: helix.EventSubTransport{
+			Method: "conduit",
+		},
+		Status: "enabled",
+	}
+	if _, err := m.twitch.CreateEventSubSubscription(payload); err != nil {
+		return err
+	}
+	if m.subscriptionConduitIds == nil {
+		m.subscriptionConduitIds = make(map[string]string)
+	}
+	m.subscriptionConduitIds[payload.ID] = conduitId
+	return nil
+}
+
+func (m *mockConduitClient) GetConduitSubscriptions(ctx context.Context, conduitId string) ([]ConduitSubscription, error) {
+	subscriptions := make([]ConduitSubscription, 0)
+	for _, subscription := range m.twitch.subscriptions {
+		if subscription.Transport.Method == "conduit" && m.subscriptionConduitIds[subscription.ID] == conduitId {
+			subscriptions = append(subscriptions, ConduitSubscription{
+				Id:        subscription.ID,
+				Type:      subscription.Type,
+				Version:   subscription.Version,
+				Condition: formatCondition(&subscription.Condition),
+			})
+		}
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,30 @@
+package subscription
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkCost returns an error if creating the given subscriptions would cause our app's
+// total EventSub subscription cost to exceed the maximum that Twitch permits. If the
+// limit is unknown, creation is permitted.
+func checkCost(cost *Cost, toCreate []State) error {
+	if cost == nil || cost.MaxTotalCost <= 0 {
+		return nil
+	}
+
+	addedCost := 0
+	costlyTypes := make([]string, 0)
+	for _, state := range toCreate {
+		addedCost += state.Cost
+		if state.Cost > 0 {
+			costlyTypes = append(costlyTypes, fmt.Sprintf("%s (v%s): %d", state.Type, state.Version, state.Cost))
+		}
+	}
+
+	predictedCost := cost.TotalCost + addedCost
+	if predictedCost > cost.MaxTotalCost {
+		return fmt.Errorf("creating %d EventSub subscription(s) would add an estimated cost of %d [%s], bringing our total cost to %d, which exceeds the maximum total cost of %d; existing subscriptions must be deleted first", len(toCreate), addedCost, strings.Join(costlyTypes, ", "), predictedCost, cost.MaxTotalCost)
+	}
+	return nil
+}
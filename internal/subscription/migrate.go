@@ -0,0 +1,279 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/golden-vcr/server-common/entry"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// DefaultVerificationTimeout is the maximum amount of time we'll wait for Twitch to
+	// verify our callback URL (i.e. for a newly created subscription or a newly
+	// assigned conduit shard to become enabled)
+	DefaultVerificationTimeout = 30 * time.Second
+
+	// DefaultVerificationPollInterval is how often we'll check the status of a newly
+	// created subscription or conduit shard while waiting for it to become enabled
+	DefaultVerificationPollInterval = time.Second
+)
+
+// statusCreatedByPreviousMigration is used in place of the required subscription's
+// status when an earlier migration in the same request has already created it, so
+// that it's not created twice
+const statusCreatedByPreviousMigration = "created-by-previous-migration"
+
+// Migration describes a required subscription which should replace an existing
+// subscription of the same type and condition: either because the required version
+// has changed, or because the existing subscription is registered against a legacy
+// callback URL (indicated by FromCallbackUrl)
+type Migration struct {
+	Type            string            `json:"type"`
+	Condition       map[string]string `json:"condition"`
+	FromVersion     string            `json:"from_version"`
+	ToVersion       string            `json:"to_version"`
+	FromCallbackUrl string            `json:"from_callback_url,omitempty"`
+
+	fromSubscriptionId string
+	toStatus           string
+	missingScopes      []string
+}
+
+// MigrationResult is the response body for POST /subscriptions/migrate
+type MigrationResult struct {
+	Migrations []Migration `json:"migrations"`
+
+	// Retired lists subscriptions registered against legacy callback URLs that don't
+	// correspond to any required subscription, and which have therefore been deleted
+	// without being replaced
+	Retired []State `json:"retired"`
+}
+
+// planMigrations examines the current status of our subscriptions to find any
+// required subscriptions which should replace an existing subscription of a different
+// version, or an existing subscription registered against a legacy callback URL. The
+// required subscription may be missing entirely, or it may exist already (e.g. if a
+// previous migration was interrupted before the old version was deleted).
+func planMigrations(status *Status) []Migration {
+	migrations := make([]Migration, 0)
+	for _, required := range status.Subscriptions {
+		if !required.Required {
+			continue
+		}
+		for _, existing := range status.Subscriptions {
+			if existing.Required || existing.subscriptionId == "" {
+				continue
+			}
+			if existing.Type != required.Type {
+				continue
+			}
+			if existing.LegacyCallbackUrl == "" && existing.Version == required.Version {
+				continue
+			}
+			if !reflect.DeepEqual(existing.Condition, required.Condition) {
+				continue
+			}
+			migrations = append(migrations, Migration{
+				Type:               required.Type,
+				Condition:          required.Condition,
+				FromVersion:        existing.Version,
+				ToVersion:          required.Version,
+				FromCallbackUrl:    existing.LegacyCallbackUrl,
+				fromSubscriptionId: existing.subscriptionId,
+				toStatus:           required.Status,
+				missingScopes:      required.MissingScopes,
+			})
+		}
+	}
+	return migrations
+}
+
+// planRetirements finds any subscriptions registered against legacy callback URLs
+// which won't be replaced by any of the given migrations: since they no longer
+// deliver notifications to us and we no longer require them, they should simply be
+// deleted.
+func planRetirements(status *Status, migrations []Migration) []State {
+	migrated := make(map[string]struct{})
+	for _, migration := range migrations {
+		migrated[migration.fromSubscriptionId] = struct{}{}
+	}
+	retirements := make([]State, 0)
+	for _, existing := range status.Subscriptions {
+		if existing.LegacyCallbackUrl == "" || existing.subscriptionId == "" {
+			continue
+		}
+		if _, ok := migrated[existing.subscriptionId]; ok {
+			continue
+		}
+		retirements = append(retirements, existing)
+	}
+	return retirements
+}
+
+// handlePostMigrate (POST /subscriptions/migrate) migrates existing subscriptions to
+// the versions and callback URL that we now require without interrupting the flow of
+// events: for each such subscription, we create the new version, wait for it to be
+// enabled, and only then delete the old version. While both versions exist, Twitch
+// will send us the same events twice; the callback handler is responsible for
+// discarding duplicates. Once all migrations are complete, any remaining subscriptions
+// on legacy callback URLs are deleted.
+func (s *Server) handlePostMigrate(res http.ResponseWriter, req *http.Request) {
+	logger := entry.Log(req)
+
+	c, err := s.newTwitchClient(req.Context())
+	if err != nil {
+		logger.Error("Failed to initialize Twitch API client", "error", err)
+		http.Error(res, fmt.Sprintf("failed to initialize Twitch API client: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	status, err := s.fetchSubscriptionStatus(req.Context(), c)
+	if err != nil {
+		logger.Error("Failed to resolve EventSub subscription status", "error", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Refuse to start if any new version can't be created due to missing scopes
+	migrations := planMigrations(status)
+	for _, migration := range migrations {
+		if migration.toStatus == "missing" && len(migration.missingScopes) > 0 {
+			http.Error(res, fmt.Sprintf("Cannot create EventSub subscription %s (v%s): the broadcaster has not granted required scopes [%s]; they must reauthorize via /userauth/start", migration.Type, migration.ToVersion, strings.Join(migration.missingScopes, ", ")), http.StatusConflict)
+			return
+		}
+	}
+
+	// While migrating, both the old and new versions of each subscription will exist,
+	// so make sure that we won't exceed our cost limit in the interim
+	toCreate := make([]State, 0)
+	for _, state := range status.Subscriptions {
+		if !state.Required || state.Status != "missing" {
+			continue
+		}
+		for _, migration := range migrations {
+			if migration.Type == state.Type && migration.ToVersion == state.Version && reflect.DeepEqual(migration.Condition, state.Condition) {
+				toCreate = append(toCreate, state)
+				break
+			}
+		}
+	}
+	if err := checkCost(status.Cost, toCreate); err != nil {
+		logger.Error("Cannot migrate EventSub subscriptions due to cost limit", "error", err, "cost", status.Cost)
+		http.Error(res, fmt.Sprintf("Cannot migrate EventSub subscriptions: %v", err), http.StatusConflict)
+		return
+	}
+
+	create, err := s.prepareCreate(req.Context(), logger, c)
+	if err != nil {
+		logger.Error("Failed to prepare for creating EventSub subscriptions", "error", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Several existing subscriptions may be replaced by the same required subscription
+	// (e.g. if it's registered against multiple legacy callback URLs), in which case we
+	// only need to create it once
+	created := make(map[string]struct{})
+	for _, migration := range migrations {
+		logger := logger.With(
+			"subscriptionType", migration.Type,
+			"subscriptionCondition", migration.Condition,
+			"fromVersion", migration.FromVersion,
+			"toVersion", migration.ToVersion,
+			"fromCallbackUrl", migration.FromCallbackUrl,
+		)
+		key := stateKey(&State{Type: migration.Type, Version: migration.ToVersion, Condition: migration.Condition})
+		if _, ok := created[key]; ok {
+			migration.toStatus = statusCreatedByPreviousMigration
+		}
+		if err := s.migrate(req.Context(), logger, c, create, &migration); err != nil {
+			logger.Error("Failed to migrate EventSub subscription", "error", err)
+			http.Error(res, fmt.Sprintf("Failed to migrate EventSub subscription %s from v%s to v%s: %v", migration.Type, migration.FromVersion, migration.ToVersion, err), http.StatusInternalServerError)
+			return
+		}
+		created[key] = struct{}{}
+		logger.Info("Migrated EventSub subscription")
+	}
+
+	retirements := planRetirements(status, migrations)
+	for _, retirement := range retirements {
+		logger := logger.With(
+			"subscriptionId", retirement.subscriptionId,
+			"subscriptionType", retirement.Type,
+			"subscriptionVersion", retirement.Version,
+			"subscriptionCondition", retirement.Condition,
+			"legacyCallbackUrl", retirement.LegacyCallbackUrl,
+		)
+		if err := s.deleteSubscription(c, retirement.subscriptionId); err != nil {
+			logger.Error("Failed to delete legacy EventSub subscription", "error", err)
+			http.Error(res, fmt.Sprintf("Failed to delete legacy EventSub subscription %s (v%s) from %s: %v", retirement.Type, retirement.Version, retirement.LegacyCallbackUrl, err), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Deleted legacy EventSub subscription that is no longer required")
+	}
+
+	if err := json.NewEncoder(res).Encode(MigrationResult{Migrations: migrations, Retired: retirements}); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// migrate carries out a single migration, ensuring that the old version of the
+// subscription is only deleted once the new version is enabled
+func (s *Server) migrate(ctx context.Context, logger *slog.Logger, c TwitchClient, create createFunc, migration *Migration) error {
+	if migration.toStatus == "missing" {
+		if err := create(migration.Type, migration.ToVersion, migration.Condition); err != nil {
+			return fmt.Errorf("failed to create new version: %w", err)
+		}
+		logger.Info("Created new version of EventSub subscription")
+	}
+
+	if err := s.waitForEnabled(ctx, c, migration.Type, migration.ToVersion, migration.Condition); err != nil {
+		return fmt.Errorf("new version was not enabled: %w", err)
+	}
+
+	if err := s.deleteSubscription(c, migration.fromSubscriptionId); err != nil {
+		return fmt.Errorf("failed to delete old version: %w", err)
+	}
+	return nil
+}
+
+// waitForEnabled polls the status of a newly-created subscription until it's enabled,
+// failing if it ends up in any other state (i.e. if Twitch failed to verify our
+// callback) or if it doesn't become enabled in time
+func (s *Server) waitForEnabled(ctx context.Context, c TwitchClient, subscriptionType string, version string, condition map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.verificationTimeout)
+	defer cancel()
+	for {
+		status, err := s.fetchSubscriptionStatus(ctx, c)
+		if err != nil {
+			return fmt.Errorf("failed to resolve EventSub subscription status: %w", err)
+		}
+		for _, state := range status.Subscriptions {
+			if state.LegacyCallbackUrl != "" || state.Type != subscriptionType || state.Version != version {
+				continue
+			}
+			if !reflect.DeepEqual(state.Condition, condition) {
+				continue
+			}
+			switch state.Status {
+			case "enabled":
+				return nil
+			case "missing", "webhook_callback_verification_pending":
+			default:
+				return fmt.Errorf("subscription has status '%s'", state.Status)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for subscription to be enabled")
+		case <-time.After(s.verificationPollInterval):
+		}
+	}
+}
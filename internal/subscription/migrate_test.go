@@ -0,0 +1,323 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_planMigrations(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *Status
+		want   []Migration
+	}{
+		{
+			"no migrations when versions match",
+			&Status{
+				Subscriptions: []State{
+					{Required: true, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled", subscriptionId: "a"},
+				},
+			},
+			[]Migration{},
+		},
+		{
+			"old version of missing subscription is migrated",
+			&Status{
+				Subscriptions: []State{
+					{Required: true, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "missing"},
+					{Required: false, Type: "channel.follow", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled", subscriptionId: "a"},
+				},
+			},
+			[]Migration{
+				{
+					Type:               "channel.follow",
+					Condition:          map[string]string{"broadcaster_user_id": "1337"},
+					FromVersion:        "1",
+					ToVersion:          "2",
+					fromSubscriptionId: "a",
+					toStatus:           "missing",
+				},
+			},
+		},
+		{
+			"interrupted migration is resumed",
+			&Status{
+				Subscriptions: []State{
+					{Required: true, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled", subscriptionId: "b"},
+					{Required: false, Type: "channel.follow", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled", subscriptionId: "a"},
+				},
+			},
+			[]Migration{
+				{
+					Type:               "channel.follow",
+					Condition:          map[string]string{"broadcaster_user_id": "1337"},
+					FromVersion:        "1",
+					ToVersion:          "2",
+					fromSubscriptionId: "a",
+					toStatus:           "enabled",
+				},
+			},
+		},
+		{
+			"subscription on legacy callback URL is migrated",
+			&Status{
+				Subscriptions: []State{
+					{Required: true, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "missing"},
+					{Required: false, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled", LegacyCallbackUrl: "https://old.com/callback", subscriptionId: "a"},
+				},
+			},
+			[]Migration{
+				{
+					Type:               "channel.follow",
+					Condition:          map[string]string{"broadcaster_user_id": "1337"},
+					FromVersion:        "2",
+					ToVersion:          "2",
+					FromCallbackUrl:    "https://old.com/callback",
+					fromSubscriptionId: "a",
+					toStatus:           "missing",
+				},
+			},
+		},
+		{
+			"subscription with different condition is not migrated",
+			&Status{
+				Subscriptions: []State{
+					{Required: true, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "missing"},
+					{Required: false, Type: "channel.follow", Version: "1", Condition: map[string]string{"broadcaster_user_id": "9999"}, Status: "enabled", subscriptionId: "a"},
+				},
+			},
+			[]Migration{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planMigrations(tt.status)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_Server_handlePostMigrate(t *testing.T) {
+	tests := []struct {
+		name                  string
+		newVersionStatus      string
+		wantStatus            int
+		wantRemainingVersions []string
+	}{
+		{
+			"old version is deleted once new version is enabled",
+			"enabled",
+			http.StatusOK,
+			[]string{"2"},
+		},
+		{
+			"old version is retained if new version fails verification",
+			"webhook_callback_verification_failed",
+			http.StatusInternalServerError,
+			[]string{"1", "2"},
+		},
+		{
+			"old version is retained if new version is never enabled",
+			"webhook_callback_verification_pending",
+			http.StatusInternalServerError,
+			[]string{"1", "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &verifyingTwitchClient{
+				mockTwitchClient: &mockTwitchClient{
+					subscriptions: []helix.EventSubSubscription{
+						{
+							ID:      "10000001",
+							Type:    helix.EventSubTypeChannelFollow,
+							Version: "1",
+							Condition: helix.EventSubCondition{
+								BroadcasterUserID: "1337",
+							},
+							Transport: helix.EventSubTransport{
+								Method:   "webhook",
+								Callback: "https://my-cool-service.com/callback",
+							},
+							Status: "enabled",
+						},
+					},
+				},
+				statusAfterVerification: tt.newVersionStatus,
+			}
+			s := &Server{
+				callbackUrl: "https://my-cool-service.com/callback",
+				conditionParams: hooks.RequiredSubscriptionConditionParams{
+					ChannelUserId: "1337",
+				},
+				requiredSubscriptions: hooks.RequiredSubscriptions{
+					{
+						Type:    helix.EventSubTypeChannelFollow,
+						Version: "2",
+						TemplatedCondition: helix.EventSubCondition{
+							BroadcasterUserID: "{{.ChannelUserId}}",
+						},
+					},
+				},
+				newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+					return c, nil
+				},
+				verificationTimeout:      50 * time.Millisecond,
+				verificationPollInterval: time.Millisecond,
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/subscriptions/migrate", nil)
+			res := httptest.NewRecorder()
+			s.handlePostMigrate(res, req)
+			assert.Equal(t, tt.wantStatus, res.Code)
+
+			if tt.wantStatus == http.StatusOK {
+				var result MigrationResult
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+				assert.Len(t, result.Migrations, 1)
+				assert.Equal(t, "1", result.Migrations[0].FromVersion)
+				assert.Equal(t, "2", result.Migrations[0].ToVersion)
+			}
+
+			remainingVersions := make([]string, 0)
+			for _, subscription := range c.subscriptions {
+				remainingVersions = append(remainingVersions, subscription.Version)
+			}
+			assert.ElementsMatch(t, tt.wantRemainingVersions, remainingVersions)
+		})
+	}
+}
+
+func Test_Server_legacyCallbackUrls(t *testing.T) {
+	newSubscription := func(id string, callbackUrl string) helix.EventSubSubscription {
+		return helix.EventSubSubscription{
+			ID:      id,
+			Type:    helix.EventSubTypeStreamOnline,
+			Version: "1",
+			Condition: helix.EventSubCondition{
+				BroadcasterUserID: "1337",
+			},
+			Transport: helix.EventSubTransport{
+				Method:   "webhook",
+				Callback: callbackUrl,
+			},
+			Status: "enabled",
+		}
+	}
+	c := &verifyingTwitchClient{
+		mockTwitchClient: &mockTwitchClient{
+			subscriptions: []helix.EventSubSubscription{
+				newSubscription("10000001", "https://old-domain.com/callback"),
+				newSubscription("10000002", "https://old-domain.com/api/hooks/callback"),
+				newSubscription("10000003", "https://someone-else.com/callback"),
+				{
+					ID:        "10000004",
+					Type:      helix.EventSubTypeChannelRaid,
+					Version:   "1",
+					Condition: helix.EventSubCondition{ToBroadcasterUserID: "1337"},
+					Transport: helix.EventSubTransport{Method: "webhook", Callback: "https://old-domain.com/callback"},
+					Status:    "enabled",
+				},
+			},
+		},
+		statusAfterVerification: "enabled",
+	}
+	s := &Server{
+		callbackUrl: "https://my-cool-service.com/callback",
+		conditionParams: hooks.RequiredSubscriptionConditionParams{
+			ChannelUserId: "1337",
+		},
+		requiredSubscriptions: hooks.RequiredSubscriptions{
+			{
+				Type:    helix.EventSubTypeStreamOnline,
+				Version: "1",
+				TemplatedCondition: helix.EventSubCondition{
+					BroadcasterUserID: "{{.ChannelUserId}}",
+				},
+			},
+		},
+		newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+			return c, nil
+		},
+		legacyCallbackUrls: []string{
+			"https://old-domain.com/callback",
+			"https://old-domain.com/api/hooks/callback",
+		},
+		verificationTimeout:      50 * time.Millisecond,
+		verificationPollInterval: time.Millisecond,
+	}
+
+	// Subscriptions on legacy callback URLs are reported, but they don't satisfy our
+	// requirements
+	status, err := s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.False(t, status.Ok)
+	assert.Len(t, status.Subscriptions, 4)
+	assert.Equal(t, "missing", status.Subscriptions[0].Status)
+	assert.Equal(t, "https://old-domain.com/callback", status.Subscriptions[1].LegacyCallbackUrl)
+	assert.Equal(t, "https://old-domain.com/api/hooks/callback", status.Subscriptions[2].LegacyCallbackUrl)
+	assert.Equal(t, helix.EventSubTypeChannelRaid, status.Subscriptions[3].Type)
+
+	// Migrating recreates the subscription on our current callback URL, once, then
+	// deletes both legacy subscriptions; the legacy subscription that we no longer
+	// require is deleted without being replaced
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/migrate", nil)
+	res := httptest.NewRecorder()
+	s.handlePostMigrate(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var result MigrationResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.Len(t, result.Migrations, 2)
+	if assert.Len(t, result.Retired, 1) {
+		assert.Equal(t, helix.EventSubTypeChannelRaid, result.Retired[0].Type)
+		assert.Equal(t, "https://old-domain.com/callback", result.Retired[0].LegacyCallbackUrl)
+	}
+
+	remainingCallbackUrls := make([]string, 0)
+	for _, subscription := range c.subscriptions {
+		remainingCallbackUrls = append(remainingCallbackUrls, subscription.Transport.Callback)
+	}
+	assert.ElementsMatch(t, []string{
+		"https://someone-else.com/callback",
+		"https://my-cool-service.com/callback",
+	}, remainingCallbackUrls)
+
+	status, err = s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.True(t, status.Ok)
+	assert.Len(t, status.Subscriptions, 1)
+}
+
+// verifyingTwitchClient simulates Twitch attempting to verify our callback URL when
+// a new subscription is created: newly-created subscriptions are initially reported as
+// pending, then take on statusAfterVerification. Unlike mockTwitchClient, it also
+// records when each subscription was created.
+type verifyingTwitchClient struct {
+	*mockTwitchClient
+	statusAfterVerification string
+}
+
+func (v *verifyingTwitchClient) GetEventSubSubscriptions(params *helix.EventSubSubscriptionsParams) (*helix.EventSubSubscriptionsResponse, error) {
+	r, err := v.mockTwitchClient.GetEventSubSubscriptions(params)
+	for i := range v.subscriptions {
+		if v.subscriptions[i].Status == "webhook_callback_verification_pending" {
+			v.subscriptions[i].Status = v.statusAfterVerification
+		}
+	}
+	return r, err
+}
+
+func (v *verifyingTwitchClient) CreateEventSubSubscription(payload *helix.EventSubSubscription) (*helix.EventSubSubscriptionsResponse, error) {
+	payload.Status = "webhook_callback_verification_pending"
+	payload.CreatedAt = helix.Time{Time: time.Now()}
+	return v.mockTwitchClient.CreateEventSubSubscription(payload)
+}
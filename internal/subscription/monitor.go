@@ -0,0 +1,280 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	ChangeSourceCheck      = "check"
+	ChangeSourceRevocation = "revocation"
+)
+
+// Monitor keeps track of the most recently-observed status of each EventSub
+// subscription, and it raises an alert whenever that status changes. Status updates
+// come from periodic checks against the Twitch API (via Run) and from revocation
+// messages that Twitch sends to our webhook callback (via HandleRevocation).
+type Monitor struct {
+	server   *Server
+	notifier alert.Notifier
+	now      func() time.Time
+
+	mu          sync.Mutex
+	snapshot    map[string]State
+	hasBaseline bool
+}
+
+func NewMonitor(server *Server, notifier alert.Notifier) *Monitor {
+	return &Monitor{
+		server:   server,
+		notifier: notifier,
+		now:      time.Now,
+	}
+}
+
+// Run blocks until the given context is canceled, checking the status of all EventSub
+// subscriptions at the given interval
+func (m *Monitor) Run(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Check(ctx, logger); err != nil {
+			logger.Error("Failed to check EventSub subscription status", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check queries the Twitch API for the current status of all EventSub subscriptions,
+// raising alerts for any subscriptions whose status has changed since the last update
+func (m *Monitor) Check(ctx context.Context, logger *slog.Logger) error {
+	c, err := m.server.newTwitchClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize Twitch API client: %w", err)
+	}
+	status, err := m.server.fetchSubscriptionStatus(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	changes := m.update(status.Subscriptions, true)
+	m.mu.Unlock()
+	return m.notify(ctx, logger, changes, ChangeSourceCheck)
+}
+
+// HandleRevocation records the new status of a subscription that Twitch has notified
+// us has been revoked, raising an alert if that subscription was previously in a
+// different state
+func (m *Monitor) HandleRevocation(ctx context.Context, logger *slog.Logger, subscription *helix.EventSubSubscription) error {
+	state := State{
+		Type:      subscription.Type,
+		Version:   subscription.Version,
+		Condition: formatCondition(&subscription.Condition),
+		Status:    subscription.Status,
+	}
+	if m.server.isLegacyCallbackUrl(&subscription.Transport) {
+		state.LegacyCallbackUrl = subscription.Transport.Callback
+	}
+
+	m.mu.Lock()
+	if prev, ok := m.snapshot[stateKey(&state)]; ok {
+		state.Required = prev.Required
+	}
+	changes := m.update([]State{state}, false)
+	m.mu.Unlock()
+	return m.notify(ctx, logger, changes, ChangeSourceRevocation)
+}
+
+// statusChange describes a change in the status of a single subscription, along with
+// the update that should be made to our snapshot once we've raised an alert for it
+type statusChange struct {
+	alert.PayloadSubscriptionStatusChanged
+
+	key     string
+	state   State
+	removed bool
+}
+
+// update merges the given subscription states into our snapshot, returning a list of
+// changes for any subscriptions whose status differs from what was previously
+// recorded. If complete is true, the given states are treated as an exhaustive list,
+// and any subscription that's no longer present is considered to have gone missing.
+// The very first complete update establishes a baseline: it yields changes only for
+// required subscriptions that aren't enabled (with a previous status of "unknown"),
+// since those need attention even if they were already broken before we started.
+//
+// Changes are not recorded in the snapshot until they're passed to apply, so that if
+// we fail to raise an alert for a change, it will be detected (and alerted) again on
+// the next update. Must be called with mu held.
+func (m *Monitor) update(states []State, complete bool) []statusChange {
+	if m.snapshot == nil {
+		m.snapshot = make(map[string]State)
+	}
+	isBaseline := complete && !m.hasBaseline
+	if complete {
+		m.hasBaseline = true
+	}
+
+	changes := make([]statusChange, 0)
+	seen := make(map[string]struct{})
+	for _, state := range states {
+		key := stateKey(&state)
+		seen[key] = struct{}{}
+		prev, existed := m.snapshot[key]
+		if isBaseline {
+			if !state.Required || state.Status == helix.EventSubStatusEnabled {
+				m.snapshot[key] = state
+				continue
+			}
+
+			// Record the subscription's status as unknown until we've raised an alert for
+			// it, so that if the alert can't be delivered, it's raised again next time
+			unknown := state
+			unknown.Status = "unknown"
+			m.snapshot[key] = unknown
+			existed = true
+			prev = unknown
+		}
+
+		prevStatus := "unknown"
+		if existed {
+			prevStatus = prev.Status
+		} else if m.hasBaseline {
+			prevStatus = "missing"
+		}
+		if prevStatus == state.Status {
+			m.snapshot[key] = state
+			continue
+		}
+		changes = append(changes, statusChange{
+			PayloadSubscriptionStatusChanged: newStatusChange(&state, prevStatus),
+			key:                              key,
+			state:                            state,
+		})
+	}
+
+	// If we've been given a full list of subscriptions, then any subscription we were
+	// previously tracking that's no longer listed has been deleted
+	if complete {
+		keys := make([]string, 0)
+		for key := range m.snapshot {
+			if _, ok := seen[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prev := m.snapshot[key]
+			if isBaseline {
+				delete(m.snapshot, key)
+				continue
+			}
+			state := prev
+			state.Status = "missing"
+			changes = append(changes, statusChange{
+				PayloadSubscriptionStatusChanged: newStatusChange(&state, prev.Status),
+				key:                              key,
+				state:                            state,
+				removed:                          true,
+			})
+		}
+	}
+	return changes
+}
+
+// apply records a change in our snapshot once we've raised an alert for it, unless the
+// subscription's status has since been updated by another check or revocation. Must
+// be called with mu held.
+func (m *Monitor) apply(change *statusChange) {
+	if prev, ok := m.snapshot[change.key]; ok {
+		if prev.Status != change.PreviousStatus {
+			return
+		}
+	} else if change.removed {
+		return
+	}
+	if change.removed {
+		delete(m.snapshot, change.key)
+	} else {
+		m.snapshot[change.key] = change.state
+	}
+}
+
+// notify raises an alert for each of the given changes, recording each change in our
+// snapshot only once its alert has been delivered. If any alerts can't be delivered,
+// the remaining alerts are still sent, and all errors are returned together.
+func (m *Monitor) notify(ctx context.Context, logger *slog.Logger, changes []statusChange, source string) error {
+	errs := make([]error, 0)
+	for i := range changes {
+		change := &changes[i].PayloadSubscriptionStatusChanged
+		change.Source = source
+		logger.Warn("EventSub subscription status changed",
+			"subscriptionType", change.Type,
+			"subscriptionVersion", change.Version,
+			"subscriptionCondition", change.Condition,
+			"previousStatus", change.PreviousStatus,
+			"status", change.Status,
+			"source", change.Source,
+		)
+		a := &alert.Alert{
+			Type:       alert.TypeSubscriptionStatusChanged,
+			Message:    fmt.Sprintf("EventSub subscription %s (v%s) changed from %s to %s", change.Type, change.Version, change.PreviousStatus, change.Status),
+			OccurredAt: m.now(),
+			Payload: &alert.Payload{
+				SubscriptionStatusChanged: change,
+			},
+		}
+		if err := m.notifier.Notify(ctx, a); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send alert for %s (v%s): %w", change.Type, change.Version, err))
+			continue
+		}
+		m.mu.Lock()
+		m.apply(&changes[i])
+		m.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func newStatusChange(state *State, prevStatus string) alert.PayloadSubscriptionStatusChanged {
+	return alert.PayloadSubscriptionStatusChanged{
+		Required:       state.Required,
+		Type:           state.Type,
+		Version:        state.Version,
+		Condition:      state.Condition,
+		PreviousStatus: prevStatus,
+		Status:         state.Status,
+	}
+}
+
+// stateKey identifies a subscription by its type, version, and condition (along with
+// its callback URL, if it's a legacy subscription), so that we can correlate states
+// across updates even when subscription IDs change
+func stateKey(state *State) string {
+	conditionKeys := make([]string, 0, len(state.Condition))
+	for k := range state.Condition {
+		conditionKeys = append(conditionKeys, k)
+	}
+	sort.Strings(conditionKeys)
+	parts := []string{state.Type, state.Version}
+	for _, k := range conditionKeys {
+		parts = append(parts, k+"="+state.Condition[k])
+	}
+	if state.LegacyCallbackUrl != "" {
+		parts = append(parts, "legacy="+state.LegacyCallbackUrl)
+	}
+	return strings.Join(parts, "|")
+}
@@ -0,0 +1,226 @@
+package subscription
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks"
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Monitor(t *testing.T) {
+	c := &mockTwitchClient{
+		subscriptions: []helix.EventSubSubscription{
+			{
+				ID:      "10000001",
+				Type:    helix.EventSubTypeChannelFollow,
+				Version: "2",
+				Condition: helix.EventSubCondition{
+					BroadcasterUserID: "1337",
+					ModeratorUserID:   "1337",
+				},
+				Transport: helix.EventSubTransport{
+					Method:   "webhook",
+					Callback: "https://my-cool-service.com/callback",
+				},
+				Status: "enabled",
+			},
+		},
+	}
+	s := &Server{
+		callbackUrl: "https://my-cool-service.com/callback",
+		conditionParams: hooks.RequiredSubscriptionConditionParams{
+			ChannelUserId: "1337",
+		},
+		requiredSubscriptions: hooks.RequiredSubscriptions{
+			{
+				Type:    helix.EventSubTypeChannelFollow,
+				Version: "2",
+				TemplatedCondition: helix.EventSubCondition{
+					BroadcasterUserID: "{{.ChannelUserId}}",
+					ModeratorUserID:   "{{.ChannelUserId}}",
+				},
+			},
+		},
+		newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+			return c, nil
+		},
+	}
+	n := &recordingNotifier{}
+	m := NewMonitor(s, n)
+	m.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+	logger := slog.Default()
+
+	// The initial check establishes a baseline and raises no alerts
+	assert.NoError(t, m.Check(ctx, logger))
+	assert.Len(t, n.alerts, 0)
+
+	// Checking again with no change raises no alerts
+	assert.NoError(t, m.Check(ctx, logger))
+	assert.Len(t, n.alerts, 0)
+
+	// A revocation callback raises an alert for the required subscription
+	revoked := c.subscriptions[0]
+	revoked.Status = "authorization_revoked"
+	assert.NoError(t, m.HandleRevocation(ctx, logger, &revoked))
+	assert.Equal(t, []*alert.Alert{
+		{
+			Type:       alert.TypeSubscriptionStatusChanged,
+			Message:    "EventSub subscription channel.follow (v2) changed from enabled to authorization_revoked",
+			OccurredAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			Payload: &alert.Payload{
+				SubscriptionStatusChanged: &alert.PayloadSubscriptionStatusChanged{
+					Required:       true,
+					Type:           helix.EventSubTypeChannelFollow,
+					Version:        "2",
+					Condition:      map[string]string{"broadcaster_user_id": "1337", "moderator_user_id": "1337"},
+					PreviousStatus: "enabled",
+					Status:         "authorization_revoked",
+					Source:         ChangeSourceRevocation,
+				},
+			},
+		},
+	}, n.alerts)
+
+	// Once Twitch deletes the revoked subscription, the next check reports it missing
+	c.subscriptions = nil
+	assert.NoError(t, m.Check(ctx, logger))
+	assert.Len(t, n.alerts, 2)
+	assert.Equal(t, "authorization_revoked", n.alerts[1].Payload.SubscriptionStatusChanged.PreviousStatus)
+	assert.Equal(t, "missing", n.alerts[1].Payload.SubscriptionStatusChanged.Status)
+	assert.Equal(t, ChangeSourceCheck, n.alerts[1].Payload.SubscriptionStatusChanged.Source)
+}
+
+func Test_Monitor_update(t *testing.T) {
+	enabled := State{Type: "stream.online", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled"}
+	failed := enabled
+	failed.Status = "webhook_callback_verification_failed"
+	ancillary := State{Type: "stream.offline", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled"}
+
+	m := &Monitor{}
+
+	// Revocations received before any check have an unknown previous state
+	changes := m.update([]State{failed}, false)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "unknown", changes[0].PreviousStatus)
+
+	// The first complete update is a baseline
+	changes = m.update([]State{enabled, ancillary}, true)
+	assert.Len(t, changes, 0)
+
+	// Subscriptions that change state or disappear are reported
+	changes = m.update([]State{failed}, true)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "stream.online", changes[0].Type)
+	assert.Equal(t, "enabled", changes[0].PreviousStatus)
+	assert.Equal(t, "webhook_callback_verification_failed", changes[0].Status)
+	assert.Equal(t, "stream.offline", changes[1].Type)
+	assert.Equal(t, "enabled", changes[1].PreviousStatus)
+	assert.Equal(t, "missing", changes[1].Status)
+}
+
+func Test_Monitor_update_baselineAlertsRequiredSubscriptions(t *testing.T) {
+	revoked := State{Required: true, Type: "channel.follow", Version: "2", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "authorization_revoked"}
+	missing := State{Required: true, Type: "stream.online", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "missing"}
+	enabled := State{Required: true, Type: "stream.offline", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled"}
+	ancillary := State{Type: "channel.cheer", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "webhook_callback_verification_failed"}
+
+	n := &recordingNotifier{failTypes: map[string]bool{"stream.online": true}}
+	m := NewMonitor(nil, n)
+	ctx := context.Background()
+	logger := slog.Default()
+
+	// Required subscriptions that are already broken when we start are reported, even
+	// though the first check is a baseline
+	m.mu.Lock()
+	changes := m.update([]State{revoked, missing, enabled, ancillary}, true)
+	m.mu.Unlock()
+	if assert.Len(t, changes, 2) {
+		assert.Equal(t, "channel.follow", changes[0].Type)
+		assert.Equal(t, "unknown", changes[0].PreviousStatus)
+		assert.Equal(t, "authorization_revoked", changes[0].Status)
+		assert.Equal(t, "stream.online", changes[1].Type)
+		assert.Equal(t, "unknown", changes[1].PreviousStatus)
+		assert.Equal(t, "missing", changes[1].Status)
+	}
+	assert.ErrorContains(t, m.notify(ctx, logger, changes, ChangeSourceCheck), "stream.online")
+
+	// If an alert couldn't be delivered, it's raised again on the next check
+	n.failTypes = nil
+	m.mu.Lock()
+	changes = m.update([]State{revoked, missing, enabled, ancillary}, true)
+	m.mu.Unlock()
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, "stream.online", changes[0].Type)
+		assert.Equal(t, "unknown", changes[0].PreviousStatus)
+	}
+	assert.NoError(t, m.notify(ctx, logger, changes, ChangeSourceCheck))
+
+	m.mu.Lock()
+	changes = m.update([]State{revoked, missing, enabled, ancillary}, true)
+	m.mu.Unlock()
+	assert.Empty(t, changes)
+}
+
+func Test_Monitor_notify_retriesUndeliveredAlerts(t *testing.T) {
+	online := State{Type: "stream.online", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled"}
+	offline := State{Type: "stream.offline", Version: "1", Condition: map[string]string{"broadcaster_user_id": "1337"}, Status: "enabled"}
+	onlineFailed := online
+	onlineFailed.Status = "webhook_callback_verification_failed"
+	offlineFailed := offline
+	offlineFailed.Status = "webhook_callback_verification_failed"
+
+	n := &recordingNotifier{failTypes: map[string]bool{"stream.online": true}}
+	m := NewMonitor(nil, n)
+	ctx := context.Background()
+	logger := slog.Default()
+
+	m.mu.Lock()
+	m.update([]State{online, offline}, true)
+	changes := m.update([]State{onlineFailed, offlineFailed}, true)
+	m.mu.Unlock()
+
+	// If one alert can't be delivered, the others are still sent, and the error is
+	// reported
+	err := m.notify(ctx, logger, changes, ChangeSourceCheck)
+	assert.ErrorContains(t, err, "stream.online")
+	if assert.Len(t, n.alerts, 1) {
+		assert.Equal(t, "stream.offline", n.alerts[0].Payload.SubscriptionStatusChanged.Type)
+	}
+
+	// The undelivered change is detected again on the next update, while the delivered
+	// one is not
+	n.failTypes = nil
+	m.mu.Lock()
+	changes = m.update([]State{onlineFailed, offlineFailed}, true)
+	m.mu.Unlock()
+	assert.NoError(t, m.notify(ctx, logger, changes, ChangeSourceCheck))
+	if assert.Len(t, n.alerts, 2) {
+		assert.Equal(t, "stream.online", n.alerts[1].Payload.SubscriptionStatusChanged.Type)
+		assert.Equal(t, "enabled", n.alerts[1].Payload.SubscriptionStatusChanged.PreviousStatus)
+	}
+
+	m.mu.Lock()
+	changes = m.update([]State{onlineFailed, offlineFailed}, true)
+	m.mu.Unlock()
+	assert.Empty(t, changes)
+}
+
+type recordingNotifier struct {
+	failTypes map[string]bool
+	alerts    []*alert.Alert
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, a *alert.Alert) error {
+	if n.failTypes[a.Payload.SubscriptionStatusChanged.Type] {
+		return fmt.Errorf("mock error")
+	}
+	n.alerts = append(n.alerts, a)
+	return nil
+}
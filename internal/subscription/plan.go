@@ -0,0 +1,113 @@
+package subscription
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// Plan describes the changes that Apply would make: i.e. which of our required EventSub
+// subscriptions are missing and would be created
+type Plan struct {
+	ToCreate []State `json:"to_create"`
+
+	// Blocker is set if the plan can't currently be applied, explaining why not (e.g.
+	// because the broadcaster hasn't granted the scopes that a subscription requires)
+	Blocker string `json:"blocker,omitempty"`
+}
+
+// BlockedError is returned from Apply if the plan can't be applied, in which case no
+// subscriptions are created
+type BlockedError struct {
+	Plan *Plan
+}
+
+func (e *BlockedError) Error() string {
+	return e.Plan.Blocker
+}
+
+// NewPlan determines which subscriptions would need to be created in order to
+// register all required subscriptions, given their current status
+func NewPlan(status *Status) *Plan {
+	plan := &Plan{
+		ToCreate: make([]State, 0),
+	}
+	for _, subscription := range status.Subscriptions {
+		if subscription.Required && subscription.Status == "missing" {
+			plan.ToCreate = append(plan.ToCreate, subscription)
+		}
+	}
+
+	// If the broadcaster hasn't granted all the scopes required to create the missing
+	// subscriptions, Twitch will reject our requests: fail early with a clear error
+	for _, subscription := range plan.ToCreate {
+		if len(subscription.MissingScopes) > 0 {
+			plan.Blocker = fmt.Sprintf("Cannot create EventSub subscription %s (v%s): the broadcaster has not granted required scopes [%s]; they must reauthorize via /userauth/start", subscription.Type, subscription.Version, strings.Join(subscription.MissingScopes, ", "))
+			return plan
+		}
+	}
+
+	// Twitch limits the total cost of all our subscriptions: if creating the missing
+	// subscriptions would exceed that limit, refuse to create any of them
+	if err := checkCost(status.Cost, plan.ToCreate); err != nil {
+		plan.Blocker = fmt.Sprintf("Cannot create EventSub subscriptions: %v", err)
+	}
+	return plan
+}
+
+// Status queries the Twitch API to resolve the current status of all subscriptions
+// required by and/or registered to this service
+func (s *Server) Status(ctx context.Context) (*Status, error) {
+	c, err := s.newTwitchClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Twitch API client: %w", err)
+	}
+	status, err := s.fetchSubscriptionStatus(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve EventSub subscription status: %w", err)
+	}
+	return status, nil
+}
+
+// Apply registers all required EventSub subscriptions that are not currently
+// registered, returning the plan that was applied. If the plan is blocked, no
+// subscriptions are created and a *BlockedError is returned.
+func (s *Server) Apply(ctx context.Context, logger *slog.Logger) (*Plan, error) {
+	c, err := s.newTwitchClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Twitch API client: %w", err)
+	}
+	status, err := s.fetchSubscriptionStatus(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve EventSub subscription status: %w", err)
+	}
+
+	plan := NewPlan(status)
+	if plan.Blocker != "" {
+		return plan, &BlockedError{Plan: plan}
+	}
+
+	create, err := s.prepareCreate(ctx, logger, c)
+	if err != nil {
+		return plan, fmt.Errorf("failed to prepare for creating EventSub subscriptions: %w", err)
+	}
+	for _, subscription := range plan.ToCreate {
+		if err := create(subscription.Type, subscription.Version, subscription.Condition); err != nil {
+			logger.Error("Failed to create EventSub subscription",
+				"error", err,
+				"subscriptionType", subscription.Type,
+				"subscriptionVersion", subscription.Version,
+				"subscriptionCondition", subscription.Condition,
+			)
+			return plan, fmt.Errorf("failed to create EventSub subscription: %w", err)
+		}
+		logger.Info("Created new EventSub subscription",
+			"subscriptionType", subscription.Type,
+			"subscriptionVersion", subscription.Version,
+			"subscriptionCondition", subscription.Condition,
+		)
+	}
+	return plan, nil
+}
@@ -0,0 +1,84 @@
+package subscription
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewPlan(t *testing.T) {
+	enabled := State{
+		Required:  true,
+		Type:      "channel.follow",
+		Version:   "2",
+		Condition: map[string]string{"broadcaster_user_id": "1337"},
+		Status:    "enabled",
+		Cost:      0,
+	}
+	missing := State{
+		Required:      true,
+		Type:          "channel.update",
+		Version:       "2",
+		Condition:     map[string]string{"broadcaster_user_id": "1337"},
+		Status:        "missing",
+		Cost:          1,
+		CostEstimated: true,
+	}
+	missingWithoutScopes := State{
+		Required:      true,
+		Type:          "channel.cheer",
+		Version:       "1",
+		Condition:     map[string]string{"broadcaster_user_id": "1337"},
+		Status:        "missing",
+		CostEstimated: true,
+		MissingScopes: []string{"bits:read"},
+	}
+	unrequired := State{
+		Type:      "channel.raid",
+		Version:   "1",
+		Condition: map[string]string{"to_broadcaster_user_id": "1337"},
+		Status:    "enabled",
+	}
+
+	tests := []struct {
+		name        string
+		status      *Status
+		wantCreate  []State
+		wantBlocker string
+	}{
+		{
+			"nothing missing, nothing to create",
+			&Status{Ok: true, Subscriptions: []State{enabled, unrequired}},
+			[]State{},
+			"",
+		},
+		{
+			"missing subscriptions are created",
+			&Status{Subscriptions: []State{enabled, missing, unrequired}},
+			[]State{missing},
+			"",
+		},
+		{
+			"missing scopes block the plan",
+			&Status{Subscriptions: []State{missing, missingWithoutScopes}},
+			[]State{missing, missingWithoutScopes},
+			"Cannot create EventSub subscription channel.cheer (v1): the broadcaster has not granted required scopes [bits:read]; they must reauthorize via /userauth/start",
+		},
+		{
+			"exceeding max cost blocks the plan",
+			&Status{
+				Subscriptions: []State{enabled, missing},
+				Cost:          &Cost{Total: 1, TotalCost: 1, MaxTotalCost: 1},
+			},
+			[]State{missing},
+			"Cannot create EventSub subscriptions: creating 1 EventSub subscription(s) would add an estimated cost of 1 [channel.update (v2): 1], bringing our total cost to 2, which exceeds the maximum total cost of 1; existing subscriptions must be deleted first",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := NewPlan(tt.status)
+			assert.Equal(t, tt.wantCreate, plan.ToCreate)
+			assert.Equal(t, tt.wantBlocker, plan.Blocker)
+		})
+	}
+}
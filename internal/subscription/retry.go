@@ -0,0 +1,419 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+)
+
+const (
+	// DefaultMaxAttempts is the maximum number of times we'll attempt a single Twitch
+	// API request before giving up
+	DefaultMaxAttempts = 4
+
+	// DefaultRetryBaseDelay is how long we'll wait before our first retry of a failed
+	// request, absent any rate-limit information; the delay doubles with each attempt
+	DefaultRetryBaseDelay = 500 * time.Millisecond
+
+	// DefaultRetryMaxDelay is the longest we'll wait between attempts, whether due to
+	// exponential backoff or to waiting for our rate limit to reset
+	DefaultRetryMaxDelay = time.Minute
+)
+
+// rateLimit records when our app's Twitch API rate limit will reset, if a response has
+// indicated that we've exhausted it. Twitch limits requests per app access token, so a
+// single rateLimit is shared by all the clients that a Server creates, even though each
+// client only lives for the duration of a single operation.
+type rateLimit struct {
+	mu    sync.Mutex
+	reset time.Time
+}
+
+func (l *rateLimit) get() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reset
+}
+
+func (l *rateLimit) set(reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if reset.After(l.reset) {
+		l.reset = reset
+	}
+}
+
+// clear forgets the given reset time once we've waited for it, unless a later reset
+// time has been recorded in the meantime
+func (l *rateLimit) clear(reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reset.Equal(reset) {
+		l.reset = time.Time{}
+	}
+}
+
+// retrier retries requests that fail due to rate limiting (429) or transient server
+// errors (5xx), and waits for our rate limit to reset if a previous response indicated
+// that we've exhausted it
+type retrier struct {
+	ctx         context.Context
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	now         func() time.Time
+	sleep       func(ctx context.Context, d time.Duration) error
+	rateLimit   *rateLimit
+}
+
+func newRetrier(ctx context.Context, limit *rateLimit) *retrier {
+	return &retrier{
+		ctx:         ctx,
+		maxAttempts: DefaultMaxAttempts,
+		baseDelay:   DefaultRetryBaseDelay,
+		maxDelay:    DefaultRetryMaxDelay,
+		now:         time.Now,
+		sleep:       sleepContext,
+		rateLimit:   limit,
+	}
+}
+
+// retryingTwitchClient wraps a TwitchClient, retrying requests as described by
+// retrier. Listing and deleting subscriptions is safe to retry; since creating a
+// subscription is not, a failed create is only retried once we've confirmed that the
+// subscription doesn't exist.
+type retryingTwitchClient struct {
+	*retrier
+	c TwitchClient
+}
+
+func newRetryingTwitchClient(ctx context.Context, c TwitchClient, limit *rateLimit) *retryingTwitchClient {
+	return &retryingTwitchClient{
+		retrier: newRetrier(ctx, limit),
+		c:       c,
+	}
+}
+
+func (r *retryingTwitchClient) GetEventSubSubscriptions(params *helix.EventSubSubscriptionsParams) (*helix.EventSubSubscriptionsResponse, error) {
+	var res *helix.EventSubSubscriptionsResponse
+	err := r.do(func() (*helix.ResponseCommon, error) {
+		var err error
+		res, err = r.c.GetEventSubSubscriptions(params)
+		if res == nil {
+			return nil, err
+		}
+		return &res.ResponseCommon, err
+	}, nil)
+	return res, err
+}
+
+func (r *retryingTwitchClient) CreateEventSubSubscription(payload *helix.EventSubSubscription) (*helix.EventSubSubscriptionsResponse, error) {
+	var res *helix.EventSubSubscriptionsResponse
+	err := r.do(func() (*helix.ResponseCommon, error) {
+		var err error
+		res, err = r.c.CreateEventSubSubscription(payload)
+		if res == nil {
+			return nil, err
+		}
+		return &res.ResponseCommon, err
+	}, func() (bool, error) {
+		// A failed create may have taken effect anyway, so before trying again, check
+		// whether the subscription now exists: if it does, report it as created
+		existing, err := r.findSubscription(payload)
+		if err != nil {
+			return false, err
+		}
+		if existing == nil {
+			return false, nil
+		}
+		res = &helix.EventSubSubscriptionsResponse{
+			ResponseCommon: helix.ResponseCommon{StatusCode: http.StatusAccepted},
+			Data: helix.ManyEventSubSubscriptions{
+				EventSubSubscriptions: []helix.EventSubSubscription{*existing},
+			},
+		}
+		return true, nil
+	})
+	return res, err
+}
+
+func (r *retryingTwitchClient) RemoveEventSubSubscription(id string) (*helix.RemoveEventSubSubscriptionParamsResponse, error) {
+	var res *helix.RemoveEventSubSubscriptionParamsResponse
+	attempt := 0
+	err := r.do(func() (*helix.ResponseCommon, error) {
+		var err error
+		attempt++
+		res, err = r.c.RemoveEventSubSubscription(id)
+		if res == nil {
+			return nil, err
+		}
+		// If a previous attempt failed after the subscription was deleted, it will no
+		// longer be found, which is what we wanted
+		if attempt > 1 && res.StatusCode == http.StatusNotFound {
+			res.StatusCode = http.StatusNoContent
+		}
+		return &res.ResponseCommon, err
+	}, nil)
+	return res, err
+}
+
+// do makes a request via send, retrying it if it fails with a retriable error. If
+// beforeRetry is non-nil, it's called prior to each retry: if it returns true, the
+// request is considered to have succeeded and is not retried.
+func (r *retrier) do(send func() (*helix.ResponseCommon, error), beforeRetry func() (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		if err := r.waitForRateLimit(); err != nil {
+			return err
+		}
+
+		res, err := send()
+		if res != nil {
+			r.recordRateLimit(res)
+		}
+		if !isRetriable(res, err) || attempt+1 >= r.maxAttempts {
+			return err
+		}
+
+		delay := r.backoff(attempt)
+		if res != nil && res.StatusCode == http.StatusTooManyRequests && !r.rateLimit.get().IsZero() {
+			delay = 0
+		}
+		if err := r.sleep(r.ctx, delay); err != nil {
+			return err
+		}
+
+		if beforeRetry != nil {
+			done, err := beforeRetry()
+			if err != nil {
+				return fmt.Errorf("failed to check outcome of failed request before retrying: %w", err)
+			}
+			if done {
+				return nil
+			}
+		}
+	}
+}
+
+// doRequest makes a request via send, which (unlike helix) reports an unexpected
+// response status as an *apiError, retrying it in the same way as do
+func (r *retrier) doRequest(send func() error, beforeRetry func() (bool, error)) error {
+	var lastErr error
+	succeeded := false
+	err := r.do(func() (*helix.ResponseCommon, error) {
+		lastErr = send()
+		var apiErr *apiError
+		if errors.As(lastErr, &apiErr) {
+			return &helix.ResponseCommon{StatusCode: apiErr.statusCode, Header: apiErr.header}, nil
+		}
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return &helix.ResponseCommon{StatusCode: http.StatusOK}, nil
+	}, func() (bool, error) {
+		if beforeRetry == nil {
+			return false, nil
+		}
+		done, err := beforeRetry()
+		succeeded = done
+		return done, err
+	})
+	if err != nil || succeeded {
+		return err
+	}
+	return lastErr
+}
+
+// waitForRateLimit blocks until our rate limit resets, if we've exhausted it
+func (r *retrier) waitForRateLimit() error {
+	reset := r.rateLimit.get()
+	if reset.IsZero() {
+		return nil
+	}
+	delay := reset.Sub(r.now())
+	if delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	if delay > 0 {
+		if err := r.sleep(r.ctx, delay); err != nil {
+			return err
+		}
+	}
+	r.rateLimit.clear(reset)
+	return nil
+}
+
+// recordRateLimit inspects the Ratelimit-Remaining and Ratelimit-Reset headers of a
+// response, noting when we'll next be able to make a request if we've run out
+func (r *retrier) recordRateLimit(res *helix.ResponseCommon) {
+	exhausted := res.StatusCode == http.StatusTooManyRequests ||
+		(res.Header.Get("Ratelimit-Remaining") != "" && res.GetRateLimitRemaining() == 0)
+	if !exhausted || res.Header.Get("Ratelimit-Reset") == "" {
+		return
+	}
+	r.rateLimit.set(time.Unix(int64(res.GetRateLimitReset()), 0))
+}
+
+// backoff returns how long to wait before the next attempt, increasing exponentially
+// with each attempt, with jitter so that concurrent clients don't retry in lockstep
+func (r *retrier) backoff(attempt int) time.Duration {
+	delay := r.baseDelay << attempt
+	if delay <= 0 || delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// findSubscription lists existing subscriptions of the given type, returning the one
+// that matches the given subscription's version, condition and transport, if any.
+// Subscriptions registered against a conduit are created via retryingConduitClient
+// instead, since helix can't tell us which conduit a subscription belongs to.
+func (r *retryingTwitchClient) findSubscription(payload *helix.EventSubSubscription) (*helix.EventSubSubscription, error) {
+	params := &helix.EventSubSubscriptionsParams{Type: payload.Type}
+	for {
+		res, err := r.GetEventSubSubscriptions(params)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("got response %d from get subscriptions request: %s", res.StatusCode, res.ErrorMessage)
+		}
+		for i := range res.Data.EventSubSubscriptions {
+			subscription := &res.Data.EventSubSubscriptions[i]
+			if subscription.Type != payload.Type || subscription.Version != payload.Version {
+				continue
+			}
+			if subscription.Transport.Method != payload.Transport.Method || subscription.Transport.Callback != payload.Transport.Callback {
+				continue
+			}
+			if !reflect.DeepEqual(subscription.Condition, payload.Condition) {
+				continue
+			}
+			return subscription, nil
+		}
+		if res.Data.Pagination.Cursor == "" {
+			return nil, nil
+		}
+		params.After = res.Data.Pagination.Cursor
+	}
+}
+
+// retryingConduitClient wraps a ConduitClient, retrying requests as described by
+// retrier. Listing and updating conduits and their shards is safe to retry; a failed
+// conduit subscription create is only retried once we've confirmed that the
+// subscription doesn't exist. Creating a conduit is not retried, since we can't tell
+// whether a failed attempt created a conduit: findConduit will refuse to guess which of
+// several conduits is ours.
+type retryingConduitClient struct {
+	*retrier
+	cc ConduitClient
+}
+
+func newRetryingConduitClient(ctx context.Context, cc ConduitClient, limit *rateLimit) *retryingConduitClient {
+	return &retryingConduitClient{
+		retrier: newRetrier(ctx, limit),
+		cc:      cc,
+	}
+}
+
+func (r *retryingConduitClient) GetConduits(ctx context.Context) ([]Conduit, error) {
+	var conduits []Conduit
+	err := r.doRequest(func() error {
+		var err error
+		conduits, err = r.cc.GetConduits(ctx)
+		return err
+	}, nil)
+	return conduits, err
+}
+
+func (r *retryingConduitClient) CreateConduit(ctx context.Context, shardCount int) (*Conduit, error) {
+	if err := r.waitForRateLimit(); err != nil {
+		return nil, err
+	}
+	return r.cc.CreateConduit(ctx, shardCount)
+}
+
+func (r *retryingConduitClient) UpdateConduit(ctx context.Context, conduitId string, shardCount int) (*Conduit, error) {
+	var conduit *Conduit
+	err := r.doRequest(func() error {
+		var err error
+		conduit, err = r.cc.UpdateConduit(ctx, conduitId, shardCount)
+		return err
+	}, nil)
+	return conduit, err
+}
+
+func (r *retryingConduitClient) GetConduitShards(ctx context.Context, conduitId string) ([]ConduitShard, error) {
+	var shards []ConduitShard
+	err := r.doRequest(func() error {
+		var err error
+		shards, err = r.cc.GetConduitShards(ctx, conduitId)
+		return err
+	}, nil)
+	return shards, err
+}
+
+func (r *retryingConduitClient) UpdateConduitShards(ctx context.Context, conduitId string, shards []ConduitShard) error {
+	return r.doRequest(func() error {
+		return r.cc.UpdateConduitShards(ctx, conduitId, shards)
+	}, nil)
+}
+
+func (r *retryingConduitClient) CreateConduitSubscription(ctx context.Context, subscriptionType string, version string, condition map[string]string, conduitId string) error {
+	return r.doRequest(func() error {
+		return r.cc.CreateConduitSubscription(ctx, subscriptionType, version, condition, conduitId)
+	}, func() (bool, error) {
+		// helix can't tell us which conduit a subscription belongs to, so check whether
+		// the failed create took effect by listing our conduit's subscriptions directly
+		subscriptions, err := r.GetConduitSubscriptions(ctx, conduitId)
+		if err != nil {
+			return false, err
+		}
+		for _, subscription := range subscriptions {
+			if subscription.Type == subscriptionType && subscription.Version == version && parseCondition(subscription.Condition) == parseCondition(condition) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func (r *retryingConduitClient) GetConduitSubscriptions(ctx context.Context, conduitId string) ([]ConduitSubscription, error) {
+	var subscriptions []ConduitSubscription
+	err := r.doRequest(func() error {
+		var err error
+		subscriptions, err = r.cc.GetConduitSubscriptions(ctx, conduitId)
+		return err
+	}, nil)
+	return subscriptions, err
+}
+
+// isRetriable returns true if a request failed in a way that may succeed if retried:
+// i.e. it failed to complete at all, or Twitch reported a rate limit or server error
+func isRetriable(res *helix.ResponseCommon, err error) bool {
+	if err != nil {
+		return true
+	}
+	if res == nil {
+		return false
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
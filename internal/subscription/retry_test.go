@@ -0,0 +1,439 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_retryingTwitchClient_GetEventSubSubscriptions(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rateLimitExhausted := http.Header{
+		"Ratelimit-Remaining": {"0"},
+		"Ratelimit-Reset":     {strconv.FormatInt(now.Add(20*time.Second).Unix(), 10)},
+	}
+	tests := []struct {
+		name          string
+		failures      []scriptedFailure
+		wantStatus    int
+		wantErr       bool
+		wantNumCalls  int
+		wantNumSleeps int
+		wantMinSleep  time.Duration
+	}{
+		{
+			"success is not retried",
+			nil,
+			http.StatusOK,
+			false,
+			1,
+			0,
+			0,
+		},
+		{
+			"server errors are retried with backoff",
+			[]scriptedFailure{{status: http.StatusServiceUnavailable}, {status: http.StatusBadGateway}},
+			http.StatusOK,
+			false,
+			3,
+			2,
+			0,
+		},
+		{
+			"network errors are retried",
+			[]scriptedFailure{{err: errors.New("connection reset by peer")}},
+			http.StatusOK,
+			false,
+			2,
+			1,
+			0,
+		},
+		{
+			"rate limited request is retried once rate limit resets",
+			[]scriptedFailure{{status: http.StatusTooManyRequests, header: rateLimitExhausted}},
+			http.StatusOK,
+			false,
+			2,
+			2,
+			20 * time.Second,
+		},
+		{
+			"client errors are not retried",
+			[]scriptedFailure{{status: http.StatusBadRequest}},
+			http.StatusBadRequest,
+			false,
+			1,
+			0,
+			0,
+		},
+		{
+			"gives up after max attempts",
+			[]scriptedFailure{{status: http.StatusInternalServerError}, {status: http.StatusInternalServerError}, {status: http.StatusInternalServerError}},
+			http.StatusInternalServerError,
+			false,
+			3,
+			2,
+			0,
+		},
+		{
+			"gives up after max attempts with network errors",
+			[]scriptedFailure{{err: errors.New("timeout")}, {err: errors.New("timeout")}, {err: errors.New("timeout")}},
+			0,
+			true,
+			3,
+			2,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &scriptedTwitchClient{mockTwitchClient: &mockTwitchClient{}, failures: tt.failures}
+			r, sleeps := newTestRetryingTwitchClient(c, now)
+
+			res, err := r.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantStatus, res.StatusCode)
+			}
+			assert.Equal(t, tt.wantNumCalls, c.numCalls)
+			assert.Len(t, *sleeps, tt.wantNumSleeps)
+			total := time.Duration(0)
+			for _, d := range *sleeps {
+				total += d
+			}
+			assert.GreaterOrEqual(t, total, tt.wantMinSleep)
+		})
+	}
+}
+
+func Test_retryingTwitchClient_rateLimitRemaining(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &scriptedTwitchClient{
+		mockTwitchClient: &mockTwitchClient{},
+		header: http.Header{
+			"Ratelimit-Remaining": {"0"},
+			"Ratelimit-Reset":     {strconv.FormatInt(now.Add(5*time.Second).Unix(), 10)},
+		},
+	}
+	r, sleeps := newTestRetryingTwitchClient(c, now)
+
+	// A successful response indicating that we've exhausted our rate limit should cause
+	// our next request to wait until the limit resets
+	_, err := r.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{})
+	assert.NoError(t, err)
+	assert.Len(t, *sleeps, 0)
+	_, err = r.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Second}, *sleeps)
+}
+
+func Test_retryingTwitchClient_sharedRateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &scriptedTwitchClient{
+		mockTwitchClient: &mockTwitchClient{},
+		header: http.Header{
+			"Ratelimit-Remaining": {"0"},
+			"Ratelimit-Reset":     {strconv.FormatInt(now.Add(5*time.Second).Unix(), 10)},
+		},
+	}
+	first, _ := newTestRetryingTwitchClient(c, now)
+	second, sleeps := newTestRetryingTwitchClient(c, now)
+	second.rateLimit = first.rateLimit
+
+	// Each operation gets its own client, but they all share our app's rate limit: once
+	// one client has exhausted it, the next client must wait for it to reset
+	_, err := first.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{})
+	assert.NoError(t, err)
+	_, err = second.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Second}, *sleeps)
+}
+
+func Test_retryingTwitchClient_CreateEventSubSubscription(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         []scriptedFailure
+		wantStatus       int
+		wantNumCalls     int
+		wantNumCreated   int
+		wantSubscription bool
+	}{
+		{
+			"failed create that did not take effect is retried",
+			[]scriptedFailure{{status: http.StatusServiceUnavailable}},
+			http.StatusAccepted,
+			2,
+			1,
+			false,
+		},
+		{
+			"failed create that took effect is not retried",
+			[]scriptedFailure{{status: http.StatusServiceUnavailable, applied: true}},
+			http.StatusAccepted,
+			1,
+			1,
+			true,
+		},
+		{
+			"create interrupted by network error that took effect is not retried",
+			[]scriptedFailure{{err: errors.New("unexpected EOF"), applied: true}},
+			http.StatusAccepted,
+			1,
+			1,
+			true,
+		},
+		{
+			"conflict is not retried",
+			[]scriptedFailure{{status: http.StatusConflict}},
+			http.StatusConflict,
+			1,
+			0,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &scriptedTwitchClient{mockTwitchClient: &mockTwitchClient{}, failures: tt.failures}
+			r, _ := newTestRetryingTwitchClient(c, time.Now())
+
+			res, err := r.CreateEventSubSubscription(&helix.EventSubSubscription{
+				Type:    helix.EventSubTypeStreamOnline,
+				Version: "1",
+				Condition: helix.EventSubCondition{
+					BroadcasterUserID: "1337",
+				},
+				Transport: helix.EventSubTransport{
+					Method:   "webhook",
+					Callback: "https://my-cool-service.com/callback",
+				},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			assert.Equal(t, tt.wantNumCalls, c.numCreateCalls)
+			assert.Len(t, c.subscriptions, tt.wantNumCreated)
+			if tt.wantSubscription {
+				assert.Len(t, res.Data.EventSubSubscriptions, 1)
+				assert.Equal(t, "10000001", res.Data.EventSubSubscriptions[0].ID)
+			}
+		})
+	}
+}
+
+func Test_retryingTwitchClient_RemoveEventSubSubscription(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   []scriptedFailure
+		wantStatus int
+	}{
+		{
+			"failed delete is retried",
+			[]scriptedFailure{{status: http.StatusInternalServerError}},
+			http.StatusNoContent,
+		},
+		{
+			"failed delete that took effect is treated as success",
+			[]scriptedFailure{{status: http.StatusInternalServerError, applied: true}},
+			http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &scriptedTwitchClient{
+				mockTwitchClient: &mockTwitchClient{
+					subscriptions: []helix.EventSubSubscription{{ID: "10000001"}},
+				},
+				failures: tt.failures,
+			}
+			r, _ := newTestRetryingTwitchClient(c, time.Now())
+
+			res, err := r.RemoveEventSubSubscription("10000001")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			assert.Len(t, c.subscriptions, 0)
+		})
+	}
+
+	// A delete that fails with a 404 on the first attempt should still be reported as
+	// such, since the subscription never existed
+	c := &scriptedTwitchClient{mockTwitchClient: &mockTwitchClient{}}
+	r, _ := newTestRetryingTwitchClient(c, time.Now())
+	res, err := r.RemoveEventSubSubscription("10000001")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func Test_retryingConduitClient_CreateConduitSubscription(t *testing.T) {
+	tests := []struct {
+		name           string
+		failures       []scriptedFailure
+		wantErr        bool
+		wantNumCalls   int
+		wantNumCreated int
+	}{
+		{
+			"failed create that did not take effect is retried",
+			[]scriptedFailure{{status: http.StatusServiceUnavailable}},
+			false,
+			2,
+			1,
+		},
+		{
+			"failed create that took effect is not retried",
+			[]scriptedFailure{{status: http.StatusServiceUnavailable, applied: true}},
+			false,
+			1,
+			1,
+		},
+		{
+			"create interrupted by network error that took effect is not retried",
+			[]scriptedFailure{{err: errors.New("unexpected EOF"), applied: true}},
+			false,
+			1,
+			1,
+		},
+		{
+			"conflict is not retried",
+			[]scriptedFailure{{status: http.StatusConflict}},
+			true,
+			1,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &mockTwitchClient{}
+			cc := &scriptedConduitClient{
+				mockConduitClient: &mockConduitClient{twitch: c},
+				failures:          tt.failures,
+			}
+			r := newRetryingConduitClient(context.Background(), cc, &rateLimit{})
+			r.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+			err := r.CreateConduitSubscription(context.Background(), helix.EventSubTypeStreamOnline, "1", map[string]string{"broadcaster_user_id": "1337"}, "my-conduit")
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantNumCalls, cc.numCreateCalls)
+			assert.Len(t, c.subscriptions, tt.wantNumCreated)
+		})
+	}
+}
+
+// newTestRetryingTwitchClient returns a retryingTwitchClient that records how long it
+// would have slept rather than sleeping, and whose clock is frozen at now
+func newTestRetryingTwitchClient(c TwitchClient, now time.Time) (*retryingTwitchClient, *[]time.Duration) {
+	sleeps := make([]time.Duration, 0)
+	r := newRetryingTwitchClient(context.Background(), c, &rateLimit{})
+	r.maxAttempts = 3
+	r.now = func() time.Time { return now }
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return r, &sleeps
+}
+
+// scriptedFailure describes a single failed request: either a network error (err) or
+// a response with the given status and headers. If applied is true, the request still
+// takes effect, as if it failed after Twitch had processed it.
+type scriptedFailure struct {
+	status  int
+	header  http.Header
+	err     error
+	applied bool
+}
+
+// scriptedTwitchClient wraps mockTwitchClient, failing each request in accordance with
+// the next scripted failure, if any remain. Successful responses carry header.
+type scriptedTwitchClient struct {
+	*mockTwitchClient
+	failures       []scriptedFailure
+	header         http.Header
+	numCalls       int
+	numCreateCalls int
+}
+
+func (s *scriptedTwitchClient) next() *scriptedFailure {
+	s.numCalls++
+	if len(s.failures) == 0 {
+		return nil
+	}
+	failure := s.failures[0]
+	s.failures = s.failures[1:]
+	return &failure
+}
+
+func (s *scriptedTwitchClient) GetEventSubSubscriptions(params *helix.EventSubSubscriptionsParams) (*helix.EventSubSubscriptionsResponse, error) {
+	if f := s.next(); f != nil {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &helix.EventSubSubscriptionsResponse{ResponseCommon: helix.ResponseCommon{StatusCode: f.status, Header: f.header}}, nil
+	}
+	res, err := s.mockTwitchClient.GetEventSubSubscriptions(params)
+	if res != nil {
+		res.Header = s.header
+	}
+	return res, err
+}
+
+func (s *scriptedTwitchClient) CreateEventSubSubscription(payload *helix.EventSubSubscription) (*helix.EventSubSubscriptionsResponse, error) {
+	s.numCreateCalls++
+	if f := s.next(); f != nil {
+		if f.applied {
+			s.mockTwitchClient.CreateEventSubSubscription(payload)
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &helix.EventSubSubscriptionsResponse{ResponseCommon: helix.ResponseCommon{StatusCode: f.status, Header: f.header}}, nil
+	}
+	return s.mockTwitchClient.CreateEventSubSubscription(payload)
+}
+
+func (s *scriptedTwitchClient) RemoveEventSubSubscription(id string) (*helix.RemoveEventSubSubscriptionParamsResponse, error) {
+	if f := s.next(); f != nil {
+		if f.applied {
+			s.mockTwitchClient.RemoveEventSubSubscription(id)
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &helix.RemoveEventSubSubscriptionParamsResponse{ResponseCommon: helix.ResponseCommon{StatusCode: f.status, Header: f.header}}, nil
+	}
+	return s.mockTwitchClient.RemoveEventSubSubscription(id)
+}
+
+// scriptedConduitClient wraps mockConduitClient, failing each attempt to create a
+// subscription in accordance with the next scripted failure, if any remain
+type scriptedConduitClient struct {
+	*mockConduitClient
+	failures       []scriptedFailure
+	numCreateCalls int
+}
+
+func (s *scriptedConduitClient) CreateConduitSubscription(ctx context.Context, subscriptionType string, version string, condition map[string]string, conduitId string) error {
+	s.numCreateCalls++
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.applied {
+			s.mockConduitClient.CreateConduitSubscription(ctx, subscriptionType, version, condition, conduitId)
+		}
+		if f.err != nil {
+			return f.err
+		}
+		return &apiError{method: http.MethodPost, path: "/eventsub/subscriptions", statusCode: f.status, header: f.header}
+	}
+	return s.mockConduitClient.CreateConduitSubscription(ctx, subscriptionType, version, condition, conduitId)
+}
@@ -0,0 +1,234 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/golden-vcr/server-common/entry"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// SecretRotationResult is the response body for POST /subscriptions/rotate-secret
+type SecretRotationResult struct {
+	Rotated                     []RotatedSubscription `json:"rotated"`
+	PreviousSecretsCanBeRetired bool                  `json:"previous_secrets_can_be_retired"`
+}
+
+// RotatedSubscription identifies a subscription that was replaced with our current
+// webhook secret, or a conduit shard that was reassigned with our current secret
+type RotatedSubscription struct {
+	Type      string            `json:"type,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Condition map[string]string `json:"condition,omitempty"`
+	ShardId   string            `json:"shard_id,omitempty"`
+}
+
+// resolveSecretRotationStatus determines how many of our subscriptions may still be
+// using a previous webhook secret, i.e. were created before the secret was rotated.
+// Subscriptions on legacy callback URLs are ignored, since they're expected to be
+// migrated rather than rotated.
+func (s *Server) resolveSecretRotationStatus(status *Status) *SecretRotationStatus {
+	numPending := len(s.getStaleSecretSubscriptions(status))
+	return &SecretRotationStatus{
+		RotatedAt:                   s.secretRotatedAt,
+		NumPending:                  numPending,
+		PreviousSecretsCanBeRetired: numPending == 0,
+	}
+}
+
+// getStaleSecretSubscriptions returns all subscriptions that may still be using a
+// previous webhook secret
+func (s *Server) getStaleSecretSubscriptions(status *Status) []State {
+	stale := make([]State, 0)
+	for _, state := range status.Subscriptions {
+		if state.subscriptionId == "" || state.LegacyCallbackUrl != "" {
+			continue
+		}
+		if state.createdAt.Before(s.secretRotatedAt) {
+			stale = append(stale, state)
+		}
+	}
+	return stale
+}
+
+// handlePostRotateSecret (POST /subscriptions/rotate-secret) ensures that all of our
+// subscriptions use our current webhook secret, so that previous secrets can be
+// retired. Each subscription that may be using a previous secret is replaced, one at a
+// time: its replacement is created first, and the old subscription is only deleted
+// once the replacement is enabled, so no subscription is ever absent. (The callback
+// handler continues to accept previous secrets throughout.) If we're using a conduit,
+// each of its shards is instead reassigned with the current secret, one at a time.
+func (s *Server) handlePostRotateSecret(res http.ResponseWriter, req *http.Request) {
+	logger := entry.Log(req)
+
+	c, err := s.newTwitchClient(req.Context())
+	if err != nil {
+		logger.Error("Failed to initialize Twitch API client", "error", err)
+		http.Error(res, fmt.Sprintf("failed to initialize Twitch API client: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var rotated []RotatedSubscription
+	if s.usesConduit() {
+		rotated, err = s.rotateConduitSecret(req.Context(), logger)
+	} else {
+		rotated, err = s.rotateSubscriptionSecrets(req.Context(), logger, c)
+	}
+	if err != nil {
+		logger.Error("Failed to rotate webhook secret", "error", err)
+		http.Error(res, fmt.Sprintf("Failed to rotate webhook secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Previous secrets can only be retired if no subscriptions are still using them:
+	// check in the same way as GET /subscriptions, in case any subscription was created
+	// with a previous secret while we were rotating. A conduit's shards have all been
+	// reassigned if we got this far, and its subscriptions have no secrets of their own.
+	result := SecretRotationResult{
+		Rotated:                     rotated,
+		PreviousSecretsCanBeRetired: true,
+	}
+	if !s.usesConduit() {
+		status, err := s.fetchSubscriptionStatus(req.Context(), c)
+		if err != nil {
+			logger.Error("Failed to resolve EventSub subscription status", "error", err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.PreviousSecretsCanBeRetired = s.resolveSecretRotationStatus(status).PreviousSecretsCanBeRetired
+	}
+	if err := json.NewEncoder(res).Encode(result); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// rotationQueryParam is the query param that we add to our callback URL in order to
+// distinguish a replacement subscription from the one it replaces
+const rotationQueryParam = "rotation"
+
+// rotateSubscriptionSecrets replaces every subscription that may be using a previous
+// webhook secret. Twitch will not register two subscriptions with identical
+// transports, so each replacement is registered against our callback URL with (or, if
+// the old subscription already had it, without) a rotation query param. Both
+// subscriptions deliver notifications until the old one is deleted, and the callback
+// handler discards the resulting duplicates.
+func (s *Server) rotateSubscriptionSecrets(ctx context.Context, logger *slog.Logger, c TwitchClient) ([]RotatedSubscription, error) {
+	status, err := s.fetchSubscriptionStatus(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve EventSub subscription status: %w", err)
+	}
+
+	rotated := make([]RotatedSubscription, 0)
+	for _, state := range s.getStaleSecretSubscriptions(status) {
+		logger := logger.With(
+			"subscriptionId", state.subscriptionId,
+			"subscriptionType", state.Type,
+			"subscriptionVersion", state.Version,
+			"subscriptionCondition", state.Condition,
+		)
+		callbackUrl := s.callbackUrl
+		if state.callbackUrl == s.callbackUrl {
+			callbackUrl = fmt.Sprintf("%s?%s=%d", s.callbackUrl, rotationQueryParam, time.Now().Unix())
+		}
+		if err := s.createSubscriptionAt(c, callbackUrl, state.Type, state.Version, state.Condition); err != nil {
+			return rotated, fmt.Errorf("failed to create replacement %s subscription: %w", state.Type, err)
+		}
+		if err := s.waitForReplacementEnabled(ctx, c, callbackUrl, state); err != nil {
+			return rotated, fmt.Errorf("replacement %s subscription was not enabled: %w", state.Type, err)
+		}
+		if err := s.deleteSubscription(c, state.subscriptionId); err != nil {
+			return rotated, fmt.Errorf("failed to delete %s subscription: %w", state.Type, err)
+		}
+		logger.Info("Replaced EventSub subscription with one using current webhook secret", "callbackUrl", callbackUrl)
+		rotated = append(rotated, RotatedSubscription{
+			Type:      state.Type,
+			Version:   state.Version,
+			Condition: state.Condition,
+		})
+	}
+	return rotated, nil
+}
+
+// waitForReplacementEnabled polls until the subscription that we've registered against
+// callbackUrl in order to replace the given subscription is enabled. Unlike
+// waitForEnabled, it can't match on type, version, and condition alone, since the
+// subscription being replaced matches those too.
+func (s *Server) waitForReplacementEnabled(ctx context.Context, c TwitchClient, callbackUrl string, replacing State) error {
+	ctx, cancel := context.WithTimeout(ctx, s.verificationTimeout)
+	defer cancel()
+	isReplacement := func(subscription *helix.EventSubSubscription) bool {
+		return subscription.Transport.Method == "webhook" && subscription.Transport.Callback == callbackUrl
+	}
+	for {
+		subscriptions, _, err := getOwnedSubscriptions(c, s.conditionParams, s.requiredSubscriptions, isReplacement)
+		if err != nil {
+			return fmt.Errorf("failed to get EventSub subscriptions: %w", err)
+		}
+		for _, subscription := range subscriptions {
+			if subscription.Type != replacing.Type || subscription.Version != replacing.Version {
+				continue
+			}
+			if !reflect.DeepEqual(formatCondition(&subscription.Condition), replacing.Condition) {
+				continue
+			}
+			switch subscription.Status {
+			case helix.EventSubStatusEnabled:
+				return nil
+			case "webhook_callback_verification_pending":
+			default:
+				return fmt.Errorf("subscription has status '%s'", subscription.Status)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for subscription to be enabled")
+		case <-time.After(s.verificationPollInterval):
+		}
+	}
+}
+
+// rotateConduitSecret reassigns each of our conduit's shards with our current webhook
+// secret
+func (s *Server) rotateConduitSecret(ctx context.Context, logger *slog.Logger) ([]RotatedSubscription, error) {
+	cc, err := s.newConduitClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Twitch API client for conduits: %w", err)
+	}
+	conduit, err := s.findConduit(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+	if conduit == nil {
+		return nil, fmt.Errorf("no conduit exists")
+	}
+
+	rotated := make([]RotatedSubscription, 0)
+	for i, callbackUrl := range s.conduitShardCallbackUrls {
+		shardId := fmt.Sprintf("%d", i)
+		err := cc.UpdateConduitShards(ctx, conduit.Id, []ConduitShard{
+			{
+				Id: shardId,
+				Transport: ConduitShardTransport{
+					Method:   "webhook",
+					Callback: callbackUrl,
+					Secret:   s.twitchWebhookSecret,
+				},
+			},
+		})
+		if err != nil {
+			return rotated, fmt.Errorf("failed to update conduit shard %s: %w", shardId, err)
+		}
+		if err := s.waitForShardEnabled(ctx, cc, shardId); err != nil {
+			return rotated, fmt.Errorf("conduit shard %s was not enabled: %w", shardId, err)
+		}
+		logger.Info("Reassigned EventSub conduit shard with current webhook secret", "conduitId", conduit.Id, "shardId", shardId)
+		rotated = append(rotated, RotatedSubscription{ShardId: shardId})
+	}
+	return rotated, nil
+}
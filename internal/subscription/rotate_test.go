@@ -0,0 +1,246 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Server_handlePostRotateSecret(t *testing.T) {
+	rotatedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newSubscription := func(id string, subscriptionType string, createdAt time.Time) helix.EventSubSubscription {
+		return helix.EventSubSubscription{
+			ID:      id,
+			Type:    subscriptionType,
+			Version: "1",
+			Condition: helix.EventSubCondition{
+				BroadcasterUserID: "1337",
+			},
+			Transport: helix.EventSubTransport{
+				Method:   "webhook",
+				Callback: "https://my-cool-service.com/callback",
+			},
+			Status:    "enabled",
+			CreatedAt: helix.Time{Time: createdAt},
+		}
+	}
+	c := &deletionRecordingTwitchClient{
+		verifyingTwitchClient: &verifyingTwitchClient{
+			mockTwitchClient: &mockTwitchClient{
+				subscriptions: []helix.EventSubSubscription{
+					newSubscription("10000001", helix.EventSubTypeStreamOnline, rotatedAt.Add(-time.Hour)),
+					newSubscription("10000002", helix.EventSubTypeStreamOffline, rotatedAt.Add(time.Hour)),
+				},
+			},
+			statusAfterVerification: "enabled",
+		},
+	}
+	s := &Server{
+		callbackUrl: "https://my-cool-service.com/callback",
+		conditionParams: hooks.RequiredSubscriptionConditionParams{
+			ChannelUserId: "1337",
+		},
+		requiredSubscriptions: hooks.RequiredSubscriptions{
+			{
+				Type:    helix.EventSubTypeStreamOnline,
+				Version: "1",
+				TemplatedCondition: helix.EventSubCondition{
+					BroadcasterUserID: "{{.ChannelUserId}}",
+				},
+			},
+			{
+				Type:    helix.EventSubTypeStreamOffline,
+				Version: "1",
+				TemplatedCondition: helix.EventSubCondition{
+					BroadcasterUserID: "{{.ChannelUserId}}",
+				},
+			},
+		},
+		newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+			return c, nil
+		},
+		twitchWebhookSecret:      "new-secret",
+		secretRotatedAt:          rotatedAt,
+		verificationTimeout:      50 * time.Millisecond,
+		verificationPollInterval: time.Millisecond,
+	}
+
+	// Only the subscription created before the rotation may be using an old secret
+	status, err := s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.Equal(t, &SecretRotationStatus{
+		RotatedAt:                   rotatedAt,
+		NumPending:                  1,
+		PreviousSecretsCanBeRetired: false,
+	}, status.SecretRotation)
+
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/rotate-secret", nil)
+	res := httptest.NewRecorder()
+	s.handlePostRotateSecret(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var result SecretRotationResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.True(t, result.PreviousSecretsCanBeRetired)
+	assert.Equal(t, []RotatedSubscription{
+		{
+			Type:      helix.EventSubTypeStreamOnline,
+			Version:   "1",
+			Condition: map[string]string{"broadcaster_user_id": "1337"},
+		},
+	}, result.Rotated)
+
+	// The stale subscription should have been replaced with one using the new secret,
+	// registered against a distinct callback URL so that Twitch would accept it while
+	// the stale subscription still existed
+	ids := make([]string, 0)
+	for _, subscription := range c.subscriptions {
+		ids = append(ids, subscription.ID)
+		if subscription.Type == helix.EventSubTypeStreamOnline {
+			assert.Equal(t, "new-secret", subscription.Transport.Secret)
+			assert.Regexp(t, `^https://my-cool-service\.com/callback\?rotation=\d+$`, subscription.Transport.Callback)
+		}
+	}
+	assert.ElementsMatch(t, []string{"10000002", "10000003"}, ids)
+
+	// The stale subscription should only have been deleted once its replacement was
+	// enabled, so that the subscription was never absent
+	assert.Equal(t, []deletion{
+		{
+			subscriptionId: "10000001",
+			remaining: map[string]string{
+				"10000001": "enabled",
+				"10000002": "enabled",
+				"10000003": "enabled",
+			},
+		},
+	}, c.deletions)
+
+	status, err = s.fetchSubscriptionStatus(context.Background(), c)
+	assert.NoError(t, err)
+	assert.True(t, status.Ok)
+	assert.Equal(t, 0, status.SecretRotation.NumPending)
+	assert.True(t, status.SecretRotation.PreviousSecretsCanBeRetired)
+}
+
+func Test_Server_handlePostRotateSecret_stillPending(t *testing.T) {
+	// If the rotation time is later than the time at which we recreate subscriptions
+	// (e.g. if it's been misconfigured), recreated subscriptions are still considered
+	// to be using a previous secret, so we mustn't report that they can be retired
+	c := &verifyingTwitchClient{
+		mockTwitchClient: &mockTwitchClient{
+			subscriptions: []helix.EventSubSubscription{
+				{
+					ID:        "10000001",
+					Type:      helix.EventSubTypeStreamOnline,
+					Version:   "1",
+					Condition: helix.EventSubCondition{BroadcasterUserID: "1337"},
+					Transport: helix.EventSubTransport{Method: "webhook", Callback: "https://my-cool-service.com/callback"},
+					Status:    "enabled",
+					CreatedAt: helix.Time{Time: time.Now().Add(-time.Hour)},
+				},
+			},
+		},
+		statusAfterVerification: "enabled",
+	}
+	s := &Server{
+		callbackUrl: "https://my-cool-service.com/callback",
+		conditionParams: hooks.RequiredSubscriptionConditionParams{
+			ChannelUserId: "1337",
+		},
+		requiredSubscriptions: hooks.RequiredSubscriptions{
+			{
+				Type:    helix.EventSubTypeStreamOnline,
+				Version: "1",
+				TemplatedCondition: helix.EventSubCondition{
+					BroadcasterUserID: "{{.ChannelUserId}}",
+				},
+			},
+		},
+		newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+			return c, nil
+		},
+		twitchWebhookSecret:      "new-secret",
+		secretRotatedAt:          time.Now().Add(time.Hour),
+		verificationTimeout:      50 * time.Millisecond,
+		verificationPollInterval: time.Millisecond,
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/rotate-secret", nil)
+	res := httptest.NewRecorder()
+	s.handlePostRotateSecret(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var result SecretRotationResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.Len(t, result.Rotated, 1)
+	assert.False(t, result.PreviousSecretsCanBeRetired)
+	if assert.Len(t, c.subscriptions, 1) {
+		assert.Equal(t, "10000002", c.subscriptions[0].ID)
+		assert.Contains(t, c.subscriptions[0].Transport.Callback, "?rotation=")
+	}
+
+	// Rotating again should replace that subscription in turn, moving it back to our
+	// callback URL as-is, since Twitch won't accept a second identical transport
+	res = httptest.NewRecorder()
+	s.handlePostRotateSecret(res, httptest.NewRequest(http.MethodPost, "/subscriptions/rotate-secret", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	if assert.Len(t, c.subscriptions, 1) {
+		assert.Equal(t, "10000003", c.subscriptions[0].ID)
+		assert.Equal(t, "https://my-cool-service.com/callback", c.subscriptions[0].Transport.Callback)
+	}
+}
+
+func Test_Server_handlePostRotateSecret_conduit(t *testing.T) {
+	c := &mockTwitchClient{}
+	cc := &mockConduitClient{
+		twitch:   c,
+		conduits: []Conduit{{Id: "my-conduit", ShardCount: 2}},
+		shards: []ConduitShard{
+			{Id: "0", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-a.com/callback"}},
+			{Id: "1", Status: "enabled", Transport: ConduitShardTransport{Method: "webhook", Callback: "https://replica-b.com/callback"}},
+		},
+	}
+	s := newTestConduitServer(c, cc)
+	s.verificationTimeout = 50 * time.Millisecond
+	s.verificationPollInterval = time.Millisecond
+
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/rotate-secret", nil)
+	res := httptest.NewRecorder()
+	s.handlePostRotateSecret(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var result SecretRotationResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.True(t, result.PreviousSecretsCanBeRetired)
+	assert.Equal(t, []RotatedSubscription{{ShardId: "0"}, {ShardId: "1"}}, result.Rotated)
+	assert.Equal(t, 2, cc.numShardUpdates)
+}
+
+// deletionRecordingTwitchClient records the status of every subscription that existed
+// at the time each subscription was deleted
+type deletionRecordingTwitchClient struct {
+	*verifyingTwitchClient
+	deletions []deletion
+}
+
+type deletion struct {
+	subscriptionId string
+	remaining      map[string]string
+}
+
+func (d *deletionRecordingTwitchClient) RemoveEventSubSubscription(id string) (*helix.RemoveEventSubSubscriptionParamsResponse, error) {
+	remaining := make(map[string]string)
+	for _, subscription := range d.subscriptions {
+		remaining[subscription.ID] = subscription.Status
+	}
+	d.deletions = append(d.deletions, deletion{subscriptionId: id, remaining: remaining})
+	return d.verifyingTwitchClient.RemoveEventSubSubscription(id)
+}
@@ -3,19 +3,32 @@ package subscription
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/golden-vcr/auth"
 	"github.com/golden-vcr/hooks"
+	"github.com/golden-vcr/hooks/internal/apptoken"
 	"github.com/golden-vcr/server-common/entry"
-	"github.com/golden-vcr/server-common/twitch"
 	"github.com/gorilla/mux"
 	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
 )
 
 type NewTwitchClientFunc func(ctx context.Context) (TwitchClient, error)
 
+// GetGrantedScopesFunc returns the list of OAuth scopes that the broadcaster has
+// granted to our app, or nil if that's unknown. It's called whenever we check the
+// status of our subscriptions, so it should be cheap and shouldn't depend on Twitch.
+type GetGrantedScopesFunc func(ctx context.Context) ([]string, error)
+
+// GetDisconnectionFunc returns details of our app having been disconnected from the
+// broadcaster's channel, or nil if it's not disconnected
+type GetDisconnectionFunc func(ctx context.Context) (*Disconnection, error)
+
 type Server struct {
 	callbackUrl           string
 	conditionParams       hooks.RequiredSubscriptionConditionParams
@@ -23,19 +36,100 @@ type Server struct {
 
 	newTwitchClient     NewTwitchClientFunc
 	twitchWebhookSecret string
+	getGrantedScopes    GetGrantedScopesFunc
+	getDisconnection    GetDisconnectionFunc
+
+	// If conduitShardCallbackUrls is non-empty, subscriptions are registered against
+	// an EventSub conduit, with one shard delivering notifications to each of these
+	// URLs; otherwise they're registered directly against callbackUrl
+	conduitShardCallbackUrls []string
+	newConduitClient         NewConduitClientFunc
+
+	// conduitId identifies the conduit that belongs to this service, if our app owns
+	// more than one: if empty, our app must own no more than one conduit
+	conduitId string
+
+	// legacyCallbackUrls lists webhook callback URLs that were used by previous
+	// deployments of this service (e.g. before ORIGIN was changed): subscriptions
+	// registered against them are reported so they can be migrated
+	legacyCallbackUrls []string
+
+	// rateLimit is shared by every Twitch API client we create, so that once we've
+	// exhausted our app's rate limit, no request is made until it resets
+	rateLimit *rateLimit
+
+	// If secretRotatedAt is set, our webhook secret has been rotated, and Twitch may
+	// still deliver notifications signed with a previous secret for any subscription
+	// created before that time
+	secretRotatedAt time.Time
+
+	verificationTimeout      time.Duration
+	verificationPollInterval time.Duration
 }
 
-func NewServer(origin, twitchChannelUserId, twitchClientId, twitchClientSecret, twitchWebhookSecret string) *Server {
+// Options configures the optional behavior of a Server
+type Options struct {
+	// GetGrantedScopes is called whenever we check the status of our subscriptions, so
+	// that we can flag any that can't be created due to missing scopes: if nil, granted
+	// scopes are unknown and nothing is flagged
+	GetGrantedScopes GetGrantedScopesFunc
+
+	// GetDisconnection is called whenever we check the status of our subscriptions, so
+	// that we can report if our app has been disconnected from the broadcaster's
+	// channel: if nil, no disconnection is reported
+	GetDisconnection GetDisconnectionFunc
+
+	// ConduitShardCallbackUrls, if non-empty, causes subscriptions to be registered
+	// against an EventSub conduit, with one shard per URL; ConduitId identifies our
+	// conduit if our app owns more than one
+	ConduitShardCallbackUrls []string
+	ConduitId                string
+
+	// LegacyCallbackUrls lists webhook callback URLs used by previous deployments of
+	// this service, so that subscriptions registered against them can be migrated
+	LegacyCallbackUrls []string
+
+	// SecretRotatedAt, if set, is when our webhook secret was last rotated: any
+	// subscription created before then may still be using a previous secret
+	SecretRotatedAt time.Time
+}
+
+func NewServer(origin, twitchChannelUserId string, appTokens *apptoken.Provider, twitchWebhookSecret string, opts Options) *Server {
+	limit := &rateLimit{}
 	return &Server{
 		callbackUrl: origin + "/callback",
 		conditionParams: hooks.RequiredSubscriptionConditionParams{
 			ChannelUserId: twitchChannelUserId,
+			ClientId:      appTokens.ClientId(),
 		},
 		requiredSubscriptions: hooks.Subscriptions,
 		newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
-			return twitch.NewClientWithAppToken(ctx, twitchClientId, twitchClientSecret)
+			c, err := appTokens.NewTwitchClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return newRetryingTwitchClient(ctx, c, limit), nil
 		},
 		twitchWebhookSecret: twitchWebhookSecret,
+		getGrantedScopes:    opts.GetGrantedScopes,
+		getDisconnection:    opts.GetDisconnection,
+
+		conduitShardCallbackUrls: opts.ConduitShardCallbackUrls,
+		newConduitClient: func(ctx context.Context) (ConduitClient, error) {
+			cc := &twitchConduitClient{
+				httpClient: appTokens,
+				baseUrl:    TwitchApiBaseUrl,
+			}
+			return newRetryingConduitClient(ctx, cc, limit), nil
+		},
+		conduitId: opts.ConduitId,
+
+		legacyCallbackUrls: opts.LegacyCallbackUrls,
+		rateLimit:          limit,
+		secretRotatedAt:    opts.SecretRotatedAt,
+
+		verificationTimeout:      DefaultVerificationTimeout,
+		verificationPollInterval: DefaultVerificationPollInterval,
 	}
 }
 
@@ -47,6 +141,18 @@ func (s *Server) RegisterRoutes(c auth.Client, r *mux.Router) {
 	subscriptions.Methods("GET").HandlerFunc(s.handleGetSubscriptions)
 	subscriptions.Methods("PATCH").HandlerFunc(s.handlePatchSubscriptions)
 	subscriptions.Methods("DELETE").HandlerFunc(s.handleDeleteSubscriptions)
+
+	migrate := r.Path("/subscriptions/migrate").Subrouter()
+	migrate.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	migrate.Methods("POST").HandlerFunc(s.handlePostMigrate)
+
+	rotateSecret := r.Path("/subscriptions/rotate-secret").Subrouter()
+	rotateSecret.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	rotateSecret.Methods("POST").HandlerFunc(s.handlePostRotateSecret)
 }
 
 // handleGetSubscriptions (GET /subscriptions) queries the Twitch API to return the
@@ -62,7 +168,7 @@ func (s *Server) handleGetSubscriptions(res http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	status, err := s.fetchSubscriptionStatus(c)
+	status, err := s.fetchSubscriptionStatus(req.Context(), c)
 	if err != nil {
 		logger.Error("Failed to resolve EventSub subscription status", "error", err)
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -79,39 +185,17 @@ func (s *Server) handleGetSubscriptions(res http.ResponseWriter, req *http.Reque
 func (s *Server) handlePatchSubscriptions(res http.ResponseWriter, req *http.Request) {
 	logger := entry.Log(req)
 
-	c, err := s.newTwitchClient(req.Context())
-	if err != nil {
-		logger.Error("Failed to initialize Twitch API client", "error", err)
-		http.Error(res, fmt.Sprintf("failed to initialize Twitch API client: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	status, err := s.fetchSubscriptionStatus(c)
-	if err != nil {
-		logger.Error("Failed to resolve EventSub subscription status", "error", err)
+	if _, err := s.Apply(req.Context(), logger); err != nil {
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			logger.Error("Cannot create EventSub subscriptions", "error", err)
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Error("Failed to create EventSub subscriptions", "error", err)
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	for _, subscription := range status.Subscriptions {
-		if subscription.Required && subscription.Status == "missing" {
-			if err := s.createSubscription(c, subscription.Type, subscription.Version, subscription.Condition); err != nil {
-				logger.Error("Failed to create EventSub subscription",
-					"error", err,
-					"subscriptionType", subscription.Type,
-					"subscriptionVersion", subscription.Version,
-					"subscriptionCondition", subscription.Condition,
-				)
-				http.Error(res, fmt.Sprintf("Failed to create EventSub subscription: %v", err), http.StatusInternalServerError)
-				return
-			}
-			logger.Info("Created new EventSub subscription",
-				"subscriptionType", subscription.Type,
-				"subscriptionVersion", subscription.Version,
-				"subscriptionCondition", subscription.Condition,
-			)
-		}
-	}
 	res.WriteHeader(http.StatusNoContent)
 }
 
@@ -119,19 +203,25 @@ func (s *Server) handlePatchSubscriptions(res http.ResponseWriter, req *http.Req
 // that have been registered to the callback URL associated with this service
 func (s *Server) handleDeleteSubscriptions(res http.ResponseWriter, req *http.Request) {
 	logger := entry.Log(req)
+	if err := s.DeleteAll(req.Context(), logger); err != nil {
+		logger.Error("Failed to delete EventSub subscriptions", "error", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
 
-	c, err := s.newTwitchClient(req.Context())
+// DeleteAll deletes ALL EventSub subscriptions that have been registered to the
+// callback URL associated with this service
+func (s *Server) DeleteAll(ctx context.Context, logger *slog.Logger) error {
+	c, err := s.newTwitchClient(ctx)
 	if err != nil {
-		logger.Error("Failed to initialize Twitch API client", "error", err)
-		http.Error(res, fmt.Sprintf("failed to initialize Twitch API client: %v", err), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("failed to initialize Twitch API client: %w", err)
 	}
 
-	status, err := s.fetchSubscriptionStatus(c)
+	status, err := s.fetchSubscriptionStatus(ctx, c)
 	if err != nil {
-		logger.Error("Failed to resolve EventSub subscription status", "error", err)
-		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("failed to resolve EventSub subscription status: %w", err)
 	}
 
 	for _, subscription := range status.Subscriptions {
@@ -144,8 +234,7 @@ func (s *Server) handleDeleteSubscriptions(res http.ResponseWriter, req *http.Re
 					"subscriptionVersion", subscription.Version,
 					"subscriptionCondition", subscription.Condition,
 				)
-				http.Error(res, fmt.Sprintf("Failed to delete EventSub subscription: %v", err), http.StatusInternalServerError)
-				return
+				return fmt.Errorf("failed to delete EventSub subscription: %w", err)
 			}
 			logger.Info("Deleted EventSub subscription",
 				"subscriptionId", subscription.subscriptionId,
@@ -155,38 +244,217 @@ func (s *Server) handleDeleteSubscriptions(res http.ResponseWriter, req *http.Re
 			)
 		}
 	}
-	res.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
 // fetchSubscriptionStatus gets current EventSub subscription state from the Twitch API,
 // then reconciles it against the set of required subscriptions in order to resolve a
 // subscription.Status struct describing the overall state of all EventSub subscriptions
 // related to this service
-func (s *Server) fetchSubscriptionStatus(c TwitchClient) (*Status, error) {
-	subscriptions, err := getOwnedSubscriptions(c, s.conditionParams.ChannelUserId, s.callbackUrl)
+func (s *Server) fetchSubscriptionStatus(ctx context.Context, c TwitchClient) (*Status, error) {
+	ownsSubscription, err := s.resolveOwnership(ctx)
+	if err != nil {
+		return nil, err
+	}
+	subscriptions, cost, err := getOwnedSubscriptions(c, s.conditionParams, s.requiredSubscriptions, ownsSubscription)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get EventSub subscriptions: %w", err)
 	}
 
-	status, err := reconcileSubscriptionStatus(subscriptions, s.conditionParams, s.requiredSubscriptions)
+	// Granted scopes are only used to flag subscriptions that can't be created: if we
+	// can't determine them, report that they're unknown rather than failing outright
+	var grantedScopes []string
+	scopesUnknown := false
+	if s.getGrantedScopes != nil {
+		grantedScopes, err = s.getGrantedScopes(ctx)
+		if err != nil {
+			grantedScopes = nil
+			scopesUnknown = true
+		}
+	}
+
+	// Subscriptions registered against legacy callback URLs can't satisfy any of our
+	// requirements, since they don't deliver notifications to our current transport:
+	// we just report them so they can be migrated
+	current := make([]helix.EventSubSubscription, 0, len(subscriptions))
+	legacy := make([]State, 0)
+	for _, subscription := range subscriptions {
+		if s.isLegacyCallbackUrl(&subscription.Transport) {
+			legacy = append(legacy, State{
+				Type:              subscription.Type,
+				Version:           subscription.Version,
+				Condition:         formatCondition(&subscription.Condition),
+				Status:            subscription.Status,
+				Cost:              subscription.Cost,
+				LegacyCallbackUrl: subscription.Transport.Callback,
+				subscriptionId:    subscription.ID,
+				createdAt:         subscription.CreatedAt.Time,
+			})
+		} else {
+			current = append(current, subscription)
+		}
+	}
+
+	status, err := reconcileSubscriptionStatus(current, s.conditionParams, s.requiredSubscriptions, grantedScopes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to reconcile EventSub subscription status: %w", err)
 	}
+	status.Subscriptions = append(status.Subscriptions, legacy...)
+	status.Cost = cost
+	status.ScopesUnknown = scopesUnknown
+
+	// If the broadcaster has disconnected our app, make that clear: none of our
+	// subscriptions can function until access is granted again
+	if s.getDisconnection != nil {
+		disconnection, err := s.getDisconnection(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get disconnection status: %w", err)
+		}
+		if disconnection != nil {
+			status.Ok = false
+			status.Disconnection = disconnection
+		}
+	}
+
+	// If we're rotating our webhook secret, report whether any subscriptions may still
+	// be using a previous secret (when using a conduit, subscriptions don't have their
+	// own secrets, so this only applies to webhook subscriptions)
+	if !s.secretRotatedAt.IsZero() && !s.usesConduit() {
+		status.SecretRotation = s.resolveSecretRotationStatus(status)
+	}
+
+	// If we're using a conduit, our subscriptions can only deliver notifications if the
+	// conduit's shards are healthy
+	if s.usesConduit() {
+		cc, err := s.newConduitClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Twitch API client for conduits: %w", err)
+		}
+		conduitStatus, err := s.fetchConduitStatus(ctx, cc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve EventSub conduit status: %w", err)
+		}
+		status.Conduit = conduitStatus
+		if !conduitStatus.Ok {
+			status.Ok = false
+		}
+	}
 
 	return status, nil
 }
 
+// resolveOwnership returns a function that reports whether an EventSub subscription
+// delivers notifications to this service: i.e. it's registered against our webhook
+// callback URL, or against our conduit if we're using one, or against one of our
+// legacy callback URLs. helix doesn't expose the conduit ID of a subscription's
+// transport, so when using a conduit, we look up the IDs of its subscriptions first.
+func (s *Server) resolveOwnership(ctx context.Context) (subscriptionMatcher, error) {
+	if !s.usesConduit() {
+		return func(subscription *helix.EventSubSubscription) bool {
+			transport := &subscription.Transport
+			if s.isLegacyCallbackUrl(transport) {
+				return true
+			}
+			return transport.Method == "webhook" && s.isOwnCallbackUrl(transport.Callback)
+		}, nil
+	}
+
+	cc, err := s.newConduitClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Twitch API client for conduits: %w", err)
+	}
+	conduit, err := s.findConduit(ctx, cc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve EventSub conduit: %w", err)
+	}
+	conduitSubscriptionIds := make(map[string]struct{})
+	if conduit != nil {
+		conduitSubscriptions, err := cc.GetConduitSubscriptions(ctx, conduit.Id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get EventSub subscriptions for conduit: %w", err)
+		}
+		for _, subscription := range conduitSubscriptions {
+			conduitSubscriptionIds[subscription.Id] = struct{}{}
+		}
+	}
+	return func(subscription *helix.EventSubSubscription) bool {
+		if s.isLegacyCallbackUrl(&subscription.Transport) {
+			return true
+		}
+		_, ok := conduitSubscriptionIds[subscription.ID]
+		return subscription.Transport.Method == "conduit" && ok
+	}, nil
+}
+
+// isOwnCallbackUrl returns true if the given URL is our webhook callback URL, either
+// as-is or with the query param that distinguishes a subscription created while
+// rotating our webhook secret (see rotateSubscriptionSecrets)
+func (s *Server) isOwnCallbackUrl(callbackUrl string) bool {
+	if callbackUrl == s.callbackUrl {
+		return true
+	}
+	return strings.HasPrefix(callbackUrl, s.callbackUrl+"?"+rotationQueryParam+"=")
+}
+
+// isLegacyCallbackUrl returns true if the given transport delivers notifications to
+// one of our legacy webhook callback URLs
+func (s *Server) isLegacyCallbackUrl(transport *helix.EventSubTransport) bool {
+	if transport.Method != "webhook" || s.isOwnCallbackUrl(transport.Callback) {
+		return false
+	}
+	for _, legacyCallbackUrl := range s.legacyCallbackUrls {
+		if transport.Callback == legacyCallbackUrl {
+			return true
+		}
+	}
+	return false
+}
+
+// createFunc registers a new EventSub subscription with the given parameters
+type createFunc func(subscriptionType string, version string, condition map[string]string) error
+
+// prepareCreate returns a function that will register new EventSub subscriptions
+// appropriately for our configured transport. By default, subscriptions are
+// registered directly against our webhook callback URL; if we're using a conduit
+// instead, we make sure that it exists and that all its shards are assigned before
+// registering subscriptions against it.
+func (s *Server) prepareCreate(ctx context.Context, logger *slog.Logger, c TwitchClient) (createFunc, error) {
+	if !s.usesConduit() {
+		return func(subscriptionType string, version string, condition map[string]string) error {
+			return s.createSubscription(c, subscriptionType, version, condition)
+		}, nil
+	}
+
+	cc, err := s.newConduitClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Twitch API client for conduits: %w", err)
+	}
+	conduitId, err := s.ensureConduit(ctx, logger, cc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up EventSub conduit: %w", err)
+	}
+	return func(subscriptionType string, version string, condition map[string]string) error {
+		return cc.CreateConduitSubscription(ctx, subscriptionType, version, condition, conduitId)
+	}, nil
+}
+
 // createSubscription uses the Twitch API to register a new EventSub subscription with
 // the given parameters, configured appropriately to register a webhook callback with
 // this service
 func (s *Server) createSubscription(c TwitchClient, subscriptionType string, version string, condition map[string]string) error {
+	return s.createSubscriptionAt(c, s.callbackUrl, subscriptionType, version, condition)
+}
+
+// createSubscriptionAt registers a new EventSub subscription that delivers
+// notifications to the given webhook callback URL, which must be one of our own
+func (s *Server) createSubscriptionAt(c TwitchClient, callbackUrl string, subscriptionType string, version string, condition map[string]string) error {
 	r, err := c.CreateEventSubSubscription(&helix.EventSubSubscription{
 		Type:      subscriptionType,
 		Version:   version,
 		Condition: parseCondition(condition),
 		Transport: helix.EventSubTransport{
 			Method:   "webhook",
-			Callback: s.callbackUrl,
+			Callback: callbackUrl,
 			Secret:   s.twitchWebhookSecret,
 		},
 	})
@@ -28,7 +28,7 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 			hooks.RequiredSubscriptions{},
 			&mockTwitchClient{},
 			200,
-			`{"ok":true,"subscriptions":[]}`,
+			`{"ok":true,"subscriptions":[],"cost":{"total":0,"total_cost":0,"max_total_cost":10000}}`,
 		},
 		{
 			"one subscription required; nothing registered",
@@ -43,7 +43,7 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 			},
 			&mockTwitchClient{},
 			200,
-			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"missing"}]}`,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":1,"cost_estimated":true}],"cost":{"total":0,"total_cost":0,"max_total_cost":10000}}`,
 		},
 		{
 			"one subscription required; one matching subscription registered",
@@ -71,11 +71,12 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 							Secret:   "my-cool-webhook-secret",
 						},
 						Status: "enabled",
+						Cost:   1,
 					},
 				},
 			},
 			200,
-			`{"ok":true,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"enabled"}]}`,
+			`{"ok":true,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"enabled","cost":1}],"cost":{"total":1,"total_cost":1,"max_total_cost":10000}}`,
 		},
 		{
 			"if matching subscription is not enabled, overall status is not ok",
@@ -103,11 +104,12 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 							Secret:   "my-cool-webhook-secret",
 						},
 						Status: "webhook_callback_verification_failed",
+						Cost:   1,
 					},
 				},
 			},
 			200,
-			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"webhook_callback_verification_failed"}]}`,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"webhook_callback_verification_failed","cost":1}],"cost":{"total":1,"total_cost":1,"max_total_cost":10000}}`,
 		},
 		{
 			"one required subscription unsatisfied; one irrelevant subscription registered",
@@ -135,11 +137,12 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 							Secret:   "my-cool-webhook-secret",
 						},
 						Status: "enabled",
+						Cost:   1,
 					},
 				},
 			},
 			200,
-			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.subscription.gift","version":"1","condition":{"broadcaster_user_id":"1337"},"status":"missing"},{"required":false,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"enabled"}]}`,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.subscription.gift","version":"1","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":1,"cost_estimated":true},{"required":false,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"enabled","cost":1}],"cost":{"total":1,"total_cost":1,"max_total_cost":10000}}`,
 		},
 		{
 			"existing subscriptions not matching channel user ID are entirely ignored",
@@ -167,11 +170,12 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 							Secret:   "my-cool-webhook-secret",
 						},
 						Status: "enabled",
+						Cost:   1,
 					},
 				},
 			},
 			200,
-			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"missing"}]}`,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":1,"cost_estimated":true}],"cost":{"total":1,"total_cost":1,"max_total_cost":10000}}`,
 		},
 		{
 			"existing subscriptions not matching callback URL are entirely ignored",
@@ -199,11 +203,12 @@ func Test_Server_handleGetSubscriptions(t *testing.T) {
 							Secret:   "my-cool-webhook-secret",
 						},
 						Status: "enabled",
+						Cost:   1,
 					},
 				},
 			},
 			200,
-			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"missing"}]}`,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.update","version":"2","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":1,"cost_estimated":true}],"cost":{"total":1,"total_cost":1,"max_total_cost":10000}}`,
 		},
 	}
 	for _, tt := range tests {
@@ -364,6 +369,40 @@ func Test_Server_handlePatchSubscriptions(t *testing.T) {
 			"",
 			[]string{"10000001", "10000002"},
 		},
+		{
+			"required subscriptions will not be created if doing so would exceed max total cost",
+			hooks.RequiredSubscriptions{
+				{
+					Type:    helix.EventSubTypeChannelUpdate,
+					Version: "2",
+					TemplatedCondition: helix.EventSubCondition{
+						BroadcasterUserID: "{{.ChannelUserId}}",
+					},
+				},
+			},
+			&mockTwitchClient{
+				subscriptions: []helix.EventSubSubscription{
+					{
+						ID:      "10000001",
+						Type:    helix.EventSubTypeStreamOnline,
+						Version: "1",
+						Condition: helix.EventSubCondition{
+							BroadcasterUserID: "9999",
+						},
+						Transport: helix.EventSubTransport{
+							Method:   "webhook",
+							Callback: "https://an-entirely-different-url.com/callback",
+						},
+						Status: "enabled",
+						Cost:   1,
+					},
+				},
+				maxTotalCost: 1,
+			},
+			409,
+			"Cannot create EventSub subscriptions: creating 1 EventSub subscription(s) would add an estimated cost of 1 [channel.update (v2): 1], bringing our total cost to 2, which exceeds the maximum total cost of 1; existing subscriptions must be deleted first",
+			[]string{"10000001"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -549,6 +588,7 @@ func Test_Server_handleDeleteSubscriptions(t *testing.T) {
 
 type mockTwitchClient struct {
 	subscriptions []helix.EventSubSubscription
+	maxTotalCost  int
 }
 
 func (m *mockTwitchClient) GetEventSubSubscriptions(params *helix.EventSubSubscriptionsParams) (*helix.EventSubSubscriptionsResponse, error) {
@@ -558,15 +598,29 @@ func (m *mockTwitchClient) GetEventSubSubscriptions(params *helix.EventSubSubscr
 	if params.Status != "" {
 		return nil, fmt.Errorf("filtering by status not nocked")
 	}
-	if params.Type != "" {
-		return nil, fmt.Errorf("filtering by type not mocked")
+	if params.UserID != "" && params.Type != "" {
+		return nil, fmt.Errorf("only one filter may be specified")
 	}
 
 	matches := make([]helix.EventSubSubscription, 0, len(m.subscriptions))
 	for _, subscription := range m.subscriptions {
-		if params.UserID == "" || matchesUserId(&subscription, params.UserID) {
-			matches = append(matches, subscription)
+		if params.UserID != "" && !matchesUserId(&subscription, params.UserID) {
+			continue
 		}
+		if params.Type != "" && subscription.Type != params.Type {
+			continue
+		}
+		matches = append(matches, subscription)
+	}
+
+	// Totals are app-wide, regardless of filters
+	totalCost := 0
+	for _, subscription := range m.subscriptions {
+		totalCost += subscription.Cost
+	}
+	maxTotalCost := m.maxTotalCost
+	if maxTotalCost == 0 {
+		maxTotalCost = 10000
 	}
 
 	return &helix.EventSubSubscriptionsResponse{
@@ -574,7 +628,9 @@ func (m *mockTwitchClient) GetEventSubSubscriptions(params *helix.EventSubSubscr
 			StatusCode: http.StatusOK,
 		},
 		Data: helix.ManyEventSubSubscriptions{
-			Total:                 len(matches),
+			Total:                 len(m.subscriptions),
+			TotalCost:             totalCost,
+			MaxTotalCost:          maxTotalCost,
 			EventSubSubscriptions: matches,
 		},
 	}, nil
@@ -628,3 +684,87 @@ func matchesUserId(subscription *helix.EventSubSubscription, userId string) bool
 		subscription.Condition.ToBroadcasterUserID == userId ||
 		subscription.Condition.UserID == userId
 }
+
+func Test_Server_missingScopes(t *testing.T) {
+	required := hooks.RequiredSubscriptions{
+		{
+			Type:    helix.EventSubTypeChannelCheer,
+			Version: "1",
+			TemplatedCondition: helix.EventSubCondition{
+				BroadcasterUserID: "{{.ChannelUserId}}",
+			},
+			RequiredScopes: []string{"bits:read"},
+		},
+	}
+	tests := []struct {
+		name          string
+		grantedScopes []string
+		scopesErr     error
+		wantGetBody   string
+		wantPatch     int
+	}{
+		{
+			"if granted scopes are unknown, nothing is flagged and cost is an upper bound",
+			nil,
+			nil,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.cheer","version":"1","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":1,"cost_estimated":true}],"cost":{"total":0,"total_cost":0,"max_total_cost":10000}}`,
+			204,
+		},
+		{
+			"if granted scopes can't be read, that's reported and nothing is flagged",
+			nil,
+			fmt.Errorf("mock error"),
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.cheer","version":"1","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":1,"cost_estimated":true}],"scopes_unknown":true,"cost":{"total":0,"total_cost":0,"max_total_cost":10000}}`,
+			204,
+		},
+		{
+			"if all scopes are granted, nothing is flagged",
+			[]string{"bits:read"},
+			nil,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.cheer","version":"1","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":0,"cost_estimated":true}],"cost":{"total":0,"total_cost":0,"max_total_cost":10000}}`,
+			204,
+		},
+		{
+			"if scopes are missing, subscription is flagged and PATCH is refused",
+			[]string{"moderator:read:followers"},
+			nil,
+			`{"ok":false,"subscriptions":[{"required":true,"type":"channel.cheer","version":"1","condition":{"broadcaster_user_id":"1337"},"status":"missing","cost":0,"cost_estimated":true,"missing_scopes":["bits:read"]}],"cost":{"total":0,"total_cost":0,"max_total_cost":10000}}`,
+			409,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &mockTwitchClient{}
+			s := &Server{
+				callbackUrl: "https://my-cool-service.com/callback",
+				conditionParams: hooks.RequiredSubscriptionConditionParams{
+					ChannelUserId: "1337",
+				},
+				requiredSubscriptions: required,
+				newTwitchClient: func(ctx context.Context) (TwitchClient, error) {
+					return c, nil
+				},
+				twitchWebhookSecret: "my-cool-webhook-secret",
+				getGrantedScopes: func(ctx context.Context) ([]string, error) {
+					return tt.grantedScopes, tt.scopesErr
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/subscriptions", nil)
+			res := httptest.NewRecorder()
+			s.handleGetSubscriptions(res, req)
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.Equal(t, tt.wantGetBody, strings.TrimSuffix(res.Body.String(), "\n"))
+
+			req = httptest.NewRequest(http.MethodPatch, "/subscriptions", nil)
+			res = httptest.NewRecorder()
+			s.handlePatchSubscriptions(res, req)
+			assert.Equal(t, tt.wantPatch, res.Code)
+			if tt.wantPatch == http.StatusConflict {
+				assert.Len(t, c.subscriptions, 0)
+			} else {
+				assert.Len(t, c.subscriptions, 1)
+			}
+		})
+	}
+}
@@ -3,53 +3,104 @@ package subscription
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/golden-vcr/hooks"
 	"github.com/nicklaw5/helix/v2"
 )
 
+// subscriptionMatcher reports whether the given EventSub subscription was registered
+// by this service
+type subscriptionMatcher func(subscription *helix.EventSubSubscription) bool
+
 // getOwnedSubscriptions queries the Twitch API to find all relevant EventSub
-// subscriptions that are registered with the given user ID and webhook callback URL
-func getOwnedSubscriptions(c TwitchClient, channelUserId, callbackUrl string) ([]helix.EventSubSubscription, error) {
-	subscriptions := make([]helix.EventSubSubscription, 0)
-	params := &helix.EventSubSubscriptionsParams{
-		UserID: channelUserId,
+// subscriptions that are registered by this service (as indicated by ownsSubscription):
+// i.e. those whose condition references our channel's user ID, along with any
+// subscriptions whose condition references our app's client ID instead
+func getOwnedSubscriptions(c TwitchClient, params hooks.RequiredSubscriptionConditionParams, requiredSubscriptions hooks.RequiredSubscriptions, ownsSubscription subscriptionMatcher) ([]helix.EventSubSubscription, *Cost, error) {
+	subscriptions, cost, err := listSubscriptions(c, &helix.EventSubSubscriptionsParams{
+		UserID: params.ChannelUserId,
+	}, ownsSubscription)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Subscriptions that are conditioned on our client ID (e.g.
+	// 'user.authorization.revoke') aren't associated with any user ID, so we have to
+	// query for them by type instead
+	queriedTypes := make(map[string]struct{})
+	for _, required := range requiredSubscriptions {
+		if required.TemplatedCondition.ClientID == "" {
+			continue
+		}
+		if _, ok := queriedTypes[required.Type]; ok {
+			continue
+		}
+		queriedTypes[required.Type] = struct{}{}
+
+		matches, _, err := listSubscriptions(c, &helix.EventSubSubscriptionsParams{
+			Type: required.Type,
+		}, ownsSubscription)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, subscription := range matches {
+			if subscription.Condition.ClientID == params.ClientId {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
 	}
+	return subscriptions, cost, nil
+}
+
+// listSubscriptions queries the Twitch API for all EventSub subscriptions matching the
+// given params, returning those which are registered by this service, along with the
+// overall cost of our app's subscriptions
+func listSubscriptions(c TwitchClient, params *helix.EventSubSubscriptionsParams, ownsSubscription subscriptionMatcher) ([]helix.EventSubSubscription, *Cost, error) {
+	subscriptions := make([]helix.EventSubSubscription, 0)
+	cost := &Cost{}
 	for {
 		// Query the Twitch API for a list of our EventSub subscriptions
 		r, err := c.GetEventSubSubscriptions(params)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if r.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("got response %d from get subscriptions request: %s", r.StatusCode, r.ErrorMessage)
+			return nil, nil, fmt.Errorf("got response %d from get subscriptions request: %s", r.StatusCode, r.ErrorMessage)
 		}
 
 		for i := range r.Data.EventSubSubscriptions {
-			// Ignore any subscriptions that don't hit our webhook API
+			// Ignore any subscriptions that don't deliver notifications to us
 			subscription := r.Data.EventSubSubscriptions[i]
-			if subscription.Transport.Method != "webhook" {
-				continue
-			}
-			if subscription.Transport.Callback != callbackUrl {
+			if !ownsSubscription(&subscription) {
 				continue
 			}
 			subscriptions = append(subscriptions, subscription)
 		}
 
+		// Cost totals are app-wide, regardless of how results are filtered
+		cost.Total = r.Data.Total
+		cost.TotalCost = r.Data.TotalCost
+		cost.MaxTotalCost = r.Data.MaxTotalCost
+
 		// Continue making requests until we've seen all subscriptions
 		if r.Data.Pagination.Cursor == "" {
 			break
 		}
 		params.After = r.Data.Pagination.Cursor
 	}
-	return subscriptions, nil
+	return subscriptions, cost, nil
 }
 
 // reconcileSubscriptionStatus examines the set of extant EventSub subscriptions as
 // returned by the Twitch API, and it compares those subscriptions against the set of
-// required subscriptions in order to determine the status of each required subscription
-func reconcileSubscriptionStatus(subscriptions []helix.EventSubSubscription, params hooks.RequiredSubscriptionConditionParams, requiredSubscriptions hooks.RequiredSubscriptions) (*Status, error) {
+// required subscriptions in order to determine the status of each required subscription.
+// If grantedScopes is non-nil, any required subscription whose required scopes have not
+// all been granted will be flagged with the scopes that are missing. Since Twitch
+// doesn't charge for subscriptions on behalf of a user who has authorized our app, the
+// estimated cost of a missing subscription depends on whether any scopes have been
+// granted: if we can't tell, we assume the higher cost.
+func reconcileSubscriptionStatus(subscriptions []helix.EventSubSubscription, params hooks.RequiredSubscriptionConditionParams, requiredSubscriptions hooks.RequiredSubscriptions, grantedScopes []string) (*Status, error) {
 	// Prepare a list that will summarize the details of all subscriptions germane to
 	// our hooks service
 	subscriptionStates := make([]State, 0, len(requiredSubscriptions))
@@ -87,18 +138,41 @@ func reconcileSubscriptionStatus(subscriptions []helix.EventSubSubscription, par
 		// we require such a subscription, but no such subscription exists)
 		status := "missing"
 		subscriptionId := ""
+		var createdAt time.Time
+		callbackUrl := ""
+		cost := required.EstimateCost(len(grantedScopes) > 0)
+		costEstimated := true
 		if foundAtIndex >= 0 {
 			status = unexamined[foundAtIndex].Status
 			subscriptionId = unexamined[foundAtIndex].ID
+			createdAt = unexamined[foundAtIndex].CreatedAt.Time
+			callbackUrl = unexamined[foundAtIndex].Transport.Callback
+			cost = unexamined[foundAtIndex].Cost
+			costEstimated = false
 			unexamined = append(unexamined[:foundAtIndex], unexamined[foundAtIndex+1:]...)
 		}
+
+		// If we know which scopes have been granted, flag any that are missing, since
+		// they'll prevent the subscription from being (re)created
+		var missingScopes []string
+		if grantedScopes != nil {
+			if missing := required.GetMissingScopes(grantedScopes); len(missing) > 0 {
+				missingScopes = missing
+			}
+		}
+
 		subscriptionStates = append(subscriptionStates, State{
 			Required:       true,
 			Type:           required.Type,
 			Version:        required.Version,
 			Condition:      formatCondition(requiredCondition),
 			Status:         status,
+			Cost:           cost,
+			CostEstimated:  costEstimated,
+			MissingScopes:  missingScopes,
 			subscriptionId: subscriptionId,
+			createdAt:      createdAt,
+			callbackUrl:    callbackUrl,
 		})
 	}
 
@@ -112,7 +186,10 @@ func reconcileSubscriptionStatus(subscriptions []helix.EventSubSubscription, par
 			Version:        subscription.Version,
 			Condition:      formatCondition(&subscription.Condition),
 			Status:         subscription.Status,
+			Cost:           subscription.Cost,
 			subscriptionId: subscription.ID,
+			createdAt:      subscription.CreatedAt.Time,
+			callbackUrl:    subscription.Transport.Callback,
 		})
 	}
 
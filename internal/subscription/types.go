@@ -1,11 +1,77 @@
 package subscription
 
-import "github.com/nicklaw5/helix/v2"
+import (
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+)
 
 // Status represents the status of all registered EventSub webhook subscriptions
 type Status struct {
 	Ok            bool    `json:"ok"`
 	Subscriptions []State `json:"subscriptions"`
+
+	// ScopesUnknown is true if we were unable to read the scopes that the broadcaster
+	// has granted, in which case subscriptions are not flagged with missing scopes
+	ScopesUnknown bool `json:"scopes_unknown,omitempty"`
+
+	// Cost describes our app's overall EventSub subscription cost and limits, as last
+	// reported by the Twitch API
+	Cost *Cost `json:"cost,omitempty"`
+
+	// Disconnection is set if the broadcaster has disconnected our app from their
+	// channel
+	Disconnection *Disconnection `json:"disconnection,omitempty"`
+
+	// Conduit describes the health of our EventSub conduit and its shards, if we're
+	// configured to register subscriptions against a conduit
+	Conduit *ConduitStatus `json:"conduit,omitempty"`
+
+	// SecretRotation is set while previous webhook secrets are still accepted,
+	// indicating whether any subscriptions may still be using them
+	SecretRotation *SecretRotationStatus `json:"secret_rotation,omitempty"`
+}
+
+// Disconnection records when and why our app was disconnected from the broadcaster's
+// channel
+type Disconnection struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+// SecretRotationStatus describes the progress of rotating our webhook secret: any
+// subscription created before RotatedAt is assumed to use a previous secret, and must
+// be replaced with one using the current secret before previous secrets can be retired
+type SecretRotationStatus struct {
+	RotatedAt                   time.Time `json:"rotated_at"`
+	NumPending                  int       `json:"num_pending"`
+	PreviousSecretsCanBeRetired bool      `json:"previous_secrets_can_be_retired"`
+}
+
+// Cost describes the total cost of the EventSub subscriptions created by our app, and
+// the maximum total cost that Twitch permits. These totals account for all
+// subscriptions created with our client ID, not just those registered to this service.
+type Cost struct {
+	Total        int `json:"total"`
+	TotalCost    int `json:"total_cost"`
+	MaxTotalCost int `json:"max_total_cost"`
+}
+
+// ConduitStatus represents the status of the EventSub conduit that delivers our
+// notifications, with one shard per callback URL
+type ConduitStatus struct {
+	Ok     bool         `json:"ok"`
+	Id     string       `json:"id,omitempty"`
+	Shards []ShardState `json:"shards"`
+}
+
+// ShardState represents the state of a single conduit shard: Status is 'missing' if
+// the shard has not been created, or 'misconfigured' if it delivers notifications to
+// a callback URL other than the one expected
+type ShardState struct {
+	Id       string `json:"id"`
+	Callback string `json:"callback"`
+	Status   string `json:"status"`
 }
 
 // State represents the state of a single EventSub subscription
@@ -16,7 +82,24 @@ type State struct {
 	Condition map[string]string `json:"condition"`
 	Status    string            `json:"status"`
 
+	// Cost is the cost of this subscription as reported by the Twitch API; or, if the
+	// subscription is missing, the cost that it's expected to have once created (in
+	// which case CostEstimated is true)
+	Cost          int  `json:"cost"`
+	CostEstimated bool `json:"cost_estimated,omitempty"`
+
+	// MissingScopes lists any OAuth scopes that are required in order to create this
+	// subscription but that the broadcaster has not granted
+	MissingScopes []string `json:"missing_scopes,omitempty"`
+
+	// LegacyCallbackUrl is set if this subscription is registered against one of our
+	// legacy callback URLs (i.e. the callback URL of a previous deployment) rather
+	// than our current transport
+	LegacyCallbackUrl string `json:"legacy_callback_url,omitempty"`
+
 	subscriptionId string
+	createdAt      time.Time
+	callbackUrl    string
 }
 
 // formatCondition converts a helix.EventSubCondition to a map[string]string so that it
@@ -0,0 +1,117 @@
+package userauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golden-vcr/auth"
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/golden-vcr/server-common/entry"
+	"github.com/gorilla/mux"
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// DeleteSubscriptionsFunc deletes all EventSub subscriptions registered by this service
+type DeleteSubscriptionsFunc func(ctx context.Context, logger *slog.Logger) error
+
+// Disconnector handles our app being disconnected from the broadcaster's channel,
+// whether that's initiated by an admin (via POST /userauth/disconnect) or by the
+// broadcaster revoking our app's access from their Twitch settings (in which case
+// Twitch notifies us via a 'user.authorization.revoke' EventSub notification)
+type Disconnector struct {
+	twitchClientId      string
+	channelUserId       string
+	tokens              *TokenManager
+	notifier            alert.Notifier
+	deleteSubscriptions DeleteSubscriptionsFunc
+	now                 func() time.Time
+}
+
+func NewDisconnector(twitchClientId, channelUserId string, tokens *TokenManager, notifier alert.Notifier, deleteSubscriptions DeleteSubscriptionsFunc) *Disconnector {
+	return &Disconnector{
+		twitchClientId:      twitchClientId,
+		channelUserId:       channelUserId,
+		tokens:              tokens,
+		notifier:            notifier,
+		deleteSubscriptions: deleteSubscriptions,
+		now:                 time.Now,
+	}
+}
+
+func (d *Disconnector) RegisterRoutes(c auth.Client, r *mux.Router) {
+	disconnect := r.Path("/userauth/disconnect").Subrouter()
+	disconnect.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	disconnect.Methods("POST").HandlerFunc(d.handlePostDisconnect)
+}
+
+// handlePostDisconnect (POST /userauth/disconnect) cleanly disconnects our app from the
+// broadcaster's channel: all of our EventSub subscriptions are deleted, and our user
+// access token is revoked
+func (d *Disconnector) handlePostDisconnect(res http.ResponseWriter, req *http.Request) {
+	logger := entry.Log(req)
+
+	if err := d.deleteSubscriptions(req.Context(), logger); err != nil {
+		logger.Error("Failed to delete EventSub subscriptions", "error", err)
+		http.Error(res, fmt.Sprintf("Failed to delete EventSub subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := d.tokens.Revoke(req.Context(), DisconnectReasonDisconnectedByAdmin); err != nil {
+		logger.Error("Failed to revoke user access token", "error", err)
+		http.Error(res, fmt.Sprintf("Failed to revoke user access token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Disconnected from broadcaster's channel")
+
+	if err := d.notify(req.Context(), "", DisconnectReasonDisconnectedByAdmin); err != nil {
+		logger.Error("Failed to send alert", "error", err)
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAuthorizationRevoke handles a 'user.authorization.revoke' EventSub
+// notification: if the user who revoked access is the broadcaster, we record that our
+// app has been disconnected and raise an alert
+func (d *Disconnector) HandleAuthorizationRevoke(ctx context.Context, logger *slog.Logger, data json.RawMessage) error {
+	var ev helix.EventSubUserAuthenticationRevokeEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return fmt.Errorf("failed to decode user.authorization.revoke event: %w", err)
+	}
+
+	// Other users (e.g. viewers who have logged in to our app) may revoke access too:
+	// we only care about the broadcaster
+	if ev.ClientID != d.twitchClientId || ev.UserID != d.channelUserId {
+		logger.Info("Ignoring authorization revocation for other user", "userId", ev.UserID)
+		return nil
+	}
+
+	if err := d.tokens.MarkDisconnected(ctx, DisconnectReasonRevokedOnTwitch); err != nil {
+		return err
+	}
+	logger.Warn("Broadcaster has revoked our app's access to their channel")
+	return d.notify(ctx, ev.UserLogin, DisconnectReasonRevokedOnTwitch)
+}
+
+func (d *Disconnector) notify(ctx context.Context, userLogin string, reason string) error {
+	message := "The broadcaster revoked access to their channel via Twitch"
+	if reason == DisconnectReasonDisconnectedByAdmin {
+		message = "The app was disconnected from the broadcaster's channel by an admin"
+	}
+	return d.notifier.Notify(ctx, &alert.Alert{
+		Type:       alert.TypeChannelDisconnected,
+		Message:    message,
+		OccurredAt: d.now(),
+		Payload: &alert.Payload{
+			ChannelDisconnected: &alert.PayloadChannelDisconnected{
+				UserId:    d.channelUserId,
+				UserLogin: userLogin,
+				Reason:    reason,
+			},
+		},
+	})
+}
@@ -0,0 +1,160 @@
+package userauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golden-vcr/hooks/internal/alert"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Disconnector_handlePostDisconnect(t *testing.T) {
+	tests := []struct {
+		name           string
+		deleteErr      error
+		wantStatus     int
+		wantRevoked    []string
+		wantDisconnect string
+	}{
+		{
+			"subscriptions are deleted and token is revoked",
+			nil,
+			http.StatusNoContent,
+			[]string{"access-1"},
+			DisconnectReasonDisconnectedByAdmin,
+		},
+		{
+			"token is not revoked if subscriptions can't be deleted",
+			errors.New("uh oh"),
+			http.StatusInternalServerError,
+			nil,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, tokens := newConnectedTokenManager(t)
+			notifier := &recordingNotifier{}
+			d := NewDisconnector("my-client-id", "1234", tokens, notifier, func(ctx context.Context, logger *slog.Logger) error {
+				return tt.deleteErr
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/userauth/disconnect", nil)
+			res := httptest.NewRecorder()
+			d.handlePostDisconnect(res, req)
+			assert.Equal(t, tt.wantStatus, res.Code)
+			assert.Equal(t, tt.wantRevoked, c.revoked)
+
+			disconnection, err := tokens.GetDisconnection(context.Background())
+			assert.NoError(t, err)
+			if tt.wantDisconnect == "" {
+				assert.Nil(t, disconnection)
+				assert.Empty(t, notifier.alerts)
+			} else {
+				assert.Equal(t, tt.wantDisconnect, disconnection.Reason)
+				_, err := tokens.Get(context.Background())
+				assert.ErrorIs(t, err, ErrNoToken)
+				assert.Len(t, notifier.alerts, 1)
+				assert.Equal(t, alert.TypeChannelDisconnected, notifier.alerts[0].Type)
+			}
+		})
+	}
+}
+
+func Test_Disconnector_HandleAuthorizationRevoke(t *testing.T) {
+	tests := []struct {
+		name             string
+		ev               helix.EventSubUserAuthenticationRevokeEvent
+		wantDisconnected bool
+	}{
+		{
+			"revocation by broadcaster disconnects our app",
+			helix.EventSubUserAuthenticationRevokeEvent{
+				ClientID:  "my-client-id",
+				UserID:    "1234",
+				UserLogin: "broadcaster",
+			},
+			true,
+		},
+		{
+			"revocation by other user is ignored",
+			helix.EventSubUserAuthenticationRevokeEvent{
+				ClientID:  "my-client-id",
+				UserID:    "5678",
+				UserLogin: "viewer",
+			},
+			false,
+		},
+		{
+			"revocation for other app is ignored",
+			helix.EventSubUserAuthenticationRevokeEvent{
+				ClientID:  "other-client-id",
+				UserID:    "1234",
+				UserLogin: "broadcaster",
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, tokens := newConnectedTokenManager(t)
+			notifier := &recordingNotifier{}
+			d := NewDisconnector("my-client-id", "1234", tokens, notifier, nil)
+
+			data, err := json.Marshal(tt.ev)
+			assert.NoError(t, err)
+			err = d.HandleAuthorizationRevoke(context.Background(), slog.Default(), data)
+			assert.NoError(t, err)
+
+			// Access has already been revoked on Twitch's end, so we never need to
+			// revoke the token ourselves
+			assert.Empty(t, c.revoked)
+
+			disconnection, err := tokens.GetDisconnection(context.Background())
+			assert.NoError(t, err)
+			if tt.wantDisconnected {
+				assert.NotNil(t, disconnection)
+				assert.Equal(t, DisconnectReasonRevokedOnTwitch, disconnection.Reason)
+				assert.Len(t, notifier.alerts, 1)
+				assert.Equal(t, "broadcaster", notifier.alerts[0].Payload.ChannelDisconnected.UserLogin)
+			} else {
+				assert.Nil(t, disconnection)
+				assert.Empty(t, notifier.alerts)
+			}
+		})
+	}
+}
+
+func newConnectedTokenManager(t *testing.T) (*mockTwitchAuthClient, *TokenManager) {
+	c := &mockTwitchAuthClient{
+		codes: map[string]helix.AccessCredentials{
+			"some-code": {
+				AccessToken:  "access-1",
+				RefreshToken: "refresh-1",
+				ExpiresIn:    3600,
+			},
+		},
+	}
+	tokens := NewTokenManager(NewMemoryTokenStore(), testEncryptionKey, c)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tokens.now = func() time.Time { return now }
+	_, err := tokens.Exchange(context.Background(), "some-code")
+	assert.NoError(t, err)
+	return c, tokens
+}
+
+type recordingNotifier struct {
+	alerts []*alert.Alert
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, a *alert.Alert) error {
+	r.alerts = append(r.alerts, a)
+	return nil
+}
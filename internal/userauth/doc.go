@@ -23,7 +23,10 @@
 //
 // As an end result of this process, we'll end up with a Twitch User Access Token that
 // includes all the requisite scopes required to register our EventSub subscriptions.
-// We don't actually use that User Access Token anywhere; all we care about is the side
-// effect on the Twitch backend of establishing that our app has the required level of
-// access to our target channel.
+// The most important result is the side effect on the Twitch backend of establishing
+// that our app has the required level of access to our target channel, but we also
+// hold onto the token itself: TokenManager encrypts it with a required encryption key
+// and persists it via a pluggable TokenStore, and keeps it refreshed, so that we can
+// check which scopes are still granted and call Twitch API endpoints that require a
+// user access token.
 package userauth
@@ -0,0 +1,82 @@
+package userauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NewFileReplayCache returns a ReplayCache that records each used nonce as a file in
+// the given directory. Linking a file into place fails if a file of that name already
+// exists, so if the directory is on a volume that's shared by all replicas, a state
+// token can only be redeemed once across all of them.
+func NewFileReplayCache(dir string) ReplayCache {
+	return &fileReplayCache{
+		dir: dir,
+		now: time.Now,
+	}
+}
+
+// tmpPrefix identifies files in a fileReplayCache's directory that are still being
+// written
+const tmpPrefix = ".tmp-"
+
+type fileReplayCache struct {
+	dir string
+	now func() time.Time
+}
+
+func (c *fileReplayCache) MarkUsed(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return false, err
+	}
+	c.purge()
+
+	// Nonces are opaque, so name each file for a hash of its nonce. The file's
+	// modification time records when the entry expires: we set that on a temporary
+	// file, then link it into place, so that an entry never exists without its expiry
+	sum := sha256.Sum256([]byte(nonce))
+	path := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+	f, err := os.CreateTemp(c.dir, tmpPrefix+"*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(f.Name(), expiresAt, expiresAt); err != nil {
+		return false, err
+	}
+	if err := os.Link(f.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// purge removes any entries that have expired, since their tokens can no longer be
+// redeemed anyway: failures are ignored, since stale entries are harmless
+func (c *fileReplayCache) purge() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	now := c.now()
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) {
+			continue
+		}
+		if !now.Before(info.ModTime()) {
+			os.Remove(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package userauth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrorCode identifies the reason that an OAuth flow failed, as conveyed to the admin
+// frontend via the 'userauth_error' query parameter when the broadcaster is redirected
+// back from /userauth/finish
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidRequest      ErrorCode = "invalid_request"
+	ErrorCodeCsrfFailed          ErrorCode = "csrf_failed"
+	ErrorCodeAccessDenied        ErrorCode = "access_denied"
+	ErrorCodeMissingScopes       ErrorCode = "missing_scopes"
+	ErrorCodeTokenExchangeFailed ErrorCode = "token_exchange_failed"
+)
+
+// result describes the outcome of an OAuth flow
+type result struct {
+	errorCode     ErrorCode
+	message       string
+	missingScopes []string
+}
+
+// apply adds query parameters describing this result to the given URL: 'userauth' is
+// either 'success' or 'error', and in the case of an error, 'userauth_error' holds an
+// ErrorCode, 'userauth_message' a human-readable description, and (if applicable)
+// 'userauth_missing_scopes' a space-separated list of scopes that were not granted
+func (r *result) apply(u *url.URL) {
+	q := u.Query()
+	if r.errorCode == "" {
+		q.Set("userauth", "success")
+	} else {
+		q.Set("userauth", "error")
+		q.Set("userauth_error", string(r.errorCode))
+		if r.message != "" {
+			q.Set("userauth_message", r.message)
+		}
+		if len(r.missingScopes) > 0 {
+			q.Set("userauth_missing_scopes", strings.Join(r.missingScopes, " "))
+		}
+	}
+	u.RawQuery = q.Encode()
+}
+
+// redirectWithResult sends the broadcaster back to the given URL (which must already
+// have been checked against our allowlist), annotated with the result of the flow
+func redirectWithResult(res http.ResponseWriter, req *http.Request, returnTo string, r *result) {
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.apply(u)
+	http.Redirect(res, req, u.String(), http.StatusSeeOther)
+}
+
+// isAllowedReturnTo returns true if the given URL matches one of the entries in our
+// allowlist, i.e. it has the same scheme and host, and its path is either identical or
+// nested beneath the allowlisted path
+func isAllowedReturnTo(allowlist []string, returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.User != nil || u.Opaque != "" {
+		return false
+	}
+	for _, entry := range allowlist {
+		allowed, err := url.Parse(entry)
+		if err != nil {
+			continue
+		}
+		if u.Scheme != allowed.Scheme || u.Host != allowed.Host {
+			continue
+		}
+		allowedPath := strings.TrimSuffix(allowed.Path, "/")
+		if u.Path == allowedPath || strings.HasPrefix(u.Path, allowedPath+"/") {
+			return true
+		}
+	}
+	return false
+}
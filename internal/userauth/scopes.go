@@ -0,0 +1,139 @@
+package userauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/golden-vcr/hooks"
+)
+
+const (
+	ScopesSourceValidation = "validation"
+	ScopesSourceRecorded   = "recorded"
+)
+
+// ErrTokenInvalid is returned when Twitch reports that our stored user access token is
+// no longer valid, e.g. because the broadcaster has disconnected our app
+var ErrTokenInvalid = errors.New("stored user access token is no longer valid")
+
+// GrantedScopes lists the OAuth scopes that the broadcaster has granted to our app
+type GrantedScopes struct {
+	Scopes []string
+	Source string
+}
+
+// GetGrantedScopes determines which scopes the broadcaster has granted to our app. We
+// prefer to validate our stored user access token with Twitch, since that reflects the
+// current state of the grant; if Twitch can't be reached, we fall back to the scopes
+// that were recorded when the token was last obtained. Returns ErrNoToken if we've
+// never obtained a token, or ErrTokenInvalid if Twitch has rejected it.
+func (m *TokenManager) GetGrantedScopes(ctx context.Context) (*GrantedScopes, error) {
+	token, err := m.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	isValid, r, err := m.client.ValidateToken(token.AccessToken)
+	if err == nil && r.StatusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("got response %d from validate token request: %s", r.StatusCode, r.ErrorMessage)
+	}
+	if err != nil {
+		return &GrantedScopes{
+			Scopes: token.Scopes,
+			Source: ScopesSourceRecorded,
+		}, nil
+	}
+	if !isValid {
+		return nil, ErrTokenInvalid
+	}
+	return &GrantedScopes{
+		Scopes: r.Data.Scopes,
+		Source: ScopesSourceValidation,
+	}, nil
+}
+
+// LookupGrantedScopes returns the list of scopes that were recorded as granted by the
+// broadcaster when our user access token was last obtained, suitable for flagging
+// subscriptions that can't be created due to missing scopes. Unlike GetGrantedScopes,
+// this never refreshes or validates the token, so it doesn't depend on Twitch: if no
+// user access token has ever been obtained, the granted scopes are unknown and nil is
+// returned; if our app has been disconnected, no scopes are granted.
+func (m *TokenManager) LookupGrantedScopes(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, err := m.load(ctx)
+	if errors.Is(err, ErrNoToken) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.Disconnection != nil {
+		return []string{}, nil
+	}
+	if token.Scopes == nil {
+		return []string{}, nil
+	}
+	return token.Scopes, nil
+}
+
+// GetScopeStatus compares the set of scopes required by the given EventSub
+// subscriptions against the scopes that the broadcaster has actually granted. If any
+// scopes are missing, the broadcaster must (re)authorize our app via the
+// /userauth/start endpoint of the service at origin.
+func GetScopeStatus(ctx context.Context, tokens *TokenManager, requiredSubscriptions hooks.RequiredSubscriptions, origin string) (*ScopeStatus, error) {
+	granted, err := tokens.GetGrantedScopes(ctx)
+	if err != nil && !errors.Is(err, ErrNoToken) && !errors.Is(err, ErrTokenInvalid) {
+		return nil, err
+	}
+	return NewScopeStatus(requiredSubscriptions, granted, origin), nil
+}
+
+// NewScopeStatus compares the set of scopes required by the given EventSub
+// subscriptions against the given granted scopes, which are nil if the broadcaster
+// hasn't connected our app
+func NewScopeStatus(requiredSubscriptions hooks.RequiredSubscriptions, granted *GrantedScopes, origin string) *ScopeStatus {
+	status := &ScopeStatus{
+		RequiredScopes: requiredSubscriptions.GetRequiredUserScopes(),
+		GrantedScopes:  []string{},
+		Subscriptions:  make([]SubscriptionScopeStatus, 0, len(requiredSubscriptions)),
+	}
+	if granted != nil {
+		status.Connected = true
+		status.ScopesSource = granted.Source
+		status.GrantedScopes = granted.Scopes
+	}
+
+	// Check each required subscription individually, so we can report exactly which
+	// subscriptions are affected by any missing scopes
+	missing := make(map[string]struct{})
+	for i := range requiredSubscriptions {
+		required := &requiredSubscriptions[i]
+		missingForSubscription := required.GetMissingScopes(status.GrantedScopes)
+		for _, scope := range missingForSubscription {
+			missing[scope] = struct{}{}
+		}
+		status.Subscriptions = append(status.Subscriptions, SubscriptionScopeStatus{
+			Type:          required.Type,
+			Version:       required.Version,
+			MissingScopes: missingForSubscription,
+		})
+	}
+	status.MissingScopes = make([]string, 0, len(missing))
+	for _, scope := range status.RequiredScopes {
+		if _, ok := missing[scope]; ok {
+			status.MissingScopes = append(status.MissingScopes, scope)
+		}
+	}
+
+	// We're OK if we know that all required scopes have been granted; otherwise the
+	// broadcaster needs to (re)authorize our app
+	status.Ok = status.Connected && len(status.MissingScopes) == 0
+	if !status.Ok {
+		status.ReauthUrl = origin + "/userauth/start"
+	}
+	return status
+}
@@ -0,0 +1,135 @@
+package userauth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TokenManager_GetGrantedScopes(t *testing.T) {
+	tests := []struct {
+		name         string
+		hasToken     bool
+		validTokens  map[string][]string
+		validateErr  error
+		wantErr      error
+		wantScopes   []string
+		wantSource   string
+		wantLookedUp []string // scopes recorded with the token, regardless of validation
+	}{
+		{
+			"no token yields ErrNoToken, and granted scopes are unknown",
+			false,
+			nil,
+			nil,
+			ErrNoToken,
+			nil,
+			"",
+			nil,
+		},
+		{
+			"scopes are taken from token validation when possible",
+			true,
+			map[string][]string{"access-1": {"bits:read"}},
+			nil,
+			nil,
+			[]string{"bits:read"},
+			ScopesSourceValidation,
+			[]string{"bits:read", "moderator:read:followers"},
+		},
+		{
+			"recorded scopes are used if validation fails",
+			true,
+			nil,
+			fmt.Errorf("network error"),
+			nil,
+			[]string{"bits:read", "moderator:read:followers"},
+			ScopesSourceRecorded,
+			[]string{"bits:read", "moderator:read:followers"},
+		},
+		{
+			"invalid token yields ErrTokenInvalid, and no scopes are granted",
+			true,
+			map[string][]string{},
+			nil,
+			ErrTokenInvalid,
+			nil,
+			"",
+			[]string{"bits:read", "moderator:read:followers"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &mockTwitchAuthClient{
+				codes: map[string]helix.AccessCredentials{
+					"some-code": {
+						AccessToken:  "access-1",
+						RefreshToken: "refresh-1",
+						ExpiresIn:    3600,
+						Scopes:       []string{"bits:read", "moderator:read:followers"},
+					},
+				},
+				validTokens: tt.validTokens,
+				validateErr: tt.validateErr,
+			}
+			m := NewTokenManager(NewMemoryTokenStore(), testEncryptionKey, c)
+			if tt.hasToken {
+				_, err := m.Exchange(context.Background(), "some-code")
+				assert.NoError(t, err)
+			}
+
+			granted, err := m.GetGrantedScopes(context.Background())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, granted)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantScopes, granted.Scopes)
+				assert.Equal(t, tt.wantSource, granted.Source)
+			}
+
+			lookedUp, err := m.LookupGrantedScopes(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantLookedUp, lookedUp)
+		})
+	}
+}
+
+func Test_TokenManager_LookupGrantedScopes(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &mockTwitchAuthClient{
+		codes: map[string]helix.AccessCredentials{
+			"some-code": {
+				AccessToken:  "access-1",
+				RefreshToken: "refresh-1",
+				ExpiresIn:    3600,
+				Scopes:       []string{"bits:read"},
+			},
+		},
+		validateErr: fmt.Errorf("Twitch should not be called"),
+	}
+	m := NewTokenManager(NewMemoryTokenStore(), testEncryptionKey, c)
+	m.now = func() time.Time { return now }
+	_, err := m.Exchange(ctx, "some-code")
+	assert.NoError(t, err)
+
+	// Once the token has expired (and our refresh token has been revoked), Get fails,
+	// but the recorded scopes can still be looked up without contacting Twitch
+	now = now.Add(2 * time.Hour)
+	_, err = m.Get(ctx)
+	assert.Error(t, err)
+	scopes, err := m.LookupGrantedScopes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bits:read"}, scopes)
+
+	// Once disconnected, no scopes are granted
+	assert.NoError(t, m.MarkDisconnected(ctx, DisconnectReasonRevokedOnTwitch))
+	scopes, err = m.LookupGrantedScopes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, scopes)
+}
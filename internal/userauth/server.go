@@ -1,43 +1,155 @@
 package userauth
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/golden-vcr/auth"
 	"github.com/golden-vcr/hooks"
+	"github.com/golden-vcr/server-common/entry"
 	"github.com/gorilla/mux"
+	"github.com/nicklaw5/helix/v2"
 )
 
 type Server struct {
 	origin                string
 	twitchClientId        string
 	requiredSubscriptions hooks.RequiredSubscriptions
-	csrf                  *csrfBuffer
+	state                 *stateSigner
+	links                 *stateSigner
+	tokens                *TokenManager
+	returnToAllowlist     []string
 }
 
-func NewServer(origin, twitchClientId string) *Server {
-	// NOTE: csrfBuffer stores CSRF tokens in-memory for validation across requests;
-	// this means that the userauth functionality (which is only used when the set of
-	// required OAuth scopes for our desired set of subscription types changes) only
-	// supports being run with a single replica
+// sessionCookieName identifies the cookie that binds an OAuth flow to the browser that
+// initiated it
+const sessionCookieName = "hooks-userauth-session"
+
+// NewTwitchAuthClient initializes a Twitch API client that can exchange authorization
+// codes obtained via our /userauth/finish redirect URI for user access tokens
+func NewTwitchAuthClient(origin, twitchClientId, twitchClientSecret string) (TwitchAuthClient, error) {
+	return helix.NewClient(&helix.Options{
+		ClientID:     twitchClientId,
+		ClientSecret: twitchClientSecret,
+		RedirectURI:  getRedirectUri(origin),
+	})
+}
+
+// NewServer initializes a userauth server. The OAuth 'state' parameter is a signed
+// token (using stateSecret) rather than a value stored in memory, so any replica can
+// complete a flow initiated by another, provided that all replicas share the same
+// secret and the same ReplayCache. The same applies to start links. Once the flow is complete, the broadcaster is
+// redirected to a URL that must match an entry in returnToAllowlist: the first entry is
+// used by default.
+func NewServer(origin, twitchClientId string, stateSecret []byte, replays ReplayCache, tokens *TokenManager, returnToAllowlist []string) *Server {
 	return &Server{
 		origin:                origin,
 		twitchClientId:        twitchClientId,
 		requiredSubscriptions: hooks.Subscriptions,
-		csrf: &csrfBuffer{
-			tokens: make([]csrfToken, 0, 8),
-		},
+		state:                 newStateSigner(stateSecret, replays),
+		links:                 newStartLinkSigner(stateSecret, replays),
+		tokens:                tokens,
+		returnToAllowlist:     returnToAllowlist,
 	}
 }
 
-func (s *Server) RegisterRoutes(r *mux.Router) {
-	r.Path("/userauth/start").Methods("GET").HandlerFunc(s.handleStartAuth)
+func (s *Server) RegisterRoutes(c auth.Client, r *mux.Router) {
 	r.Path("/userauth/finish").Methods("GET").HandlerFunc(s.handleFinishAuth)
+	r.Path("/userauth/start-link").Methods("GET").HandlerFunc(s.handleOpenStartLink)
+
+	admin := r.NewRoute().Subrouter()
+	admin.Use(func(next http.Handler) http.Handler {
+		return auth.RequireAccess(c, auth.RoleBroadcaster, next)
+	})
+	admin.Path("/userauth/start").Methods("GET").HandlerFunc(s.handleStartAuth)
+	admin.Path("/userauth/start-link").Methods("POST").HandlerFunc(s.handleCreateStartLink)
+	admin.Path("/userauth/token").Methods("GET").HandlerFunc(s.handleGetToken)
+	admin.Path("/userauth/status").Methods("GET").HandlerFunc(s.handleGetStatus)
 }
 
+// handleStartAuth (GET /userauth/start) initiates an OAuth flow, redirecting the
+// broadcaster to Twitch. The optional 'return_to' query parameter indicates where the
+// broadcaster should be sent once the flow is complete; it must match an allowlisted
+// URL. If the request accepts 'application/json', we respond with the Twitch URL in a
+// JSON body rather than redirecting, so that a frontend can call this endpoint with an
+// Authorization header and then navigate to that URL itself.
 func (s *Server) handleStartAuth(res http.ResponseWriter, req *http.Request) {
+	returnTo := req.URL.Query().Get("return_to")
+	if returnTo == "" {
+		returnTo = s.getDefaultReturnTo()
+	} else if !isAllowedReturnTo(s.returnToAllowlist, returnTo) {
+		http.Error(res, "'return_to' URL is not allowed", http.StatusBadRequest)
+		return
+	}
+	s.startFlow(res, req, returnTo, strings.Contains(req.Header.Get("accept"), "application/json"))
+}
+
+// handleCreateStartLink (POST /userauth/start-link) issues a link that initiates an
+// OAuth flow when opened in a browser, without an Authorization header: this allows a
+// client that isn't a browser (such as hooksctl) to give the broadcaster a URL to
+// open. Each link can be opened once, within startLinkLifetime. The optional
+// 'return_to' query parameter is handled as for GET /userauth/start.
+func (s *Server) handleCreateStartLink(res http.ResponseWriter, req *http.Request) {
+	returnTo := req.URL.Query().Get("return_to")
+	if returnTo == "" {
+		returnTo = s.getDefaultReturnTo()
+	} else if !isAllowedReturnTo(s.returnToAllowlist, returnTo) {
+		http.Error(res, "'return_to' URL is not allowed", http.StatusBadRequest)
+		return
+	}
+	ticket, err := s.links.issue("", returnTo)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(res).Encode(StartAuthResponse{Url: getStartLinkUrl(s.origin, ticket)}); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleOpenStartLink (GET /userauth/start-link) initiates an OAuth flow from a link
+// issued by POST /userauth/start-link, redirecting the broadcaster to Twitch. The link
+// itself serves as proof that the broadcaster requested it.
+func (s *Server) handleOpenStartLink(res http.ResponseWriter, req *http.Request) {
+	returnTo, err := s.links.redeem(req.Context(), req.URL.Query().Get("ticket"), "")
+	if err != nil {
+		entry.Log(req).Error("Start link verification failed", "error", err)
+		redirectWithResult(res, req, s.getDefaultReturnTo(), &result{
+			errorCode: ErrorCodeInvalidRequest,
+			message:   "start link is not valid: " + err.Error(),
+		})
+		return
+	}
+	if !isAllowedReturnTo(s.returnToAllowlist, returnTo) {
+		returnTo = s.getDefaultReturnTo()
+	}
+	s.startFlow(res, req, returnTo, false)
+}
+
+// startFlow initiates an OAuth flow that will return the broadcaster to returnTo,
+// either redirecting to Twitch or, if asJson is set, responding with the Twitch URL
+func (s *Server) startFlow(res http.ResponseWriter, req *http.Request, returnTo string, asJson bool) {
+	// Generate a random session ID and store it in a cookie, then issue a state token
+	// that's bound to that session: only the browser that started this flow will be
+	// able to finish it
+	sessionId, err := generateRandomHex(16)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state, err := s.state.issue(sessionId, returnTo)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(res, s.newSessionCookie(sessionId, int(stateTokenLifetime.Seconds())))
+
 	u, err := url.Parse("https://id.twitch.tv/oauth2/authorize")
 	if err != nil {
 		panic(err)
@@ -45,38 +157,80 @@ func (s *Server) handleStartAuth(res http.ResponseWriter, req *http.Request) {
 	q := u.Query()
 	q.Add("response_type", "code")
 	q.Add("client_id", s.twitchClientId)
-	q.Add("redirect_uri", s.origin+"/userauth/finish")
+	q.Add("redirect_uri", getRedirectUri(s.origin))
 	q.Add("scope", strings.Join(s.requiredSubscriptions.GetRequiredUserScopes(), " "))
-	q.Add("state", s.csrf.generate())
+	q.Add("state", state)
 	u.RawQuery = q.Encode()
 
+	if asJson {
+		res.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(res).Encode(StartAuthResponse{Url: u.String()}); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
 	res.Header().Set("location", u.String())
 	res.WriteHeader(http.StatusSeeOther)
 }
 
+// StartAuthResponse is returned from GET /userauth/start when JSON is requested, and
+// from POST /userauth/start-link
+type StartAuthResponse struct {
+	Url string `json:"url"`
+}
+
+// handleFinishAuth (GET /userauth/finish) is the redirect URI for our OAuth flow: it
+// completes the flow and redirects the broadcaster back to the admin frontend, with
+// query params indicating whether access was granted (and if not, why not)
 func (s *Server) handleFinishAuth(res http.ResponseWriter, req *http.Request) {
-	// Verify the CSRF token carried in the 'state' parameter
+	logger := entry.Log(req)
+
+	// Verify the signed token carried in the 'state' parameter, ensuring that it was
+	// issued to this browser's session: if valid, it tells us where to send the user
+	// once we're done
 	tokenValue := req.URL.Query().Get("state")
 	if tokenValue == "" {
-		http.Error(res, "'state' value not found in URL query params", http.StatusBadRequest)
+		redirectWithResult(res, req, s.getDefaultReturnTo(), &result{
+			errorCode: ErrorCodeInvalidRequest,
+			message:   "'state' value not found in URL query params",
+		})
 		return
 	}
-	if !s.csrf.check(tokenValue) {
-		http.Error(res, "CSRF token verification failed", http.StatusBadRequest)
-		return
+	sessionId := ""
+	if cookie, err := req.Cookie(sessionCookieName); err == nil {
+		sessionId = cookie.Value
 	}
-
-	// Verify that all requested scopes were granted
-	scopeValue := req.URL.Query().Get("scope")
-	if scopeValue == "" {
-		http.Error(res, "'scope' value not found in URL query params", http.StatusBadRequest)
+	http.SetCookie(res, s.newSessionCookie("", -1))
+	returnTo, err := s.state.redeem(req.Context(), tokenValue, sessionId)
+	if err != nil {
+		logger.Error("CSRF token verification failed", "error", err)
+		redirectWithResult(res, req, s.getDefaultReturnTo(), &result{
+			errorCode: ErrorCodeCsrfFailed,
+			message:   err.Error(),
+		})
 		return
 	}
-	scopes := strings.Split(scopeValue, " ")
-	if len(scopes) == 0 {
-		http.Error(res, "'scope' must specify at least one user scope", http.StatusBadRequest)
+	if !isAllowedReturnTo(s.returnToAllowlist, returnTo) {
+		returnTo = s.getDefaultReturnTo()
+	}
+
+	// If the broadcaster declined to authorize our app, Twitch tells us so
+	if errorValue := req.URL.Query().Get("error"); errorValue != "" {
+		logger.Warn("OAuth flow was not completed", "error", errorValue, "errorDescription", req.URL.Query().Get("error_description"))
+		code := ErrorCodeInvalidRequest
+		if errorValue == "access_denied" {
+			code = ErrorCodeAccessDenied
+		}
+		redirectWithResult(res, req, returnTo, &result{
+			errorCode: code,
+			message:   req.URL.Query().Get("error_description"),
+		})
 		return
 	}
+
+	// Verify that all requested scopes were granted
+	scopes := strings.Fields(req.URL.Query().Get("scope"))
+	missingScopes := make([]string, 0)
 	for _, desiredScope := range s.requiredSubscriptions.GetRequiredUserScopes() {
 		wasGranted := false
 		for _, scope := range scopes {
@@ -86,11 +240,151 @@ func (s *Server) handleFinishAuth(res http.ResponseWriter, req *http.Request) {
 			}
 		}
 		if !wasGranted {
-			http.Error(res, fmt.Sprintf("required scope '%s' was not granted", desiredScope), http.StatusBadRequest)
+			missingScopes = append(missingScopes, desiredScope)
+		}
+	}
+	if len(missingScopes) > 0 {
+		redirectWithResult(res, req, returnTo, &result{
+			errorCode:     ErrorCodeMissingScopes,
+			message:       "not all required scopes were granted",
+			missingScopes: missingScopes,
+		})
+		return
+	}
+
+	// Exchange the authorization code for a user access token, and store that token so
+	// that we can use it (and keep it refreshed) going forward
+	code := req.URL.Query().Get("code")
+	if code == "" {
+		redirectWithResult(res, req, returnTo, &result{
+			errorCode: ErrorCodeInvalidRequest,
+			message:   "'code' value not found in URL query params",
+		})
+		return
+	}
+	token, err := s.tokens.Exchange(req.Context(), code)
+	if err != nil {
+		logger.Error("Failed to obtain user access token", "error", err)
+		redirectWithResult(res, req, returnTo, &result{
+			errorCode: ErrorCodeTokenExchangeFailed,
+			message:   "failed to obtain user access token",
+		})
+		return
+	}
+	logger.Info("Obtained user access token", "scopes", token.Scopes, "expiresAt", token.ExpiresAt)
+
+	redirectWithResult(res, req, returnTo, &result{})
+}
+
+// handleGetToken (GET /userauth/token) reports whether we currently hold a user access
+// token for the broadcaster, along with the scopes it grants and when it expires: the
+// token itself is never revealed
+func (s *Server) handleGetToken(res http.ResponseWriter, req *http.Request) {
+	status := TokenStatus{}
+	token, err := s.tokens.Get(req.Context())
+	if err != nil && !errors.Is(err, ErrNoToken) {
+		entry.Log(req).Error("Failed to get user access token", "error", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if token != nil {
+		status.Connected = true
+		status.Scopes = token.Scopes
+		status.ExpiresAt = &token.ExpiresAt
+		status.ObtainedAt = &token.ObtainedAt
+	} else {
+		disconnection, err := s.tokens.GetDisconnection(req.Context())
+		if err != nil {
+			entry.Log(req).Error("Failed to get disconnection details", "error", err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		status.Disconnection = disconnection
+	}
+
+	if err := json.NewEncoder(res).Encode(status); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleGetStatus (GET /userauth/status) compares the set of scopes required by our
+// EventSub subscriptions against the scopes that the broadcaster has actually granted,
+// so that the broadcaster can be prompted to redo the OAuth flow when we add a new
+// subscription that requires additional scopes
+func (s *Server) handleGetStatus(res http.ResponseWriter, req *http.Request) {
+	status, err := GetScopeStatus(req.Context(), s.tokens, s.requiredSubscriptions, s.origin)
+	if err != nil {
+		entry.Log(req).Error("Failed to get granted scopes", "error", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	res.Header().Set("Content-Type", "text/html; charset=utf-8")
-	res.Write([]byte("<!DOCTYPE html><html><head><title>OK</title></head><body><h1>Success!</h1><p>Access granted. You may close this window.</p></body></html>"))
+	if err := json.NewEncoder(res).Encode(status); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ScopeStatus describes whether the broadcaster has granted all the OAuth scopes
+// required in order to create our EventSub subscriptions
+type ScopeStatus struct {
+	Ok             bool                      `json:"ok"`
+	Connected      bool                      `json:"connected"`
+	ScopesSource   string                    `json:"scopes_source,omitempty"`
+	RequiredScopes []string                  `json:"required_scopes"`
+	GrantedScopes  []string                  `json:"granted_scopes"`
+	MissingScopes  []string                  `json:"missing_scopes"`
+	Subscriptions  []SubscriptionScopeStatus `json:"subscriptions"`
+	ReauthUrl      string                    `json:"reauth_url,omitempty"`
+}
+
+// SubscriptionScopeStatus lists the scopes that are required by a single EventSub
+// subscription but have not been granted
+type SubscriptionScopeStatus struct {
+	Type          string   `json:"type"`
+	Version       string   `json:"version"`
+	MissingScopes []string `json:"missing_scopes"`
+}
+
+// TokenStatus describes the user access token currently held for the broadcaster
+type TokenStatus struct {
+	Connected     bool           `json:"connected"`
+	Scopes        []string       `json:"scopes,omitempty"`
+	ExpiresAt     *time.Time     `json:"expires_at,omitempty"`
+	ObtainedAt    *time.Time     `json:"obtained_at,omitempty"`
+	Disconnection *Disconnection `json:"disconnection,omitempty"`
+}
+
+// newSessionCookie prepares a cookie that stores the given session ID, scoped to our
+// userauth endpoints: a negative maxAge clears the cookie
+func (s *Server) newSessionCookie(sessionId string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionId,
+		Path:     "/userauth",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if u, err := url.Parse(s.origin); err == nil {
+		cookie.Path = strings.TrimSuffix(u.Path, "/") + "/userauth"
+		cookie.Secure = u.Scheme == "https"
+	}
+	return cookie
+}
+
+// getDefaultReturnTo returns the URL that the broadcaster should be sent to after
+// completing the OAuth flow, if no valid 'return_to' URL was specified
+func (s *Server) getDefaultReturnTo() string {
+	if len(s.returnToAllowlist) > 0 {
+		return s.returnToAllowlist[0]
+	}
+	return s.origin + "/userauth/status"
+}
+
+func getRedirectUri(origin string) string {
+	return origin + "/userauth/finish"
+}
+
+func getStartLinkUrl(origin string, ticket string) string {
+	return origin + "/userauth/start-link?" + url.Values{"ticket": {ticket}}.Encode()
 }
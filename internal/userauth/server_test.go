@@ -0,0 +1,292 @@
+package userauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golden-vcr/auth"
+	authmock "github.com/golden-vcr/auth/mock"
+	"github.com/golden-vcr/hooks"
+	"github.com/gorilla/mux"
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Server_handleStartAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		returnTo     string
+		accept       string
+		wantStatus   int
+		wantReturnTo string
+	}{
+		{
+			"redirects to Twitch with default return URL",
+			"",
+			"",
+			http.StatusSeeOther,
+			"https://goldenvcr.com/admin/hooks",
+		},
+		{
+			"allowlisted return URL is accepted",
+			"https://goldenvcr.com/admin/hooks/details?tab=scopes",
+			"",
+			http.StatusSeeOther,
+			"https://goldenvcr.com/admin/hooks/details?tab=scopes",
+		},
+		{
+			"Twitch URL is returned as JSON if requested",
+			"",
+			"application/json",
+			http.StatusOK,
+			"https://goldenvcr.com/admin/hooks",
+		},
+		{
+			"return URL on another host is rejected",
+			"https://evil.example.com/admin/hooks",
+			"",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"return URL outside of allowlisted path is rejected",
+			"https://goldenvcr.com/admin/hooksevil",
+			"",
+			http.StatusBadRequest,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(&mockTwitchAuthClient{})
+			target := "/userauth/start"
+			if tt.returnTo != "" {
+				target += "?return_to=" + url.QueryEscape(tt.returnTo)
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("accept", tt.accept)
+			res := httptest.NewRecorder()
+			s.handleStartAuth(res, req)
+			assert.Equal(t, tt.wantStatus, res.Code)
+			if tt.wantReturnTo == "" {
+				return
+			}
+
+			twitchUrl := res.Header().Get("location")
+			if tt.accept == "application/json" {
+				var body StartAuthResponse
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+				twitchUrl = body.Url
+			}
+			u, err := url.Parse(twitchUrl)
+			assert.NoError(t, err)
+			assert.Equal(t, "id.twitch.tv", u.Host)
+			assert.Equal(t, "bits:read", u.Query().Get("scope"))
+			assert.Equal(t, "https://goldenvcr.com/api/hooks/userauth/finish", u.Query().Get("redirect_uri"))
+
+			cookies := res.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			assert.Equal(t, sessionCookieName, cookies[0].Name)
+			assert.Equal(t, "/api/hooks/userauth", cookies[0].Path)
+			returnTo, err := s.state.redeem(context.Background(), u.Query().Get("state"), cookies[0].Value)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantReturnTo, returnTo)
+		})
+	}
+}
+
+func Test_Server_handleFinishAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		useValidState bool
+		useSession    bool
+		query         url.Values
+		wantQuery     url.Values
+	}{
+		{
+			"successful flow redirects with success",
+			true,
+			true,
+			url.Values{"code": {"some-code"}, "scope": {"bits:read"}},
+			url.Values{"tab": {"scopes"}, "userauth": {"success"}},
+		},
+		{
+			"missing state is an invalid request",
+			false,
+			true,
+			url.Values{"code": {"some-code"}, "scope": {"bits:read"}},
+			url.Values{"userauth": {"error"}, "userauth_error": {"invalid_request"}, "userauth_message": {"'state' value not found in URL query params"}},
+		},
+		{
+			"state from another session fails CSRF check",
+			true,
+			false,
+			url.Values{"code": {"some-code"}, "scope": {"bits:read"}},
+			url.Values{"userauth": {"error"}, "userauth_error": {"csrf_failed"}, "userauth_message": {ErrStateSessionMismatch.Error()}},
+		},
+		{
+			"denied access is reported",
+			true,
+			true,
+			url.Values{"error": {"access_denied"}, "error_description": {"The user denied you access"}},
+			url.Values{"tab": {"scopes"}, "userauth": {"error"}, "userauth_error": {"access_denied"}, "userauth_message": {"The user denied you access"}},
+		},
+		{
+			"missing scopes are reported",
+			true,
+			true,
+			url.Values{"code": {"some-code"}, "scope": {"moderator:read:followers"}},
+			url.Values{"tab": {"scopes"}, "userauth": {"error"}, "userauth_error": {"missing_scopes"}, "userauth_message": {"not all required scopes were granted"}, "userauth_missing_scopes": {"bits:read"}},
+		},
+		{
+			"failed token exchange is reported",
+			true,
+			true,
+			url.Values{"code": {"bad-code"}, "scope": {"bits:read"}},
+			url.Values{"tab": {"scopes"}, "userauth": {"error"}, "userauth_error": {"token_exchange_failed"}, "userauth_message": {"failed to obtain user access token"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(&mockTwitchAuthClient{
+				codes: map[string]helix.AccessCredentials{
+					"some-code": {AccessToken: "access-1", RefreshToken: "refresh-1", ExpiresIn: 3600, Scopes: []string{"bits:read"}},
+				},
+			})
+			if tt.useValidState {
+				state, err := s.state.issue("session-1", "https://goldenvcr.com/admin/hooks?tab=scopes")
+				assert.NoError(t, err)
+				tt.query.Set("state", state)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/userauth/finish?"+tt.query.Encode(), nil)
+			if tt.useSession {
+				req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session-1"})
+			}
+			res := httptest.NewRecorder()
+			s.handleFinishAuth(res, req)
+
+			assert.Equal(t, http.StatusSeeOther, res.Code)
+			u, err := url.Parse(res.Header().Get("location"))
+			assert.NoError(t, err)
+			assert.Equal(t, "goldenvcr.com", u.Host)
+			assert.Equal(t, "/admin/hooks", u.Path)
+			assert.Equal(t, tt.wantQuery, u.Query())
+
+			_, err = s.tokens.Peek(context.Background())
+			if tt.wantQuery.Get("userauth") == "success" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrNoToken)
+			}
+		})
+	}
+}
+
+func Test_Server_startLink(t *testing.T) {
+	s := newTestServer(&mockTwitchAuthClient{
+		codes: map[string]helix.AccessCredentials{
+			"some-code": {AccessToken: "access-1", RefreshToken: "refresh-1", ExpiresIn: 3600, Scopes: []string{"bits:read"}},
+		},
+	})
+	r := mux.NewRouter()
+	authClient := authmock.NewClient().
+		AllowTwitchUserAccessToken("broadcaster-token", auth.RoleBroadcaster, auth.UserDetails{Id: "1337", Login: "broadcaster", DisplayName: "Broadcaster"}).
+		AllowTwitchUserAccessToken("viewer-token", auth.RoleViewer, auth.UserDetails{Id: "5678", Login: "viewer", DisplayName: "Viewer"})
+	s.RegisterRoutes(authClient, r)
+	do := func(method string, target string, authorization string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if authorization != "" {
+			req.Header.Set("authorization", authorization)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		return res
+	}
+	returnTo := "https://goldenvcr.com/admin/hooks?tab=scopes"
+
+	// Only the broadcaster may issue a start link, and only with an allowlisted return URL
+	res := do(http.MethodPost, "/userauth/start-link", "", nil)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = do(http.MethodPost, "/userauth/start-link", "Bearer viewer-token", nil)
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	res = do(http.MethodPost, "/userauth/start-link?return_to="+url.QueryEscape("https://evil.example.com/"), "Bearer broadcaster-token", nil)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = do(http.MethodPost, "/userauth/start-link?return_to="+url.QueryEscape(returnTo), "Bearer broadcaster-token", nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var link StartAuthResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&link))
+	assert.True(t, strings.HasPrefix(link.Url, "https://goldenvcr.com/api/hooks/userauth/start-link?ticket="))
+	linkPath := strings.TrimPrefix(link.Url, "https://goldenvcr.com/api/hooks")
+
+	// Opening the link in a browser, without an Authorization header, should send the
+	// broadcaster to Twitch with a session cookie
+	res = do(http.MethodGet, linkPath, "", nil)
+	assert.Equal(t, http.StatusSeeOther, res.Code)
+	twitchUrl, err := url.Parse(res.Header().Get("location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "id.twitch.tv", twitchUrl.Host)
+	cookies := res.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+
+	// Once Twitch redirects back to us, the flow should complete as usual
+	query := url.Values{"code": {"some-code"}, "scope": {"bits:read"}, "state": {twitchUrl.Query().Get("state")}}
+	res = do(http.MethodGet, "/userauth/finish?"+query.Encode(), "", cookies[0])
+	assert.Equal(t, http.StatusSeeOther, res.Code)
+	assert.Equal(t, returnTo+"&userauth=success", res.Header().Get("location"))
+	_, err = s.tokens.Peek(context.Background())
+	assert.NoError(t, err)
+
+	// A link may only be opened once
+	res = do(http.MethodGet, linkPath, "", nil)
+	assert.Equal(t, http.StatusSeeOther, res.Code)
+	u, err := url.Parse(res.Header().Get("location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "goldenvcr.com", u.Host)
+	assert.Equal(t, "error", u.Query().Get("userauth"))
+	assert.Equal(t, "invalid_request", u.Query().Get("userauth_error"))
+
+	// A link can't be forged from a state token, or vice versa
+	state, err := s.state.issue("", returnTo)
+	assert.NoError(t, err)
+	res = do(http.MethodGet, "/userauth/start-link?ticket="+url.QueryEscape(state), "", nil)
+	assert.Equal(t, "invalid_request", mustParseUrl(t, res.Header().Get("location")).Query().Get("userauth_error"))
+	ticket, err := s.links.issue("session-1", returnTo)
+	assert.NoError(t, err)
+	_, err = s.state.redeem(context.Background(), ticket, "session-1")
+	assert.ErrorIs(t, err, ErrStateInvalid)
+}
+
+func mustParseUrl(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	return u
+}
+
+func newTestServer(c TwitchAuthClient) *Server {
+	s := NewServer(
+		"https://goldenvcr.com/api/hooks",
+		"my-client-id",
+		[]byte("my-state-secret"),
+		NewMemoryReplayCache(),
+		NewTokenManager(NewMemoryTokenStore(), testEncryptionKey, c),
+		[]string{"https://goldenvcr.com/admin/hooks"},
+	)
+	s.requiredSubscriptions = hooks.RequiredSubscriptions{
+		{
+			Type:           helix.EventSubTypeChannelCheer,
+			Version:        "1",
+			RequiredScopes: []string{"bits:read"},
+		},
+	}
+	return s
+}
@@ -0,0 +1,193 @@
+package userauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateTokenLifetime is how long the broadcaster has to complete the OAuth flow once
+// it's been initiated
+const stateTokenLifetime = 15 * time.Minute
+
+// startLinkLifetime is how long a start link (see handleCreateStartLink) may be opened
+// once it's been issued
+const startLinkLifetime = 10 * time.Minute
+
+var (
+	ErrStateInvalid         = errors.New("state token is malformed or has an invalid signature")
+	ErrStateExpired         = errors.New("state token has expired")
+	ErrStateSessionMismatch = errors.New("state token was not issued to this session")
+	ErrStateReused          = errors.New("state token has already been used")
+)
+
+// ReplayCache records which state tokens have already been used, so that each token can
+// only be redeemed once. When running multiple replicas, all replicas must share the
+// same ReplayCache (e.g. a file-based cache on a shared volume); the in-memory
+// implementation is only suitable for a single replica.
+type ReplayCache interface {
+	// MarkUsed records that the given nonce has been used, returning false if it was
+	// already marked as used. Entries need only be retained until expiresAt.
+	MarkUsed(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// stateSigner issues and verifies the values we pass as the 'state' parameter in our
+// OAuth flow. Rather than storing each issued token server-side, a state token carries
+// its own details (a random nonce, a hash of the session that initiated the flow, and
+// an expiry time), signed with HMAC-SHA256 using a secret shared by all replicas: any
+// replica can therefore verify a token that was issued by any other.
+type stateSigner struct {
+	secret   []byte
+	replays  ReplayCache
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+// statePayload is the signed content of a state token
+type statePayload struct {
+	Nonce       string `json:"n"`
+	SessionHash string `json:"s"`
+	ExpiresAt   int64  `json:"e"`
+	ReturnTo    string `json:"r,omitempty"`
+}
+
+func newStateSigner(secret []byte, replays ReplayCache) *stateSigner {
+	return &stateSigner{
+		secret:   secret,
+		replays:  replays,
+		lifetime: stateTokenLifetime,
+		now:      time.Now,
+	}
+}
+
+// newStartLinkSigner returns a stateSigner that issues the tokens carried by start
+// links rather than state tokens. Start links aren't bound to a session, since they're
+// issued to a client other than the browser that will open them: they're signed with a
+// key derived from secret, so that neither kind of token can be passed off as the
+// other.
+func newStartLinkSigner(secret []byte, replays ReplayCache) *stateSigner {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("userauth-start-link"))
+	s := newStateSigner(mac.Sum(nil), replays)
+	s.lifetime = startLinkLifetime
+	return s
+}
+
+// issue generates a new state token that's bound to the given session ID, and which
+// records the URL that the user should be returned to once the flow is complete
+func (s *stateSigner) issue(sessionId string, returnTo string) (string, error) {
+	nonce, err := generateRandomHex(16)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(statePayload{
+		Nonce:       nonce,
+		SessionHash: hashSessionId(sessionId),
+		ExpiresAt:   s.now().Add(s.lifetime).Unix(),
+		ReturnTo:    returnTo,
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded + "." + s.sign(encoded), nil
+}
+
+// redeem verifies that the given state token is authentic, unexpired, bound to the
+// given session ID, and has not previously been redeemed. If so, returns the return-to
+// URL that was recorded when the token was issued.
+func (s *stateSigner) redeem(ctx context.Context, token string, sessionId string) (string, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", ErrStateInvalid
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return "", ErrStateInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrStateInvalid
+	}
+	var payload statePayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return "", ErrStateInvalid
+	}
+
+	expiresAt := time.Unix(payload.ExpiresAt, 0)
+	if !s.now().Before(expiresAt) {
+		return "", ErrStateExpired
+	}
+	if !hmac.Equal([]byte(payload.SessionHash), []byte(hashSessionId(sessionId))) {
+		return "", ErrStateSessionMismatch
+	}
+
+	firstUse, err := s.replays.MarkUsed(ctx, payload.Nonce, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	if !firstUse {
+		return "", ErrStateReused
+	}
+	return payload.ReturnTo, nil
+}
+
+func (s *stateSigner) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hashSessionId(sessionId string) string {
+	sum := sha256.Sum256([]byte(sessionId))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRandomHex(numBytes int) (string, error) {
+	b := make([]byte, numBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewMemoryReplayCache returns a ReplayCache that stores used nonces in memory
+func NewMemoryReplayCache() ReplayCache {
+	return &memoryReplayCache{
+		used: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+type memoryReplayCache struct {
+	used map[string]time.Time
+	now  func() time.Time
+	mu   sync.Mutex
+}
+
+func (c *memoryReplayCache) MarkUsed(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Purge any entries that have expired, since their tokens can no longer be redeemed
+	// anyway
+	now := c.now()
+	for k, v := range c.used {
+		if !now.Before(v) {
+			delete(c.used, k)
+		}
+	}
+
+	if _, ok := c.used[nonce]; ok {
+		return false, nil
+	}
+	c.used[nonce] = expiresAt
+	return true, nil
+}
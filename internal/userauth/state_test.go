@@ -0,0 +1,143 @@
+package userauth
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_stateSigner(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newSigner := func(secret string) *stateSigner {
+		replays := &memoryReplayCache{
+			used: make(map[string]time.Time),
+			now:  func() time.Time { return now },
+		}
+		s := newStateSigner([]byte(secret), replays)
+		s.now = func() time.Time { return now }
+		return s
+	}
+
+	t.Run("valid token can be redeemed by another replica with the same secret", func(t *testing.T) {
+		token, err := newSigner("secret").issue("session-1", "https://goldenvcr.com/admin/hooks")
+		assert.NoError(t, err)
+		returnTo, err := newSigner("secret").redeem(ctx, token, "session-1")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://goldenvcr.com/admin/hooks", returnTo)
+	})
+
+	t.Run("token cannot be reused", func(t *testing.T) {
+		s := newSigner("secret")
+		token, err := s.issue("session-1", "https://goldenvcr.com/admin/hooks")
+		assert.NoError(t, err)
+		returnTo, err := s.redeem(ctx, token, "session-1")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://goldenvcr.com/admin/hooks", returnTo)
+		_, err = s.redeem(ctx, token, "session-1")
+		assert.ErrorIs(t, err, ErrStateReused)
+	})
+
+	t.Run("token is bound to the initiating session", func(t *testing.T) {
+		s := newSigner("secret")
+		token, err := s.issue("session-1", "https://goldenvcr.com/admin/hooks")
+		assert.NoError(t, err)
+		_, err = s.redeem(ctx, token, "session-2")
+		assert.ErrorIs(t, err, ErrStateSessionMismatch)
+		_, err = s.redeem(ctx, token, "")
+		assert.ErrorIs(t, err, ErrStateSessionMismatch)
+	})
+
+	t.Run("token expires", func(t *testing.T) {
+		s := newSigner("secret")
+		token, err := s.issue("session-1", "https://goldenvcr.com/admin/hooks")
+		assert.NoError(t, err)
+		s.now = func() time.Time { return now.Add(stateTokenLifetime) }
+		_, err = s.redeem(ctx, token, "session-1")
+		assert.ErrorIs(t, err, ErrStateExpired)
+	})
+
+	t.Run("token signed with a different secret is rejected", func(t *testing.T) {
+		token, err := newSigner("some-other-secret").issue("session-1", "https://goldenvcr.com/admin/hooks")
+		assert.NoError(t, err)
+		_, err = newSigner("secret").redeem(ctx, token, "session-1")
+		assert.ErrorIs(t, err, ErrStateInvalid)
+	})
+
+	t.Run("tampered token is rejected", func(t *testing.T) {
+		s := newSigner("secret")
+		token, err := s.issue("session-1", "https://goldenvcr.com/admin/hooks")
+		assert.NoError(t, err)
+
+		// Extend the expiry time without re-signing
+		encoded, signature, _ := strings.Cut(token, ".")
+		data, err := base64.RawURLEncoding.DecodeString(encoded)
+		assert.NoError(t, err)
+		tampered := strings.Replace(string(data), `"e":`, `"e":9`, 1)
+		tamperedToken := base64.RawURLEncoding.EncodeToString([]byte(tampered)) + "." + signature
+		_, err = s.redeem(ctx, tamperedToken, "session-1")
+		assert.ErrorIs(t, err, ErrStateInvalid)
+
+		_, err = s.redeem(ctx, "garbage", "session-1")
+		assert.ErrorIs(t, err, ErrStateInvalid)
+		_, err = s.redeem(ctx, encoded+".", "session-1")
+		assert.ErrorIs(t, err, ErrStateInvalid)
+	})
+}
+
+func Test_memoryReplayCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &memoryReplayCache{
+		used: make(map[string]time.Time),
+		now:  func() time.Time { return now },
+	}
+
+	ok, err := c.MarkUsed(ctx, "a", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = c.MarkUsed(ctx, "a", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Expired entries are purged
+	now = now.Add(time.Minute)
+	ok, err = c.MarkUsed(ctx, "b", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, c.used, 1)
+}
+
+func Test_fileReplayCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newCache := func() *fileReplayCache {
+		return &fileReplayCache{dir: dir, now: func() time.Time { return now }}
+	}
+
+	ok, err := newCache().MarkUsed(ctx, "a", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// A nonce that's been used can't be used again, even via another instance sharing
+	// the same directory (e.g. another replica)
+	ok, err = newCache().MarkUsed(ctx, "a", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Expired entries are purged
+	now = now.Add(time.Minute)
+	ok, err = newCache().MarkUsed(ctx, "b", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
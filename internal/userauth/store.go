@@ -0,0 +1,88 @@
+package userauth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/golden-vcr/hooks/internal/statefile"
+)
+
+// ErrNoToken is returned when no user access token has been stored
+var ErrNoToken = errors.New("no user access token has been stored")
+
+// TokenStore persists the broadcaster's user access token across restarts. Stores only
+// ever deal with opaque, encrypted data: tokens are encrypted before being saved and
+// decrypted after being loaded.
+type TokenStore interface {
+	Load(ctx context.Context) ([]byte, error)
+	Save(ctx context.Context, data []byte) error
+	Clear(ctx context.Context) error
+}
+
+// NewFileTokenStore returns a TokenStore that persists encrypted token data to a file
+// at the given path
+func NewFileTokenStore(path string) TokenStore {
+	return &fileTokenStore{path: path}
+}
+
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load(ctx context.Context) ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoToken
+	}
+	return data, err
+}
+
+func (s *fileTokenStore) Save(ctx context.Context, data []byte) error {
+	// Replace the file atomically, so that we never leave a partially written token on
+	// disk
+	return statefile.Write(s.path, data)
+}
+
+func (s *fileTokenStore) Clear(ctx context.Context) error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// NewMemoryTokenStore returns a TokenStore that only holds token data in memory, for
+// use in tests and local development
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{}
+}
+
+type memoryTokenStore struct {
+	data []byte
+	mu   sync.Mutex
+}
+
+func (s *memoryTokenStore) Load(ctx context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return nil, ErrNoToken
+	}
+	return s.data, nil
+}
+
+func (s *memoryTokenStore) Save(ctx context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	return nil
+}
+
+func (s *memoryTokenStore) Clear(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = nil
+	return nil
+}
@@ -0,0 +1,271 @@
+package userauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"golang.org/x/exp/slog"
+)
+
+// refreshMargin is how long before a token's expiry we'll preemptively refresh it
+const refreshMargin = 10 * time.Minute
+
+// Token is a Twitch User Access Token that the broadcaster has granted to our app,
+// along with the refresh token that allows us to keep it valid
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Scopes       []string  `json:"scopes"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	ObtainedAt   time.Time `json:"obtained_at"`
+
+	// Disconnection is set once the broadcaster has disconnected our app, at which
+	// point we no longer hold a usable access token or refresh token
+	Disconnection *Disconnection `json:"disconnection,omitempty"`
+}
+
+const (
+	DisconnectReasonRevokedOnTwitch     = "revoked_on_twitch"
+	DisconnectReasonDisconnectedByAdmin = "disconnected_by_admin"
+)
+
+// Disconnection records when and why our app was disconnected from the broadcaster's
+// channel
+type Disconnection struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+// TwitchAuthClient represents the subset of Twitch API client functionality used to
+// obtain, refresh, and validate user access tokens
+type TwitchAuthClient interface {
+	RequestUserAccessToken(code string) (*helix.UserAccessTokenResponse, error)
+	RefreshUserAccessToken(refreshToken string) (*helix.RefreshTokenResponse, error)
+	ValidateToken(accessToken string) (bool, *helix.ValidateTokenResponse, error)
+	RevokeUserAccessToken(accessToken string) (*helix.RevokeAccessTokenResponse, error)
+}
+
+// TokenManager holds the broadcaster's user access token: it exchanges authorization
+// codes for new tokens, encrypts and persists those tokens via a TokenStore, and
+// refreshes them as they near expiry. Tokens are never stored in plaintext: the
+// encryption key must be a valid 32-byte key, as returned by ParseEncryptionKey.
+type TokenManager struct {
+	store  TokenStore
+	key    []byte
+	client TwitchAuthClient
+	now    func() time.Time
+
+	mu sync.Mutex
+}
+
+func NewTokenManager(store TokenStore, encryptionKey []byte, client TwitchAuthClient) *TokenManager {
+	return &TokenManager{
+		store:  store,
+		key:    encryptionKey,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// Exchange redeems an authorization code (as obtained at the end of an OAuth code
+// grant flow) for a new user access token, which is then persisted
+func (m *TokenManager) Exchange(ctx context.Context, code string) (*Token, error) {
+	r, err := m.client.RequestUserAccessToken(code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request user access token: %w", err)
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got response %d from user access token request: %s", r.StatusCode, r.ErrorMessage)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token := m.newToken(&r.Data)
+	if err := m.save(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Get returns the current user access token, refreshing it first if it's close to
+// expiry. Returns ErrNoToken if the broadcaster has not yet granted access, or has
+// since disconnected our app.
+func (m *TokenManager) Get(ctx context.Context) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, err := m.loadConnected(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m.now().Add(refreshMargin).Before(token.ExpiresAt) {
+		return token, nil
+	}
+	return m.refresh(ctx, token)
+}
+
+// Peek returns the current user access token as stored, without refreshing it
+func (m *TokenManager) Peek(ctx context.Context) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loadConnected(ctx)
+}
+
+// GetDisconnection returns details of when and why our app was disconnected from the
+// broadcaster's channel, or nil if it has not been disconnected since access was last
+// granted
+func (m *TokenManager) GetDisconnection(ctx context.Context) (*Disconnection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, err := m.load(ctx)
+	if errors.Is(err, ErrNoToken) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token.Disconnection, nil
+}
+
+// Revoke asks Twitch to revoke our user access token (if we hold one), then records
+// that our app has been disconnected for the given reason
+func (m *TokenManager) Revoke(ctx context.Context, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, err := m.loadConnected(ctx)
+	if err != nil && !errors.Is(err, ErrNoToken) {
+		return err
+	}
+	if token != nil {
+		r, err := m.client.RevokeUserAccessToken(token.AccessToken)
+		if err != nil {
+			return fmt.Errorf("failed to revoke user access token: %w", err)
+		}
+		if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusBadRequest {
+			return fmt.Errorf("got response %d from revoke token request: %s", r.StatusCode, r.ErrorMessage)
+		}
+	}
+	return m.disconnect(ctx, reason)
+}
+
+// MarkDisconnected records that our app has been disconnected for the given reason,
+// discarding our user access token without attempting to revoke it
+func (m *TokenManager) MarkDisconnected(ctx context.Context, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.disconnect(ctx, reason)
+}
+
+// disconnect replaces our stored token with a record of the disconnection. Must be
+// called with mu held.
+func (m *TokenManager) disconnect(ctx context.Context, reason string) error {
+	return m.save(ctx, &Token{
+		Disconnection: &Disconnection{
+			At:     m.now(),
+			Reason: reason,
+		},
+	})
+}
+
+// Run blocks until the given context is canceled, periodically ensuring that the
+// stored user access token (if any) is refreshed before it expires
+func (m *TokenManager) Run(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := m.Get(ctx); err != nil && !errors.Is(err, ErrNoToken) {
+			logger.Error("Failed to refresh user access token", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh uses the given token's refresh token to obtain a new access token, which is
+// then persisted. Must be called with mu held.
+func (m *TokenManager) refresh(ctx context.Context, token *Token) (*Token, error) {
+	r, err := m.client.RefreshUserAccessToken(token.RefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh user access token: %w", err)
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got response %d from refresh token request: %s", r.StatusCode, r.ErrorMessage)
+	}
+
+	refreshed := m.newToken(&r.Data)
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+	if err := m.save(ctx, refreshed); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
+
+func (m *TokenManager) newToken(creds *helix.AccessCredentials) *Token {
+	now := m.now()
+	return &Token{
+		AccessToken:  creds.AccessToken,
+		RefreshToken: creds.RefreshToken,
+		Scopes:       creds.Scopes,
+		ExpiresAt:    now.Add(time.Duration(creds.ExpiresIn) * time.Second),
+		ObtainedAt:   now,
+	}
+}
+
+// loadConnected loads our stored token, returning ErrNoToken if we've been
+// disconnected
+func (m *TokenManager) loadConnected(ctx context.Context) (*Token, error) {
+	token, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token.Disconnection != nil {
+		return nil, ErrNoToken
+	}
+	return token, nil
+}
+
+// load loads, decrypts, and decodes our stored token. Must be called with mu held.
+func (m *TokenManager) load(ctx context.Context) (*Token, error) {
+	ciphertext, err := m.store.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(m.key, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stored user access token: %w", err)
+	}
+	var token Token
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, fmt.Errorf("failed to decode stored user access token: %w", err)
+	}
+	return &token, nil
+}
+
+// save encrypts and persists the given token: without a valid encryption key, it fails
+// rather than storing the token in plaintext. Must be called with mu held.
+func (m *TokenManager) save(ctx context.Context, token *Token) error {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := encrypt(m.key, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt user access token: %w", err)
+	}
+	if err := m.store.Save(ctx, ciphertext); err != nil {
+		return fmt.Errorf("failed to store user access token: %w", err)
+	}
+	return nil
+}
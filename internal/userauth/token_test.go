@@ -0,0 +1,173 @@
+package userauth
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func Test_TokenManager(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewFileTokenStore(filepath.Join(t.TempDir(), "token.enc"))
+	c := &mockTwitchAuthClient{
+		codes: map[string]helix.AccessCredentials{
+			"some-code": {
+				AccessToken:  "access-1",
+				RefreshToken: "refresh-1",
+				ExpiresIn:    3600,
+				Scopes:       []string{"bits:read"},
+			},
+		},
+		refreshes: map[string]helix.AccessCredentials{
+			"refresh-1": {
+				AccessToken:  "access-2",
+				RefreshToken: "refresh-2",
+				ExpiresIn:    3600,
+				Scopes:       []string{"bits:read"},
+			},
+		},
+	}
+	m := NewTokenManager(store, testEncryptionKey, c)
+	m.now = func() time.Time { return now }
+
+	// Before any token has been obtained, there's nothing to get
+	_, err := m.Get(ctx)
+	assert.ErrorIs(t, err, ErrNoToken)
+
+	// Exchanging an invalid code fails
+	_, err = m.Exchange(ctx, "bad-code")
+	assert.Error(t, err)
+
+	// Exchanging a valid code stores a token, which is encrypted at rest
+	token, err := m.Exchange(ctx, "some-code")
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token.AccessToken)
+	assert.Equal(t, now.Add(time.Hour), token.ExpiresAt)
+	data, err := store.Load(ctx)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("access-1")))
+	assert.False(t, bytes.Contains(data, []byte("refresh-1")))
+
+	// The token is returned as-is while it's not close to expiry
+	token, err = m.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token.AccessToken)
+
+	// As it nears expiry, it's refreshed and the new token is persisted
+	now = now.Add(55 * time.Minute)
+	token, err = m.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-2", token.AccessToken)
+	assert.Equal(t, "refresh-2", token.RefreshToken)
+	token, err = NewTokenManager(store, testEncryptionKey, c).Peek(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-2", token.AccessToken)
+
+	// Stored data can't be read without the correct key
+	_, err = NewTokenManager(store, []byte("fedcba9876543210fedcba9876543210"), c).Peek(ctx)
+	assert.Error(t, err)
+}
+
+func Test_TokenManager_requiresKey(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryTokenStore()
+	c := &mockTwitchAuthClient{
+		codes: map[string]helix.AccessCredentials{
+			"some-code": {AccessToken: "access-1", RefreshToken: "refresh-1", ExpiresIn: 3600},
+		},
+	}
+
+	// Without an encryption key, the token is never persisted
+	_, err := NewTokenManager(store, nil, c).Exchange(ctx, "some-code")
+	assert.ErrorContains(t, err, "failed to encrypt user access token")
+	_, err = store.Load(ctx)
+	assert.ErrorIs(t, err, ErrNoToken)
+}
+
+func Test_ParseEncryptionKey(t *testing.T) {
+	key, err := ParseEncryptionKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	_, err = ParseEncryptionKey("not-hex")
+	assert.Error(t, err)
+
+	_, err = ParseEncryptionKey("0001")
+	assert.Error(t, err)
+}
+
+type mockTwitchAuthClient struct {
+	codes       map[string]helix.AccessCredentials
+	refreshes   map[string]helix.AccessCredentials
+	validTokens map[string][]string
+	validateErr error
+	revoked     []string
+}
+
+func (m *mockTwitchAuthClient) RequestUserAccessToken(code string) (*helix.UserAccessTokenResponse, error) {
+	creds, ok := m.codes[code]
+	if !ok {
+		return &helix.UserAccessTokenResponse{
+			ResponseCommon: helix.ResponseCommon{
+				StatusCode:   http.StatusBadRequest,
+				ErrorMessage: "Invalid authorization code",
+			},
+		}, nil
+	}
+	return &helix.UserAccessTokenResponse{
+		ResponseCommon: helix.ResponseCommon{StatusCode: http.StatusOK},
+		Data:           creds,
+	}, nil
+}
+
+func (m *mockTwitchAuthClient) RefreshUserAccessToken(refreshToken string) (*helix.RefreshTokenResponse, error) {
+	creds, ok := m.refreshes[refreshToken]
+	if !ok {
+		return &helix.RefreshTokenResponse{
+			ResponseCommon: helix.ResponseCommon{
+				StatusCode:   http.StatusBadRequest,
+				ErrorMessage: "Invalid refresh token",
+			},
+		}, nil
+	}
+	return &helix.RefreshTokenResponse{
+		ResponseCommon: helix.ResponseCommon{StatusCode: http.StatusOK},
+		Data:           creds,
+	}, nil
+}
+
+func (m *mockTwitchAuthClient) ValidateToken(accessToken string) (bool, *helix.ValidateTokenResponse, error) {
+	if m.validateErr != nil {
+		return false, nil, m.validateErr
+	}
+	scopes, ok := m.validTokens[accessToken]
+	if !ok {
+		return false, &helix.ValidateTokenResponse{
+			ResponseCommon: helix.ResponseCommon{
+				StatusCode:   http.StatusUnauthorized,
+				ErrorMessage: "invalid access token",
+			},
+		}, nil
+	}
+	r := &helix.ValidateTokenResponse{
+		ResponseCommon: helix.ResponseCommon{StatusCode: http.StatusOK},
+	}
+	r.Data.Scopes = scopes
+	return true, r, nil
+}
+
+func (m *mockTwitchAuthClient) RevokeUserAccessToken(accessToken string) (*helix.RevokeAccessTokenResponse, error) {
+	m.revoked = append(m.revoked, accessToken)
+	return &helix.RevokeAccessTokenResponse{
+		ResponseCommon: helix.ResponseCommon{StatusCode: http.StatusOK},
+	}, nil
+}
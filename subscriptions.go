@@ -106,4 +106,11 @@ var Subscriptions = RequiredSubscriptions{
 			"channel:read:subscriptions",
 		},
 	},
+	{
+		Type:    helix.EventSubTypeUserAuthorizationRevoke,
+		Version: "1",
+		TemplatedCondition: helix.EventSubCondition{
+			ClientID: "{{.ClientId}}",
+		},
+	},
 }
@@ -22,6 +22,7 @@ type RequiredSubscription struct {
 // specifying the EventSubCondition values for required subscriptions
 type RequiredSubscriptionConditionParams struct {
 	ChannelUserId string
+	ClientId      string
 }
 
 // Format takes a helix.EventSubCondition struct whose values may contain template
@@ -75,3 +76,34 @@ func (r RequiredSubscriptions) GetRequiredUserScopes() []string {
 	sort.Strings(scopesArray)
 	return scopesArray
 }
+
+// EstimateCost returns the cost that Twitch is expected to assign to this subscription
+// once it's created: a subscription whose condition names a user costs nothing if
+// that user (i.e. the broadcaster) has authorized our app, regardless of the scopes
+// it requires, whereas all others cost 1. If userAuthorized is false because we can't
+// tell whether the broadcaster has authorized our app, the result is an upper bound.
+// See https://dev.twitch.tv/docs/eventsub/manage-subscriptions/#subscription-limits
+func (r *RequiredSubscription) EstimateCost(userAuthorized bool) int {
+	c := &r.TemplatedCondition
+	namesUser := c.BroadcasterUserID != "" || c.FromBroadcasterUserID != "" || c.ToBroadcasterUserID != "" || c.ModeratorUserID != "" || c.UserID != ""
+	if namesUser && userAuthorized {
+		return 0
+	}
+	return 1
+}
+
+// GetMissingScopes returns the subset of this subscription's RequiredScopes that do not
+// appear in the given list of scopes granted by the broadcaster
+func (r *RequiredSubscription) GetMissingScopes(grantedScopes []string) []string {
+	granted := make(map[string]struct{}, len(grantedScopes))
+	for _, scope := range grantedScopes {
+		granted[scope] = struct{}{}
+	}
+	missing := make([]string, 0)
+	for _, scope := range r.RequiredScopes {
+		if _, ok := granted[scope]; !ok {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
@@ -51,3 +51,49 @@ func Test_GetRequiredUserScopes(t *testing.T) {
 		"user:read:subscriptions",
 	})
 }
+
+func Test_RequiredSubscription_EstimateCost(t *testing.T) {
+	tests := []struct {
+		name           string
+		required       RequiredSubscription
+		userAuthorized bool
+		want           int
+	}{
+		{
+			"subscription for an authorized user is free, even without scopes",
+			RequiredSubscription{TemplatedCondition: helix.EventSubCondition{BroadcasterUserID: "{{.ChannelUserId}}"}},
+			true,
+			0,
+		},
+		{
+			"subscription requiring scopes costs 1 if the user hasn't authorized our app",
+			RequiredSubscription{TemplatedCondition: helix.EventSubCondition{BroadcasterUserID: "{{.ChannelUserId}}"}, RequiredScopes: []string{"bits:read"}},
+			false,
+			1,
+		},
+		{
+			"subscription that names no user costs 1",
+			RequiredSubscription{TemplatedCondition: helix.EventSubCondition{ClientID: "{{.ClientId}}"}},
+			true,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.required.EstimateCost(tt.userAuthorized))
+		})
+	}
+}
+
+func Test_RequiredSubscription_GetMissingScopes(t *testing.T) {
+	required := RequiredSubscription{
+		RequiredScopes: []string{
+			"channel:read:subscriptions",
+			"moderator:read:followers",
+		},
+	}
+	assert.Equal(t, []string{}, required.GetMissingScopes([]string{"channel:read:subscriptions", "moderator:read:followers", "bits:read"}))
+	assert.Equal(t, []string{"moderator:read:followers"}, required.GetMissingScopes([]string{"channel:read:subscriptions"}))
+	assert.Equal(t, []string{"channel:read:subscriptions", "moderator:read:followers"}, required.GetMissingScopes(nil))
+	assert.Equal(t, []string{}, (&RequiredSubscription{}).GetMissingScopes(nil))
+}